@@ -10,8 +10,13 @@ import (
 //   - Checks: a collection of host/path checks with access rules
 //   - PublicKeys: mappings of public key names to key values
 //   - Tokens: mappings of bearer token values to token names
+//   - Digests: mappings of bearer token digests (see HashToken) to token names
+//   - CertificateAuthorities: named CA bundles used to verify client certificates
 //   - JWTSecretKey (optional): the secret key used to validate user JSON Web Tokens if using shared secret
+//   - Version: the published version of the host checks loaded from a store that records versions
+//     (see Versioner); zero if the host checks are not versioned
 type AccessSystem struct {
+	Version      int               `json:"version,omitempty"`
 	Owner        Owner             `json:"owner"`
 	Blocks       map[string]bool   `json:"blocks"`
 	Applications []Application     `json:"applications"`
@@ -22,6 +27,8 @@ type AccessSystem struct {
 	Digests      map[string]string `json:"digests"`
 	RootToken    string            `json:"rootToken"`
 	JWTSecretKey string            `json:"jwtSecret,omitempty"`
+
+	CertificateAuthorities []CertificateAuthority `json:"certificateAuthorities,omitempty"`
 }
 
 type Owner struct {
@@ -33,9 +40,14 @@ type Owner struct {
 }
 
 // HostChecks ...
+//   - Headers maps response header names to decision fields (uid, tenant, email, name,
+//     token, rule, classification, permissions, credential) added to allowed requests
+//   - Mode is the run mode of all host groups that do not set their own (default enforcing)
 type HostChecks struct {
 	RootCheck  string            `json:"rootCheck"`
+	Mode       string            `json:"mode,omitempty"`
 	Overrides  map[string]string `json:"overrides,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
 	HostGroups []HostGroup       `json:"hostGroups"`
 }
 
@@ -58,6 +70,46 @@ type HostGroup struct {
 	Hosts       []string `json:"hosts"`
 	Default     string   `json:"default"` // "allow" or "deny" (define in pat?)
 	Checks      []Check  `json:"checks"`
+
+	// Headers adds to or replaces the global decision headers for the hosts in the group
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Login enables an OIDC browser login for unauthenticated requests to the hosts in the group
+	Login *Login `json:"login,omitempty"`
+
+	// Mode is the run mode of the hosts in the group: enforcing, permissive or disabled
+	Mode string `json:"mode,omitempty"`
+}
+
+// Login configures the OIDC authorization code flow used to log in browser requests to a host group:
+//   - Issuer is the OIDC issuer; endpoints not given are discovered from its openid-configuration
+//   - ClientID and ClientSecret are the credentials of forward-auth registered with the issuer
+//   - Scopes are requested in addition to openid
+//   - CallbackPath and LogoutPath are paths on the group hosts served by forward-auth
+//     (default /_oauth/callback and /_oauth/logout)
+//   - LogoutRedirect is the URL to return to after logout (default /)
+//   - CookieName names the session cookie (default _forward_auth) and CookieDomain optionally
+//     shares it across the group hosts
+type Login struct {
+	Issuer           string   `json:"issuer"`
+	AuthorizationURL string   `json:"authorizationURL,omitempty"`
+	TokenURL         string   `json:"tokenURL,omitempty"`
+	EndSessionURL    string   `json:"endSessionURL,omitempty"`
+	ClientID         string   `json:"clientID"`
+	ClientSecret     *Secret  `json:"clientSecret,omitempty"`
+	Scopes           []string `json:"scopes,omitempty"`
+	CallbackPath     string   `json:"callbackPath,omitempty"`
+	LogoutPath       string   `json:"logoutPath,omitempty"`
+	LogoutRedirect   string   `json:"logoutRedirect,omitempty"`
+	CookieName       string   `json:"cookieName,omitempty"`
+	CookieDomain     string   `json:"cookieDomain,omitempty"`
+}
+
+func (l Login) Validate() error {
+	return validation.ValidateStruct(&l,
+		validation.Field(&l.Issuer, validation.Required, validation.Length(1, 1024)),
+		validation.Field(&l.ClientID, validation.Required, validation.Length(1, 256)),
+	)
 }
 
 func (hg HostGroup) Validate() error {
@@ -65,6 +117,7 @@ func (hg HostGroup) Validate() error {
 		validation.Field(&hg.Name, validation.Required, validation.Length(1, 32)),
 		validation.Field(&hg.Description, validation.Length(0, 1024)),
 		validation.Field(&hg.Default, validation.Required, validation.In("allow", "deny")),
+		validation.Field(&hg.Mode, validation.In(RunEnforcing, RunPermissive, RunDisabled)),
 	)
 }
 
@@ -122,10 +175,17 @@ func (p Path) Validate() error {
 }
 
 // Rule ...
+//   - Name identifies the rule in decision headers and logs; it defaults to the
+//     check name, method and path to which the rule applies
+//   - CacheTTL (optional) is the duration, eg 30s, that decisions of the rule are cached for
+//     requests with the same credentials and parameters; rules calling builtins that depend on
+//     more than the credentials and parameters of a request, such as allow(), are not cached
 type Rule struct {
+	Name        string `json:"name,omitempty"`
 	Description string `json:"description"`
 	Expression  string `json:"expression"`
 	MustAuth    bool   `json:"mustAuth,omitempty"`
+	CacheTTL    string `json:"cacheTTL,omitempty"`
 }
 
 // construct a root check function
@@ -0,0 +1,265 @@
+package fauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// AssertionTTL is the lifetime of an identity assertion; assertions are bound to a single
+// request so they need only outlive the hop to the upstream service
+const AssertionTTL = 60 * time.Second
+
+// AssertionClaims are the claims of the identity assertion minted for an allowed request
+// and signed with the owner private key:
+//   - Identity is the verified identity from the request JWT, if any
+//   - Tenant is the tenant of the identity, if any
+//   - Token is the name of the verified bearer token, if any
+//   - Credentials are the credential types verified in the request (jwt, bearer, signature, certificate)
+//   - Rule is the name of the rule that allowed the request
+//   - Request binds the assertion to the forwarded request
+//
+// the subject is the identity UID or else the bearer token name and the audience is the forwarded host
+type AssertionClaims struct {
+	Identity    *Identity        `json:"identity,omitempty"`
+	Tenant      string           `json:"tid,omitempty"`
+	Token       string           `json:"token,omitempty"`
+	Credentials []string         `json:"cred"`
+	Rule        string           `json:"rule,omitempty"`
+	Request     AssertionRequest `json:"req"`
+	jwt.RegisteredClaims
+}
+
+// AssertionRequest binds an assertion to the request it was minted for; PathHash is the
+// unpadded base64url SHA-256 of the escaped request path without its query
+type AssertionRequest struct {
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	PathHash string `json:"pathHash"`
+}
+
+// JWK is a JSON Web Key (RFC 7517) for an RSA, EC or OKP (Ed25519) public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// signer signs identity assertions with the owner private key
+type signer struct {
+	issuer string
+	key    crypto.Signer
+	method jwt.SigningMethod
+	jwk    JWK
+}
+
+// newSigner returns a signer for the private key of owner, or nil if owner has no private key;
+// the owner public key, if given, must match the private key
+func newSigner(owner Owner) (*signer, error) {
+	if owner.PrivateKey == nil || owner.PrivateKey.Value == "" {
+		return nil, nil
+	}
+
+	key, err := loadPrivateKey([]byte(owner.PrivateKey.Value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %s for owner %s: %s", owner.PrivateKey.Name, owner.Name, err)
+	}
+
+	if owner.PublicKey != nil && owner.PublicKey.Value != "" {
+		pub, err := loadPublicKey([]byte(owner.PublicKey.Value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s for owner %s: %s", owner.PublicKey.Name, owner.Name, err)
+		}
+		if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(pub) {
+			return nil, fmt.Errorf("public key %s does not match private key %s for owner %s", owner.PublicKey.Name, owner.PrivateKey.Name, owner.Name)
+		}
+	}
+
+	s := &signer{issuer: owner.UID, key: key}
+	if s.issuer == "" {
+		s.issuer = "forward-auth"
+	}
+	s.jwk, s.method, err = newJWK(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadPrivateKey loads an RSA, ECDSA or Ed25519 private key from PEM encoded keyData
+// in PKCS #1, SEC 1 or PKCS #8 form
+func loadPrivateKey(keyData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("private key is of the wrong type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// newJWK returns the JWK and JWT signing method for public key; the key ID is the
+// RFC 7638 thumbprint of the key
+func newJWK(key crypto.PublicKey) (jwk JWK, method jwt.SigningMethod, err error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	var thumbprint string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk = JWK{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+		method = jwt.SigningMethodRS256
+		thumbprint = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		switch k.Curve {
+		case elliptic.P256():
+			jwk.Crv, method = "P-256", jwt.SigningMethodES256
+		case elliptic.P384():
+			jwk.Crv, method = "P-384", jwt.SigningMethodES384
+		case elliptic.P521():
+			jwk.Crv, method = "P-521", jwt.SigningMethodES512
+		default:
+			return jwk, method, fmt.Errorf("unsupported elliptic curve %s", k.Curve.Params().Name)
+		}
+		jwk.Kty = "EC"
+		jwk.X = b64(k.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64(k.Y.FillBytes(make([]byte, size)))
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	case ed25519.PublicKey:
+		jwk = JWK{Kty: "OKP", Crv: "Ed25519", X: b64(k)}
+		method = jwt.SigningMethodEdDSA
+		thumbprint = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, jwk.X)
+	default:
+		return jwk, method, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	sum := sha256.Sum256([]byte(thumbprint))
+	jwk.Kid = b64(sum[:])
+	jwk.Use = "sig"
+	jwk.Alg = method.Alg()
+	return jwk, method, nil
+}
+
+func (auth *Auth) getSigner() *signer {
+	return auth.current().signer
+}
+
+// CanAssert returns true if an owner private key is configured for signing identity assertions
+func (auth *Auth) CanAssert() bool {
+	return auth.getSigner() != nil
+}
+
+// JWKS returns the key set publishing the owner public key that verifies identity assertions;
+// the key set is empty if no owner private key is configured
+func (auth *Auth) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	if s := auth.getSigner(); s != nil {
+		jwks.Keys = append(jwks.Keys, s.jwk)
+	}
+	return jwks
+}
+
+// Assert returns an identity assertion for the allowed decision on the forwarded request
+// method host uri, signed with the owner private key
+func (auth *Auth) Assert(decision *Decision, host, method, uri string) (assertion string, err error) {
+	s := auth.getSigner()
+	if s == nil {
+		return assertion, fmt.Errorf("no owner private key is configured for identity assertions")
+	}
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return assertion, fmt.Errorf("invalid request URI %s: %s", uri, err)
+	}
+	pathHash := sha256.Sum256([]byte(u.EscapedPath()))
+
+	jti := make([]byte, 16)
+	if _, err = rand.Read(jti); err != nil {
+		return assertion, err
+	}
+
+	now := time.Now()
+	claims := AssertionClaims{
+		Identity:    decision.Identity,
+		Token:       decision.Token,
+		Credentials: decision.Credentials,
+		Rule:        decision.Rule,
+		Request: AssertionRequest{
+			Method:   method,
+			Host:     host,
+			PathHash: base64.RawURLEncoding.EncodeToString(pathHash[:]),
+		},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   decision.User(),
+			Audience:  jwt.ClaimStrings{host},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AssertionTTL)),
+			ID:        hex.EncodeToString(jti),
+		},
+	}
+	if claims.Credentials == nil {
+		claims.Credentials = []string{}
+	}
+	if decision.Identity != nil {
+		claims.Tenant = decision.Identity.TenantID()
+	}
+	if claims.Subject == "" {
+		claims.Subject = decision.Token
+	}
+
+	token := jwt.NewWithClaims(s.method, claims)
+	token.Header["kid"] = s.jwk.Kid
+	return token.SignedString(s.key)
+}
@@ -0,0 +1,171 @@
+package fauth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ownerKeys returns PEM encoded PKCS #8 private and PKIX public keys for key
+func ownerKeys(t *testing.T, key crypto.Signer) (private, public string) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+}
+
+func newAssertionAuth(t *testing.T, key crypto.Signer) *fauth.Auth {
+	private, public := ownerKeys(t, key)
+	return newTestAuth(t, &fauth.AccessSystem{
+		Owner: fauth.Owner{
+			Name:       "Example",
+			UID:        "owner-1",
+			PrivateKey: &fauth.PrivateKey{Source: "file", Name: "OWNER_PRIVATE_KEY", Value: private},
+			PublicKey:  &fauth.PublicKey{Source: "file", Name: "OWNER_PUBLIC_KEY", Value: public},
+		},
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com"},
+					Default: "deny",
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path:  "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "bearer('MC_APP_KEY')"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func TestAssert(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{"ecdsa", ecKey, "ES256"},
+		{"ed25519", edKey, "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAssertionAuth(t, tt.key)
+			if !auth.CanAssert() {
+				t.Fatal("CanAssert() = false, want true")
+			}
+
+			jwks := auth.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != tt.alg {
+				t.Fatalf("JWKS() = %+v, want one %s key", jwks, tt.alg)
+			}
+
+			uri := "/widgets-api/v1/widgets?limit=10"
+			header := http.Header{"Authorization": []string{"Bearer app-token-value"}}
+			decision := auth.Check("apis.example.com", "GET", uri, header)
+			if decision.Status != http.StatusOK {
+				t.Fatalf("Check() status = %d, want 200: %s", decision.Status, decision.Message)
+			}
+
+			assertion, err := auth.Assert(decision, "apis.example.com", "GET", uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims := &fauth.AssertionClaims{}
+			token, err := jwt.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != jwks.Keys[0].Kid {
+					t.Errorf("kid = %v, want %s", token.Header["kid"], jwks.Keys[0].Kid)
+				}
+				return tt.key.Public(), nil
+			})
+			if err != nil || !token.Valid {
+				t.Fatalf("failed to verify assertion: %v", err)
+			}
+
+			sum := sha256.Sum256([]byte("/widgets-api/v1/widgets"))
+			if claims.Request.PathHash != base64.RawURLEncoding.EncodeToString(sum[:]) {
+				t.Errorf("Request.PathHash = %s, want hash of request path", claims.Request.PathHash)
+			}
+			if claims.Subject != "MC_APP_KEY" || claims.Token != "MC_APP_KEY" {
+				t.Errorf("Subject, Token = %s, %s, want MC_APP_KEY", claims.Subject, claims.Token)
+			}
+			if len(claims.Credentials) != 1 || claims.Credentials[0] != fauth.CredentialBearer {
+				t.Errorf("Credentials = %v, want [bearer]", claims.Credentials)
+			}
+			if claims.Issuer != "owner-1" || !claims.VerifyAudience("apis.example.com", true) {
+				t.Errorf("Issuer, Audience = %s, %v, want owner-1, apis.example.com", claims.Issuer, claims.Audience)
+			}
+		})
+	}
+}
+
+func TestAssertKeyMismatch(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, _ := ownerKeys(t, key)
+	_, public := ownerKeys(t, other)
+
+	acs := &fauth.AccessSystem{
+		Owner: fauth.Owner{
+			Name:       "Example",
+			PrivateKey: &fauth.PrivateKey{Source: "file", Name: "OWNER_PRIVATE_KEY", Value: private},
+			PublicKey:  &fauth.PublicKey{Source: "file", Name: "OWNER_PUBLIC_KEY", Value: public},
+		},
+	}
+	if _, err := fauth.NewAuth(acs, jwtHeader, nil, nil); err == nil {
+		t.Error("NewAuth() with mismatched owner keys succeeded, want error")
+	}
+}
+
+func TestJWKSWithoutOwnerKey(t *testing.T) {
+	auth := newTestAuth(t, &fauth.AccessSystem{})
+	if auth.CanAssert() {
+		t.Error("CanAssert() = true, want false")
+	}
+	if keys := auth.JWKS().Keys; keys == nil || len(keys) != 0 {
+		t.Errorf("JWKS().Keys = %v, want empty", keys)
+	}
+}
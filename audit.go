@@ -0,0 +1,319 @@
+package fauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// Audit outcomes of a decision
+const (
+	AuditAllow = "allow"
+	AuditDeny  = "deny"
+)
+
+// AuditEvent is the structured record of a decision:
+//   - Path is the forwarded request URI with the values of secret query parameters redacted
+//   - Check and Pattern are the check and path pattern the request was routed to, if any
+//   - Outcome is allow or deny and Reason is the decision message, redacted as Path is
+//   - Mode is the run mode of the host and Unenforced the status of a denial allowed by the
+//     permissive run mode
+//   - Subject identifies the user, bearer token and tenant of the request; secrets are never
+//     recorded
+//   - Latency is the time taken to decide in milliseconds
+type AuditEvent struct {
+	Time       time.Time    `json:"time"`
+	TraceID    string       `json:"traceId,omitempty"`
+	Host       string       `json:"host"`
+	Method     string       `json:"method"`
+	Path       string       `json:"path"`
+	Check      string       `json:"check,omitempty"`
+	Pattern    string       `json:"pattern,omitempty"`
+	Rule       string       `json:"rule,omitempty"`
+	Outcome    string       `json:"outcome"`
+	Status     int          `json:"status"`
+	Reason     string       `json:"reason"`
+	Mode       string       `json:"mode,omitempty"`
+	Unenforced int          `json:"unenforced,omitempty"`
+	Subject    AuditSubject `json:"subject"`
+	Latency    float64      `json:"latencyMs"`
+}
+
+// AuditSubject identifies who made an audited request
+type AuditSubject struct {
+	UID    string `json:"uid,omitempty"`
+	Token  string `json:"token,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// AuditEvent returns the audit event of decision for the forwarded request method host uri with
+// header; the subject of a denied request is read from its bearer token and valid JWT, if any
+func (auth *Auth) AuditEvent(decision *Decision, host, method, uri string, header http.Header, traceID string, latency time.Duration) *AuditEvent {
+	e := &AuditEvent{
+		Time:       time.Now().UTC(),
+		TraceID:    traceID,
+		Host:       host,
+		Method:     method,
+		Path:       RedactURI(uri),
+		Check:      decision.Check,
+		Pattern:    decision.Path,
+		Rule:       decision.Rule,
+		Outcome:    AuditDeny,
+		Status:     decision.Status,
+		Reason:     decision.Message,
+		Mode:       decision.Mode,
+		Unenforced: decision.Unenforced,
+		Latency:    float64(latency.Microseconds()) / 1000,
+	}
+	if decision.Status == http.StatusOK {
+		e.Outcome = AuditAllow
+	}
+	// decision messages may quote the request URI
+	if _, query, ok := strings.Cut(uri, "?"); ok && query != "" {
+		_, redacted, _ := strings.Cut(e.Path, "?")
+		e.Reason = strings.ReplaceAll(e.Reason, query, redacted)
+	}
+
+	identity, token := decision.Identity, decision.Token
+	if decision.Status != http.StatusOK || decision.Unenforced != 0 {
+		if t := bearerToken(header); t != "" {
+			token = auth.current().tokenName(t)
+		}
+		if jwt := header.Get(auth.jwtHeader); jwt != "" {
+			identity, _ = jwtIdentity(jwt, auth)
+		}
+	}
+	e.Subject.Token = token
+	if identity != nil {
+		e.Subject.UID = identity.UserID()
+		e.Subject.Tenant = identity.TenantID()
+	}
+	return e
+}
+
+// secretParams are the substrings of query parameter names whose values are redacted
+var secretParams = []string{"token", "key", "secret", "password", "passwd", "auth", "session", "credential", "signature", "code"}
+
+// RedactURI returns uri with the values of query parameters that may carry secrets redacted
+func RedactURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok || query == "" {
+		return uri
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return path + "?REDACTED"
+	}
+	for name := range values {
+		lower := strings.ToLower(name)
+		for _, secret := range secretParams {
+			if strings.Contains(lower, secret) {
+				values[name] = []string{"REDACTED"}
+				break
+			}
+		}
+	}
+	return path + "?" + values.Encode()
+}
+
+// AuditSink writes audit events
+type AuditSink interface {
+	Write(event *AuditEvent) error
+	Close() error
+}
+
+// Auditor writes the audit events of decisions to its sinks; allowed decisions are sampled at
+// the rate sampleAllowed (0 to 1) while denied and unenforced decisions are always written
+type Auditor struct {
+	sinks         []AuditSink
+	sampleAllowed float64
+}
+
+// NewAuditor returns an auditor writing to sinks
+func NewAuditor(sampleAllowed float64, sinks ...AuditSink) (auditor *Auditor, err error) {
+	if sampleAllowed < 0 || sampleAllowed > 1 {
+		return auditor, fmt.Errorf("invalid audit sample rate %g; must be between 0 and 1", sampleAllowed)
+	}
+	return &Auditor{sinks: sinks, sampleAllowed: sampleAllowed}, nil
+}
+
+// Audit writes event to the sinks of the auditor unless it is an allowed decision that is not
+// sampled; sink errors are logged. A nil auditor writes nothing
+func (a *Auditor) Audit(event *AuditEvent) {
+	if a == nil || len(a.sinks) == 0 {
+		return
+	}
+	if event.Outcome == AuditAllow && event.Unenforced == 0 && a.sampleAllowed < 1 && rand.Float64() >= a.sampleAllowed {
+		return
+	}
+	for _, sink := range a.sinks {
+		if err := sink.Write(event); err != nil {
+			log.Errorf("failed to write audit event: %s", err)
+		}
+	}
+}
+
+// Close closes the sinks of the auditor
+func (a *Auditor) Close() (err error) {
+	if a == nil {
+		return nil
+	}
+	for _, sink := range a.sinks {
+		if e := sink.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// JSONAuditSink writes audit events as JSON lines
+type JSONAuditSink struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewJSONAuditSink returns a sink writing JSON lines to w, eg os.Stdout
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+func (s *JSONAuditSink) Write(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// Close does nothing; the writer is owned by the caller
+func (s *JSONAuditSink) Close() error {
+	return nil
+}
+
+// FileAuditSink writes audit events as JSON lines to a file that is rotated when it reaches
+// maxSize bytes; rotated files are renamed file.1 (the most recent) to file.maxBackups. A file
+// that fails to rotate is reopened and written past maxSize until it can be rotated
+type FileAuditSink struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	closed     bool
+	mutex      sync.Mutex
+}
+
+// NewFileAuditSink opens file for appending audit events
+func NewFileAuditSink(file string, maxSize int64, maxBackups int) (sink *FileAuditSink, err error) {
+	if maxSize <= 0 {
+		return sink, fmt.Errorf("invalid audit file size %d", maxSize)
+	}
+	sink = &FileAuditSink{name: file, maxSize: maxSize, maxBackups: maxBackups}
+	if err = sink.open(); err != nil {
+		return sink, err
+	}
+	return sink, nil
+}
+
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Write(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("audit file %s is closed", s.name)
+	}
+	// a file that failed to reopen after rotating is opened again
+	if s.file == nil {
+		if err = s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			if s.file == nil {
+				return err
+			}
+			log.Errorf("failed to rotate audit file %s; writing past its maximum size: %s", s.name, err)
+		}
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// rotate renames the current file to file.1, shifting older backups and removing the oldest, and
+// opens a new file; the current file is reopened if it cannot be renamed
+func (s *FileAuditSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err == nil {
+		err = s.shift()
+	}
+	if openErr := s.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames the closed current file to file.1, shifting older backups and removing the oldest
+func (s *FileAuditSink) shift() error {
+	if s.maxBackups <= 0 {
+		return os.Remove(s.name)
+	}
+	for i := s.maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.name, i)
+		if _, err := os.Stat(from); err == nil {
+			if err = os.Rename(from, fmt.Sprintf("%s.%d", s.name, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(s.name, s.name+".1")
+}
+
+// Close closes the audit file; events written after Close are rejected
+func (s *FileAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
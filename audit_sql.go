@@ -0,0 +1,151 @@
+package fauth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// SQLAuditSink inserts audit events into a database table in batches; events are written when
+// a batch is full, every interval and on Close. Events are dropped with an error if the
+// database falls behind by more than ten batches
+type SQLAuditSink struct {
+	db       *sql.DB
+	insert   string
+	size     int
+	interval time.Duration
+	events   chan *AuditEvent
+	done     chan struct{}
+	once     sync.Once
+	mutex    sync.RWMutex
+	closed   bool
+}
+
+// NewSQLAuditSink returns a sink executing the insert statement for each event in batches of
+// size; the statement takes the parameters returned by AuditEvent.Values in order
+func NewSQLAuditSink(db *sql.DB, insert string, size int, interval time.Duration) (sink *SQLAuditSink, err error) {
+	if size <= 0 || interval <= 0 {
+		return sink, fmt.Errorf("invalid audit batch size %d or interval %s", size, interval)
+	}
+	sink = &SQLAuditSink{
+		db:       db,
+		insert:   insert,
+		size:     size,
+		interval: interval,
+		events:   make(chan *AuditEvent, 10*size),
+		done:     make(chan struct{}),
+	}
+	go sink.run()
+	return sink, nil
+}
+
+// Values returns the column values of an audit event in the order time, trace ID, host, method,
+// path, check, pattern, rule, outcome, status, reason, mode, unenforced, uid, token, tenant and
+// latency in milliseconds; strings are truncated to the column lengths of authz.DECISIONS so that
+// one long value cannot fail the insert of its batch
+func (e *AuditEvent) Values() []interface{} {
+	return []interface{}{
+		e.Time, truncate(e.TraceID, 64), truncate(e.Host, 255), truncate(e.Method, 16), truncate(e.Path, 2048),
+		truncate(e.Check, 64), truncate(e.Pattern, 1024), truncate(e.Rule, 1024), truncate(e.Outcome, 8), e.Status,
+		truncate(e.Reason, 1024), truncate(e.Mode, 16), e.Unenforced, truncate(e.Subject.UID, 64),
+		truncate(e.Subject.Token, 64), truncate(e.Subject.Tenant, 64), e.Latency,
+	}
+}
+
+// truncate returns the longest prefix of s of at most n bytes that does not split a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Write queues event for insertion; it returns an error if the sink is closed or too far behind
+func (s *SQLAuditSink) Write(event *AuditEvent) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit table sink is closed; dropping event")
+	}
+	select {
+	case s.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("audit table is %d events behind; dropping event", cap(s.events))
+	}
+}
+
+// Close writes the pending events and stops the sink
+func (s *SQLAuditSink) Close() error {
+	s.once.Do(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.closed = true
+		close(s.events)
+	})
+	<-s.done
+	return nil
+}
+
+func (s *SQLAuditSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]*AuditEvent, 0, s.size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.flush(batch); err != nil {
+			log.Errorf("failed to write %d audit events: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) == s.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flush inserts a batch of events in a transaction
+func (s *SQLAuditSink) flush(batch []*AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval+10*time.Second)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, s.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, event := range batch {
+		if _, err = stmt.ExecContext(ctx, event.Values()...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package fauth
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogAuditSink writes audit events as JSON messages to syslog; denied decisions are written
+// with warning severity and allowed decisions with info severity
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink connects to the syslog daemon at raddr on network, or to the local syslog
+// daemon if network is empty, writing messages tagged with tag to the auth facility
+func NewSyslogAuditSink(network, raddr, tag string) (sink *SyslogAuditSink, err error) {
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return sink, err
+	}
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+func (s *SyslogAuditSink) Write(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Outcome == AuditDeny || event.Unenforced != 0 {
+		return s.writer.Warning(string(data))
+	}
+	return s.writer.Info(string(data))
+}
+
+// Close closes the connection to syslog
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package fauth
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NewSyslogAuditSink returns an error since syslog is not supported on this platform
+func NewSyslogAuditSink(network, raddr, tag string) (sink AuditSink, err error) {
+	return sink, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
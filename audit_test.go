@@ -0,0 +1,190 @@
+package fauth_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestAuditEvent(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token-value")
+	uri := "/widgets-api/v1/widgets?access_token=secret-value&page=2"
+	d := auth.Check("apis.example.com", "GET", uri, header)
+	e := auth.AuditEvent(d, "apis.example.com", "GET", uri, header, "trace-1", 1500*time.Microsecond)
+
+	if e.Outcome != fauth.AuditAllow || e.Status != http.StatusOK || e.TraceID != "trace-1" || e.Latency != 1.5 {
+		t.Errorf("got event %+v", e)
+	}
+	if e.Check != "widgets-api" || e.Pattern != "/widgets-api/v1/widgets" || e.Subject.Token != "MC_APP_KEY" {
+		t.Errorf("got check %s pattern %s token %s", e.Check, e.Pattern, e.Subject.Token)
+	}
+	if e.Path != "/widgets-api/v1/widgets?access_token=REDACTED&page=2" {
+		t.Errorf("got path %s", e.Path)
+	}
+	data, _ := json.Marshal(e)
+	if strings.Contains(string(data), "secret-value") || strings.Contains(string(data), "app-token-value") {
+		t.Errorf("audit event contains secrets: %s", data)
+	}
+
+	// the subject of a denied request is recorded
+	header = http.Header{}
+	header.Set(jwtHeader, testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-1")}))
+	uri = "/widgets-api/v1/users/user-2/widgets"
+	d = auth.Check("apis.example.com", "GET", uri, header)
+	e = auth.AuditEvent(d, "apis.example.com", "GET", uri, header, "", 0)
+	if e.Outcome != fauth.AuditDeny || e.Subject.UID != "user-1" || e.Subject.Tenant != "tenant-1" || e.Reason == "" {
+		t.Errorf("got event %+v", e)
+	}
+}
+
+func TestAuditorSampling(t *testing.T) {
+	var out bytes.Buffer
+	auditor, err := fauth.NewAuditor(0, fauth.NewJSONAuditSink(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor.Audit(&fauth.AuditEvent{Outcome: fauth.AuditAllow, Status: 200})
+	auditor.Audit(&fauth.AuditEvent{Outcome: fauth.AuditAllow, Status: 200, Unenforced: 403})
+	auditor.Audit(&fauth.AuditEvent{Outcome: fauth.AuditDeny, Status: 403})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d events, want 2: %s", len(lines), out.String())
+	}
+	e := &fauth.AuditEvent{}
+	if err := json.Unmarshal([]byte(lines[1]), e); err != nil || e.Outcome != fauth.AuditDeny {
+		t.Errorf("got event %s: %v", lines[1], err)
+	}
+
+	if _, err := fauth.NewAuditor(1.5); err == nil {
+		t.Errorf("got no error for invalid sample rate")
+	}
+	var nilAuditor *fauth.Auditor
+	nilAuditor.Audit(&fauth.AuditEvent{})
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+
+	sink, err := fauth.NewFileAuditSink(file, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := sink.Write(&fauth.AuditEvent{TraceID: fmt.Sprintf("trace-%d", i), Outcome: fauth.AuditAllow}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Errorf("missing audit file: %s", err)
+			continue
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s has size %d, want at most 300", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(file + ".3"); err == nil {
+		t.Errorf("got more than 2 backups")
+	}
+	data, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(data), "trace-9") {
+		t.Errorf("latest event not in current file: %s", data)
+	}
+}
+
+func TestFileAuditSinkRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+
+	// the current file cannot be renamed over a directory, so it fails to rotate
+	if err = os.MkdirAll(filepath.Join(file+".1", "blocked"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := fauth.NewFileAuditSink(file, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := sink.Write(&fauth.AuditEvent{TraceID: fmt.Sprintf("trace-%d", i), Outcome: fauth.AuditAllow}); err != nil {
+			t.Fatalf("got error %s writing past a failed rotation", err)
+		}
+	}
+	data, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(data), "trace-4") {
+		t.Errorf("latest event not in current file: %s", data)
+	}
+
+	// the file rotates once it can be renamed
+	if err = os.RemoveAll(file + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(&fauth.AuditEvent{TraceID: "trace-5", Outcome: fauth.AuditAllow}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = ioutil.ReadFile(file + ".1"); !strings.Contains(string(data), "trace-4") {
+		t.Errorf("rotated file does not contain the events written past the failed rotation: %s", data)
+	}
+
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(&fauth.AuditEvent{Outcome: fauth.AuditAllow}); err == nil {
+		t.Error("got no error writing to a closed sink")
+	}
+}
+
+func TestSQLAuditSink(t *testing.T) {
+	// values are truncated to the column lengths without splitting a UTF-8 sequence
+	event := &fauth.AuditEvent{Path: "/" + strings.Repeat("é", 1500), Check: strings.Repeat("c", 100), Outcome: fauth.AuditDeny}
+	values := event.Values()
+	if path := values[4].(string); len(path) != 2047 || !strings.HasSuffix(path, "é") {
+		t.Errorf("got path of %d bytes", len(path))
+	}
+	if check := values[5].(string); len(check) != 64 {
+		t.Errorf("got check of %d bytes, want 64", len(check))
+	}
+	if outcome := values[8].(string); outcome != fauth.AuditDeny {
+		t.Errorf("got outcome %q, want %q", outcome, fauth.AuditDeny)
+	}
+
+	sink, err := fauth.NewSQLAuditSink(nil, "INSERT", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(event); err == nil {
+		t.Error("got no error writing to a closed sink")
+	}
+	if err = sink.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,19 +1,22 @@
 package fauth
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"bitbucket.org/_metalogic_/config"
-	"bitbucket.org/_metalogic_/eval"
 	"bitbucket.org/_metalogic_/httpsig"
 	"bitbucket.org/_metalogic_/ident"
 	"bitbucket.org/_metalogic_/log"
@@ -41,48 +44,63 @@ const (
 // Auth type holds data for authorization
 //   - jwtHeader is the name of the header containing the user's JWT
 //   - keyFunc is a function passed to JWT parse function to return the key for decrypting the JWT token
-//   - owner is the owner of the current forward-auth deployment
-//   - publicKeys maps key names to their rsa.PublicKey value
-//   - tokens maps token values passed in a request to token names referenced in
-//     access control functions; eg: bearer(ROOT_KEY) returns true if the bearer
-//     auth token in the request maps to the token name ROOT_KEY
+//   - state holds the current snapshot of the access system: its owner, tokens, keys and compiled
+//     host checks (see snapshot); serial numbers the snapshots built for auth
 //   - blocks is a map of subjects (usernames, hostnames, IP addresses) to be denied
 //     access; subject names must be unique for all subjects
+//   - sessionKey encrypts login cookies
+//   - runModes holds the run modes set at runtime
+//   - reload records the outcome of the reloads since the current snapshot was loaded
+//   - lkgFile is the file each access system loaded by UpdateFunc is saved to as the last known
+//     good access system of the store lkgStore
+//   - shadow decides requests with shadow host checks next to the live host checks, if set
+//   - metrics are the decision and access system metrics exported at /metrics
 //
 // an instance of Auth is passed to handlers to drive authorization calculations
 type Auth struct {
-	runMode    string
-	jwtHeader  string
-	keyFunc    func(token *jwt.Token) (interface{}, error)
-	owner      Owner
-	publicKeys map[string]*rsa.PublicKey
-	tokens     map[string]string
-	blocks     map[string]bool
-	overrides  map[string]string
-	mutex      sync.RWMutex
-	hostMuxers map[string]*pat.HostMux
+	runModes        runModes
+	reload          reloadState
+	lkgFile         string
+	lkgStore        string
+	jwtHeader       string
+	keyFunc         func(token *jwt.Token) (interface{}, error)
+	state           atomic.Value
+	serial          uint64
+	blocks          map[string]bool
+	sessionKey      []byte
+	signatureMaxAge time.Duration
+	mutex           sync.RWMutex
+	traces          sync.Map
+	spans           sync.Map
+	callouts        sync.Map
+	calloutStubs    map[string]bool
+	shadow          *shadow
+	metrics         *Metrics
+	cache           *decisionCache
 }
 
 // NewAuth returns a new RSA Auth
 func NewAuth(acs *AccessSystem, jwtHeader string, publicKey, secret []byte) (auth *Auth, err error) {
 	auth = &Auth{
-		jwtHeader:  jwtHeader,
-		hostMuxers: make(map[string]*pat.HostMux),
-		owner:      acs.Owner,
-		publicKeys: make(map[string]*rsa.PublicKey),
-		tokens:     acs.Tokens,
-		blocks:     acs.Blocks,
+		jwtHeader:       jwtHeader,
+		blocks:          acs.Blocks,
+		signatureMaxAge: DefaultSignatureMaxAge,
+		metrics:         newMetrics(),
 	}
 
-	auth.setRSAPublicKeys(acs.PublicKeys)
-	err = auth.setAccess(acs.Checks, false)
+	s, err := newSnapshot(auth, acs)
 	if err != nil {
 		return auth, err
 	}
+	auth.state.Store(s)
 
-	rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKey)
-	if err != nil {
-		return auth, err
+	// the RSA public key of the identity provider is optional when JWTs are signed with a secret
+	var rsaKey *rsa.PublicKey
+	if len(publicKey) > 0 {
+		rsaKey, err = jwt.ParseRSAPublicKeyFromPEM(publicKey)
+		if err != nil {
+			return auth, err
+		}
 	}
 	// support JWT signing by either symmetric secret key or RSA public/private key
 	auth.keyFunc = func(token *jwt.Token) (key interface{}, err error) {
@@ -90,17 +108,30 @@ func NewAuth(acs *AccessSystem, jwtHeader string, publicKey, secret []byte) (aut
 		case "HS256":
 			return secret, nil
 		case "RS256":
+			if rsaKey == nil {
+				return key, fmt.Errorf("no RSA public key is configured for JWT alg RS256")
+			}
 			return rsaKey, nil
 		}
 		return key, fmt.Errorf("invalid JWT alg: %s", token.Method.Alg())
 	}
+	auth.metrics.loaded()
 	return auth, nil
 }
 
 // CheckBearerAuth checks for token in list of tokens returning true if found
 func (auth *Auth) CheckBearerAuth(token string, tokens ...string) bool {
+	return auth.current().checkBearer(token, tokens...)
+}
+
+func (s *snapshot) checkBearer(token string, tokens ...string) bool {
+	name := s.tokenName(token)
+	if name == "" {
+		log.Debugf("rejecting unknown bearer token '%s'", redact(token))
+		return false
+	}
 	for _, t := range tokens {
-		if t == auth.tokens[token] {
+		if t == name {
 			log.Debugf("allowing by bearer token '%s'", redact(token))
 			return true
 		}
@@ -111,13 +142,17 @@ func (auth *Auth) CheckBearerAuth(token string, tokens ...string) bool {
 
 // CheckJWT returns true if jwt has action permission on category in the tenantID
 func (auth *Auth) CheckJWT(jwt, context, action, category string) (allow bool) {
+	return auth.current().checkJWT(jwt, context, action, category)
+}
+
+func (s *snapshot) checkJWT(jwt, context, action, category string) (allow bool) {
 	if jwt == "" {
 		return false
 	}
 
 	var err error
 	var identity *Identity
-	if identity, err = jwtIdentity(jwt, auth); err != nil {
+	if identity, err = jwtIdentity(jwt, s.auth); err != nil {
 		log.Errorf("JWT found in request is invalid: %s", err)
 		return false
 	}
@@ -126,7 +161,7 @@ func (auth *Auth) CheckJWT(jwt, context, action, category string) (allow bool) {
 
 	// superuser only applies in the tenant of the user
 	if identity.Superuser {
-		if identity.TID != nil && *identity.TID == auth.owner.UID {
+		if identity.TID != nil && *identity.TID == s.owner.UID {
 			return true
 		}
 	}
@@ -164,13 +199,17 @@ func (auth *Auth) JWTIdentity(tknStr string) (identity *Identity, err error) {
 
 // Superuser returns true if jwt has superuser privilege
 func (auth *Auth) Superuser(jwt string) bool {
+	return auth.current().superuser(jwt)
+}
+
+func (s *snapshot) superuser(jwt string) bool {
 	if jwt == "" {
 		return false
 	}
 
 	var err error
 	var identity *Identity
-	if identity, err = jwtIdentity(jwt, auth); err != nil {
+	if identity, err = jwtIdentity(jwt, s.auth); err != nil {
 		log.Errorf("JWT found in request is invalid: %s", err)
 		return false
 	}
@@ -179,7 +218,7 @@ func (auth *Auth) Superuser(jwt string) bool {
 
 	// superuser only applies in the tenant of the user
 	if identity.Superuser {
-		if identity.TID != nil && *identity.TID == auth.owner.UID {
+		if identity.TID != nil && *identity.TID == s.owner.UID {
 			return true
 		}
 	}
@@ -207,11 +246,15 @@ func (auth *Auth) Classification(jwt string) *Classification {
 
 // Identify returns the Identity found in jwt
 func (auth *Auth) Identity(jwt string) error {
+	return auth.current().identity(jwt)
+}
+
+func (s *snapshot) identity(jwt string) error {
 	if jwt == "" {
 		return fmt.Errorf("empty JWT")
 	}
 
-	identity, err := jwtIdentity(jwt, auth)
+	identity, err := jwtIdentity(jwt, s.auth)
 	if err != nil {
 		return fmt.Errorf("JWT is invalid: %s", err)
 	}
@@ -224,8 +267,8 @@ func (auth *Auth) Identity(jwt string) error {
 		return fmt.Errorf("tenant ID in JWT cannot be nil")
 	}
 
-	if *identity.TID != auth.owner.UID {
-		return fmt.Errorf("tenant ID (%s) in JWT does not match owner (%s)", *identity.TID, auth.owner.UID)
+	if *identity.TID != s.owner.UID {
+		return fmt.Errorf("tenant ID (%s) in JWT does not match owner (%s)", *identity.TID, s.owner.UID)
 	}
 
 	log.Debugf("identity found in JWT: %+v", *identity)
@@ -376,33 +419,65 @@ func Action(method string) string {
 	}
 }
 
-// Handler returns a handler implementing rule evaluation for an auth environment and authorizer
-func Handler(rule Rule, auth *Auth) func(method, path string, params map[string][]string, header http.Header) (status int, message, username string) {
+// Handler returns a handler implementing rule evaluation for an auth environment and authorizer;
+// the rule expression is compiled once and an error is returned if it is invalid. The handler
+// evaluates rule with the tokens and keys of the current access system of auth
+func Handler(rule Rule, auth *Auth) (handler pat.HandlerFunc, err error) {
+	if auth == nil {
+		return (&snapshot{}).handler(rule)
+	}
+	return auth.current().handler(rule)
+}
+
+// handler returns the handler of rule bound to the tokens and keys of s
+func (s *snapshot) handler(rule Rule) (handler pat.HandlerFunc, err error) {
+	auth := s.auth
 	mustAuth := rule.MustAuth
 
 	if !mustAuth {
 		if rule.Expression == "true" {
-			return pat.AllowHandler
+			return func(method, path string, params map[string][]string, header http.Header) (status int, message, username string) {
+				header.Set(ruleHeader, rule.Name)
+				return pat.AllowHandler(method, path, params, header)
+			}, nil
 		}
 		if rule.Expression == "false" {
-			return pat.DenyHandler
+			return func(method, path string, params map[string][]string, header http.Header) (status int, message, username string) {
+				header.Set(ruleHeader, rule.Name)
+				return pat.DenyHandler(method, path, params, header)
+			}, nil
 		}
 	}
 
+	expression, err := compile(rule.Expression)
+	if err != nil {
+		return handler, fmt.Errorf("invalid expression for rule %s: %s", rule.Name, err)
+	}
+	ttl, err := rule.cacheTTL()
+	if err != nil {
+		return handler, err
+	}
+	defer func() {
+		if ttl == 0 {
+			return
+		}
+		params, reason := cachePolicy(rule.Expression)
+		if reason != "" {
+			log.Warningf("decisions of rule %s are not cached because %s", rule.Name, reason)
+			return
+		}
+		handler = s.cached(rule, ttl, params, handler)
+	}()
+
 	return func(method, path string, params map[string][]string, header http.Header) (status int, message, username string) {
 		log.Debugf("running handler on %s: %s", method, path)
 
+		// record the deciding rule for Check
+		header.Set(ruleHeader, rule.Name)
+		trace := auth.traceOf(header)
+
 		// Request Headers
-		authHeader := header.Get("Authorization")
-
-		var token string
-		if authHeader != "" {
-			// Get the Bearer auth token
-			splitToken := strings.Split(authHeader, "Bearer ")
-			if len(splitToken) == 2 {
-				token = splitToken[1]
-			}
-		}
+		token := bearerToken(header)
 
 		jwt := header.Get(auth.jwtHeader)
 
@@ -410,7 +485,7 @@ func Handler(rule Rule, auth *Auth) func(method, path string, params map[string]
 			if jwt == "" {
 				return http.StatusUnauthorized, "rule requires authentication but no JWT is present in request header", username
 			}
-			if err := auth.Identity(jwt); err != nil {
+			if err := s.identity(jwt); err != nil {
 				return http.StatusUnauthorized, fmt.Sprintf("rule requires authentication but JWT contains invalid identity: %s", err), username
 			}
 		}
@@ -431,242 +506,135 @@ func Handler(rule Rule, auth *Auth) func(method, path string, params map[string]
 			return http.StatusForbidden, message, username
 		}
 
-		// get signature verifier
-		var verifier httpsig.Verifier
-		if header.Get(string(httpsig.Signature)) != "" {
+		// get signature verifiers; RFC 9421 signatures are identified by the Signature-Input header
+		var (
+			verifier        httpsig.Verifier
+			messageVerifier *RFC9421Verifier
+		)
+		if header.Get(SignatureInputHeader) != "" {
+			// the client signed the request target as forwarded, not the path routed to the check
+			target := u
+			if uri := header.Get("X-Forwarded-Uri"); uri != "" {
+				if forwarded, err := url.Parse(uri); err == nil {
+					target = forwarded
+				}
+			}
+			messageVerifier, err = newRFC9421Verifier(header, method, target.EscapedPath(), target.RawQuery, "", auth.getSignatureMaxAge())
+			if err != nil {
+				log.Warningf("found signature input header but failed to get RFC 9421 verifier: %s", err)
+			}
+		} else if header.Get(string(httpsig.Signature)) != "" {
 			verifier, err = httpsig.NewForwardAuthVerifier(header, method, path, u.RawQuery)
 			if err != nil {
 				log.Warning(fmt.Sprintf("found signature header but failed to get verifier: %s", err))
 			}
 		}
 
-		if t, err := evaluate(rule.Expression, params, auth, credentials, verifier); err != nil {
+		// the client certificate forwarded by Traefik is parsed and verified on first use
+		cert := newClientCert(header.Get(ClientCertHeader))
+
+		// builtins record the types of credential they verify
+		verified := make(map[string]bool)
+
+		ctx := &evalContext{
+			snap:            s,
+			params:          params,
+			credentials:     credentials,
+			verifier:        verifier,
+			messageVerifier: messageVerifier,
+			cert:            cert,
+			verified:        verified,
+			tracer:          trace,
+			span:            auth.spanOf(header).Child("rule.evaluate", SpanInternal),
+			callouts:        auth.calloutsOf(header),
+		}
+		ctx.span.SetAttribute("forward_auth.rule", rule.Name)
+		ctx.span.SetAttribute("forward_auth.expression", rule.Expression)
+		defer ctx.span.End()
+
+		t, err := evaluate(expression, ctx)
+		if trace != nil {
+			trace.terms(rule.Expression, ctx)
+		}
+		ctx.span.SetAttribute("forward_auth.result", t)
+		ctx.span.SetError(err)
+		if err != nil {
 			message := fmt.Sprintf("%s %s failed evaluation for rule %s: %s", method, path, rule.Expression, err)
 			log.Error(message)
+			if trace == nil {
+				auth.metrics.ruleError(rule.Name)
+			}
 			return http.StatusForbidden, message, username
 		} else if t {
 			message := fmt.Sprintf("%s %s allowed by rule %s", method, path, rule.Expression)
 			log.Debug(message)
+			setCredentials(header, verified)
 			return http.StatusOK, message, username
 		} else {
 			message := fmt.Sprintf("%s %s denied by rule %s", method, path, rule.Expression)
 			log.Debug(message)
 			return http.StatusForbidden, message, username
 		}
-	}
+	}, nil
 }
 
-func (auth *Auth) setAccess(checks *HostChecks, refresh bool) error {
-	if checks == nil {
-		log.Warning("empty host checks for auth")
-		return nil
+// namedRule returns rule with its name defaulted to the check, method and path it applies to
+func namedRule(rule Rule, check Check, path Path, method string) Rule {
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("%s %s %s%s", check.Name, method, check.Base, path.Path)
 	}
-	auth.overrides = checks.Overrides
-
-	// create Pat Host Muxers from Checks
-	for _, group := range checks.HostGroups {
-		// default to deny
-		hostMux := pat.NewDenyMux()
-		if group.Default == "allow" {
-			hostMux = pat.NewAllowMux()
-		}
-		// each host in a group shares the hostMux
-		for _, host := range group.Hosts {
-			if v, ok := auth.overrides[host]; ok {
-				log.Warningf("%s override on host %s disables defined host checks", v, host)
-			}
-			if _, ok := auth.getMux(host); !refresh && ok {
-				log.Errorf("ignoring duplicate host checks for %s", host)
-				continue
-			}
-			auth.setMux(host, hostMux)
-		}
-		// add path prefixes to hostMux
-		for _, check := range group.Checks {
-			// deny if method + path is not found
-			pathPrefix := hostMux.AddPrefix(check.Base, pat.NotFoundHandler)
-			for _, path := range check.Paths {
-				if r, ok := path.Rules["GET"]; ok {
-					pathPrefix.Get(path.Path, Handler(r, auth))
-				}
-				if r, ok := path.Rules["POST"]; ok {
-					pathPrefix.Post(path.Path, Handler(r, auth))
-				}
-				if r, ok := path.Rules["PUT"]; ok {
-					pathPrefix.Put(path.Path, Handler(r, auth))
-				}
-				if r, ok := path.Rules["PATCH"]; ok {
-					pathPrefix.Patch(path.Path, Handler(r, auth))
-				}
-				if r, ok := path.Rules["DELETE"]; ok {
-					pathPrefix.Del(path.Path, Handler(r, auth))
-				}
-				if r, ok := path.Rules["HEAD"]; ok {
-					pathPrefix.Head(path.Path, Handler(r, auth))
-				}
-				if r, ok := path.Rules["OPTIONS"]; ok {
-					pathPrefix.Options(path.Path, Handler(r, auth))
-				}
-			}
-		}
-	}
-	return nil
+	return rule
 }
 
-func (auth *Auth) setRSAPublicKeys(publicKeys map[string]string) {
-	auth.mutex.Lock()
-	defer auth.mutex.Unlock()
-	auth.publicKeys = make(map[string]*rsa.PublicKey)
+// loadPublicKeys loads the named PEM encoded public keys; invalid keys are logged and skipped
+func loadPublicKeys(publicKeys map[string]string) map[string]crypto.PublicKey {
+	keys := make(map[string]crypto.PublicKey)
 	for id, value := range publicKeys {
-		rsa, err := loadPublicKey([]byte(value))
+		key, err := loadPublicKey([]byte(value))
 		if err != nil {
-			log.Warningf("failed to load RSA public key for %s: %s", id, err)
+			log.Warningf("failed to load public key for %s: %s", id, err)
 			continue
 		}
-		auth.publicKeys[id] = rsa
+		keys[id] = key
 	}
+	return keys
 }
 
-func (auth *Auth) getRSAPublicKeys() map[string]*rsa.PublicKey {
-	auth.mutex.RLock()
-	defer auth.mutex.RUnlock()
-	return auth.publicKeys
-}
-
-func (auth *Auth) setTokens(tokens map[string]string) {
-	auth.tokens = tokens
-}
-
-func evaluate(expr string, paramMap map[string][]string, auth *Auth, credentials *ident.Credentials, verifier httpsig.Verifier) (result bool, err error) {
-	log.Debugf("evaluating expr '%s' with params %v, auth %v, credentials %v", expr, paramMap, auth, credentials)
-	// define builtins
-	functions := map[string]eval.ExpressionFunction{
-		// return true if call to URL returns HTTP status 200 ok
-		// eg: allow(action, user, "sources/{sid}", "https://example.com/check")
-		// action is one of HEAD (should we call this EXISTS?), CREATE, READ, UPDATE, DELETE
-		"allow": func(args ...interface{}) (interface{}, error) {
-			action, _ := args[0].(string)
-			uid, _ := args[1].(string)
-			rid, _ := args[2].(string)
-			route, _ := args[3].(string)
-			log.Debugf("checking user %s for access to resource '%s' at URL %s", uid, rid, route)
-
-			body := []byte(fmt.Sprintf(`{ "action": "%s", "user": "%s", "resource": "%s"}`, action, uid, rid))
-			key := config.MustGetConfig("ROOT_KEY")
-			client := &http.Client{}
-			req, err := http.NewRequest("POST", route, bytes.NewBuffer(body))
-			if err != nil {
-				return false, err
-			}
-
-			req.Header.Set("Authorization", "Bearer "+key)
-			resp, err := client.Do(req)
-			if err != nil {
-				return false, err
-			}
-
-			if resp.StatusCode != 200 {
-				return false, fmt.Errorf(resp.Status)
-			}
+// TokenDigestPrefix prefixes the token digests returned by HashToken
+const TokenDigestPrefix = "sha256:"
 
-			return true, nil
-		},
-		// return true if the value of one of the bearer tokens is valid in the environment
-		// eg: bearer('ROOT_KEY', 'MC_APP_KEY' ...)
-		"bearer": func(args ...interface{}) (interface{}, error) {
-			if credentials.Token == "" {
-				return false, nil
-			}
-			var tokens []string
-			for _, arg := range args {
-				tokens = append(tokens, arg.(string))
-			}
-			log.Debugf("calling bearer(%v)", tokens)
-			return auth.CheckBearerAuth(credentials.Token, tokens...), nil
-		},
-		// return the binding of a path or query parameter
-		// eg: param(':tenantID'), param('summary')
-		"param": func(args ...interface{}) (interface{}, error) {
-			param := args[0].(string)
-			log.Debugf("calling param(%s)", param)
-			if v, ok := paramMap[param]; ok {
-				return v[0], nil
-			}
-			return "", nil
-		},
-		// return true if identity has role permission in tenant
-		// eg: role('INSTITUTION','CREATE'),
-		// role(param(':context'), 'CONTENT','CREATE') etc
-		"role": func(args ...interface{}) (interface{}, error) {
-			var (
-				context  string
-				action   string
-				category string
-			)
-			if len(args) == 2 {
-				context = ALL // default if not provided
-				action = args[0].(string)
-				category = args[1].(string)
-			} else if len(args) == 3 {
-				context = args[0].(string)
-				action = args[1].(string)
-				category = args[2].(string)
-			} else {
-				return false, fmt.Errorf("function role takes 2 or 3 arguments")
-			}
+// HashToken returns the digest of a bearer token value; a digest may be configured in place
+// of the token value so that the value itself is never stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return TokenDigestPrefix + hex.EncodeToString(sum[:])
+}
 
-			log.Debugf("calling role(%s,%s,%s)", context, action, category)
-			return auth.CheckJWT(credentials.JWT, context, action, category), nil
-		},
-		// return true if identity has root permission
-		"root": func(args ...interface{}) (interface{}, error) {
-			log.Debug("calling Superuser()")
-			return auth.Superuser(credentials.JWT), nil
-		},
-		"classification": func(args ...interface{}) (interface{}, error) {
-			log.Debug("calling classification()")
-			return auth.Classification(credentials.JWT), nil
-		},
-		// return true if a request signed with tenant's private key is valid
-		// with respect to tenant's public key
-		"signature": func(args ...interface{}) (interface{}, error) {
-			tenantID, _ := args[0].(string)
-			log.Debugf("calling signature(%s)", tenantID)
-			return verify(verifier, tenantID, auth.getRSAPublicKeys()), nil
-		},
-		// return the subdomain of the request
-		"subdomain": func(args ...interface{}) (interface{}, error) {
-			log.Debugf("calling subdomain()")
-			return "TODO", nil
-		},
-		// return true if identity matches the user UUID in path
-		// eg: user(param(':uuid'))
-		"user": func(args ...interface{}) (interface{}, error) {
-			uuid, _ := args[0].(string)
-			log.Debugf("calling user(%s)", uuid)
-			return strings.EqualFold(auth.User(credentials.JWT), uuid), nil
-		},
-	}
-
-	expression, err := eval.NewEvaluableExpressionWithFunctions(expr, functions)
-	if err != nil {
-		log.Error(err)
-		return result, err
+// bundleArg returns the optional CA bundle name at args[i]
+func bundleArg(name string, args []interface{}, i int) (bundle string, err error) {
+	if len(args) > i+1 {
+		return bundle, fmt.Errorf("function %s takes at most %d arguments", name, i+1)
 	}
-
-	parameters := make(map[string]interface{}, 8)
-	for k, v := range paramMap {
-		parameters[k] = v
+	if len(args) == i+1 {
+		var ok bool
+		if bundle, ok = args[i].(string); !ok {
+			return bundle, fmt.Errorf("function %s requires a string CA bundle name", name)
+		}
 	}
+	return bundle, nil
+}
 
-	log.Debugf("evaluating expression %s", expr)
-	val, err := expression.Evaluate(parameters)
-	if err != nil {
-		log.Error(err)
-		return result, err
+// certArgs returns the required string argument and optional CA bundle name of a cert builtin
+func certArgs(name string, args []interface{}) (value, bundle string, err error) {
+	if len(args) == 0 {
+		return value, bundle, fmt.Errorf("function %s takes 1 or 2 arguments", name)
 	}
-
-	return val.(bool), nil
+	var ok bool
+	if value, ok = args[0].(string); !ok {
+		return value, bundle, fmt.Errorf("function %s requires a string argument", name)
+	}
+	bundle, err = bundleArg(name, args, 1)
+	return value, bundle, err
 }
 
 func redact(secret string) string {
@@ -677,20 +645,9 @@ func redact(secret string) string {
 	return secret[:4] + " *REDACTED* " + secret[l-4:]
 }
 
-func (auth *Auth) setMux(host string, mux *pat.HostMux) {
-	auth.mutex.Lock()
-	defer auth.mutex.Unlock()
-	auth.hostMuxers[host] = mux
-}
-
-func (auth *Auth) getMux(host string) (mux *pat.HostMux, ok bool) {
+func (auth *Auth) Blocked() (blocked []string) {
 	auth.mutex.RLock()
 	defer auth.mutex.RUnlock()
-	mux, ok = auth.hostMuxers[host]
-	return mux, ok
-}
-
-func (auth *Auth) Blocked() (blocked []string) {
 	for k := range auth.blocks {
 		if auth.blocks[k] {
 			blocked = append(blocked, k)
@@ -700,28 +657,29 @@ func (auth *Auth) Blocked() (blocked []string) {
 }
 
 func (auth *Auth) Block(user string) {
+	defer auth.FlushDecisions()
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if auth.blocks == nil {
+		auth.blocks = make(map[string]bool)
+	}
 	auth.blocks[user] = true
 }
 
 func (auth *Auth) Unblock(user string) {
-	auth.blocks[user] = false
+	defer auth.FlushDecisions()
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	delete(auth.blocks, user)
 }
 
 func (auth *Auth) Override(host string) string {
-	return auth.overrides[host]
-}
-
-func (auth *Auth) RunMode() string {
-	return auth.runMode
+	return auth.current().overrides[host]
 }
 
 // Muxer returns the pattern mux for host
 func (auth *Auth) Muxer(host string) (mux *pat.HostMux, err error) {
-	var ok bool
-	if mux, ok = auth.getMux(host); ok {
-		return mux, nil
-	}
-	return mux, fmt.Errorf("host checks not defined for %s", host)
+	return auth.current().muxer(host)
 }
 
 // HostChecks returns JSON formatted host checks
@@ -733,16 +691,28 @@ func (auth *Auth) Muxer(host string) (mux *pat.HostMux, err error) {
 // 	return string(data), nil
 // }
 
-// UpdateFunc returns a function to update access system
+// UpdateFunc returns a function to update access system; the update is validated and builds a
+// complete snapshot of the access system that replaces the current snapshot atomically, so that
+// an invalid update changes nothing and requests in flight finish on the snapshot they started
+// on. Updates are recorded in the reload status of auth
 func (auth *Auth) UpdateFunc() (f func(*AccessSystem) error) {
-	return func(acs *AccessSystem) error {
-		auth.setTokens(acs.Tokens)
-		auth.setRSAPublicKeys(acs.PublicKeys)
-		return auth.setAccess(acs.Checks, true)
+	return func(acs *AccessSystem) (err error) {
+		defer func() { auth.reloaded(err) }()
+		if err = validateReload(acs); err != nil {
+			return err
+		}
+		s, err := newSnapshot(auth, acs)
+		if err != nil {
+			return err
+		}
+		auth.swap(s)
+		auth.saveLastKnownGood(acs)
+		return nil
 	}
 }
 
-func loadPublicKey(keyData []byte) (*rsa.PublicKey, error) {
+// loadPublicKey loads an RSA, ECDSA or Ed25519 public key from PEM encoded keyData
+func loadPublicKey(keyData []byte) (crypto.PublicKey, error) {
 	pem, _ := pem.Decode(keyData)
 	if pem == nil {
 		return nil, fmt.Errorf("failed to decode public key %s", string(keyData))
@@ -756,5 +726,9 @@ func loadPublicKey(keyData []byte) (*rsa.PublicKey, error) {
 		return nil, err
 	}
 
-	return key.(*rsa.PublicKey), nil
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
 }
@@ -1,28 +1,280 @@
 package fauth
 
-// the public key for testSpecPrivateKeyPEM used by client
-const spuzzumPublicKeyPEM = `-----BEGIN PUBLIC KEY-----
-MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDCFENGw33yGihy92pDjZQhl0C3
-6rPJj+CvfSC8+q28hxA161QFNUd13wuCTUcq0Qd2qsBe/2hFyc2DCJJg0h1L78+6
-Z4UMR7EOcpfdUE9Hf3m/hs+FUR45uBJeDK1HSFHD8bHKD6kv8FPGfJTotc+2xjJw
-oYi+1hqp1fIekaxsyQIDAQAB
------END PUBLIC KEY-----`
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
-const spuzzumTenantID = "2D03D677-6D64-4F36-B098-9CA487E3B6EA"
+	"bitbucket.org/_metalogic_/eval"
+	"bitbucket.org/_metalogic_/log"
+	"bitbucket.org/_metalogic_/pat"
+	"github.com/golang-jwt/jwt/v4"
+)
 
-// pubKeys is a map of keyIDs to their respective public keys
-var pubKeys map[string][]byte
+// hostHeader is set by Check on the request header passed to the host muxer to identify the
+// host of a request to the decision cache; incoming copies are removed before evaluation
+const hostHeader = "X-Forward-Auth-Host"
 
-func init() {
-	pubKeys = make(map[string][]byte)
-	pubKeys[spuzzumTenantID] = []byte(spuzzumPublicKeyPEM)
+// cacheableBuiltins are the builtins whose results depend only on the credentials and the
+// parameters of a request; rules calling any other builtin, such as allow(), are never cached
+var cacheableBuiltins = map[string]bool{
+	"bearer":         true,
+	"param":          true,
+	"role":           true,
+	"root":           true,
+	"classification": true,
+	"user":           true,
+	"cert":           true,
+	"certsubject":    true,
+	"certsan":        true,
+	"certissuer":     true,
 }
 
-func get(keyID string) (publicKey []byte, err error) {
-	var found bool
-	publicKey, found = pubKeys[keyID]
-	if !found {
+// cachePolicy returns the sorted names of the request parameters used by expr if its decisions
+// may be cached; otherwise reason explains why they may not
+func cachePolicy(expr string) (params []string, reason string) {
+	parsed, err := eval.NewEvaluableExpressionWithFunctions(expr, stubs)
+	if err != nil {
+		return params, err.Error()
+	}
+	tokens := parsed.Tokens()
+
+	used := make(map[string]bool)
+	for _, c := range calls(tokens) {
+		if !cacheableBuiltins[c.name] {
+			return params, fmt.Sprintf("it calls %s()", c.name)
+		}
+		if c.name == "param" {
+			if len(c.args) == 0 || c.args[0].literal == nil {
+				return params, "it calls param() with a computed name"
+			}
+			used[*c.args[0].literal] = true
+		}
+	}
+	for _, token := range tokens {
+		if name, ok := token.Value.(string); ok && token.Kind == eval.VARIABLE {
+			used[name] = true
+		}
+	}
+	for name := range used {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	return params, ""
+}
+
+// cacheTTL returns the time the decisions of rule are cached or 0 if they are not cached
+func (rule Rule) cacheTTL() (ttl time.Duration, err error) {
+	if rule.CacheTTL == "" {
+		return 0, nil
+	}
+	ttl, err = time.ParseDuration(rule.CacheTTL)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid cache TTL '%s' for rule %s; must be a duration such as 30s", rule.CacheTTL, rule.Name)
+	}
+	return ttl, nil
+}
+
+// decisionCache holds the outcomes of rules with a cache TTL keyed by the fingerprint of the
+// credentials of a request, its host, method and matched pattern and the parameters the rule
+// uses; when full, expired entries are evicted and then arbitrary entries. Flushing the cache
+// starts a new generation so that decisions reached before a flush are not cached after it
+type decisionCache struct {
+	size       int
+	mutex      sync.Mutex
+	generation uint64
+	entries    map[string]cachedDecision
+}
+
+// cachedDecision is the outcome of a rule handler and the credential types it verified
+type cachedDecision struct {
+	status   int
+	message  string
+	username string
+	verified string
+	expires  time.Time
+}
+
+func newDecisionCache(size int) *decisionCache {
+	return &decisionCache{size: size, entries: make(map[string]cachedDecision)}
+}
+
+// get returns the unexpired decision for key and the current generation of the cache
+func (c *decisionCache) get(key string) (d cachedDecision, generation uint64, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	d, ok = c.entries[key]
+	if ok && !time.Now().Before(d.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return d, c.generation, ok
+}
+
+// put caches d for key unless the cache was flushed since generation
+func (c *decisionCache) put(key string, d cachedDecision, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = d
+}
+
+func (c *decisionCache) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	c.entries = make(map[string]cachedDecision)
+}
 
+func (c *decisionCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// SetDecisionCache caches the decisions of rules with a cache TTL in at most size entries; a
+// size of 0 disables the decision cache
+func (auth *Auth) SetDecisionCache(size int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid decision cache size %d", size)
+	}
+	var cache *decisionCache
+	if size > 0 {
+		cache = newDecisionCache(size)
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.cache = cache
+	return nil
+}
+
+// FlushDecisions removes all cached decisions; it is called when the access system is updated
+// and when users are blocked or unblocked, and should be called when credentials are revoked
+// by an identity provider. It returns the number of decisions removed
+func (auth *Auth) FlushDecisions() (flushed int) {
+	cache := auth.getCache()
+	if cache == nil {
+		return 0
+	}
+	flushed = cache.len()
+	cache.flush()
+	return flushed
+}
+
+// CachedDecisions returns the number of cached decisions
+func (auth *Auth) CachedDecisions() int {
+	cache := auth.getCache()
+	if cache == nil {
+		return 0
+	}
+	return cache.len()
+}
+
+func (auth *Auth) getCache() *decisionCache {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	return auth.cache
+}
+
+// cached wraps the handler of rule to cache its decisions for ttl, or until the request JWT
+// expires if sooner; params are the request parameters used by the rule. Explained decisions
+// are never cached and decisions are only cached for the snapshot s that reached them
+func (s *snapshot) cached(rule Rule, ttl time.Duration, params []string, handler pat.HandlerFunc) pat.HandlerFunc {
+	auth := s.auth
+	return func(method, path string, values map[string][]string, header http.Header) (status int, message, username string) {
+		cache := auth.getCache()
+		if cache == nil || auth.traceOf(header) != nil {
+			return handler(method, path, values, header)
+		}
+
+		key := s.decisionKey(rule.Name, method, header, values, params)
+		d, generation, ok := cache.get(key)
+		auth.metrics.cacheLookup(ok)
+		if ok {
+			log.Debugf("cached decision of rule %s for %s %s", rule.Name, method, path)
+			header.Set(ruleHeader, rule.Name)
+			if d.verified != "" {
+				header.Set(credentialHeader, d.verified)
+			}
+			auth.spanOf(header).SetAttribute("forward_auth.cached", true)
+			return d.status, d.message, d.username
+		}
+
+		status, message, username = handler(method, path, values, header)
+		expires := time.Now().Add(ttl)
+		if exp := jwtExpiry(header.Get(auth.jwtHeader)); !exp.IsZero() && exp.Before(expires) {
+			expires = exp
+		}
+		cache.put(key, cachedDecision{
+			status:   status,
+			message:  message,
+			username: username,
+			verified: header.Get(credentialHeader),
+			expires:  expires,
+		}, generation)
+		return status, message, username
+	}
+}
+
+// decisionKey returns the cache key of a request decided by rule with snapshot s: the digest of
+// the serial of s, the credentials of the request, its host, method and matched pattern and the
+// values of params
+func (s *snapshot) decisionKey(rule, method string, header http.Header, values map[string][]string, params []string) string {
+	h := sha256.New()
+	for _, v := range []string{
+		strconv.FormatUint(s.serial, 10),
+		header.Get("Authorization"),
+		header.Get(s.auth.jwtHeader),
+		header.Get(ClientCertHeader),
+		header.Get(hostHeader),
+		method,
+		header.Get(pathHeader),
+		rule,
+	} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	for _, name := range params {
+		h.Write([]byte(name))
+		for _, value := range values[name] {
+			h.Write([]byte{1})
+			h.Write([]byte(value))
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// jwtExpiry returns the expiry time of token or the zero time if it has none; the token is not
+// verified
+func jwtExpiry(token string) (expires time.Time) {
+	if token == "" {
+		return expires
+	}
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil || claims.ExpiresAt == nil {
+		return expires
 	}
-	return publicKey, nil
+	return claims.ExpiresAt.Time
 }
@@ -0,0 +1,140 @@
+package fauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// cacheLookups returns the number of decision cache lookups of auth with result
+func cacheLookups(auth *fauth.Auth, result string) float64 {
+	for _, family := range auth.Metrics().Families() {
+		if family.Name != "forward_auth_decision_cache_lookups_total" {
+			continue
+		}
+		for _, sample := range family.Samples {
+			if sample.Labels["result"] == result {
+				return sample.Value
+			}
+		}
+	}
+	return 0
+}
+
+func TestDecisionCache(t *testing.T) {
+	t.Setenv("ROOT_KEY", "root-key-value")
+
+	callouts := 0
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callouts++
+	}))
+	defer resource.Close()
+
+	acs := &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{HostGroups: []fauth.HostGroup{{
+			Name:    "API Hosts",
+			Hosts:   []string{"apis.example.com"},
+			Default: "deny",
+			Checks: []fauth.Check{{Name: "widgets-api", Base: "/widgets-api/v1", Paths: []fauth.Path{
+				{
+					Path: "/widgets/:wid",
+					Rules: map[fauth.Method]fauth.Rule{
+						"GET": {Name: "read widget", CacheTTL: "1m", Expression: "bearer('MC_APP_KEY') && param(':wid') != 'w-0'"},
+					},
+				},
+				{
+					Path: "/widgets/:wid/owner",
+					Rules: map[fauth.Method]fauth.Rule{
+						"GET": {Name: "read owner", CacheTTL: "1m", Expression: "allow('READ', 'user-1', param(':wid'), '" + resource.URL + "')"},
+					},
+				},
+			}}},
+		}}},
+	}
+	auth := newTestAuth(t, acs)
+	if err := auth.SetDecisionCache(100); err != nil {
+		t.Fatal(err)
+	}
+
+	header := func() http.Header {
+		h := http.Header{}
+		h.Set("Authorization", "Bearer app-token-value")
+		return h
+	}
+	first := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header())
+	second := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header())
+	if first.Status != http.StatusOK || second.Status != http.StatusOK {
+		t.Fatalf("got status %d and %d", first.Status, second.Status)
+	}
+	if second.Rule != "read widget" || second.Token != "MC_APP_KEY" || len(second.Credentials) != 1 || second.Credentials[0] != fauth.CredentialBearer {
+		t.Errorf("got cached decision %+v", second)
+	}
+	if hits, misses := cacheLookups(auth, "hit"), cacheLookups(auth, "miss"); hits != 1 || misses != 1 {
+		t.Errorf("got %g hits and %g misses, want 1 and 1", hits, misses)
+	}
+
+	// the parameters used by the rule are part of the key
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-0", header()); d.Status != http.StatusForbidden {
+		t.Errorf("got status %d for w-0", d.Status)
+	}
+	// as are the credentials
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", http.Header{}); d.Status != http.StatusForbidden {
+		t.Errorf("got status %d without credentials", d.Status)
+	}
+	if n := auth.CachedDecisions(); n != 3 {
+		t.Errorf("got %d cached decisions, want 3", n)
+	}
+
+	// explained decisions are evaluated
+	if e := auth.Explain("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header()); len(e.Calls) == 0 {
+		t.Errorf("explained decision has no builtin calls")
+	}
+
+	// rules calling allow() are not cached
+	for i := 0; i < 2; i++ {
+		if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1/owner", header()); d.Status != http.StatusOK {
+			t.Errorf("got status %d for owner: %s", d.Status, d.Message)
+		}
+	}
+	if callouts != 2 {
+		t.Errorf("got %d allow callouts, want 2", callouts)
+	}
+
+	// blocks and updates flush the cache
+	auth.Block("user-2")
+	if n := auth.CachedDecisions(); n != 0 {
+		t.Errorf("got %d cached decisions after block, want 0", n)
+	}
+	auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header())
+	acs.Tokens = map[string]string{}
+	if err := auth.UpdateFunc()(acs); err != nil {
+		t.Fatal(err)
+	}
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header()); d.Status != http.StatusForbidden {
+		t.Errorf("got status %d for revoked token", d.Status)
+	}
+}
+
+func TestInvalidCacheTTL(t *testing.T) {
+	checks := &fauth.HostChecks{HostGroups: []fauth.HostGroup{{
+		Name:    "API Hosts",
+		Hosts:   []string{"apis.example.com"},
+		Default: "deny",
+		Checks: []fauth.Check{{Name: "widgets-api", Base: "/widgets-api/v1", Paths: []fauth.Path{{
+			Path:  "/widgets",
+			Rules: map[fauth.Method]fauth.Rule{"GET": {CacheTTL: "forever", Expression: "bearer('ROOT_KEY')"}},
+		}}}},
+	}}}
+	if _, err := fauth.NewAuth(&fauth.AccessSystem{Checks: checks}, jwtHeader, nil, []byte("secret")); err == nil {
+		t.Errorf("got no error for invalid cache TTL")
+	}
+
+	checks.HostGroups[0].Checks[0].Paths[0].Rules["GET"] = fauth.Rule{CacheTTL: "30s", Expression: "allow('READ', 'user-1', 'w-1', 'http://localhost')"}
+	diagnostics := fauth.ValidateAccessSystem(&fauth.AccessSystem{Checks: checks})
+	if len(diagnostics) != 1 || diagnostics[0].Severity != fauth.SeverityWarning {
+		t.Errorf("got diagnostics %v, want a warning that decisions are not cached", diagnostics)
+	}
+}
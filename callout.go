@@ -0,0 +1,120 @@
+package fauth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// calloutHeader is set by Check on the request header passed to the host muxer to identify the
+// allow() callout results of a decision
+const calloutHeader = "X-Forward-Auth-Callouts"
+
+// callouts records the results of the allow() callouts of a live decision so that the shadow
+// replays them instead of calling out again; a callout the live decision did not make fails
+// in the shadow with errNotEvaluated. Stubbed callouts never call out: a callout is answered
+// with the result stubbed for its URL and fails with errNotEvaluated if there is none
+type callouts struct {
+	mutex   sync.Mutex
+	results map[string]callResult
+	replay  bool
+	stubs   map[string]bool
+}
+
+func newCallouts() *callouts {
+	return &callouts{results: make(map[string]callResult)}
+}
+
+// stubbedCallouts returns callouts that answer each callout with the result in stubs for its URL
+func stubbedCallouts(stubs map[string]bool) *callouts {
+	return &callouts{results: make(map[string]callResult), replay: true, stubs: stubs}
+}
+
+// call returns the recorded result of the callout with args or records the result of f; a nil
+// callouts calls f
+func (c *callouts) call(args []interface{}, f func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return f()
+	}
+	key := fmt.Sprintf("allow%v", args)
+	c.mutex.Lock()
+	r, ok := c.results[key]
+	c.mutex.Unlock()
+	if ok {
+		return r.value, r.err
+	}
+	if c.replay {
+		if c.stubs == nil {
+			return false, errNotEvaluated
+		}
+		// the URL is the last argument of allow()
+		var url string
+		if len(args) > 0 {
+			url, _ = args[len(args)-1].(string)
+		}
+		if allowed, ok := c.stubs[url]; ok {
+			return allowed, nil
+		}
+		return false, fmt.Errorf("%w: no result is stubbed for the allow() callout to %s", errNotEvaluated, url)
+	}
+	value, err := f()
+	c.mutex.Lock()
+	c.results[key] = callResult{value, err}
+	c.mutex.Unlock()
+	return value, err
+}
+
+// replayed returns a copy of c that replays its results
+func (c *callouts) replayed() *callouts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r := &callouts{results: make(map[string]callResult, len(c.results)), replay: true, stubs: c.stubs}
+	for key, result := range c.results {
+		r.results[key] = result
+	}
+	return r
+}
+
+// calloutsOf returns the callouts identified by the callout header of a request or nil
+func (auth *Auth) calloutsOf(header http.Header) *callouts {
+	id := header.Get(calloutHeader)
+	if id == "" {
+		return nil
+	}
+	if c, ok := auth.callouts.Load(id); ok {
+		return c.(*callouts)
+	}
+	return nil
+}
+
+// StubCallouts makes auth answer each allow() callout with the result in stubs for its URL instead
+// of calling the URL, so that access systems can be evaluated without network access or the
+// ROOT_KEY the callouts are authorized with; a callout to a URL not in stubs is not evaluated and
+// fails. A nil stubs restores the callouts
+func (auth *Auth) StubCallouts(stubs map[string]bool) {
+	if stubs != nil {
+		copied := make(map[string]bool, len(stubs))
+		for url, allowed := range stubs {
+			copied[url] = allowed
+		}
+		stubs = copied
+	}
+	auth.mutex.Lock()
+	auth.calloutStubs = stubs
+	auth.mutex.Unlock()
+}
+
+// decisionCallouts returns the callouts of a decision: stubbed callouts if auth stubs callouts,
+// new callouts if record is true and nil otherwise
+func (auth *Auth) decisionCallouts(record bool) *callouts {
+	auth.mutex.RLock()
+	stubs := auth.calloutStubs
+	auth.mutex.RUnlock()
+	switch {
+	case stubs != nil:
+		return stubbedCallouts(stubs)
+	case record:
+		return newCallouts()
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package fauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestStubCallouts(t *testing.T) {
+	// stubbed callouts never read the ROOT_KEY that callouts are authorized with
+	t.Setenv("ROOT_KEY", "")
+	os.Unsetenv("ROOT_KEY")
+	var calls int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer service.Close()
+
+	auth := newTestAuth(t, &fauth.AccessSystem{Checks: shadowChecks("allow('READ', 'u1', 'widgets', '" + service.URL + "')")})
+
+	// a callout without a stubbed result is not evaluated
+	auth.StubCallouts(map[string]bool{})
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{}); d.Status != http.StatusForbidden || !strings.Contains(d.Message, "not evaluated") {
+		t.Errorf("got status %d (%s), want %d for an unevaluated callout", d.Status, d.Message, http.StatusForbidden)
+	}
+	e := auth.Explain("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{})
+	if len(e.Calls) != 1 || e.Calls[0].Function != "allow" || !strings.Contains(e.Calls[0].Error, "not evaluated") {
+		t.Errorf("got calls %+v, want an unevaluated allow()", e.Calls)
+	}
+
+	stubs := map[string]bool{service.URL: true}
+	auth.StubCallouts(stubs)
+	stubs[service.URL] = false
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{}); d.Status != http.StatusOK {
+		t.Errorf("got status %d (%s), want %d for a stubbed callout", d.Status, d.Message, http.StatusOK)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("got %d callouts of stubbed callouts", n)
+	}
+
+	// callouts are restored
+	t.Setenv("ROOT_KEY", "root-key")
+	auth.StubCallouts(nil)
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{}); d.Status != http.StatusOK {
+		t.Errorf("got status %d (%s), want %d", d.Status, d.Message, http.StatusOK)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d callouts, want 1", n)
+	}
+}
@@ -0,0 +1,243 @@
+package fauth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// ClientCertHeader is the header in which Traefik passes the client certificate (passTLSClientCert.pem);
+// the value is the URL-escaped certificate chain, either as PEM or as comma-separated base64 DER
+// with the PEM delimiters removed, leaf certificate first
+const ClientCertHeader = "X-Forwarded-Tls-Client-Cert"
+
+// CertificateAuthority is a named bundle of PEM encoded CA certificates used to
+// verify client certificates in the cert builtins:
+//   - source "file": value is the PEM bundle
+//   - source "env": name is a config/secret variable holding the PEM bundle
+type CertificateAuthority struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Value  string `json:"value,omitempty"`
+}
+
+// ParseClientCertificates parses the value of the ClientCertHeader returning the certificate chain
+func ParseClientCertificates(value string) (certs []*x509.Certificate, err error) {
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		return certs, fmt.Errorf("failed to unescape client certificate: %s", err)
+	}
+
+	if strings.Contains(unescaped, "-----BEGIN") {
+		rest := []byte(unescaped)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return certs, err
+			}
+			certs = append(certs, cert)
+		}
+	} else {
+		for _, part := range strings.Split(unescaped, ",") {
+			// base64 has no spaces, so any found were '+' unescaped as a query
+			part = strings.ReplaceAll(strings.TrimSpace(part), " ", "+")
+			if part == "" {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(part)
+			if err != nil {
+				return certs, fmt.Errorf("failed to decode client certificate: %s", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return certs, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	if len(certs) == 0 {
+		return certs, fmt.Errorf("no client certificate found")
+	}
+	return certs, nil
+}
+
+// clientCert holds the client certificate chain found in a request; chains are verified lazily
+// and at most once per CA bundle
+type clientCert struct {
+	header   string
+	certs    []*x509.Certificate
+	err      error
+	parsed   bool
+	verified map[string]error
+}
+
+func newClientCert(header string) *clientCert {
+	return &clientCert{header: header, verified: make(map[string]error)}
+}
+
+// leaf returns the client certificate after verifying its chain against the named CA bundle,
+// or against every configured bundle if bundle is empty
+func (c *clientCert) leaf(s *snapshot, bundle string) (*x509.Certificate, error) {
+	if c == nil || c.header == "" {
+		return nil, fmt.Errorf("no client certificate in request")
+	}
+	if !c.parsed {
+		c.certs, c.err = ParseClientCertificates(c.header)
+		c.parsed = true
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	err, ok := c.verified[bundle]
+	if !ok {
+		err = s.verifyClientCert(c.certs, bundle)
+		c.verified[bundle] = err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.certs[0], nil
+}
+
+// verifyClientCert verifies chain for client authentication against the named CA bundle
+func (s *snapshot) verifyClientCert(chain []*x509.Certificate, bundle string) error {
+	pools := s.caPools
+	if len(pools) == 0 {
+		return fmt.Errorf("no certificate authorities are configured")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	var lastErr error
+	for name, pool := range pools {
+		if bundle != "" && name != bundle {
+			continue
+		}
+		_, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return fmt.Errorf("certificate authority '%s' is not configured", bundle)
+	}
+	return lastErr
+}
+
+// loadCertificateAuthorities returns the pools of the named certificate authorities; authorities
+// without valid certificates are logged and skipped
+func loadCertificateAuthorities(cas []CertificateAuthority) map[string]*x509.CertPool {
+	pools := make(map[string]*x509.CertPool)
+	for _, ca := range cas {
+		if ca.Value == "" {
+			log.Warningf("certificate authority %s has no certificates", ca.Name)
+			continue
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca.Value)) {
+			log.Warningf("failed to load certificates for certificate authority %s", ca.Name)
+			continue
+		}
+		pools[ca.Name] = pool
+	}
+	return pools
+}
+
+// short names of distinguished name attributes accepted in certsubject() and certissuer()
+var attributeTypes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"POSTALCODE":   {2, 5, 4, 17},
+	"DC":           {0, 9, 2342, 19200300, 100, 1, 25},
+	"UID":          {0, 9, 2342, 19200300, 100, 1, 1},
+}
+
+// matchName returns true if every attribute in spec (eg "CN=billing,O=Acme") is
+// present in the distinguished name; attribute values are compared case-sensitively
+func matchName(name pkix.Name, spec string) (bool, error) {
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return false, fmt.Errorf("invalid distinguished name attribute '%s'", part)
+		}
+		oid, ok := attributeTypes[strings.ToUpper(strings.TrimSpace(kv[0]))]
+		if !ok {
+			return false, fmt.Errorf("unsupported distinguished name attribute '%s'", kv[0])
+		}
+		want := strings.TrimSpace(kv[1])
+		found := false
+		for _, atv := range name.Names {
+			if v, ok := atv.Value.(string); ok && atv.Type.Equal(oid) && v == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchSAN returns true if name matches a DNS, URI, email or IP subject alternative name of cert.
+// Names are matched exactly, so a wildcard DNS SAN such as *.example.com does not satisfy
+// billing.example.com; a name of the form *.example.com is a pattern that matches any DNS SAN of
+// a single label under example.com
+func matchSAN(cert *x509.Certificate, name string) bool {
+	for _, dns := range cert.DNSNames {
+		if strings.EqualFold(dns, name) {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			if i := strings.Index(dns, "."); i > 0 && strings.EqualFold(dns[i:], name[1:]) {
+				return true
+			}
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == name {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if strings.EqualFold(email, name) {
+			return true
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package fauth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// issue returns a client certificate signed by ca in Traefik's passTLSClientCert format
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, dnsNames []string, uris []string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.QueryEscape(base64.StdEncoding.EncodeToString(der))
+}
+
+func TestCertBuiltins(t *testing.T) {
+	internal := newTestCA(t, "Internal Issuing CA")
+	partner := newTestCA(t, "Partner CA")
+	untrusted := newTestCA(t, "Untrusted CA")
+
+	auth := newTestAuth(t, &fauth.AccessSystem{
+		CertificateAuthorities: []fauth.CertificateAuthority{
+			{Name: "internal", Source: "file", Value: internal.pem},
+			{Name: "partner", Source: "file", Value: partner.pem},
+		},
+	})
+
+	billing := internal.issue(t, pkix.Name{CommonName: "billing", Organization: []string{"Acme"}},
+		[]string{"billing.svc.internal"}, []string{"spiffe://cluster.local/ns/apis/sa/billing"})
+	partnerCert := partner.issue(t, pkix.Name{CommonName: "reports"}, []string{"reports.partner.example"}, nil)
+	rogue := untrusted.issue(t, pkix.Name{CommonName: "billing"}, []string{"billing.svc.internal"}, nil)
+	wildcard := internal.issue(t, pkix.Name{CommonName: "gateway"}, []string{"*.svc.internal"}, nil)
+
+	tests := []struct {
+		name       string
+		cert       string
+		expression string
+		want       int
+	}{
+		{"no certificate", "", "cert()", http.StatusForbidden},
+		{"verified certificate", billing, "cert()", http.StatusOK},
+		{"verified by named bundle", billing, "cert('internal')", http.StatusOK},
+		{"wrong named bundle", billing, "cert('partner')", http.StatusForbidden},
+		{"partner certificate", partnerCert, "cert('partner')", http.StatusOK},
+		{"untrusted certificate", rogue, "cert()", http.StatusForbidden},
+		{"subject", billing, "certsubject('CN=billing')", http.StatusOK},
+		{"subject attributes", billing, "certsubject('CN=billing,O=Acme', 'internal')", http.StatusOK},
+		{"subject mismatch", billing, "certsubject('CN=reports')", http.StatusForbidden},
+		{"untrusted subject", rogue, "certsubject('CN=billing')", http.StatusForbidden},
+		{"dns san", billing, "certsan('billing.svc.internal')", http.StatusOK},
+		{"uri san", billing, "certsan('spiffe://cluster.local/ns/apis/sa/billing')", http.StatusOK},
+		{"san mismatch", billing, "certsan('reports.svc.internal')", http.StatusForbidden},
+		{"untrusted san", rogue, "certsan('billing.svc.internal')", http.StatusForbidden},
+		{"wildcard san", wildcard, "certsan('billing.svc.internal')", http.StatusForbidden},
+		{"wildcard san matches itself", wildcard, "certsan('*.svc.internal')", http.StatusOK},
+		{"wildcard name", billing, "certsan('*.svc.internal')", http.StatusOK},
+		{"wildcard name of a single label", billing, "certsan('*.internal')", http.StatusForbidden},
+		{"issuer", billing, "certissuer('CN=Internal Issuing CA')", http.StatusOK},
+		{"issuer mismatch", partnerCert, "certissuer('CN=Internal Issuing CA')", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.cert != "" {
+				h.Set(fauth.ClientCertHeader, tt.cert)
+			}
+			handler, err := fauth.Handler(fauth.Rule{Expression: tt.expression}, auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, message, _ := handler("GET", "/billing", map[string][]string{}, h)
+			if status != tt.want {
+				t.Errorf("%s: status = %d, want %d: %s", tt.expression, status, tt.want, message)
+			}
+		})
+	}
+}
+
+func TestParseClientCertificatesPEM(t *testing.T) {
+	ca := newTestCA(t, "PEM CA")
+	certs, err := fauth.ParseClientCertificates(url.QueryEscape(ca.pem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Subject.CommonName != "PEM CA" {
+		t.Errorf("ParseClientCertificates() = %v, want certificate for PEM CA", certs)
+	}
+}
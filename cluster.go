@@ -0,0 +1,230 @@
+package fauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// Cluster discovers the replicas of forward-auth that enforce the same access system and
+// reloads them together:
+//   - peers are the base URLs of replicas listed statically, eg http://forward-auth-0:8080
+//   - service is a DNS name the replicas are discovered from; an SRV name, eg
+//     _http._tcp.forward-auth.auth.svc.cluster.local, gives the host and port of each replica,
+//     while the addresses of a headless service name are combined with port
+//
+// Requests to peers carry the authorization of the request that started them, so that every
+// replica checks it against its own ROOT_KEY
+type Cluster struct {
+	peers   []string
+	service string
+	port    int
+	scheme  string
+	client  *http.Client
+}
+
+// NewCluster returns a cluster of the static peers and the replicas discovered from service,
+// which may be empty; peers without a scheme, and discovered replicas, are addressed with scheme.
+// Each request to a peer times out after timeout
+func NewCluster(peers []string, service string, port int, scheme string, timeout time.Duration) (cluster *Cluster, err error) {
+	if scheme != "http" && scheme != "https" {
+		return cluster, fmt.Errorf("invalid peer scheme '%s'", scheme)
+	}
+	if service != "" && !strings.HasPrefix(service, "_") && (port <= 0 || port > 65535) {
+		return cluster, fmt.Errorf("invalid peer port %d of service %s", port, service)
+	}
+	cluster = &Cluster{
+		service: service,
+		port:    port,
+		scheme:  scheme,
+		client:  &http.Client{Timeout: timeout},
+	}
+	for _, peer := range peers {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		if !strings.Contains(peer, "://") {
+			peer = scheme + "://" + peer
+		}
+		cluster.peers = append(cluster.peers, strings.TrimSuffix(peer, "/"))
+	}
+	return cluster, nil
+}
+
+// Peers returns the base URLs of the static and discovered replicas, sorted and without duplicates
+func (c *Cluster) Peers(ctx context.Context) (peers []string, err error) {
+	seen := make(map[string]bool)
+	add := func(peer string) {
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	for _, peer := range c.peers {
+		add(peer)
+	}
+
+	switch {
+	case c.service == "":
+	case strings.HasPrefix(c.service, "_"):
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", c.service)
+		if err != nil {
+			return peers, fmt.Errorf("failed to discover peers of %s: %s", c.service, err)
+		}
+		for _, srv := range records {
+			add(c.url(strings.TrimSuffix(srv.Target, "."), int(srv.Port)))
+		}
+	default:
+		addrs, err := net.DefaultResolver.LookupHost(ctx, c.service)
+		if err != nil {
+			return peers, fmt.Errorf("failed to discover peers of %s: %s", c.service, err)
+		}
+		for _, addr := range addrs {
+			add(c.url(addr, c.port))
+		}
+	}
+
+	if len(peers) == 0 {
+		return peers, fmt.Errorf("no forward-auth peers are configured or discovered")
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+func (c *Cluster) url(host string, port int) string {
+	return c.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// PeerStatus is the reload status reported by a replica; Error is the reason the replica could
+// not be reloaded or reached, and Mismatch flags a replica whose access system version differs
+// from that of the majority of its peers
+type PeerStatus struct {
+	Peer     string     `json:"peer"`
+	Version  string     `json:"version,omitempty"`
+	Loaded   *time.Time `json:"loaded,omitempty"`
+	Degraded string     `json:"degraded,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Mismatch bool       `json:"mismatch,omitempty"`
+}
+
+// ClusterStatus reports the access system versions of the replicas of a cluster; Version is the
+// version enforced by the majority of the replicas, and Converged is true if every replica
+// reported it
+type ClusterStatus struct {
+	Version   string       `json:"version"`
+	Converged bool         `json:"converged"`
+	Peers     []PeerStatus `json:"peers"`
+}
+
+// Status returns the reload status of every replica of the cluster
+func (c *Cluster) Status(ctx context.Context, authorization string) (status *ClusterStatus, err error) {
+	return c.fanOut(ctx, authorization, false)
+}
+
+// Reload reloads the access system of every replica from its store and returns the resulting
+// reload status of each
+func (c *Cluster) Reload(ctx context.Context, authorization string) (status *ClusterStatus, err error) {
+	return c.fanOut(ctx, authorization, true)
+}
+
+// fanOut requests the reload status of each replica concurrently, reloading it first if reload
+func (c *Cluster) fanOut(ctx context.Context, authorization string, reload bool) (status *ClusterStatus, err error) {
+	peers, err := c.Peers(ctx)
+	if err != nil {
+		return status, err
+	}
+	status = &ClusterStatus{Peers: make([]PeerStatus, len(peers))}
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			status.Peers[i] = c.peerStatus(ctx, peer, authorization, reload)
+		}(i, peer)
+	}
+	wg.Wait()
+	status.compare()
+	return status, nil
+}
+
+func (c *Cluster) peerStatus(ctx context.Context, peer, authorization string, reload bool) (ps PeerStatus) {
+	ps.Peer = peer
+	if reload {
+		if err := c.request(ctx, http.MethodPost, peer+"/auth/update", authorization, nil); err != nil {
+			ps.Error = "reload failed: " + err.Error()
+		}
+	}
+	var rs ReloadStatus
+	if err := c.request(ctx, http.MethodGet, peer+"/admin/reload", authorization, &rs); err != nil {
+		if ps.Error == "" {
+			ps.Error = "status failed: " + err.Error()
+		}
+		return ps
+	}
+	ps.Version, ps.Loaded, ps.Degraded = rs.Version, &rs.Loaded, rs.Degraded
+	if ps.Error == "" && rs.Failed() {
+		ps.Error = "reload failed: " + rs.LastError
+	}
+	return ps
+}
+
+// request sends a request to a peer and decodes its JSON response into v if v is not nil
+func (c *Cluster) request(ctx context.Context, method, url, authorization string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// compare sets the version of the majority of the replicas that reported one, flagging those
+// that differ from it; ties are decided by the smallest version so that the result is stable
+func (s *ClusterStatus) compare() {
+	counts := make(map[string]int)
+	for _, p := range s.Peers {
+		if p.Version != "" {
+			counts[p.Version]++
+		}
+	}
+	for version, n := range counts {
+		if n > counts[s.Version] || (n == counts[s.Version] && version < s.Version) {
+			s.Version = version
+		}
+	}
+	s.Converged = s.Version != ""
+	for i, p := range s.Peers {
+		if p.Version != "" && p.Version != s.Version {
+			s.Peers[i].Mismatch = true
+			log.Warningf("forward-auth peer %s enforces access system version %s; the majority of its peers enforce %s", p.Peer, p.Version, s.Version)
+		}
+		if p.Version != s.Version || p.Error != "" {
+			s.Converged = false
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package fauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// testPeer serves the reload endpoints of a replica that loads version from its store
+func testPeer(t *testing.T, version string, reloadFails bool) *httptest.Server {
+	current := "v1"
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer root-key" {
+			http.Error(w, "requires the ROOT_KEY bearer token", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/auth/update":
+			if reloadFails {
+				http.Error(w, "store is unavailable", http.StatusInternalServerError)
+				return
+			}
+			current = version
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/reload":
+			json.NewEncoder(w).Encode(fauth.ReloadStatus{Version: current, Loaded: time.Now()})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func TestClusterReload(t *testing.T) {
+	a, b, c := testPeer(t, "v2", false), testPeer(t, "v2", false), testPeer(t, "v3", false)
+	cluster, err := fauth.NewCluster([]string{c.URL, a.URL + "/", strings.TrimPrefix(b.URL, "http://"), a.URL}, "", 0, "http", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := cluster.Peers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 3 {
+		t.Fatalf("got peers %v, want 3 without duplicates", peers)
+	}
+
+	status, err := cluster.Status(context.Background(), "Bearer root-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "v1" || !status.Converged {
+		t.Errorf("got status %+v before reload", status)
+	}
+
+	// the replica that loads another version is flagged
+	status, err = cluster.Reload(context.Background(), "Bearer root-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "v2" || status.Converged {
+		t.Errorf("got status %+v after reload", status)
+	}
+	for _, p := range status.Peers {
+		if p.Mismatch != (p.Peer == c.URL) || p.Error != "" {
+			t.Errorf("got peer status %+v", p)
+		}
+	}
+
+	// requests to peers carry the authorization of the caller
+	status, err = cluster.Status(context.Background(), "Bearer app-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Converged || status.Version != "" || !strings.Contains(status.Peers[0].Error, "401") {
+		t.Errorf("got status %+v without the root key", status)
+	}
+}
+
+func TestClusterReloadFailure(t *testing.T) {
+	a, b := testPeer(t, "v2", false), testPeer(t, "v2", true)
+	cluster, err := fauth.NewCluster([]string{a.URL, b.URL}, "", 0, "http", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := cluster.Reload(context.Background(), "Bearer root-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Converged {
+		t.Errorf("got converged status %+v with a failed reload", status)
+	}
+	for _, p := range status.Peers {
+		if p.Peer == b.URL && (p.Version != "v1" || !strings.Contains(p.Error, "store is unavailable")) {
+			t.Errorf("got status %+v of the replica that failed to reload", p)
+		}
+	}
+
+	if _, err = fauth.NewCluster(nil, "", 0, "ftp", time.Second); err == nil {
+		t.Error("got no error for an invalid peer scheme")
+	}
+	if _, err = fauth.NewCluster(nil, "forward-auth-headless", 0, "http", time.Second); err == nil {
+		t.Error("got no error for a headless service without a port")
+	}
+	cluster, _ = fauth.NewCluster(nil, "", 0, "http", time.Second)
+	if _, err = cluster.Peers(context.Background()); err == nil {
+		t.Error("got no error for a cluster without peers")
+	}
+}
@@ -0,0 +1,520 @@
+// fauthctl is the command-line tool for forward-auth policy authors:
+//
+//	fauthctl validate [-json] [-base=false] FILE
+//	fauthctl eval [-explain] [options] FILE METHOD URL
+//	fauthctl test [-suite FILE] [-v] FILE
+//	fauthctl diff [-json] FROM TO
+//	fauthctl fmt [-w] FILE...
+//	fauthctl hash-token [TOKEN]
+//	fauthctl export [-store TYPE] [-config DIR] [-o FILE]
+//	fauthctl import [-store TYPE] [-config DIR] [-force] FILE
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/_metalogic_/build"
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/forward-auth/stores/file"
+	"bitbucket.org/_metalogic_/forward-auth/stores/mssql"
+	"bitbucket.org/_metalogic_/forward-auth/stores/postgres"
+	"bitbucket.org/_metalogic_/log"
+)
+
+// command is a fauthctl subcommand; run returns the process exit status
+type command struct {
+	usage   string
+	summary string
+	run     func(args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"validate":   {"validate [-json] [-base=false] FILE", "lint the rules of an access file", validate},
+		"eval":       {"eval [options] FILE METHOD URL", "decide a request offline against an access file", evaluate},
+		"test":       {"test [-suite FILE] [-v] FILE", "run the policy test suite of an access file", test},
+		"diff":       {"diff [-json] FROM TO", "show the semantic differences between two access files", diff},
+		"fmt":        {"fmt [-w] FILE...", "format access files in canonical order", format},
+		"hash-token": {"hash-token [TOKEN]", "print the digest of a bearer token read from the argument or stdin", hashToken},
+		"export":     {"export [-store TYPE] [-config DIR] [-o FILE]", "export the access system of a store", export},
+		"import":     {"import [-store TYPE] [-config DIR] [-force] FILE", "import an access file to a store", importFile},
+	}
+}
+
+var order = []string{"validate", "eval", "test", "diff", "fmt", "hash-token", "export", "import"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Project %s:\n\nUsage: fauthctl COMMAND [options] [args]\n\nCommands:\n", build.Info.String())
+	for _, name := range order {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun fauthctl COMMAND -help for the options of a command\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	// policy commands report through their output; log only errors unless asked
+	log.SetLevel(log.ErrorLevel)
+	if os.Getenv("LOG_LEVEL") == "DEBUG" {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-help" && os.Args[1] != "-h" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "fauthctl: unknown command %s\n\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
+
+// flags returns the flag set of the named command
+func flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: fauthctl %s\n\n%s\n\n", commands[name].usage, commands[name].summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// fail prints an error and returns exit status 2
+func fail(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "fauthctl: "+format+"\n", args...)
+	return 2
+}
+
+// readAccessSystem reads the access file without resolving secrets
+func readAccessSystem(name string) (acs *fauth.AccessSystem, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return acs, err
+	}
+	acs = &fauth.AccessSystem{}
+	if err = json.Unmarshal(data, acs); err != nil {
+		return acs, fmt.Errorf("%s: %s", name, err)
+	}
+	return acs, nil
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// validate lints an access file; the exit status is 1 if any errors are found
+func validate(args []string) int {
+	fs := flags("validate")
+	jsonFlg := fs.Bool("json", false, "print diagnostics as JSON")
+	baseFlg := fs.Bool("base", true, "resolve token names defined by the base access system of the file store")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	acs, err := readAccessSystem(fs.Arg(0))
+	if err != nil {
+		return fail("%s", err)
+	}
+	if *baseFlg {
+		base, err := file.Base()
+		if err != nil {
+			return fail("%s", err)
+		}
+		acs.Applications = append(acs.Applications, base.Applications...)
+		acs.Tenants = append(acs.Tenants, base.Tenants...)
+	}
+
+	diagnostics := fauth.ValidateAccessSystem(acs)
+	if *jsonFlg {
+		if diagnostics == nil {
+			diagnostics = fauth.Diagnostics{}
+		}
+		printJSON(diagnostics)
+	} else {
+		for _, d := range diagnostics {
+			fmt.Printf("%s: %s\n", fs.Arg(0), d)
+		}
+	}
+	if diagnostics.HasErrors() {
+		return 1
+	}
+	return 0
+}
+
+// headerFlags collects repeated -H 'Name: value' flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return ""
+}
+
+func (h headerFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("header must be of the form 'Name: value'")
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(v))
+	return nil
+}
+
+// evaluate decides a request offline against an access file; token, key and secret values
+// are resolved by source as by the file store and allow() callouts are not evaluated; the exit
+// status is 1 if the request is denied
+func evaluate(args []string) int {
+	fs := flags("eval")
+	header := make(http.Header)
+	fs.Var(headerFlags(header), "H", "add request header 'Name: value' (repeatable)")
+	jwtHeaderFlg := fs.String("jwt-header", config.IfGetenv("JWT_HEADER_NAME", "X-Jwt-Header"), "name of the header carrying the user JWT")
+	publicKeyFlg := fs.String("public-key", "", "PEM file of the identity provider public key verifying RS256 JWTs")
+	secretFlg := fs.String("secret", os.Getenv("JWT_SECRET_KEY"), "secret key verifying HS256 JWTs")
+	jsonFlg := fs.Bool("json", false, "print the decision as JSON")
+	explainFlg := fs.Bool("explain", false, "print the decision trace as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return 2
+	}
+
+	u, err := url.Parse(fs.Arg(2))
+	if err != nil || u.Host == "" {
+		return fail("URL must be absolute: %s", fs.Arg(2))
+	}
+	method := strings.ToUpper(fs.Arg(1))
+
+	acs, err := file.LoadFile(fs.Arg(0))
+	if err != nil {
+		return fail("%s", err)
+	}
+
+	var publicKey []byte
+	if *publicKeyFlg != "" {
+		if publicKey, err = ioutil.ReadFile(*publicKeyFlg); err != nil {
+			return fail("%s", err)
+		}
+	}
+
+	auth, err := fauth.NewAuth(acs, *jwtHeaderFlg, publicKey, []byte(*secretFlg))
+	if err != nil {
+		return fail("%s", err)
+	}
+	// allow() would call out to the URLs named by the access file with the ROOT_KEY
+	auth.StubCallouts(map[string]bool{})
+
+	if *explainFlg {
+		explanation := auth.Explain(u.Hostname(), method, u.RequestURI(), header)
+		printJSON(explanation)
+		if explanation.Status != http.StatusOK {
+			return 1
+		}
+		return 0
+	}
+
+	decision := auth.Check(u.Hostname(), method, u.RequestURI(), header)
+	if *jsonFlg {
+		printJSON(decision)
+	} else {
+		fmt.Printf("%d %s\n", decision.Status, http.StatusText(decision.Status))
+		fmt.Printf("rule:        %s\n", decision.Rule)
+		fmt.Printf("message:     %s\n", decision.Message)
+		if user := decision.User(); user != "" {
+			fmt.Printf("user:        %s\n", user)
+		}
+		if decision.Token != "" {
+			fmt.Printf("token:       %s\n", decision.Token)
+		}
+		if len(decision.Credentials) > 0 {
+			fmt.Printf("credentials: %s\n", strings.Join(decision.Credentials, ", "))
+		}
+	}
+	if decision.Status != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// test runs a policy test suite against an access file; the suite defaults to the file with
+// extension .tests.json next to the access file; the exit status is 1 if any case fails
+func test(args []string) int {
+	fs := flags("test")
+	suiteFlg := fs.String("suite", "", "policy test suite file (default FILE with extension .tests.json)")
+	verboseFlg := fs.Bool("v", false, "print passing cases")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	acs, err := readAccessSystem(fs.Arg(0))
+	if err != nil {
+		return fail("%s", err)
+	}
+	// token names may be defined by the base access system of the file store
+	base, err := file.Base()
+	if err != nil {
+		return fail("%s", err)
+	}
+	acs.Applications = append(acs.Applications, base.Applications...)
+	acs.Tenants = append(acs.Tenants, base.Tenants...)
+
+	suiteFile := *suiteFlg
+	if suiteFile == "" {
+		suiteFile = strings.TrimSuffix(fs.Arg(0), filepath.Ext(fs.Arg(0))) + ".tests.json"
+	}
+	suite, err := fauth.LoadPolicyTestSuite(suiteFile)
+	if err != nil {
+		return fail("%s", err)
+	}
+
+	results, err := fauth.RunPolicyTests(acs, suite)
+	if err != nil {
+		return fail("%s", err)
+	}
+	failed := 0
+	for _, r := range results {
+		if !r.Passed() {
+			failed++
+		}
+		if !r.Passed() || *verboseFlg {
+			fmt.Println(r)
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", len(results)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// diff shows the semantic differences between two access files; the exit status is 1 if
+// the files differ
+func diff(args []string) int {
+	fs := flags("diff")
+	jsonFlg := fs.Bool("json", false, "print changes as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	from, err := readAccessSystem(fs.Arg(0))
+	if err != nil {
+		return fail("%s", err)
+	}
+	to, err := readAccessSystem(fs.Arg(1))
+	if err != nil {
+		return fail("%s", err)
+	}
+
+	changes := fauth.DiffAccessSystems(from, to)
+	if *jsonFlg {
+		if changes == nil {
+			changes = []fauth.Change{}
+		}
+		printJSON(changes)
+	} else {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	}
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// format prints access files in canonical order or rewrites them with -w; with -l the
+// names of files that are not canonical are listed and the exit status is 1 if any are found
+func format(args []string) int {
+	fs := flags("fmt")
+	writeFlg := fs.Bool("w", false, "write the result to the file instead of stdout")
+	listFlg := fs.Bool("l", false, "list files whose formatting differs from canonical")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, name := range fs.Args() {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return fail("%s", err)
+		}
+		acs, err := readAccessSystem(name)
+		if err != nil {
+			return fail("%s", err)
+		}
+		formatted, err := fauth.FormatAccessSystem(acs)
+		if err != nil {
+			return fail("%s: %s", name, err)
+		}
+
+		switch {
+		case *listFlg:
+			if !bytes.Equal(data, formatted) {
+				fmt.Println(name)
+				status = 1
+			}
+		case *writeFlg:
+			if bytes.Equal(data, formatted) {
+				continue
+			}
+			info, err := os.Stat(name)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if err = ioutil.WriteFile(name, formatted, info.Mode()); err != nil {
+				return fail("%s", err)
+			}
+		default:
+			os.Stdout.Write(formatted)
+		}
+	}
+	return status
+}
+
+// hashToken prints the digest of a bearer token for configuration with source digest
+func hashToken(args []string) int {
+	fs := flags("hash-token")
+	fs.Parse(args)
+
+	var token string
+	switch fs.NArg() {
+	case 0:
+		// read from stdin so the token does not appear in shell history
+		scanner := bufio.NewScanner(os.Stdin)
+		if scanner.Scan() {
+			token = strings.TrimSpace(scanner.Text())
+		}
+	case 1:
+		token = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if token == "" {
+		return fail("empty bearer token")
+	}
+	fmt.Println(fauth.HashToken(token))
+	return 0
+}
+
+// storeFlags adds the store selection flags to fs returning a function creating the store
+func storeFlags(fs *flag.FlagSet) func() (fauth.Store, error) {
+	storeFlg := fs.String("store", config.IfGetenv("FORWARD_AUTH_STORAGE", "file"), "storage adapter type - one of file, mssql, postgres")
+	configFlg := fs.String("config", config.IfGetenv("FORWARD_AUTH_DATA_DIR", "/usr/local/etc/forward-auth"), "path to file adapter config directory")
+	return func() (fauth.Store, error) {
+		switch *storeFlg {
+		case "file":
+			return file.New(*configFlg)
+		case "mssql":
+			return mssql.New()
+		case "postgres":
+			return postgres.New()
+		}
+		return nil, fmt.Errorf("unknown store %s", *storeFlg)
+	}
+}
+
+// export writes the access system of a store as canonical JSON
+func export(args []string) int {
+	fs := flags("export")
+	newStore := storeFlags(fs)
+	outFlg := fs.String("o", "", "write to file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	store, err := newStore()
+	if err != nil {
+		return fail("%s", err)
+	}
+	defer store.Close()
+
+	exporter, ok := store.(fauth.Exporter)
+	if !ok {
+		return fail("%s store does not support export", store.ID())
+	}
+	acs, err := exporter.Export()
+	if err != nil {
+		return fail("%s", err)
+	}
+	data, err := fauth.FormatAccessSystem(acs)
+	if err != nil {
+		return fail("%s", err)
+	}
+
+	if *outFlg == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err = ioutil.WriteFile(*outFlg, data, 0644); err != nil {
+		return fail("%s", err)
+	}
+	return 0
+}
+
+// importFile validates an access file and imports it to a store; files with validation
+// errors are rejected unless -force is given
+func importFile(args []string) int {
+	fs := flags("import")
+	newStore := storeFlags(fs)
+	forceFlg := fs.Bool("force", false, "import even if validation finds errors")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	acs, err := readAccessSystem(fs.Arg(0))
+	if err != nil {
+		return fail("%s", err)
+	}
+	diagnostics := fauth.ValidateAccessSystem(acs)
+	for _, d := range diagnostics {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), d)
+	}
+	if diagnostics.HasErrors() && !*forceFlg {
+		return fail("%s has validation errors; not imported", fs.Arg(0))
+	}
+
+	store, err := newStore()
+	if err != nil {
+		return fail("%s", err)
+	}
+	defer store.Close()
+
+	importer, ok := store.(fauth.Importer)
+	if !ok {
+		return fail("%s store does not support import", store.ID())
+	}
+	if err = importer.Import(acs); err != nil {
+		return fail("%s", err)
+	}
+	return 0
+}
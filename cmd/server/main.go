@@ -74,11 +74,14 @@ func main() {
 	// - traceHeader is the name of the header containing a trace identifier used for log coordination
 	//   and returned by forward-auth; Traefik attaches the userHeader and traceHeader to the request
 	//   for downstream consumption
+	// - assertionHeader is the name of the header carrying the identity assertion signed with the owner
+	//   private key; it is returned only if an owner private key is configured
 
 	tenantParam := config.IfGetenv("TENANT_PARAM_NAME", ":tenantID")
 	jwtHeader := config.IfGetenv("JWT_HEADER_NAME", "X-Jwt-Header")
 	userHeader := config.IfGetenv("USER_HEADER_NAME", "X-User-Header")
 	traceHeader := config.IfGetenv("TRACE_HEADER_NAME", "X-Trace-Header")
+	assertionHeader := config.IfGetenv("ASSERTION_HEADER_NAME", "X-Forward-Auth-Assertion")
 
 	if levelFlg == log.None {
 		loglevel := os.Getenv("LOG_LEVEL")
@@ -90,7 +93,7 @@ func main() {
 	}
 
 	if disableFlg {
-		runMode = "noAuth"
+		runMode = fauth.RunDisabled
 	}
 
 	dataDir := configFlg
@@ -117,7 +120,7 @@ func main() {
 	exitDone := &sync.WaitGroup{}
 	exitDone.Add(2)
 
-	authzSrv := server.Start(portFlg, runMode, tenantParam, jwtHeader, userHeader, traceHeader, store, exitDone)
+	authzSrv := server.Start(portFlg, runMode, tenantParam, jwtHeader, userHeader, traceHeader, assertionHeader, store, exitDone)
 
 	log.Infof("forward-auth started with %s storage adapter", store.ID())
 
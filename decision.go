@@ -0,0 +1,505 @@
+package fauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// Decision header fields; HostChecks.Headers and HostGroup.Headers map response header
+// names to one of these fields, eg:
+//
+//	"headers": {
+//	  "X-Tenant-ID": "tenant",
+//	  "X-User-Email": "email",
+//	  "X-Auth-Rule": "rule"
+//	}
+//
+// Traefik copies the headers to the forwarded request when they are listed in authResponseHeaders
+const (
+	FieldUID            = "uid"
+	FieldTenant         = "tenant"
+	FieldEmail          = "email"
+	FieldName           = "name"
+	FieldToken          = "token"
+	FieldRule           = "rule"
+	FieldClassification = "classification"
+	FieldPermissions    = "permissions"
+	FieldCredential     = "credential"
+)
+
+// DecisionFields lists the valid decision header fields
+var DecisionFields = []string{FieldUID, FieldTenant, FieldEmail, FieldName, FieldToken, FieldRule, FieldClassification, FieldPermissions, FieldCredential}
+
+// Credential types verified in an allowed request
+const (
+	CredentialJWT         = "jwt"
+	CredentialBearer      = "bearer"
+	CredentialSignature   = "signature"
+	CredentialCertificate = "certificate"
+)
+
+// ruleHeader and credentialHeader are set by a rule handler on the request header it is passed to
+// record the name of the rule that decided and the credential types verified by its builtins;
+// checkHeader and pathHeader record the check and path pattern routed to. Check removes any
+// incoming copies before evaluation
+const (
+	ruleHeader       = "X-Forward-Auth-Rule"
+	credentialHeader = "X-Forward-Auth-Credential"
+	checkHeader      = "X-Forward-Auth-Check"
+	pathHeader       = "X-Forward-Auth-Path"
+)
+
+// internalHeaders lists the headers used to pass decision details from handlers to Check
+var internalHeaders = []string{ruleHeader, credentialHeader, checkHeader, pathHeader, traceHeader, spanHeader, hostHeader, calloutHeader}
+
+func delInternalHeaders(header http.Header) {
+	for _, name := range internalHeaders {
+		header.Del(name)
+	}
+}
+
+// Decision is the outcome of checking a forwarded request
+//   - Status is the HTTP status of the decision; 200 allows the request
+//   - Message describes the decision
+//   - Rule is the name of the rule that decided, if any
+//   - Check and Path are the check and the path pattern, prefixed by the check base path,
+//     that the request was routed to; Path is the base path if no path pattern matched
+//   - Identity is the identity found in the request JWT of an allowed request
+//   - Token is the name of the bearer token presented in an allowed request
+//   - Credentials are the sorted credential types verified in an allowed request
+//   - Mode is the run mode in effect for the host
+//   - Unenforced is the status of a denial that was allowed by the permissive run mode
+type Decision struct {
+	Status      int
+	Message     string
+	Rule        string
+	Check       string
+	Path        string
+	Identity    *Identity
+	Token       string
+	Credentials []string
+	Mode        string
+	Unenforced  int
+}
+
+// Enforced returns true if the decision was reached by evaluating and enforcing the host checks
+func (d *Decision) Enforced() bool {
+	return d.Mode != RunDisabled && d.Unenforced == 0
+}
+
+// Check decides whether the forwarded request method host uri with header is allowed
+// by applying blocks, host overrides and the host checks of host in the run mode of host; the
+// request is also decided by the shadow host checks, if set, without enforcing the shadow decision
+func (auth *Auth) Check(host, method, uri string, header http.Header) (decision *Decision) {
+	return auth.CheckSpan(nil, host, method, uri, header)
+}
+
+// CheckSpan decides a forwarded request as Check does, recording the verification of the request
+// JWT, the evaluation of the deciding rule and its allow callouts as children of span
+func (auth *Auth) CheckSpan(span *Span, host, method, uri string, header http.Header) (decision *Decision) {
+	var shadowHeader http.Header
+	s := auth.getShadow()
+	if s != nil {
+		shadowHeader = header.Clone()
+	}
+	// the callouts of the decision are recorded for the shadow to replay
+	c := auth.decisionCallouts(s != nil)
+
+	start := time.Now()
+	snap := auth.current()
+	decision = auth.check(snap, host, method, uri, header, nil, span, c)
+	group := snap.hostGroups[host]
+	auth.metrics.decided(group.Name, decision.Check, method, decision.Status, time.Since(start))
+	span.SetAttribute("forward_auth.host_group", group.Name)
+	span.SetAttribute("forward_auth.check", decision.Check)
+	span.SetAttribute("forward_auth.rule", decision.Rule)
+	span.SetAttribute("forward_auth.status", decision.Status)
+	span.SetAttribute("forward_auth.mode", decision.Mode)
+
+	if s != nil {
+		s.enqueue(host, method, uri, shadowHeader, decision, c)
+	}
+	return decision
+}
+
+// check decides a forwarded request with snapshot s in the run mode of host recording the trace
+// of the decision in t, its spans in span and its allow() callouts in c if not nil
+func (auth *Auth) check(s *snapshot, host, method, uri string, header http.Header, t *tracer, span *Span, c *callouts) (decision *Decision) {
+	mode := auth.hostRunMode(s, host)
+	if t != nil {
+		t.explanation.Mode = mode
+	}
+
+	if mode == RunDisabled {
+		delInternalHeaders(header)
+		return &Decision{Status: http.StatusOK, Message: "run mode disabled for host " + host, Mode: mode}
+	}
+
+	decision = auth.decide(s, host, method, uri, header, t, span, c)
+	decision.Mode = mode
+	if mode == RunPermissive && decision.Status != http.StatusOK {
+		log.Warningf("permissive run mode allowed %s %s%s that would be denied with %d: %s",
+			method, host, uri, decision.Status, decision.Message)
+		decision.Unenforced = decision.Status
+		decision.Status = http.StatusOK
+	}
+	return decision
+}
+
+// decide decides a forwarded request by applying blocks and the host overrides and host checks
+// of snapshot s
+func (auth *Auth) decide(s *snapshot, host, method, uri string, header http.Header, t *tracer, span *Span, c *callouts) (decision *Decision) {
+	decision = &Decision{}
+
+	// check for blocked subjects
+	if subject := auth.blockedSubject(host, header); subject != "" {
+		if t != nil {
+			t.explanation.Block = subject
+		}
+		decision.Status = http.StatusForbidden
+		decision.Message = "blocked subject " + subject
+		decision.Rule = "block"
+		return decision
+	}
+
+	if t != nil {
+		if group, ok := s.hostGroups[host]; ok {
+			t.explanation.HostGroup, t.explanation.Default = group.Name, group.Default
+		}
+	}
+
+	// check for host overrides
+	switch override := s.overrides[host]; override {
+	case "allow":
+		decision.Status = http.StatusOK
+		decision.Message = "allow override for host " + host
+		decision.Rule = "allow override"
+		if t != nil {
+			t.explanation.Override = override
+		}
+		return decision
+	case "deny":
+		decision.Status = http.StatusForbidden
+		decision.Message = "deny override for host " + host
+		decision.Rule = "deny override"
+		if t != nil {
+			t.explanation.Override = override
+		}
+		return decision
+	}
+
+	mux, err := s.muxer(host)
+	if err != nil { // shouldn't happen
+		decision.Status = http.StatusForbidden
+		decision.Message = err.Error()
+		return decision
+	}
+
+	delInternalHeaders(header)
+	if t != nil {
+		id := randomString()
+		auth.traces.Store(id, t)
+		defer auth.traces.Delete(id)
+		header.Set(traceHeader, id)
+	}
+	header.Set(hostHeader, host)
+	if span != nil {
+		id := randomString()
+		auth.spans.Store(id, span)
+		defer auth.spans.Delete(id)
+		header.Set(spanHeader, id)
+	}
+	if c != nil {
+		id := randomString()
+		auth.callouts.Store(id, c)
+		defer auth.callouts.Delete(id)
+		header.Set(calloutHeader, id)
+	}
+	decision.Status, decision.Message, _ = mux.Check(method, uri, header)
+	decision.Rule = header.Get(ruleHeader)
+	decision.Check = header.Get(checkHeader)
+	decision.Path = header.Get(pathHeader)
+	verified := header.Get(credentialHeader)
+	delInternalHeaders(header)
+
+	// the JWT is verified once per decision to record verification failures
+	var (
+		identity *Identity
+		jwtErr   error
+	)
+	jwt := header.Get(auth.jwtHeader)
+	if jwt != "" {
+		jwtSpan := span.Child("jwt.verify", SpanInternal)
+		identity, jwtErr = jwtIdentity(jwt, auth)
+		jwtSpan.SetAttribute("forward_auth.jwt.valid", jwtErr == nil)
+		if jwtErr != nil {
+			jwtSpan.SetAttribute("forward_auth.jwt.failure", jwtFailureReason(jwtErr))
+		}
+		jwtSpan.End()
+		if jwtErr != nil && t == nil {
+			auth.metrics.jwtFailure(jwtErr)
+		}
+	}
+
+	if decision.Status != http.StatusOK {
+		return decision
+	}
+
+	credentials := make(map[string]bool)
+	for _, c := range strings.Split(verified, ",") {
+		if c != "" {
+			credentials[c] = true
+		}
+	}
+	if token := bearerToken(header); token != "" {
+		decision.Token = s.tokenName(token)
+		if decision.Token != "" {
+			credentials[CredentialBearer] = true
+		}
+	}
+	if jwt != "" {
+		if jwtErr != nil {
+			log.Debugf("allowed request has invalid JWT: %s", jwtErr)
+		} else {
+			decision.Identity = identity
+			credentials[CredentialJWT] = true
+		}
+	}
+	decision.Credentials = sortedKeys(credentials)
+	return decision
+}
+
+// blockedSubject returns the first blocked subject of a request or the empty string; the
+// subjects of a request are its host, its client address and the user of a valid JWT
+func (auth *Auth) blockedSubject(host string, header http.Header) string {
+	blocks := auth.Blocked()
+	if len(blocks) == 0 {
+		return ""
+	}
+
+	subjects := []string{host, clientAddress(header)}
+	if jwt := header.Get(auth.jwtHeader); jwt != "" {
+		if identity, err := jwtIdentity(jwt, auth); err == nil && identity != nil {
+			subjects = append(subjects, identity.UserID())
+		}
+	}
+	for _, subject := range subjects {
+		for _, blocked := range blocks {
+			if subject != "" && subject == blocked {
+				return subject
+			}
+		}
+	}
+	return ""
+}
+
+// clientAddress returns the client IP address of a forwarded request
+func clientAddress(header http.Header) string {
+	if forwarded := header.Get("X-Forwarded-For"); forwarded != "" {
+		client, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(client)
+	}
+	return header.Get("X-Real-Ip")
+}
+
+// setCredentials records the credential types verified by a rule handler in header
+func setCredentials(header http.Header, verified map[string]bool) {
+	if len(verified) > 0 {
+		header.Set(credentialHeader, strings.Join(sortedKeys(verified), ","))
+	}
+}
+
+// sortedKeys returns the sorted keys of m that map to true
+func sortedKeys(m map[string]bool) (keys []string) {
+	for k, v := range m {
+		if v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// User returns the UID of the identity in the decision or the empty string
+func (d *Decision) User() string {
+	if d.Identity == nil {
+		return ""
+	}
+	return d.Identity.UserID()
+}
+
+// Field returns the value of a decision header field or the empty string if it is not
+// present in the decision
+func (d *Decision) Field(field string) string {
+	switch field {
+	case FieldRule:
+		return d.Rule
+	case FieldToken:
+		return d.Token
+	case FieldCredential:
+		return strings.Join(d.Credentials, ",")
+	}
+
+	if d.Identity == nil {
+		return ""
+	}
+	id := d.Identity
+	switch field {
+	case FieldUID:
+		return id.UserID()
+	case FieldTenant:
+		return id.TenantID()
+	case FieldEmail:
+		if id.Email != nil {
+			return *id.Email
+		}
+	case FieldName:
+		if id.Name != nil {
+			return *id.Name
+		}
+	case FieldClassification:
+		if id.Classification != nil {
+			return id.Classification.Level
+		}
+	case FieldPermissions:
+		if len(id.UserPermissions) == 0 {
+			return ""
+		}
+		data, err := json.Marshal(permissionSummary(id.UserPermissions))
+		if err != nil {
+			log.Errorf("failed to marshal permissions summary: %s", err)
+			return ""
+		}
+		return string(data)
+	}
+	return ""
+}
+
+// Headers returns the response headers configured for host populated from the decision;
+// fields that are empty in the decision are omitted
+func (d *Decision) Headers(fields map[string]string) http.Header {
+	h := http.Header{}
+	for name, field := range fields {
+		if v := d.Field(field); v != "" {
+			h.Set(name, v)
+		}
+	}
+	return h
+}
+
+// permissionSummary maps each permission context to its sorted CATEGORY:ACTION grants
+func permissionSummary(perms []UserPermission) map[string][]string {
+	summary := make(map[string][]string)
+	for _, up := range perms {
+		for _, p := range up.Permissions {
+			for _, a := range p.Actions {
+				summary[up.Context] = append(summary[up.Context], p.Category+":"+a)
+			}
+		}
+	}
+	for _, grants := range summary {
+		sort.Strings(grants)
+	}
+	return summary
+}
+
+// ResponseHeaders returns the decision headers configured for host, mapping header
+// names to decision fields; host group headers take precedence over global headers
+func (auth *Auth) ResponseHeaders(host string) map[string]string {
+	s := auth.current()
+	if h, ok := s.headers[host]; ok {
+		return h
+	}
+	return s.globalHeaders
+}
+
+// setHeaders computes the decision headers for each host in checks
+func (s *snapshot) setHeaders(checks *HostChecks) {
+	global := make(map[string]string)
+	hosts := make(map[string]map[string]string)
+	if checks != nil {
+		for name, field := range checks.Headers {
+			global[http.CanonicalHeaderKey(name)] = field
+		}
+		for _, group := range checks.HostGroups {
+			if len(group.Headers) == 0 {
+				continue
+			}
+			merged := make(map[string]string, len(global)+len(group.Headers))
+			for name, field := range global {
+				merged[name] = field
+			}
+			for name, field := range group.Headers {
+				merged[http.CanonicalHeaderKey(name)] = field
+			}
+			for _, host := range group.Hosts {
+				hosts[host] = merged
+			}
+		}
+	}
+
+	s.globalHeaders = global
+	s.headers = hosts
+}
+
+// reservedHeaders may not be decision headers: the server strips decision headers from incoming
+// requests, so a decision header must not be a hop-by-hop header or carry credentials or the
+// forwarded request
+var reservedHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	SignatureHeader:       true,
+	SignatureInputHeader:  true,
+}
+
+// validateHeaders returns an error if headers maps a header name to an unknown decision field, or
+// if a header name is reserved, is an X-Forwarded-* header or is jwtHeader
+func validateHeaders(headers map[string]string, jwtHeader string) error {
+	for name, field := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if reservedHeaders[canonical] || strings.HasPrefix(canonical, "X-Forwarded-") ||
+			(jwtHeader != "" && canonical == http.CanonicalHeaderKey(jwtHeader)) {
+			return fmt.Errorf("header %s is reserved and cannot be a decision header", name)
+		}
+		valid := false
+		for _, f := range DecisionFields {
+			if field == f {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("header %s has invalid decision field '%s'; must be one of %s", name, field, strings.Join(DecisionFields, ", "))
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the bearer token in the Authorization header or the empty string
+func bearerToken(header http.Header) (token string) {
+	authHeader := header.Get("Authorization")
+	if authHeader != "" {
+		// Get the Bearer auth token
+		splitToken := strings.Split(authHeader, "Bearer ")
+		if len(splitToken) == 2 {
+			token = splitToken[1]
+		}
+	}
+	return token
+}
@@ -0,0 +1,235 @@
+package fauth_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// testJWT returns an HS256 JWT signed with the newTestAuth secret carrying identity
+func testJWT(t testing.TB, identity *fauth.Identity) string {
+	claims := struct {
+		Identity *fauth.Identity `json:"identity"`
+		jwt.RegisteredClaims
+	}{
+		Identity: identity,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func strptr(s string) *string {
+	return &s
+}
+
+func TestDecisionHeaders(t *testing.T) {
+	auth := newTestAuth(t, &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{
+			Headers: map[string]string{
+				"X-Tenant-ID": "tenant",
+				"X-Auth-Rule": "rule",
+			},
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com"},
+					Default: "deny",
+					Headers: map[string]string{
+						"X-User-Email":  "email",
+						"X-Token-Name":  "token",
+						"X-Permissions": "permissions",
+					},
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path: "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{
+										"GET":  {Expression: "role('READ', 'WIDGETS') || bearer('MC_APP_KEY')"},
+										"POST": {Name: "create widgets", Expression: "role('CREATE', 'WIDGETS')"},
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					Name:    "Other Hosts",
+					Hosts:   []string{"other.example.com"},
+					Default: "allow",
+				},
+			},
+		},
+	})
+
+	user := testJWT(t, &fauth.Identity{
+		TID:   strptr("tenant-1"),
+		UID:   strptr("user-1"),
+		Email: strptr("user@example.com"),
+		UserPermissions: []fauth.UserPermission{
+			{Context: fauth.ALL, Permissions: []fauth.Permission{{Category: "WIDGETS", Actions: []string{"READ"}}}},
+		},
+	})
+
+	if fields := auth.ResponseHeaders("other.example.com"); len(fields) != 2 {
+		t.Errorf("ResponseHeaders(other.example.com) = %v, want global headers", fields)
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		method string
+		header http.Header
+		status int
+		want   map[string]string
+	}{
+		{
+			name:   "user allowed",
+			host:   "apis.example.com",
+			method: "GET",
+			header: http.Header{http.CanonicalHeaderKey(jwtHeader): []string{user}},
+			status: http.StatusOK,
+			want: map[string]string{
+				"X-Tenant-Id":   "tenant-1",
+				"X-Auth-Rule":   "widgets-api GET /widgets-api/v1/widgets",
+				"X-User-Email":  "user@example.com",
+				"X-Token-Name":  "",
+				"X-Permissions": `{"ALL":["WIDGETS:READ"]}`,
+			},
+		},
+		{
+			name:   "application allowed",
+			host:   "apis.example.com",
+			method: "GET",
+			header: http.Header{"Authorization": []string{"Bearer app-token-value"}},
+			status: http.StatusOK,
+			want: map[string]string{
+				"X-Tenant-Id":  "",
+				"X-Auth-Rule":  "widgets-api GET /widgets-api/v1/widgets",
+				"X-Token-Name": "MC_APP_KEY",
+			},
+		},
+		{
+			name:   "spoofed rule is replaced",
+			host:   "apis.example.com",
+			method: "GET",
+			header: http.Header{http.CanonicalHeaderKey(jwtHeader): []string{user}, "X-Forward-Auth-Rule": []string{"spoofed"}},
+			status: http.StatusOK,
+			want: map[string]string{
+				"X-Auth-Rule": "widgets-api GET /widgets-api/v1/widgets",
+			},
+		},
+		{
+			name:   "named rule denies",
+			host:   "apis.example.com",
+			method: "POST",
+			header: http.Header{http.CanonicalHeaderKey(jwtHeader): []string{user}},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := auth.Check(tt.host, tt.method, "/widgets-api/v1/widgets", tt.header)
+			if decision.Status != tt.status {
+				t.Fatalf("Check() status = %d, want %d: %s", decision.Status, tt.status, decision.Message)
+			}
+			headers := decision.Headers(auth.ResponseHeaders(tt.host))
+			for name, want := range tt.want {
+				if got := headers.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	decision := auth.Check("apis.example.com", "POST", "/widgets-api/v1/widgets", http.Header{http.CanonicalHeaderKey(jwtHeader): []string{user}})
+	if decision.Rule != "create widgets" {
+		t.Errorf("Rule = %q, want %q", decision.Rule, "create widgets")
+	}
+}
+
+func TestInvalidDecisionHeader(t *testing.T) {
+	acs := &fauth.AccessSystem{
+		Checks: &fauth.HostChecks{
+			Headers: map[string]string{"X-Password": "password"},
+		},
+	}
+	if _, err := fauth.NewAuth(acs, jwtHeader, nil, nil); err == nil {
+		t.Error("NewAuth() with invalid decision header field succeeded, want error")
+	}
+
+	// the server strips decision headers from requests, so they cannot name credential,
+	// hop-by-hop or forwarded request headers
+	for _, name := range []string{"authorization", "Cookie", "Connection", "Transfer-Encoding", "x-forwarded-uri", "X-Forwarded-Tls-Client-Cert", jwtHeader} {
+		acs := &fauth.AccessSystem{
+			Checks: &fauth.HostChecks{
+				HostGroups: []fauth.HostGroup{{Name: "API Hosts", Hosts: []string{"apis.example.com"}, Default: "deny",
+					Headers: map[string]string{name: fauth.FieldUID}}},
+			},
+		}
+		if _, err := fauth.NewAuth(acs, jwtHeader, nil, nil); err == nil {
+			t.Errorf("NewAuth() with decision header %s succeeded, want error", name)
+		}
+		if name != jwtHeader && len(fauth.ValidateAccessSystem(acs)) == 0 {
+			t.Errorf("ValidateAccessSystem() with decision header %s returned no diagnostics", name)
+		}
+	}
+}
+
+func TestBearerDigest(t *testing.T) {
+	auth := newTestAuth(t, &fauth.AccessSystem{
+		Digests: map[string]string{fauth.HashToken("app-token-value"): "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com"},
+					Default: "deny",
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path:  "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "bearer('MC_APP_KEY')"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"app-token-value", http.StatusOK},
+		{"other-token-value", http.StatusForbidden},
+		{fauth.HashToken("app-token-value"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		decision := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{"Authorization": []string{"Bearer " + tt.token}})
+		if decision.Status != tt.want {
+			t.Errorf("Check() with token %s = %d, want %d: %s", tt.token, decision.Status, tt.want, decision.Message)
+		}
+		if tt.want == http.StatusOK && decision.Token != "MC_APP_KEY" {
+			t.Errorf("Token = %q, want MC_APP_KEY", decision.Token)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package fauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ChangeKind is the kind of a change between access systems
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change is a semantic difference between two access systems; HostGroup, Check, Path and
+// Method locate the change in the host checks and are empty if not applicable; Subject is
+// what was added, removed or changed and From and To are the changed values (secret values
+// are never included)
+type Change struct {
+	Kind      ChangeKind `json:"kind"`
+	HostGroup string     `json:"hostGroup,omitempty"`
+	Check     string     `json:"check,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	Method    string     `json:"method,omitempty"`
+	Subject   string     `json:"subject"`
+	From      string     `json:"from,omitempty"`
+	To        string     `json:"to,omitempty"`
+}
+
+func (c Change) String() string {
+	symbol := map[ChangeKind]string{Added: "+", Removed: "-", Changed: "~"}[c.Kind]
+	s := symbol + " "
+	if at := location(c.HostGroup, c.Check, c.Method, c.Path); at != "" {
+		s += at + ": "
+	}
+	s += c.Subject
+	if c.Kind == Changed && (c.From != "" || c.To != "") {
+		s += fmt.Sprintf(" %s -> %s", strconv.Quote(c.From), strconv.Quote(c.To))
+	}
+	return s
+}
+
+// DiffAccessSystems returns the semantic differences between access systems from and to:
+// the owner, token names, tenants, public keys, certificate authorities, blocks, overrides,
+// decision headers and the host groups, hosts, checks, paths and rules of the host checks;
+// host groups and checks are matched by name, paths by pattern and rules by method
+func DiffAccessSystems(from, to *AccessSystem) (changes []Change) {
+	d := &differ{}
+
+	d.value(Change{Subject: "owner name"}, from.Owner.Name, to.Owner.Name)
+	d.value(Change{Subject: "owner uid"}, from.Owner.UID, to.Owner.UID)
+	d.value(Change{Subject: "owner bearer token"}, secretName(from.Owner.Bearer), secretName(to.Owner.Bearer))
+	d.value(Change{Subject: "owner private key"}, secretName(from.Owner.PrivateKey), secretName(to.Owner.PrivateKey))
+
+	d.set(Change{Subject: "token"}, tokenNames(from), tokenNames(to))
+	d.set(Change{Subject: "tenant"}, tenantIDs(from), tenantIDs(to))
+	d.keyed(Change{Subject: "public key"}, from.PublicKeys, to.PublicKeys, false)
+	d.keyed(Change{Subject: "certificate authority"}, caValues(from), caValues(to), false)
+	d.set(Change{Subject: "block"}, blocked(from.Blocks), blocked(to.Blocks))
+
+	fromChecks, toChecks := from.Checks, to.Checks
+	if fromChecks == nil {
+		fromChecks = &HostChecks{}
+	}
+	if toChecks == nil {
+		toChecks = &HostChecks{}
+	}
+	d.value(Change{Subject: "mode"}, fromChecks.Mode, toChecks.Mode)
+	d.keyed(Change{Subject: "override"}, fromChecks.Overrides, toChecks.Overrides, true)
+	d.keyed(Change{Subject: "header"}, fromChecks.Headers, toChecks.Headers, true)
+
+	fromGroups, toGroups := make(map[string]HostGroup), make(map[string]HostGroup)
+	for _, group := range fromChecks.HostGroups {
+		fromGroups[group.Name] = group
+	}
+	for _, group := range toChecks.HostGroups {
+		toGroups[group.Name] = group
+	}
+	for _, name := range unionKeys(fromGroups, toGroups) {
+		f, inFrom := fromGroups[name]
+		t, inTo := toGroups[name]
+		switch {
+		case !inTo:
+			d.add(Change{Kind: Removed, Subject: fmt.Sprintf("host group '%s'", name)})
+		case !inFrom:
+			d.add(Change{Kind: Added, Subject: fmt.Sprintf("host group '%s'", name)})
+			d.hostGroup(HostGroup{Name: name}, t)
+		default:
+			d.hostGroup(f, t)
+		}
+	}
+	return d.changes
+}
+
+// differ accumulates the changes between access systems
+type differ struct {
+	changes []Change
+}
+
+func (d *differ) add(c Change) {
+	d.changes = append(d.changes, c)
+}
+
+// value records a change of value from to to
+func (d *differ) value(c Change, from, to string) {
+	if from != to {
+		c.Kind, c.From, c.To = Changed, from, to
+		d.add(c)
+	}
+}
+
+// set records the members added to and removed from a set
+func (d *differ) set(c Change, from, to map[string]bool) {
+	subject := c.Subject
+	for _, member := range unionKeys(from, to) {
+		if from[member] == to[member] {
+			continue
+		}
+		c.Kind = Added
+		if from[member] {
+			c.Kind = Removed
+		}
+		c.Subject = fmt.Sprintf("%s %s", subject, member)
+		d.add(c)
+	}
+}
+
+// keyed records the keys added, removed and changed in a map; values are reported only if
+// show is true
+func (d *differ) keyed(c Change, from, to map[string]string, show bool) {
+	subject := c.Subject
+	for _, key := range unionKeys(from, to) {
+		f, inFrom := from[key]
+		t, inTo := to[key]
+		c.Subject = fmt.Sprintf("%s %s", subject, key)
+		c.From, c.To = "", ""
+		switch {
+		case !inFrom:
+			c.Kind = Added
+		case !inTo:
+			c.Kind = Removed
+		case f != t:
+			c.Kind = Changed
+			if show {
+				c.From, c.To = f, t
+			}
+		default:
+			continue
+		}
+		d.add(c)
+	}
+}
+
+func (d *differ) hostGroup(from, to HostGroup) {
+	at := Change{HostGroup: to.Name}
+
+	d.value(withSubject(at, "default"), from.Default, to.Default)
+	d.value(withSubject(at, "mode"), from.Mode, to.Mode)
+	d.value(withSubject(at, "description"), from.Description, to.Description)
+	d.value(withSubject(at, "login"), jsonString(from.Login), jsonString(to.Login))
+	d.set(withSubject(at, "host"), stringSet(from.Hosts), stringSet(to.Hosts))
+	d.keyed(withSubject(at, "header"), from.Headers, to.Headers, true)
+
+	fromChecks, toChecks := make(map[string]Check), make(map[string]Check)
+	for _, check := range from.Checks {
+		fromChecks[check.Name] = check
+	}
+	for _, check := range to.Checks {
+		toChecks[check.Name] = check
+	}
+	for _, name := range unionKeys(fromChecks, toChecks) {
+		f, inFrom := fromChecks[name]
+		t, inTo := toChecks[name]
+		switch {
+		case !inTo:
+			d.add(withSubject(at, fmt.Sprintf("check '%s'", name)).kind(Removed))
+		case !inFrom:
+			d.add(withSubject(at, fmt.Sprintf("check '%s'", name)).kind(Added))
+			d.check(to.Name, Check{Name: name, Base: t.Base}, t)
+		default:
+			d.check(to.Name, f, t)
+		}
+	}
+}
+
+func (d *differ) check(group string, from, to Check) {
+	at := Change{HostGroup: group, Check: to.Name}
+
+	d.value(withSubject(at, "base"), from.Base, to.Base)
+
+	fromPaths, toPaths := make(map[string]Path), make(map[string]Path)
+	for _, path := range from.Paths {
+		fromPaths[path.Path] = path
+	}
+	for _, path := range to.Paths {
+		toPaths[path.Path] = path
+	}
+	for _, pattern := range unionKeys(fromPaths, toPaths) {
+		f, inFrom := fromPaths[pattern]
+		t, inTo := toPaths[pattern]
+		at := at
+		at.Path = to.Base + pattern
+		switch {
+		case !inTo:
+			at.Path = from.Base + pattern
+			d.add(withSubject(at, "path").kind(Removed))
+		case !inFrom:
+			d.add(withSubject(at, "path").kind(Added))
+			d.rules(at, nil, t.Rules)
+		default:
+			d.rules(at, f.Rules, t.Rules)
+		}
+	}
+
+	// paths are matched in order so a change in the order of common paths changes decisions
+	var fromOrder, toOrder []string
+	for _, path := range from.Paths {
+		if _, ok := toPaths[path.Path]; ok {
+			fromOrder = append(fromOrder, path.Path)
+		}
+	}
+	for _, path := range to.Paths {
+		if _, ok := fromPaths[path.Path]; ok {
+			toOrder = append(toOrder, path.Path)
+		}
+	}
+	d.value(withSubject(at, "path order"), jsonString(fromOrder), jsonString(toOrder))
+}
+
+func (d *differ) rules(at Change, from, to map[Method]Rule) {
+	for _, method := range unionKeys(from, to) {
+		f, inFrom := from[method]
+		t, inTo := to[method]
+		at := at
+		at.Method = string(method)
+		switch {
+		case !inTo:
+			d.add(withSubject(at, "rule").kind(Removed))
+		case !inFrom:
+			d.add(withSubject(at, "rule "+t.Expression).kind(Added))
+		default:
+			d.value(withSubject(at, "expression"), f.Expression, t.Expression)
+			d.value(withSubject(at, "mustAuth"), strconv.FormatBool(f.MustAuth), strconv.FormatBool(t.MustAuth))
+			d.value(withSubject(at, "name"), f.Name, t.Name)
+			d.value(withSubject(at, "cacheTTL"), f.CacheTTL, t.CacheTTL)
+		}
+	}
+}
+
+func withSubject(c Change, subject string) Change {
+	c.Subject = subject
+	return c
+}
+
+func (c Change) kind(kind ChangeKind) Change {
+	c.Kind = kind
+	return c
+}
+
+// unionKeys returns the sorted union of the keys of maps a and b
+func unionKeys[K ~string, V any](a, b map[K]V) (keys []K) {
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func blocked(blocks map[string]bool) map[string]bool {
+	set := make(map[string]bool)
+	for subject, block := range blocks {
+		if block {
+			set[subject] = true
+		}
+	}
+	return set
+}
+
+// tokenNames returns the names of the bearer tokens defined by acs
+func tokenNames(acs *AccessSystem) map[string]bool {
+	return newValidator(acs).tokens
+}
+
+// tenantIDs returns the IDs of the tenants of acs
+func tenantIDs(acs *AccessSystem) map[string]bool {
+	ids := make(map[string]bool)
+	for _, tenant := range acs.Tenants {
+		ids[tenant.UUID] = true
+	}
+	return ids
+}
+
+// caValues returns the configured source of each certificate authority of acs
+func caValues(acs *AccessSystem) map[string]string {
+	values := make(map[string]string)
+	for _, ca := range acs.CertificateAuthorities {
+		values[ca.Name] = ca.Source + ":" + ca.Value
+	}
+	return values
+}
+
+// secretName describes the source of an owner secret without its value
+func secretName(secret interface{}) string {
+	switch s := secret.(type) {
+	case *Token:
+		if s != nil {
+			return s.Source + ":" + s.Name
+		}
+	case *PrivateKey:
+		if s != nil {
+			return s.Source + ":" + s.Name
+		}
+	}
+	return ""
+}
+
+func jsonString(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
@@ -0,0 +1,114 @@
+package fauth_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func diffAccessSystem() *fauth.AccessSystem {
+	return &fauth.AccessSystem{
+		Owner:        fauth.Owner{Name: "Example", UID: "tenant-1"},
+		Applications: []fauth.Application{{Name: "widgets", Bearer: &fauth.Token{Source: "env", Name: "MC_APP_KEY"}}},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com", "api.example.com"},
+					Default: "deny",
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{Path: "/widgets", Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "bearer('MC_APP_KEY')"}}},
+								{Path: "/widgets/:id", Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "role('READ', 'WIDGETS')"}}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDiffAccessSystems(t *testing.T) {
+	from := diffAccessSystem()
+	if changes := fauth.DiffAccessSystems(from, diffAccessSystem()); len(changes) != 0 {
+		t.Fatalf("DiffAccessSystems() of equal access systems = %v, want none", changes)
+	}
+
+	to := diffAccessSystem()
+	to.Applications = append(to.Applications, fauth.Application{Name: "reports", Bearer: &fauth.Token{Source: "env", Name: "REPORTS_APP_KEY"}})
+	group := &to.Checks.HostGroups[0]
+	group.Hosts = []string{"apis.example.com", "www.example.com"}
+	check := &group.Checks[0]
+	check.Paths[0].Rules["GET"] = fauth.Rule{Expression: "bearer('MC_APP_KEY', 'REPORTS_APP_KEY')"}
+	check.Paths[1].Rules["DELETE"] = fauth.Rule{Expression: "root()", MustAuth: true}
+	check.Paths[0], check.Paths[1] = check.Paths[1], check.Paths[0]
+	to.Checks.HostGroups = append(to.Checks.HostGroups, fauth.HostGroup{Name: "Web Hosts", Hosts: []string{"app.example.com"}, Default: "allow"})
+
+	var got []string
+	for _, c := range fauth.DiffAccessSystems(from, to) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"+ token REPORTS_APP_KEY",
+		"- host group 'API Hosts': host api.example.com",
+		"+ host group 'API Hosts': host www.example.com",
+		`~ host group 'API Hosts', check 'widgets-api', GET /widgets-api/v1/widgets: expression "bearer('MC_APP_KEY')" -> "bearer('MC_APP_KEY', 'REPORTS_APP_KEY')"`,
+		"+ host group 'API Hosts', check 'widgets-api', DELETE /widgets-api/v1/widgets/:id: rule root()",
+		`~ host group 'API Hosts', check 'widgets-api': path order "[\"/widgets\",\"/widgets/:id\"]" -> "[\"/widgets/:id\",\"/widgets\"]"`,
+		"+ host group 'Web Hosts'",
+		`~ host group 'Web Hosts': default "" -> "allow"`,
+		"+ host group 'Web Hosts': host app.example.com",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("DiffAccessSystems() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFormatAccessSystem(t *testing.T) {
+	acs := diffAccessSystem()
+	acs.Checks.HostGroups = append([]fauth.HostGroup{{Name: "Web Hosts", Default: "allow"}}, acs.Checks.HostGroups...)
+
+	data, err := fauth.FormatAccessSystem(acs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"expression": "bearer('MC_APP_KEY')"`) {
+		t.Errorf("FormatAccessSystem() escaped expressions:\n%s", data)
+	}
+	// empty fields are left out of the canonical format but not the JSON of an access system
+	for _, field := range []string{`"tokens"`, `"blocks"`, `"rootToken"`, `"privateKey"`, `"guid"`} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("FormatAccessSystem() kept empty field %s:\n%s", field, data)
+		}
+	}
+	if encoded, _ := json.Marshal(acs); !strings.Contains(string(encoded), `"tokens":null`) {
+		t.Errorf("got JSON %s without the empty tokens field", encoded)
+	}
+
+	formatted := &fauth.AccessSystem{}
+	if err := json.Unmarshal(data, formatted); err != nil {
+		t.Fatal(err)
+	}
+	groups := formatted.Checks.HostGroups
+	if groups[0].Name != "API Hosts" || groups[0].Hosts[0] != "api.example.com" {
+		t.Errorf("FormatAccessSystem() host groups = %+v, want sorted by name with sorted hosts", groups)
+	}
+	if paths := groups[0].Checks[0].Paths; paths[0].Path != "/widgets" {
+		t.Errorf("FormatAccessSystem() reordered paths %+v", paths)
+	}
+
+	// formatting is idempotent
+	again, err := fauth.FormatAccessSystem(formatted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("FormatAccessSystem() is not idempotent:\n%s\n%s", data, again)
+	}
+}
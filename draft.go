@@ -0,0 +1,225 @@
+package fauth
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/validation"
+)
+
+// Draft is a named set of edits to the host checks of an access system; edits are saved to the
+// draft, which is reviewed (see Auth.ReviewDraft) and then published as a whole:
+//   - Base is the published version the draft was created from (zero if unversioned)
+//   - Revision counts the saved edits; a draft is only saved at the revision it was read at
+//   - Checks are the host checks as edited; they are omitted from draft lists
+//   - Approved and ApproveUser record the approval of the current revision by an administrator
+//     other than its editor; saving an edit clears the approval
+type Draft struct {
+	Name        string      `json:"name"`
+	Base        int         `json:"base"`
+	Revision    int         `json:"revision"`
+	Checks      *HostChecks `json:"authorization,omitempty"`
+	Created     time.Time   `json:"created"`
+	CreateUser  string      `json:"createUser"`
+	Updated     time.Time   `json:"updated"`
+	UpdateUser  string      `json:"updateUser"`
+	Approved    *time.Time  `json:"approved,omitempty"`
+	ApproveUser string      `json:"approveUser,omitempty"`
+}
+
+// draftName matches draft names, which are also used as file names
+var draftName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (d Draft) Validate() error {
+	return validation.ValidateStruct(&d,
+		validation.Field(&d.Name, validation.Required, validation.Length(1, 64), validation.Match(draftName)),
+	)
+}
+
+// ErrDraftConflict is returned by a DraftStore if a draft was saved since it was read
+var ErrDraftConflict = errors.New("the draft was changed since it was read")
+
+// ErrDraftStale is returned by a DraftStore if the host checks were published since the draft was
+// created, so that publishing the draft would discard the published changes
+var ErrDraftStale = errors.New("the host checks were published since the draft was created from them")
+
+// DraftStore is implemented by stores that keep drafts of their host checks and publish them
+type DraftStore interface {
+	// Drafts returns the drafts without their host checks
+	Drafts() ([]Draft, error)
+	// Draft returns a draft with its host checks
+	Draft(name string) (*Draft, error)
+	// CreateDraft creates a draft of the host checks as stored
+	CreateDraft(sessionGUID, name string) (*Draft, error)
+	// SaveDraft saves the host checks of draft if it is at the stored revision, clearing its
+	// approval, and returns the draft at its new revision
+	SaveDraft(sessionGUID string, draft *Draft) (*Draft, error)
+	// ApproveDraft records the approval of draft if it is at the stored revision
+	ApproveDraft(sessionGUID string, draft *Draft) (*Draft, error)
+	// DeleteDraft deletes a draft
+	DeleteDraft(name string) error
+	// DraftAccess returns the access system the store would load if draft were published
+	DraftAccess(draft *Draft) (*AccessSystem, error)
+	// PublishDraft replaces the host checks of the store with those of draft in a single step,
+	// if it is at the stored revision and its base is the active version, and deletes the draft
+	PublishDraft(sessionGUID string, draft *Draft, comment string) error
+}
+
+// SetHostGroup adds group to the draft or replaces the host group of the same name
+func (d *Draft) SetHostGroup(group HostGroup) {
+	checks := d.checks()
+	for i, g := range checks.HostGroups {
+		if g.Name == group.Name {
+			checks.HostGroups[i] = group
+			return
+		}
+	}
+	checks.HostGroups = append(checks.HostGroups, group)
+}
+
+// RemoveHostGroup removes the named host group from the draft
+func (d *Draft) RemoveHostGroup(name string) error {
+	checks := d.checks()
+	for i, g := range checks.HostGroups {
+		if g.Name == name {
+			checks.HostGroups = append(checks.HostGroups[:i], checks.HostGroups[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("draft %s has no host group '%s'", d.Name, name)
+}
+
+// SetCheck adds check to the named host group of the draft or replaces the check of the same name
+func (d *Draft) SetCheck(group string, check Check) error {
+	g, err := d.hostGroup(group)
+	if err != nil {
+		return err
+	}
+	for i, c := range g.Checks {
+		if c.Name == check.Name {
+			g.Checks[i] = check
+			return nil
+		}
+	}
+	g.Checks = append(g.Checks, check)
+	return nil
+}
+
+// RemoveCheck removes the named check from the named host group of the draft
+func (d *Draft) RemoveCheck(group, name string) error {
+	g, err := d.hostGroup(group)
+	if err != nil {
+		return err
+	}
+	for i, c := range g.Checks {
+		if c.Name == name {
+			g.Checks = append(g.Checks[:i], g.Checks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("draft %s host group '%s' has no check '%s'", d.Name, group, name)
+}
+
+// CanApprove returns an error if user may not approve the current revision of the draft: an
+// administrator cannot approve their own edit
+func (d *Draft) CanApprove(user string) error {
+	if user == d.UpdateUser {
+		return fmt.Errorf("draft %s revision %d was edited by %s and must be approved by another administrator", d.Name, d.Revision, user)
+	}
+	return nil
+}
+
+func (d *Draft) checks() *HostChecks {
+	if d.Checks == nil {
+		d.Checks = &HostChecks{}
+	}
+	return d.Checks
+}
+
+func (d *Draft) hostGroup(name string) (*HostGroup, error) {
+	checks := d.checks()
+	for i := range checks.HostGroups {
+		if checks.HostGroups[i].Name == name {
+			return &checks.HostGroups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("draft %s has no host group '%s'", d.Name, name)
+}
+
+// DraftReview explains what publishing a draft would change:
+//   - Changes are the differences from the live access system to the draft
+//   - Diagnostics are the problems found in the draft; NewErrors are the errors among them that
+//     are not found in the live access system
+//   - Tests are the results of the policy tests run against the draft and Failures the number
+//     of them that did not pass
+type DraftReview struct {
+	Draft       string      `json:"draft"`
+	Revision    int         `json:"revision"`
+	Changes     []Change    `json:"changes"`
+	Diagnostics Diagnostics `json:"diagnostics"`
+	NewErrors   Diagnostics `json:"newErrors,omitempty"`
+	Tests       []string    `json:"tests,omitempty"`
+	Failures    int         `json:"failures"`
+}
+
+// Publishable returns an error if the reviewed draft introduces validation errors or fails
+// policy tests
+func (r *DraftReview) Publishable() error {
+	var problems []string
+	if len(r.NewErrors) > 0 {
+		problems = append(problems, fmt.Sprintf("%d new validation errors", len(r.NewErrors)))
+	}
+	if r.Failures > 0 {
+		problems = append(problems, fmt.Sprintf("%d failed policy tests", r.Failures))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("draft %s revision %d has %s", r.Draft, r.Revision, strings.Join(problems, " and "))
+	}
+	return nil
+}
+
+// ReviewDraft reviews draft against the live access system of auth; acs is the access system
+// that publishing the draft would load (see DraftStore.DraftAccess) and suite, if not nil, is
+// run against it
+func (auth *Auth) ReviewDraft(draft *Draft, acs *AccessSystem, suite *PolicyTestSuite) (review *DraftReview, err error) {
+	live := auth.current().acs
+	review = &DraftReview{
+		Draft:       draft.Name,
+		Revision:    draft.Revision,
+		Changes:     DiffAccessSystems(live, acs),
+		Diagnostics: ValidateAccessSystem(acs),
+	}
+	if review.Changes == nil {
+		review.Changes = []Change{}
+	}
+	if review.Diagnostics == nil {
+		review.Diagnostics = Diagnostics{}
+	}
+
+	known := make(map[string]bool)
+	for _, d := range ValidateAccessSystem(live) {
+		known[d.String()] = true
+	}
+	for _, d := range review.Diagnostics {
+		if d.Severity == SeverityError && !known[d.String()] {
+			review.NewErrors = append(review.NewErrors, d)
+		}
+	}
+
+	if suite != nil {
+		results, err := RunPolicyTests(acs, suite)
+		if err != nil {
+			return review, err
+		}
+		for _, result := range results {
+			review.Tests = append(review.Tests, result.String())
+			if !result.Passed() {
+				review.Failures++
+			}
+		}
+	}
+	return review, nil
+}
@@ -0,0 +1,96 @@
+package fauth_test
+
+import (
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestDraftEdits(t *testing.T) {
+	draft := &fauth.Draft{Name: "widgets-v2", Checks: versionedAccess(1).Checks}
+	if err := draft.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "../access", ".hidden", strings.Repeat("x", 65)} {
+		if err := (fauth.Draft{Name: name}).Validate(); err == nil {
+			t.Errorf("got no error for draft name '%s'", name)
+		}
+	}
+
+	draft.SetHostGroup(fauth.HostGroup{Name: "Web Hosts", Hosts: []string{"app.example.com"}, Default: "allow"})
+	if err := draft.SetCheck("Web Hosts", fauth.Check{Name: "app", Base: "/app"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := draft.SetCheck("API Hosts", fauth.Check{Name: "widgets-api", Base: "/widgets-api/v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := draft.SetCheck("Other Hosts", fauth.Check{Name: "app"}); err == nil {
+		t.Error("got no error setting a check of a missing host group")
+	}
+	groups := draft.Checks.HostGroups
+	if len(groups) != 2 || len(groups[0].Checks) != 1 || groups[0].Checks[0].Base != "/widgets-api/v2" || len(groups[1].Checks) != 1 {
+		t.Fatalf("got host groups %+v after edits", groups)
+	}
+
+	if err := draft.RemoveCheck("API Hosts", "widgets-api"); err != nil {
+		t.Fatal(err)
+	}
+	if err := draft.RemoveCheck("API Hosts", "widgets-api"); err == nil {
+		t.Error("got no error removing a missing check")
+	}
+	if err := draft.RemoveHostGroup("Web Hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := draft.RemoveHostGroup("Web Hosts"); err == nil {
+		t.Error("got no error removing a missing host group")
+	}
+	if groups := draft.Checks.HostGroups; len(groups) != 1 || len(groups[0].Checks) != 0 {
+		t.Errorf("got host groups %+v after removals", groups)
+	}
+
+	// the editor of a revision cannot approve it
+	draft.UpdateUser = "admin-1"
+	if err := draft.CanApprove("admin-1"); err == nil {
+		t.Error("got no error for approval by the editor")
+	}
+	if err := draft.CanApprove("admin-2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewDraft(t *testing.T) {
+	auth := newTestAuth(t, versionedAccess(1))
+	suite := &fauth.PolicyTestSuite{Cases: []fauth.PolicyTestCase{
+		{Name: "app reads widget", Host: "apis.example.com", Method: "GET", URI: "/widgets-api/v1/widgets/w-1", Bearer: "APP_KEY_1", Want: 200},
+	}}
+
+	// a draft that keeps the live host checks changes nothing and passes its tests
+	draft := &fauth.Draft{Name: "noop", Revision: 2, Checks: versionedAccess(1).Checks}
+	review, err := auth.ReviewDraft(draft, versionedAccess(1), suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(review.Changes) != 0 || len(review.NewErrors) != 0 || review.Failures != 0 || len(review.Tests) != 1 {
+		t.Errorf("got review %+v of unchanged draft", review)
+	}
+	if err := review.Publishable(); err != nil {
+		t.Error(err)
+	}
+
+	// a draft whose rule references an undefined token introduces an error and fails its test
+	acs := versionedAccess(1)
+	acs.Checks.HostGroups[0].Checks[0].Paths[0].Rules["GET"] = fauth.Rule{Expression: "bearer('APP_KEY_2')"}
+	draft = &fauth.Draft{Name: "broken", Revision: 3, Checks: acs.Checks}
+	review, err = auth.ReviewDraft(draft, acs, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(review.Changes) == 0 || len(review.NewErrors) != 1 || review.Failures != 1 {
+		t.Fatalf("got review %+v of broken draft", review)
+	}
+	err = review.Publishable()
+	if err == nil || !strings.Contains(err.Error(), "1 new validation errors and 1 failed policy tests") {
+		t.Errorf("got publishable error %v", err)
+	}
+}
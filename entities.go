@@ -61,6 +61,12 @@ type PrivateKey struct {
 	Value  string `json:"value,omitempty"`
 }
 
+type Secret struct {
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+}
+
 type Token struct {
 	Source string `json:"source"`
 	Name   string `json:"name"`
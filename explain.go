@@ -0,0 +1,343 @@
+package fauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/eval"
+	"bitbucket.org/_metalogic_/pat"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// traceHeader is set by Check on the request header passed to the host muxer to identify the
+// tracer of an explained decision; incoming copies are removed before evaluation
+const traceHeader = "X-Forward-Auth-Trace"
+
+// Explanation is the trace of a decision made by Explain:
+//   - Mode is the run mode of the host and Unenforced the status of a denial allowed by the
+//     permissive run mode
+//   - Block and Override are the blocked subject and the host override that decided, if any
+//   - HostGroup and Default are the host group of the host and its default decision
+//   - Check, Prefix and Pattern are the check, base path and path pattern that matched, and
+//     Params the captured path parameters merged with the query parameters
+//   - Rule, Expression and MustAuth describe the rule that decided
+//   - JWT describes the validation of the request JWT, if present
+//   - Calls are the builtin calls made by the rule expression in order, with their results
+//   - Terms are the sub-expressions of the rule expression with their values; a term that was
+//     skipped by short-circuit evaluation is not evaluated
+//   - Token and Credentials are the bearer token name and the credential types verified in an
+//     allowed request
+type Explanation struct {
+	Host        string              `json:"host"`
+	Method      string              `json:"method"`
+	URI         string              `json:"uri"`
+	Status      int                 `json:"status"`
+	Message     string              `json:"message"`
+	Mode        string              `json:"mode"`
+	Unenforced  int                 `json:"unenforced,omitempty"`
+	Block       string              `json:"block,omitempty"`
+	Override    string              `json:"override,omitempty"`
+	HostGroup   string              `json:"hostGroup,omitempty"`
+	Default     string              `json:"default,omitempty"`
+	Check       string              `json:"check,omitempty"`
+	Prefix      string              `json:"prefix,omitempty"`
+	Pattern     string              `json:"pattern,omitempty"`
+	Params      map[string][]string `json:"params,omitempty"`
+	Rule        string              `json:"rule,omitempty"`
+	Expression  string              `json:"expression,omitempty"`
+	MustAuth    bool                `json:"mustAuth,omitempty"`
+	JWT         *JWTTrace           `json:"jwt,omitempty"`
+	Calls       []CallTrace         `json:"calls,omitempty"`
+	Terms       []TermTrace         `json:"terms,omitempty"`
+	Token       string              `json:"token,omitempty"`
+	Credentials []string            `json:"credentials,omitempty"`
+}
+
+// JWTTrace describes the request JWT; the claims are read without verification so that the
+// identity of an invalid JWT is shown along with the reason it is invalid
+type JWTTrace struct {
+	Algorithm   string              `json:"alg"`
+	Valid       bool                `json:"valid"`
+	Error       string              `json:"error,omitempty"`
+	UID         string              `json:"uid,omitempty"`
+	Tenant      string              `json:"tenant,omitempty"`
+	Superuser   bool                `json:"superuser,omitempty"`
+	ExpiresAt   *time.Time          `json:"expiresAt,omitempty"`
+	Permissions map[string][]string `json:"permissions,omitempty"`
+}
+
+// CallTrace is a builtin call made during the evaluation of a rule expression
+type CallTrace struct {
+	Function string        `json:"function"`
+	Args     []interface{} `json:"args"`
+	Result   interface{}   `json:"result"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// TermTrace is a sub-expression of a rule expression and its value
+type TermTrace struct {
+	Expression string      `json:"expression"`
+	Evaluated  bool        `json:"evaluated"`
+	Value      interface{} `json:"value,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Explain decides the forwarded request method host uri with header as Check does and returns
+// the decision with a trace of how it was reached
+func (auth *Auth) Explain(host, method, uri string, header http.Header) *Explanation {
+	t := &tracer{
+		explanation: &Explanation{Host: host, Method: method, URI: uri},
+		results:     make(map[string]callResult),
+	}
+	if jwt := header.Get(auth.jwtHeader); jwt != "" {
+		t.explanation.JWT = auth.traceJWT(jwt)
+	}
+
+	decision := auth.check(auth.current(), host, method, uri, header, t, nil, auth.decisionCallouts(false))
+
+	e := t.explanation
+	e.Status = decision.Status
+	e.Message = decision.Message
+	e.Unenforced = decision.Unenforced
+	e.Rule = decision.Rule
+	e.Token = decision.Token
+	e.Credentials = decision.Credentials
+	return e
+}
+
+// tracer records the trace of an explained decision; builtin results are recorded so that
+// the terms of the rule expression can be replayed without calling builtins again
+type tracer struct {
+	explanation *Explanation
+	results     map[string]callResult
+	replay      bool
+}
+
+type callResult struct {
+	value interface{}
+	err   error
+}
+
+// errNotEvaluated is returned by a replayed builtin call that was not made in the evaluation
+var errNotEvaluated = errors.New("not evaluated")
+
+// traced wraps the builtin name to record its calls when the decision is explained
+func traced(name string, f eval.ExpressionFunction) eval.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) > 0 {
+			if ctx, ok := args[0].(*evalContext); ok && ctx.tracer != nil {
+				return ctx.tracer.call(name, f, args)
+			}
+		}
+		return f(args...)
+	}
+}
+
+func (t *tracer) call(name string, f eval.ExpressionFunction, args []interface{}) (interface{}, error) {
+	callArgs := append([]interface{}{}, args[1:]...)
+	key := fmt.Sprintf("%s%v", name, callArgs)
+	if t.replay {
+		if r, ok := t.results[key]; ok {
+			return r.value, r.err
+		}
+		return nil, errNotEvaluated
+	}
+
+	value, err := f(args...)
+	t.results[key] = callResult{value, err}
+	c := CallTrace{Function: name, Args: callArgs, Result: value}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	t.explanation.Calls = append(t.explanation.Calls, c)
+	return value, err
+}
+
+// route records where a rule handler is registered in the host checks
+type route struct {
+	check   string
+	prefix  string
+	pattern string
+	rule    *Rule
+}
+
+// traceOf returns the tracer identified by the trace header of a request or nil
+func (auth *Auth) traceOf(header http.Header) *tracer {
+	id := header.Get(traceHeader)
+	if id == "" {
+		return nil
+	}
+	if t, ok := auth.traces.Load(id); ok {
+		return t.(*tracer)
+	}
+	return nil
+}
+
+// traceRoute wraps handler to record route r in the decision and in the trace of an explained
+// decision
+func (auth *Auth) traceRoute(r route, handler pat.HandlerFunc) pat.HandlerFunc {
+	return func(method, path string, params map[string][]string, header http.Header) (status int, message, username string) {
+		header.Set(checkHeader, r.check)
+		header.Set(pathHeader, r.prefix+r.pattern)
+		if t := auth.traceOf(header); t != nil {
+			e := t.explanation
+			e.Check, e.Prefix, e.Pattern = r.check, r.prefix, r.pattern
+			if len(params) > 0 {
+				e.Params = params
+			}
+			if r.rule != nil {
+				e.Expression, e.MustAuth = r.rule.Expression, r.rule.MustAuth
+			}
+		}
+		return handler(method, path, params, header)
+	}
+}
+
+// terms records the value of each sub-expression of expr by replaying its builtin calls in ctx
+func (t *tracer) terms(expr string, ctx *evalContext) {
+	parsed, err := eval.NewEvaluableExpressionWithFunctions(expr, stubs)
+	if err != nil {
+		return
+	}
+
+	t.replay = true
+	defer func() { t.replay = false }()
+
+	for _, term := range subExpressions(parsed.Tokens()) {
+		trace := TermTrace{Expression: render(term)}
+		tokens := make([]eval.ExpressionToken, len(term))
+		for i, token := range term {
+			if token.Kind == eval.FUNCTION {
+				token.Value = builtins[functionName(term, i)]
+			}
+			tokens[i] = token
+		}
+		expression, err := compileTokens(tokens)
+		if err == nil {
+			trace.Value, err = expression.Eval(ctx)
+		}
+		switch {
+		case errors.Is(err, errNotEvaluated):
+			trace.Value = nil
+		case err != nil:
+			trace.Evaluated, trace.Error = true, err.Error()
+		default:
+			trace.Evaluated = true
+		}
+		t.explanation.Terms = append(t.explanation.Terms, trace)
+	}
+}
+
+// subExpressions returns the operands of the logical operators of an expression and,
+// recursively, the sub-expressions of its parenthesized and negated operands
+func subExpressions(tokens []eval.ExpressionToken) (terms [][]eval.ExpressionToken) {
+	var operands [][]eval.ExpressionToken
+	depth, start := 0, 0
+	for i, token := range tokens {
+		switch token.Kind {
+		case eval.CLAUSE:
+			depth++
+		case eval.CLAUSE_CLOSE:
+			depth--
+		case eval.LOGICALOP:
+			if depth == 0 {
+				operands = append(operands, tokens[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if len(operands) == 0 {
+		// a single operand has sub-expressions only if it is parenthesized or negated
+		inner := unwrap(tokens)
+		if len(inner) == len(tokens) {
+			return nil
+		}
+		if tokens[0].Kind == eval.PREFIX {
+			terms = append(terms, inner)
+		}
+		return append(terms, subExpressions(inner)...)
+	}
+
+	operands = append(operands, tokens[start:])
+	for _, operand := range operands {
+		terms = append(terms, operand)
+		terms = append(terms, subExpressions(operand)...)
+	}
+	return terms
+}
+
+// unwrap strips a negation and the parentheses enclosing a whole expression
+func unwrap(tokens []eval.ExpressionToken) []eval.ExpressionToken {
+	for len(tokens) > 0 {
+		switch {
+		case tokens[0].Kind == eval.PREFIX && tokens[0].Value == "!":
+			tokens = tokens[1:]
+		case tokens[0].Kind == eval.CLAUSE && closes(tokens, 0) == len(tokens)-1:
+			tokens = tokens[1 : len(tokens)-1]
+		default:
+			return tokens
+		}
+	}
+	return tokens
+}
+
+// render returns the source of parsed expression tokens
+func render(tokens []eval.ExpressionToken) string {
+	var b strings.Builder
+	for i, token := range tokens {
+		switch token.Kind {
+		case eval.FUNCTION:
+			b.WriteString(functionName(tokens, i))
+		case eval.STRING:
+			fmt.Fprintf(&b, "'%v'", token.Value)
+		case eval.CLAUSE:
+			b.WriteString("(")
+		case eval.CLAUSE_CLOSE:
+			b.WriteString(")")
+		case eval.SEPARATOR:
+			b.WriteString(", ")
+		case eval.COMPARATOR, eval.LOGICALOP, eval.MODIFIER, eval.TERNARY:
+			fmt.Fprintf(&b, " %v ", token.Value)
+		default:
+			fmt.Fprintf(&b, "%v", token.Value)
+		}
+	}
+	return b.String()
+}
+
+// traceJWT describes jwt and the result of its validation
+func (auth *Auth) traceJWT(token string) *JWTTrace {
+	t := &JWTTrace{}
+	if _, err := jwtIdentity(token, auth); err != nil {
+		t.Error = err.Error()
+	} else {
+		t.Valid = true
+	}
+
+	claims := &struct {
+		Identity *Identity `json:"identity"`
+		jwt.RegisteredClaims
+	}{}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return t
+	}
+	t.Algorithm = parsed.Method.Alg()
+	if claims.ExpiresAt != nil {
+		expires := claims.ExpiresAt.Time
+		t.ExpiresAt = &expires
+	}
+	if id := claims.Identity; id != nil {
+		t.UID = id.UserID()
+		t.Tenant = id.TenantID()
+		t.Superuser = id.Superuser
+		if len(id.UserPermissions) > 0 {
+			t.Permissions = permissionSummary(id.UserPermissions)
+		}
+	}
+	return t
+}
@@ -0,0 +1,176 @@
+package fauth_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestExplainRoute(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer reports-token-value")
+	e := auth.Explain("apis.example.com", "GET", "/reports-api/v1/reports/2019/06", header)
+
+	if e.Status != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", e.Status, http.StatusForbidden)
+	}
+	if e.HostGroup != "API Hosts" || e.Default != "deny" {
+		t.Errorf("got host group %s default %s", e.HostGroup, e.Default)
+	}
+	if e.Check != "reports-api" || e.Prefix != "/reports-api/v1" || e.Pattern != "/reports/:year/:month" {
+		t.Errorf("got check %s prefix %s pattern %s", e.Check, e.Prefix, e.Pattern)
+	}
+	if got := e.Params[":year"]; len(got) != 1 || got[0] != "2019" {
+		t.Errorf("got param :year %v, want 2019", got)
+	}
+	if e.Rule != "reports-api GET /reports-api/v1/reports/:year/:month" {
+		t.Errorf("got rule %s", e.Rule)
+	}
+	if e.Expression != "bearer('REPORTS_APP_KEY') && param(':year') >= '2020'" {
+		t.Errorf("got expression %s", e.Expression)
+	}
+
+	wantCalls := []fauth.CallTrace{
+		{Function: "bearer", Args: []interface{}{"REPORTS_APP_KEY"}, Result: true},
+		{Function: "param", Args: []interface{}{":year"}, Result: "2019"},
+	}
+	if !reflect.DeepEqual(e.Calls, wantCalls) {
+		t.Errorf("got calls %+v, want %+v", e.Calls, wantCalls)
+	}
+	wantTerms := []fauth.TermTrace{
+		{Expression: "bearer('REPORTS_APP_KEY')", Evaluated: true, Value: true},
+		{Expression: "param(':year') >= '2020'", Evaluated: true, Value: false},
+	}
+	if !reflect.DeepEqual(e.Terms, wantTerms) {
+		t.Errorf("got terms %+v, want %+v", e.Terms, wantTerms)
+	}
+	if header.Get("X-Forward-Auth-Trace") != "" {
+		t.Errorf("trace header left on request")
+	}
+}
+
+func TestExplainShortCircuit(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	header := http.Header{}
+	header.Set(jwtHeader, testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-1")}))
+	e := auth.Explain("apis.example.com", "GET", "/widgets-api/v1/users/user-1/widgets", header)
+
+	if e.Status != http.StatusOK || !e.MustAuth {
+		t.Errorf("got status %d mustAuth %t", e.Status, e.MustAuth)
+	}
+	if e.JWT == nil || !e.JWT.Valid || e.JWT.Algorithm != "HS256" || e.JWT.UID != "user-1" || e.JWT.ExpiresAt == nil {
+		t.Errorf("got JWT trace %+v", e.JWT)
+	}
+	wantTerms := []fauth.TermTrace{
+		{Expression: "user(param(':uid'))", Evaluated: true, Value: true},
+		{Expression: "role('READ', 'WIDGETS')", Evaluated: false},
+	}
+	if !reflect.DeepEqual(e.Terms, wantTerms) {
+		t.Errorf("got terms %+v, want %+v", e.Terms, wantTerms)
+	}
+	if len(e.Calls) != 2 || e.Calls[0].Function != "param" || e.Calls[1].Function != "user" {
+		t.Errorf("got calls %+v", e.Calls)
+	}
+}
+
+func TestExplainInvalidJWT(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	header := http.Header{}
+	header.Set(jwtHeader, testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-1")})+"x")
+	e := auth.Explain("apis.example.com", "POST", "/widgets-api/v1/widgets", header)
+
+	if e.Status != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", e.Status, http.StatusUnauthorized)
+	}
+	if e.JWT == nil || e.JWT.Valid || e.JWT.Error == "" || e.JWT.UID != "user-1" {
+		t.Errorf("got JWT trace %+v", e.JWT)
+	}
+}
+
+func TestExplainNestedTerms(t *testing.T) {
+	auth := newTestAuth(t, &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:  "API Hosts",
+					Hosts: []string{"apis.example.com"},
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path: "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{
+										"GET": {Expression: "(bearer('ROOT_KEY') || bearer('MC_APP_KEY')) && !(param('debug') == 'true')"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token-value")
+	e := auth.Explain("apis.example.com", "GET", "/widgets-api/v1/widgets?debug=false", header)
+
+	if e.Status != http.StatusOK {
+		t.Errorf("got status %d, want %d", e.Status, http.StatusOK)
+	}
+	wantTerms := []fauth.TermTrace{
+		{Expression: "(bearer('ROOT_KEY') || bearer('MC_APP_KEY'))", Evaluated: true, Value: true},
+		{Expression: "bearer('ROOT_KEY')", Evaluated: true, Value: false},
+		{Expression: "bearer('MC_APP_KEY')", Evaluated: true, Value: true},
+		{Expression: "!(param('debug') == 'true')", Evaluated: true, Value: true},
+		{Expression: "param('debug') == 'true'", Evaluated: true, Value: false},
+	}
+	if !reflect.DeepEqual(e.Terms, wantTerms) {
+		t.Errorf("got terms %+v, want %+v", e.Terms, wantTerms)
+	}
+}
+
+func TestExplainBlocksAndOverrides(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	header := http.Header{}
+	header.Set(jwtHeader, testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-1")}))
+	auth.Block("user-1")
+	e := auth.Explain("apis.example.com", "GET", "/widgets-api/v1/users/user-1/widgets", header)
+	if e.Status != http.StatusForbidden || e.Block != "user-1" || e.Rule != "block" {
+		t.Errorf("got status %d block %s rule %s", e.Status, e.Block, e.Rule)
+	}
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/users/user-1/widgets", header); d.Status != http.StatusForbidden {
+		t.Errorf("Check of blocked user got status %d", d.Status)
+	}
+	auth.Unblock("user-1")
+
+	header = http.Header{}
+	header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	auth.Block("10.0.0.1")
+	if e := auth.Explain("www.example.com", "GET", "/", header); e.Status != http.StatusForbidden || e.Block != "10.0.0.1" {
+		t.Errorf("got status %d block %s", e.Status, e.Block)
+	}
+	auth.Unblock("10.0.0.1")
+
+	acs := &fauth.AccessSystem{
+		Checks: &fauth.HostChecks{
+			Overrides:  map[string]string{"www.example.com": "deny"},
+			HostGroups: []fauth.HostGroup{{Name: "No Auth Application Hosts", Hosts: []string{"www.example.com"}, Default: "allow"}},
+		},
+	}
+	auth = newTestAuth(t, acs)
+	e = auth.Explain("www.example.com", "GET", "/", http.Header{})
+	if e.Status != http.StatusForbidden || e.Override != "deny" || e.HostGroup != "No Auth Application Hosts" {
+		t.Errorf("got status %d override %s host group %s", e.Status, e.Override, e.HostGroup)
+	}
+}
@@ -0,0 +1,327 @@
+package fauth
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/_metalogic_/config"
+	"bitbucket.org/_metalogic_/eval"
+	"bitbucket.org/_metalogic_/httpsig"
+	"bitbucket.org/_metalogic_/ident"
+	"bitbucket.org/_metalogic_/log"
+)
+
+// contextParameter is the name of the parameter that binds the evaluation context of a
+// request; compile passes it as the first argument of every builtin call
+const contextParameter = "__ctx"
+
+// evalContext binds the request-scoped data used by builtins during the evaluation of a rule:
+//   - params are the path and query parameters of the request
+//   - credentials carry the bearer token and JWT if present
+//   - verifier and messageVerifier verify draft-cavage and RFC 9421 signatures if present
+//   - cert is the client certificate forwarded by Traefik, parsed and verified on first use
+//   - verified records the types of credential verified by builtins
+//   - tracer records builtin calls when the decision is explained
+//   - span is the span of the rule evaluation when the decision is traced
+type evalContext struct {
+	snap            *snapshot
+	params          map[string][]string
+	credentials     *ident.Credentials
+	verifier        httpsig.Verifier
+	messageVerifier *RFC9421Verifier
+	cert            *clientCert
+	verified        map[string]bool
+	tracer          *tracer
+	span            *Span
+	callouts        *callouts
+}
+
+// Get implements eval.Parameters returning the evaluation context or a request parameter
+func (ctx *evalContext) Get(name string) (interface{}, error) {
+	if name == contextParameter {
+		return ctx, nil
+	}
+	if v, ok := ctx.params[name]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("no parameter '%s' found", name)
+}
+
+// builtin adapts a builtin taking an evaluation context to an eval.ExpressionFunction
+func builtin(f func(ctx *evalContext, args ...interface{}) (interface{}, error)) eval.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return false, fmt.Errorf("builtin called without evaluation context")
+		}
+		ctx, ok := args[0].(*evalContext)
+		if !ok {
+			return false, fmt.Errorf("builtin called without evaluation context")
+		}
+		return f(ctx, args[1:]...)
+	}
+}
+
+// builtins are the functions available in rule expressions
+var builtins map[string]eval.ExpressionFunction
+
+func init() {
+	builtins = map[string]eval.ExpressionFunction{
+		// return true if call to URL returns HTTP status 200 ok
+		// eg: allow(action, user, "sources/{sid}", "https://example.com/check")
+		// action is one of HEAD (should we call this EXISTS?), CREATE, READ, UPDATE, DELETE
+		"allow": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			// the results of the callouts of a live decision are replayed by its shadow decision
+			return ctx.callouts.call(args, func() (interface{}, error) {
+				return allow(ctx, args...)
+			})
+		}),
+		// return true if the value of one of the bearer tokens is valid in the environment
+		// eg: bearer('ROOT_KEY', 'MC_APP_KEY' ...)
+		"bearer": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			if ctx.credentials.Token == "" {
+				return false, nil
+			}
+			var tokens []string
+			for _, arg := range args {
+				tokens = append(tokens, arg.(string))
+			}
+			log.Debugf("calling bearer(%v)", tokens)
+			ok := ctx.snap.checkBearer(ctx.credentials.Token, tokens...)
+			ctx.verified[CredentialBearer] = ctx.verified[CredentialBearer] || ok
+			return ok, nil
+		}),
+		// return the binding of a path or query parameter
+		// eg: param(':tenantID'), param('summary')
+		"param": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			param := args[0].(string)
+			log.Debugf("calling param(%s)", param)
+			if v, ok := ctx.params[param]; ok {
+				return v[0], nil
+			}
+			return "", nil
+		}),
+		// return true if identity has role permission in tenant
+		// eg: role('INSTITUTION','CREATE'),
+		// role(param(':context'), 'CONTENT','CREATE') etc
+		"role": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			var (
+				context  string
+				action   string
+				category string
+			)
+			if len(args) == 2 {
+				context = ALL // default if not provided
+				action = args[0].(string)
+				category = args[1].(string)
+			} else if len(args) == 3 {
+				context = args[0].(string)
+				action = args[1].(string)
+				category = args[2].(string)
+			} else {
+				return false, fmt.Errorf("function role takes 2 or 3 arguments")
+			}
+
+			log.Debugf("calling role(%s,%s,%s)", context, action, category)
+			return ctx.snap.checkJWT(ctx.credentials.JWT, context, action, category), nil
+		}),
+		// return true if identity has root permission
+		"root": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			log.Debug("calling Superuser()")
+			return ctx.snap.superuser(ctx.credentials.JWT), nil
+		}),
+		"classification": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			log.Debug("calling classification()")
+			return ctx.snap.auth.Classification(ctx.credentials.JWT), nil
+		}),
+		// return true if a request signed with tenant's private key is valid
+		// with respect to tenant's public key; the optional mode selects the
+		// signature format: 'cavage' (default), 'rfc9421' or 'any'
+		// eg: signature(param(':tenantID')), signature(param(':tenantID'), 'any')
+		"signature": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			if len(args) < 1 || len(args) > 2 {
+				return false, fmt.Errorf("function signature takes 1 or 2 arguments")
+			}
+			tenantID, _ := args[0].(string)
+			mode := SignatureCavage
+			if len(args) == 2 {
+				mode, _ = args[1].(string)
+			}
+			log.Debugf("calling signature(%s, %s)", tenantID, mode)
+			ok := verifySignature(mode, ctx.verifier, ctx.messageVerifier, tenantID, ctx.snap.publicKeys)
+			ctx.verified[CredentialSignature] = ctx.verified[CredentialSignature] || ok
+			return ok, nil
+		}),
+		// return true if the request carries a client certificate that verifies against
+		// the named CA bundle, or against any configured bundle if none is named
+		// eg: cert(), cert('internal')
+		"cert": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			bundle, err := bundleArg("cert", args, 0)
+			if err != nil {
+				return false, err
+			}
+			log.Debugf("calling cert(%s)", bundle)
+			if _, err := ctx.cert.leaf(ctx.snap, bundle); err != nil {
+				log.Debugf("client certificate rejected: %s", err)
+				return false, nil
+			}
+			ctx.verified[CredentialCertificate] = true
+			return true, nil
+		}),
+		// return true if the verified client certificate subject has all the given attributes
+		// eg: certsubject('CN=billing'), certsubject('CN=billing,O=Acme', 'internal')
+		"certsubject": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			spec, bundle, err := certArgs("certsubject", args)
+			if err != nil {
+				return false, err
+			}
+			log.Debugf("calling certsubject(%s, %s)", spec, bundle)
+			leaf, err := ctx.cert.leaf(ctx.snap, bundle)
+			if err != nil {
+				log.Debugf("client certificate rejected: %s", err)
+				return false, nil
+			}
+			ok, err := matchName(leaf.Subject, spec)
+			ctx.verified[CredentialCertificate] = ctx.verified[CredentialCertificate] || ok
+			return ok, err
+		}),
+		// return true if the verified client certificate has the given subject alternative name; a
+		// wildcard matches a single DNS label, while a wildcard SAN of the certificate matches only itself
+		// eg: certsan('billing.svc.internal'), certsan('*.svc.internal'), certsan('spiffe://cluster.local/ns/apis/sa/billing')
+		"certsan": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			name, bundle, err := certArgs("certsan", args)
+			if err != nil {
+				return false, err
+			}
+			log.Debugf("calling certsan(%s, %s)", name, bundle)
+			leaf, err := ctx.cert.leaf(ctx.snap, bundle)
+			if err != nil {
+				log.Debugf("client certificate rejected: %s", err)
+				return false, nil
+			}
+			ok := matchSAN(leaf, name)
+			ctx.verified[CredentialCertificate] = ctx.verified[CredentialCertificate] || ok
+			return ok, nil
+		}),
+		// return true if the verified client certificate issuer has all the given attributes
+		// eg: certissuer('CN=Internal Issuing CA')
+		"certissuer": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			spec, bundle, err := certArgs("certissuer", args)
+			if err != nil {
+				return false, err
+			}
+			log.Debugf("calling certissuer(%s, %s)", spec, bundle)
+			leaf, err := ctx.cert.leaf(ctx.snap, bundle)
+			if err != nil {
+				log.Debugf("client certificate rejected: %s", err)
+				return false, nil
+			}
+			ok, err := matchName(leaf.Issuer, spec)
+			ctx.verified[CredentialCertificate] = ctx.verified[CredentialCertificate] || ok
+			return ok, err
+		}),
+		// return the subdomain of the request
+		"subdomain": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			log.Debugf("calling subdomain()")
+			return "TODO", nil
+		}),
+		// return true if identity matches the user UUID in path
+		// eg: user(param(':uuid'))
+		"user": builtin(func(ctx *evalContext, args ...interface{}) (interface{}, error) {
+			uuid, _ := args[0].(string)
+			log.Debugf("calling user(%s)", uuid)
+			return strings.EqualFold(ctx.snap.auth.User(ctx.credentials.JWT), uuid), nil
+		}),
+	}
+
+	for name, f := range builtins {
+		builtins[name] = traced(name, f)
+	}
+}
+
+// allow returns true if a POST of the action, user and resource to the URL route returns 200 OK
+func allow(ctx *evalContext, args ...interface{}) (interface{}, error) {
+	action, _ := args[0].(string)
+	uid, _ := args[1].(string)
+	rid, _ := args[2].(string)
+	route, _ := args[3].(string)
+	log.Debugf("checking user %s for access to resource '%s' at URL %s", uid, rid, route)
+
+	body := []byte(fmt.Sprintf(`{ "action": "%s", "user": "%s", "resource": "%s"}`, action, uid, rid))
+	key := config.MustGetConfig("ROOT_KEY")
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", route, bytes.NewBuffer(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	// the callout continues the trace of the decision
+	span := ctx.span.Child("allow", SpanClient)
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", route)
+	if span != nil {
+		span.Context().Inject(req.Header)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		span.SetError(err)
+		return false, err
+	}
+	resp.Body.Close()
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
+	if resp.StatusCode != 200 {
+		span.SetError(fmt.Errorf(resp.Status))
+		return false, fmt.Errorf(resp.Status)
+	}
+
+	return true, nil
+}
+
+// compile parses expr once into an expression evaluated against an evalContext; each
+// builtin call is rewritten to take the context parameter as its first argument
+func compile(expr string) (*eval.EvaluableExpression, error) {
+	parsed, err := eval.NewEvaluableExpressionWithFunctions(expr, builtins)
+	if err != nil {
+		return nil, err
+	}
+	return compileTokens(parsed.Tokens())
+}
+
+// compileTokens rewrites the builtin calls of parsed expression tokens to take the context parameter
+func compileTokens(parsedTokens []eval.ExpressionToken) (*eval.EvaluableExpression, error) {
+	// the parser guarantees that a function is followed by its opening parenthesis
+	tokens := make([]eval.ExpressionToken, 0, len(parsedTokens)+8)
+	for i := 0; i < len(parsedTokens); i++ {
+		tokens = append(tokens, parsedTokens[i])
+		if parsedTokens[i].Kind != eval.FUNCTION || i+1 >= len(parsedTokens) {
+			continue
+		}
+		i++
+		tokens = append(tokens, parsedTokens[i], eval.ExpressionToken{Kind: eval.VARIABLE, Value: contextParameter})
+		if i+1 < len(parsedTokens) && parsedTokens[i+1].Kind != eval.CLAUSE_CLOSE {
+			tokens = append(tokens, eval.ExpressionToken{Kind: eval.SEPARATOR, Value: ","})
+		}
+	}
+	return eval.NewEvaluableExpressionFromTokens(tokens)
+}
+
+// evaluate evaluates a compiled rule expression in ctx
+func evaluate(expression *eval.EvaluableExpression, ctx *evalContext) (result bool, err error) {
+	log.Debugf("evaluating expression %s with params %v", expression, ctx.params)
+	val, err := expression.Eval(ctx)
+	if err != nil {
+		log.Error(err)
+		return result, err
+	}
+	result, ok := val.(bool)
+	if !ok {
+		return result, fmt.Errorf("expression '%s' evaluated to %v not a boolean", expression, val)
+	}
+	return result, nil
+}
@@ -0,0 +1,180 @@
+package fauth_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// loadAccessSystem returns an Auth for the access system in testdata/access.json
+func loadAccessSystem(t testing.TB) *fauth.Auth {
+	data, err := ioutil.ReadFile("testdata/access.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs := &fauth.AccessSystem{}
+	if err := json.Unmarshal(data, acs); err != nil {
+		t.Fatal(err)
+	}
+	return newTestAuth(t, acs)
+}
+
+func TestHandlerCompileError(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       string
+	}{
+		{"syntax error", "bearer('MC_APP_KEY' ||", "invalid expression"},
+		{"unknown function", "superuser('MC_APP_KEY')", "Undefined function"},
+		{"unbalanced parentheses", "(role('READ', 'WIDGETS')", "invalid expression"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fauth.Handler(fauth.Rule{Name: "widgets", Expression: tt.expression}, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Handler(%s) error = %v, want %s", tt.expression, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidExpressionFailsLoad(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	acs := &fauth.AccessSystem{
+		Tokens: map[string]string{},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com"},
+					Default: "allow",
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path:  "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "role('READ', "}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if _, err := fauth.NewAuth(acs, jwtHeader, nil, []byte("secret")); err == nil {
+		t.Error("NewAuth() with invalid expression succeeded, want error")
+	}
+
+	// a failed update leaves the current host checks in place
+	if err := auth.UpdateFunc()(acs); err == nil {
+		t.Fatal("update with invalid expression succeeded, want error")
+	}
+	decision := auth.Check("apis.example.com", "GET", "/example-api/v1/info", http.Header{"Authorization": []string{"Bearer root-token-value"}})
+	if decision.Status != http.StatusOK {
+		t.Errorf("Check() after failed update = %d, want 200: %s", decision.Status, decision.Message)
+	}
+}
+
+func TestCompiledExpressions(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	reader := testJWT(t, &fauth.Identity{
+		TID: strptr("tenant-1"),
+		UID: strptr("user-1"),
+		UserPermissions: []fauth.UserPermission{
+			{Context: fauth.ALL, Permissions: []fauth.Permission{{Category: "WIDGETS", Actions: []string{"READ"}}}},
+		},
+	})
+	other := testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-2")})
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": []string{"Bearer " + token}}
+	}
+	user := func(jwt string) http.Header {
+		return http.Header{http.CanonicalHeaderKey(jwtHeader): []string{jwt}}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		header http.Header
+		want   int
+	}{
+		{"literal", "GET", "/example-api/v1/health", http.Header{}, http.StatusOK},
+		{"bearer", "GET", "/example-api/v1/info", bearer("root-token-value"), http.StatusOK},
+		{"wrong bearer", "GET", "/example-api/v1/info", bearer("app-token-value"), http.StatusForbidden},
+		{"variadic bearer", "GET", "/widgets-api/v1/widgets", bearer("reports-token-value"), http.StatusOK},
+		{"role", "GET", "/widgets-api/v1/widgets/42", user(reader), http.StatusOK},
+		{"missing role", "PUT", "/widgets-api/v1/widgets/42", user(reader), http.StatusForbidden},
+		{"nested param", "GET", "/widgets-api/v1/users/user-2/widgets", user(other), http.StatusOK},
+		{"nested param mismatch", "GET", "/widgets-api/v1/users/user-1/widgets", user(other), http.StatusForbidden},
+		{"comparison", "GET", "/reports-api/v1/reports/2023/01", bearer("reports-token-value"), http.StatusOK},
+		{"failed comparison", "GET", "/reports-api/v1/reports/2019/01", bearer("reports-token-value"), http.StatusForbidden},
+		{"no arguments", "DELETE", "/widgets-api/v1/widgets/42", user(reader), http.StatusForbidden},
+		{"not found", "GET", "/widgets-api/v1/gadgets", bearer("app-token-value"), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := auth.Check("apis.example.com", tt.method, tt.uri, tt.header)
+			if decision.Status != tt.want {
+				t.Errorf("Check(%s %s) = %d, want %d: %s", tt.method, tt.uri, decision.Status, tt.want, decision.Message)
+			}
+		})
+	}
+}
+
+func BenchmarkHostMuxCheck(b *testing.B) {
+	auth := loadAccessSystem(b)
+	mux, err := auth.Muxer("apis.example.com")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	reader := testJWT(b, &fauth.Identity{
+		TID: strptr("tenant-1"),
+		UID: strptr("user-1"),
+		UserPermissions: []fauth.UserPermission{
+			{Context: fauth.ALL, Permissions: []fauth.Permission{{Category: "WIDGETS", Actions: []string{"READ"}}}},
+		},
+	})
+
+	benchmarks := []struct {
+		name   string
+		method string
+		uri    string
+		header http.Header
+		want   int
+	}{
+		{"literal", "GET", "/example-api/v1/health", http.Header{}, http.StatusOK},
+		{"bearer", "GET", "/widgets-api/v1/widgets", http.Header{"Authorization": []string{"Bearer app-token-value"}}, http.StatusOK},
+		{"role", "GET", "/widgets-api/v1/widgets/42", http.Header{http.CanonicalHeaderKey(jwtHeader): []string{reader}}, http.StatusOK},
+		{"params", "GET", "/reports-api/v1/reports/2023/01?format=csv", http.Header{"Authorization": []string{"Bearer reports-token-value"}}, http.StatusOK},
+		{"not found", "GET", "/widgets-api/v1/gadgets", http.Header{}, http.StatusNotFound},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			if status, message, _ := mux.Check(bm.method, bm.uri, bm.header.Clone()); status != bm.want {
+				b.Fatalf("Check(%s %s) = %d, want %d: %s", bm.method, bm.uri, status, bm.want, message)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mux.Check(bm.method, bm.uri, bm.header.Clone())
+			}
+		})
+	}
+}
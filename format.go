@@ -0,0 +1,139 @@
+package fauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// FormatAccessSystem returns acs as canonical JSON; acs is sorted in place:
+//   - applications, tenants and certificate authorities by name
+//   - host groups and the checks of each host group by name
+//   - the hosts of each host group
+//
+// paths are left in place since they are matched in order; map keys are sorted by encoding/json
+// and expressions are not HTML escaped. The empty fields of omittedFields are left out
+func FormatAccessSystem(acs *AccessSystem) ([]byte, error) {
+	sort.SliceStable(acs.Applications, func(i, j int) bool { return acs.Applications[i].Name < acs.Applications[j].Name })
+	sort.SliceStable(acs.Tenants, func(i, j int) bool { return acs.Tenants[i].Name < acs.Tenants[j].Name })
+	sort.SliceStable(acs.CertificateAuthorities, func(i, j int) bool {
+		return acs.CertificateAuthorities[i].Name < acs.CertificateAuthorities[j].Name
+	})
+
+	if acs.Checks != nil {
+		groups := acs.Checks.HostGroups
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		for _, group := range groups {
+			sort.Strings(group.Hosts)
+			checks := group.Checks
+			sort.SliceStable(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(acs); err != nil {
+		return nil, err
+	}
+	data, err := omitEmpty(bytes.TrimSpace(buf.Bytes()), "")
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	if err = json.Indent(&buf, data, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// omittedFields are the fields of an access system left out of its canonical format when they
+// are empty, by the path of the object they belong to; * stands for the elements of an array
+var omittedFields = map[string][]string{
+	"":                                    {"blocks", "applications", "tenants", "publicKeys", "tokens", "digests", "rootToken"},
+	"owner":                               {"bearer", "publicKey", "privateKey"},
+	"authorization":                       {"rootCheck"},
+	"authorization.hostGroups.*":          {"guid"},
+	"authorization.hostGroups.*.checks.*": {"guid", "version"},
+}
+
+// omitEmpty returns the JSON value at path with the empty fields of omittedFields left out; the
+// order of object keys is kept
+func omitEmpty(value json.RawMessage, path string) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok || (delim != '{' && delim != '[') {
+		return value, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(delim))
+	for n := 0; decoder.More(); n++ {
+		elementPath := joinPath(path, "*")
+		var key string
+		if delim == '{' {
+			if token, err = decoder.Token(); err != nil {
+				return nil, err
+			}
+			key = token.(string)
+			elementPath = joinPath(path, key)
+		}
+		var element json.RawMessage
+		if err = decoder.Decode(&element); err != nil {
+			return nil, err
+		}
+		if delim == '{' && isEmptyJSON(element) && contains(omittedFields[path], key) {
+			n--
+			continue
+		}
+		if element, err = omitEmpty(element, elementPath); err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		if delim == '{' {
+			name, _ := json.Marshal(key)
+			buf.Write(name)
+			buf.WriteByte(':')
+		}
+		buf.Write(element)
+	}
+	if delim == '{' {
+		buf.WriteByte('}')
+	} else {
+		buf.WriteByte(']')
+	}
+	return buf.Bytes(), nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// isEmptyJSON returns true if value is null or the JSON encoding of an empty value
+func isEmptyJSON(value json.RawMessage) bool {
+	switch string(bytes.TrimSpace(value)) {
+	case "null", `""`, "0", "false", "{}", "[]":
+		return true
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
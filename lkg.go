@@ -0,0 +1,96 @@
+package fauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// LastKnownGood is an access system saved to a local file each time it is loaded from a store,
+// so that forward-auth can start from it when the store is unavailable:
+//   - Store is the ID of the store the access system was loaded from
+//   - Saved is the time the access system was saved and Version its fingerprint
+//   - Access is the access system as loaded, with token, key and secret values resolved
+type LastKnownGood struct {
+	Store   string        `json:"store"`
+	Saved   time.Time     `json:"saved"`
+	Version string        `json:"version"`
+	Access  *AccessSystem `json:"access"`
+}
+
+// SaveLastKnownGood saves acs loaded from store to file, replacing the file atomically; the file
+// is readable only by its owner since it holds the resolved token, key and secret values
+func SaveLastKnownGood(file, store string, acs *AccessSystem) error {
+	data, err := json.Marshal(&LastKnownGood{Store: store, Saved: time.Now(), Version: Fingerprint(acs), Access: acs})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".last-known-good-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// LoadLastKnownGood loads the last known good access system saved to file
+func LoadLastKnownGood(file string) (lkg *LastKnownGood, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return lkg, err
+	}
+	lkg = &LastKnownGood{}
+	if err = json.Unmarshal(data, lkg); err != nil {
+		return lkg, fmt.Errorf("invalid last known good access system %s: %s", file, err)
+	}
+	if lkg.Access == nil {
+		return lkg, fmt.Errorf("last known good file %s has no access system", file)
+	}
+	return lkg, nil
+}
+
+// SetLastKnownGood saves every access system successfully loaded by the update function of auth
+// to file as the last known good access system of store; an empty file disables saving
+func (auth *Auth) SetLastKnownGood(file, store string) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.lkgFile, auth.lkgStore = file, store
+}
+
+// saveLastKnownGood saves acs as the last known good access system if a file is set; failures
+// are logged since the access system is already live
+func (auth *Auth) saveLastKnownGood(acs *AccessSystem) {
+	auth.mutex.RLock()
+	file, store := auth.lkgFile, auth.lkgStore
+	auth.mutex.RUnlock()
+	if file == "" {
+		return
+	}
+	if err := SaveLastKnownGood(file, store, acs); err != nil {
+		log.Errorf("failed to save last known good access system to %s: %s", file, err)
+	}
+}
+
+// SetDegraded records why auth is degraded, eg because it started from a last known good access
+// system while its store was unavailable; the next successful reload clears it
+func (auth *Auth) SetDegraded(reason string) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.reload.degraded = reason
+}
@@ -0,0 +1,74 @@
+package fauth_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestLastKnownGood(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache", "last-known-good.json")
+	if err := fauth.SaveLastKnownGood(file, "file", versionedAccess(1)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("got last known good file mode %o, want 600", perm)
+	}
+
+	lkg, err := fauth.LoadLastKnownGood(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lkg.Store != "file" || lkg.Version != fauth.Fingerprint(versionedAccess(1)) || lkg.Saved.IsZero() {
+		t.Errorf("got last known good %s %s %s", lkg.Store, lkg.Version, lkg.Saved)
+	}
+
+	// an auth started from the last known good access system enforces it while degraded
+	auth := newTestAuth(t, lkg.Access)
+	auth.SetLastKnownGood(file, "file")
+	auth.SetDegraded("file store failed to load at startup")
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token")
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header); d.Token != "APP_KEY_1" {
+		t.Errorf("got token '%s' from last known good, want APP_KEY_1", d.Token)
+	}
+	if status := auth.ReloadStatus(); status.Degraded == "" {
+		t.Errorf("got status %+v, want degraded", status)
+	}
+
+	// a successful reload clears degraded and replaces the last known good access system
+	if err := auth.UpdateFunc()(versionedAccess(2)); err != nil {
+		t.Fatal(err)
+	}
+	if status := auth.ReloadStatus(); status.Degraded != "" {
+		t.Errorf("got degraded '%s' after reload", status.Degraded)
+	}
+	lkg, err = fauth.LoadLastKnownGood(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lkg.Version != fauth.Fingerprint(versionedAccess(2)) {
+		t.Errorf("got last known good version %s after reload, want version 2", lkg.Version)
+	}
+}
+
+func TestLoadLastKnownGoodErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := fauth.LoadLastKnownGood(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("got no error for missing last known good file")
+	}
+	file := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fauth.LoadLastKnownGood(file); err == nil {
+		t.Error("got no error for last known good file without access system")
+	}
+}
@@ -0,0 +1,488 @@
+package fauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultCallbackPath = "/_oauth/callback"
+	defaultLogoutPath   = "/_oauth/logout"
+	defaultCookieName   = "_forward_auth"
+
+	// loginStateTTL bounds the time a user has to complete login at the identity provider
+	loginStateTTL = 10 * time.Minute
+)
+
+// oidcLogin is the OIDC login flow of a host group; endpoints not configured are
+// discovered from the issuer on first use
+type oidcLogin struct {
+	Login
+	client     *http.Client
+	mutex      sync.Mutex
+	discovered bool
+}
+
+// oidcConfiguration is the subset of OIDC provider metadata used by forward-auth
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// loginState is sealed in the state cookie while a login is in progress
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+// session is sealed in the session cookie of a logged in user
+type session struct {
+	JWT     string `json:"jwt"`
+	Expires int64  `json:"exp"`
+}
+
+func newOIDCLogin(login Login) *oidcLogin {
+	if login.CallbackPath == "" {
+		login.CallbackPath = defaultCallbackPath
+	}
+	if login.LogoutPath == "" {
+		login.LogoutPath = defaultLogoutPath
+	}
+	if login.LogoutRedirect == "" {
+		login.LogoutRedirect = "/"
+	}
+	if login.CookieName == "" {
+		login.CookieName = defaultCookieName
+	}
+	return &oidcLogin{Login: login, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// endpoints returns the authorization, token and end session endpoints of the login,
+// discovering those not configured from the issuer
+func (l *oidcLogin) endpoints() (authorization, token, endSession string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.discovered && (l.AuthorizationURL == "" || l.TokenURL == "") {
+		discovery := strings.TrimSuffix(l.Issuer, "/") + "/.well-known/openid-configuration"
+		resp, err := l.client.Get(discovery)
+		if err != nil {
+			return authorization, token, endSession, fmt.Errorf("OIDC discovery failed for %s: %s", l.Issuer, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return authorization, token, endSession, fmt.Errorf("OIDC discovery failed for %s: %s", l.Issuer, resp.Status)
+		}
+		config := &oidcConfiguration{}
+		if err := json.NewDecoder(resp.Body).Decode(config); err != nil {
+			return authorization, token, endSession, fmt.Errorf("invalid OIDC configuration for %s: %s", l.Issuer, err)
+		}
+		if l.AuthorizationURL == "" {
+			l.AuthorizationURL = config.AuthorizationEndpoint
+		}
+		if l.TokenURL == "" {
+			l.TokenURL = config.TokenEndpoint
+		}
+		if l.EndSessionURL == "" {
+			l.EndSessionURL = config.EndSessionEndpoint
+		}
+		l.discovered = true
+	}
+	return l.AuthorizationURL, l.TokenURL, l.EndSessionURL, nil
+}
+
+// exchange redeems an authorization code at the token endpoint returning the ID token
+func (l *oidcLogin) exchange(tokenURL, code, redirectURI, verifier string) (idToken string, err error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {l.ClientID},
+		"code_verifier": {verifier},
+	}
+	if l.ClientSecret != nil && l.ClientSecret.Value != "" {
+		form.Set("client_secret", l.ClientSecret.Value)
+	}
+
+	resp, err := l.client.PostForm(tokenURL, form)
+	if err != nil {
+		return idToken, fmt.Errorf("token request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return idToken, fmt.Errorf("token request failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return idToken, fmt.Errorf("token request failed: %s: %s", resp.Status, string(data))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return idToken, fmt.Errorf("invalid token response: %s", err)
+	}
+	if tokens.IDToken == "" {
+		return idToken, fmt.Errorf("token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// validate checks the issuer, audience, nonce and expiry of an ID token returning its expiry;
+// the token was received directly from the token endpoint over TLS so its signature is
+// verified later, when forward-auth evaluates it as the request JWT
+func (l *oidcLogin) validate(idToken, nonce string) (expires time.Time, err error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(idToken, claims); err != nil {
+		return expires, fmt.Errorf("invalid id_token: %s", err)
+	}
+	if !claims.VerifyIssuer(l.Issuer, true) {
+		return expires, fmt.Errorf("id_token issuer %v is not %s", claims["iss"], l.Issuer)
+	}
+	if !claims.VerifyAudience(l.ClientID, true) {
+		return expires, fmt.Errorf("id_token audience %v does not include %s", claims["aud"], l.ClientID)
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return expires, fmt.Errorf("id_token nonce does not match login")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Unix(int64(exp), 0).Before(time.Now()) {
+		return expires, fmt.Errorf("id_token is expired")
+	}
+	return time.Unix(int64(exp), 0), nil
+}
+
+func (s *snapshot) setLogins(checks *HostChecks) error {
+	logins := make(map[string]*oidcLogin)
+	if checks != nil {
+		for _, group := range checks.HostGroups {
+			if group.Login == nil {
+				continue
+			}
+			if err := group.Login.Validate(); err != nil {
+				return fmt.Errorf("host group %s login: %s", group.Name, err)
+			}
+			login := newOIDCLogin(*group.Login)
+			for _, host := range group.Hosts {
+				logins[host] = login
+			}
+		}
+	}
+	s.logins = logins
+	return nil
+}
+
+func (auth *Auth) getLogin(host string) *oidcLogin {
+	return auth.current().logins[host]
+}
+
+// SetSessionKey sets the AES key (16, 24 or 32 bytes) that encrypts login cookies; replicas
+// must share the key for sessions to survive a change of replica. If no key is set a
+// random key is generated on first use
+func (auth *Auth) SetSessionKey(key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid session key: %s", err)
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.sessionKey = key
+	return nil
+}
+
+func (auth *Auth) getSessionKey() ([]byte, error) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if auth.sessionKey == nil {
+		log.Warning("no session key is configured - generating a random key; sessions will not survive a restart")
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		auth.sessionKey = key
+	}
+	return auth.sessionKey, nil
+}
+
+// seal encrypts v as the value of cookie name; the name is authenticated so
+// a sealed value can't be replayed in another cookie
+func (auth *Auth) seal(name string, v interface{}) (string, error) {
+	gcm, err := auth.sessionAEAD()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+// open decrypts the value of cookie name into v
+func (auth *Auth) open(name, value string, v interface{}) error {
+	gcm, err := auth.sessionAEAD()
+	if err != nil {
+		return err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return fmt.Errorf("invalid %s cookie", name)
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return fmt.Errorf("invalid %s cookie", name)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func (auth *Auth) sessionAEAD() (cipher.AEAD, error) {
+	key, err := auth.getSessionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// JWTHeader returns the name of the request header that carries the user JWT
+func (auth *Auth) JWTHeader() string {
+	return auth.jwtHeader
+}
+
+// Session sets the JWT of the login session found in header as the request JWT, returning
+// the JWT; it returns the empty string if the host has no login, the request already carries
+// a JWT or there is no valid session
+func (auth *Auth) Session(host string, header http.Header) (jwt string) {
+	login := auth.getLogin(host)
+	if login == nil || header.Get(auth.jwtHeader) != "" {
+		return jwt
+	}
+	cookie, err := (&http.Request{Header: header}).Cookie(login.CookieName)
+	if err != nil {
+		return jwt
+	}
+	s := &session{}
+	if err := auth.open(login.CookieName, cookie.Value, s); err != nil {
+		log.Debugf("ignoring session cookie: %s", err)
+		return jwt
+	}
+	if time.Unix(s.Expires, 0).Before(time.Now()) {
+		log.Debugf("ignoring expired session cookie")
+		return jwt
+	}
+	header.Set(auth.jwtHeader, s.JWT)
+	return s.JWT
+}
+
+// LoginChallenge redirects an unauthenticated browser request for host uri to the identity
+// provider of the host group, returning false if the host has no login or r is not from a browser
+func (auth *Auth) LoginChallenge(w http.ResponseWriter, r *http.Request, host, uri string) bool {
+	login := auth.getLogin(host)
+	if login == nil || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+
+	authorizationURL, _, _, err := login.endpoints()
+	if err != nil {
+		auth.metrics.KeyFetchError("oidc_discovery")
+		log.Error(err)
+		return false
+	}
+
+	state := &loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString() + randomString(),
+		Redirect: origin(r, host) + uri,
+		Expires:  time.Now().Add(loginStateTTL).Unix(),
+	}
+	sealed, err := auth.seal(stateCookie(login), state)
+	if err != nil {
+		log.Errorf("failed to seal login state: %s", err)
+		return false
+	}
+	http.SetCookie(w, login.cookie(r, stateCookie(login), sealed, int(loginStateTTL.Seconds())))
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {login.ClientID},
+		"redirect_uri":          {origin(r, host) + login.CallbackPath},
+		"scope":                 {strings.Join(append([]string{"openid"}, login.Scopes...), " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(authorizationURL, "?") {
+		separator = "&"
+	}
+	log.Debugf("redirecting browser request for %s%s to login at %s", host, uri, login.Issuer)
+	http.Redirect(w, r, authorizationURL+separator+query.Encode(), http.StatusFound)
+	return true
+}
+
+// HandleLogin serves the login callback and logout paths of the host group of host, returning
+// false if uri is not one of them
+func (auth *Auth) HandleLogin(w http.ResponseWriter, r *http.Request, host, uri string) (handled bool, err error) {
+	login := auth.getLogin(host)
+	if login == nil {
+		return false, nil
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return false, nil
+	}
+
+	switch u.Path {
+	case login.CallbackPath:
+		return true, auth.callback(w, r, login, host, u.Query())
+	case login.LogoutPath:
+		auth.logout(w, r, login, host)
+		return true, nil
+	}
+	return false, nil
+}
+
+// callback completes a login by redeeming the authorization code for an ID token,
+// which is sealed in the session cookie before redirecting to the originally requested URL
+func (auth *Auth) callback(w http.ResponseWriter, r *http.Request, login *oidcLogin, host string, query url.Values) error {
+	if e := query.Get("error"); e != "" {
+		return fmt.Errorf("login failed: %s %s", e, query.Get("error_description"))
+	}
+
+	cookie, err := r.Cookie(stateCookie(login))
+	if err != nil {
+		return fmt.Errorf("login failed: no login in progress")
+	}
+	state := &loginState{}
+	if err := auth.open(stateCookie(login), cookie.Value, state); err != nil {
+		return fmt.Errorf("login failed: %s", err)
+	}
+	if time.Unix(state.Expires, 0).Before(time.Now()) {
+		return fmt.Errorf("login failed: login expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		return fmt.Errorf("login failed: state does not match login")
+	}
+
+	_, tokenURL, _, err := login.endpoints()
+	if err != nil {
+		auth.metrics.KeyFetchError("oidc_discovery")
+		return err
+	}
+	idToken, err := login.exchange(tokenURL, query.Get("code"), origin(r, host)+login.CallbackPath, state.Verifier)
+	if err != nil {
+		return fmt.Errorf("login failed: %s", err)
+	}
+	expires, err := login.validate(idToken, state.Nonce)
+	if err != nil {
+		return fmt.Errorf("login failed: %s", err)
+	}
+
+	sealed, err := auth.seal(login.CookieName, &session{JWT: idToken, Expires: expires.Unix()})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, login.cookie(r, login.CookieName, sealed, int(time.Until(expires).Seconds())))
+	http.SetCookie(w, login.cookie(r, stateCookie(login), "", -1))
+
+	log.Debugf("login complete for %s - redirecting to %s", host, state.Redirect)
+	http.Redirect(w, r, state.Redirect, http.StatusFound)
+	return nil
+}
+
+// logout clears the session cookie and redirects to the end session endpoint of the
+// identity provider if it has one, otherwise to the logout redirect
+func (auth *Auth) logout(w http.ResponseWriter, r *http.Request, login *oidcLogin, host string) {
+	redirect := login.LogoutRedirect
+	if strings.HasPrefix(redirect, "/") {
+		redirect = origin(r, host) + redirect
+	}
+
+	jwt := ""
+	if cookie, err := r.Cookie(login.CookieName); err == nil {
+		s := &session{}
+		if err := auth.open(login.CookieName, cookie.Value, s); err == nil {
+			jwt = s.JWT
+		}
+	}
+	http.SetCookie(w, login.cookie(r, login.CookieName, "", -1))
+
+	if _, _, endSessionURL, err := login.endpoints(); err == nil && endSessionURL != "" {
+		query := url.Values{"post_logout_redirect_uri": {redirect}, "client_id": {login.ClientID}}
+		if jwt != "" {
+			query.Set("id_token_hint", jwt)
+		}
+		redirect = endSessionURL + "?" + query.Encode()
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// cookie returns a login cookie; a negative maxAge deletes the cookie
+func (l *oidcLogin) cookie(r *http.Request, name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   l.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   forwardedProto(r) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func stateCookie(login *oidcLogin) string {
+	return login.CookieName + "_state"
+}
+
+// origin returns the scheme and host of the forwarded request
+func origin(r *http.Request, host string) string {
+	return forwardedProto(r) + "://" + host
+}
+
+func forwardedProto(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	return "https"
+}
+
+// randomString returns 128 random bits encoded as unpadded base64url
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
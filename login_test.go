@@ -0,0 +1,218 @@
+package fauth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testClientID = "forward-auth"
+	testCode     = "authorization-code"
+)
+
+// stubIdP is a minimal OIDC provider that issues an ID token for testCode
+type stubIdP struct {
+	*httptest.Server
+	t         *testing.T
+	key       *rsa.PrivateKey
+	mutex     sync.Mutex
+	nonce     string
+	challenge string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"end_session_endpoint":   idp.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize records the nonce and PKCE challenge of an authorization request
+func (idp *stubIdP) authorize(query url.Values) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.nonce = query.Get("nonce")
+	idp.challenge = query.Get("code_challenge")
+}
+
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("code") != testCode || r.PostFormValue("client_id") != testClientID ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":      idp.URL,
+		"aud":      testClientID,
+		"sub":      "user-1",
+		"nonce":    idp.nonce,
+		"exp":      time.Now().Add(time.Hour).Unix(),
+		"identity": &fauth.Identity{UID: strptr("user-1"), TID: strptr("tenant-1")},
+	}
+	idToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(idp.key)
+	if err != nil {
+		idp.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+// forwarded returns a request to /auth forwarded by Traefik for uri on app.example.com
+func forwarded(uri string, cookies []*http.Cookie, accept string) *http.Request {
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", uri)
+	r.Header.Set("Accept", accept)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestLogin(t *testing.T) {
+	idp := newStubIdP(t)
+	auth := newTestAuthWithIdP(t, &fauth.AccessSystem{
+		Owner: fauth.Owner{Name: "Example", UID: "tenant-1"},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "App Hosts",
+					Hosts:   []string{"app.example.com"},
+					Default: "deny",
+					Login:   &fauth.Login{Issuer: idp.URL, ClientID: testClientID},
+					Checks: []fauth.Check{
+						{
+							Name: "app",
+							Base: "/app",
+							Paths: []fauth.Path{
+								{
+									Path:  "/home",
+									Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "true", MustAuth: true}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, idp.key)
+
+	const host = "app.example.com"
+	const html = "text/html,application/xhtml+xml"
+
+	// an API request without a JWT is not redirected
+	r := forwarded("/app/home", nil, "application/json")
+	if auth.LoginChallenge(httptest.NewRecorder(), r, host, "/app/home") {
+		t.Error("LoginChallenge() redirected a non-browser request")
+	}
+
+	// a browser request without a JWT is redirected to the identity provider
+	r = forwarded("/app/home", nil, html)
+	if d := auth.Check(host, "GET", "/app/home", r.Header); d.Status != http.StatusUnauthorized {
+		t.Fatalf("Check() status = %d, want 401", d.Status)
+	}
+	w := httptest.NewRecorder()
+	if !auth.LoginChallenge(w, r, host, "/app/home") {
+		t.Fatal("LoginChallenge() = false, want redirect")
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound || location.Path != "/authorize" {
+		t.Fatalf("LoginChallenge() = %d %s, want redirect to authorize", w.Code, w.Header().Get("Location"))
+	}
+	query := location.Query()
+	if query.Get("redirect_uri") != "https://app.example.com/_oauth/callback" || query.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorization request = %s", location.RawQuery)
+	}
+	idp.authorize(query)
+	stateCookies := w.Result().Cookies()
+
+	// a callback with a forged state is rejected
+	callback := "/_oauth/callback?code=" + testCode + "&state=forged"
+	if handled, err := auth.HandleLogin(httptest.NewRecorder(), forwarded(callback, stateCookies, html), host, callback); !handled || err == nil {
+		t.Errorf("HandleLogin() with forged state = %t, %v, want error", handled, err)
+	}
+
+	// the callback redeems the code and redirects to the original request with a session cookie
+	callback = "/_oauth/callback?code=" + testCode + "&state=" + url.QueryEscape(query.Get("state"))
+	w = httptest.NewRecorder()
+	if handled, err := auth.HandleLogin(w, forwarded(callback, stateCookies, html), host, callback); !handled || err != nil {
+		t.Fatalf("HandleLogin() = %t, %v, want callback handled", handled, err)
+	}
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://app.example.com/app/home" {
+		t.Fatalf("callback = %d %s, want redirect to original request", w.Code, w.Header().Get("Location"))
+	}
+	var sessionCookies []*http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "_forward_auth" && c.Value != "" {
+			if !c.HttpOnly || !c.Secure {
+				t.Errorf("session cookie is not HttpOnly and Secure: %+v", c)
+			}
+			sessionCookies = append(sessionCookies, c)
+		}
+	}
+	if len(sessionCookies) != 1 {
+		t.Fatalf("callback set cookies %v, want session cookie", w.Result().Cookies())
+	}
+
+	// the session JWT authenticates subsequent requests
+	r = forwarded("/app/home", sessionCookies, html)
+	if jwt := auth.Session(host, r.Header); jwt == "" || r.Header.Get(auth.JWTHeader()) != jwt {
+		t.Fatal("Session() did not set the request JWT")
+	}
+	d := auth.Check(host, "GET", "/app/home", r.Header)
+	if d.Status != http.StatusOK || d.User() != "user-1" {
+		t.Errorf("Check() with session = %d %s, want 200 for user-1: %s", d.Status, d.User(), d.Message)
+	}
+
+	// a tampered session cookie is ignored
+	tampered := *sessionCookies[0]
+	tampered.Value = strings.ToUpper(tampered.Value)
+	if jwt := auth.Session(host, forwarded("/app/home", []*http.Cookie{&tampered}, html).Header); jwt != "" {
+		t.Error("Session() accepted a tampered session cookie")
+	}
+
+	// logout clears the session and redirects to the identity provider
+	w = httptest.NewRecorder()
+	if handled, err := auth.HandleLogin(w, forwarded("/_oauth/logout", sessionCookies, html), host, "/_oauth/logout"); !handled || err != nil {
+		t.Fatalf("HandleLogin() = %t, %v, want logout handled", handled, err)
+	}
+	if !strings.HasPrefix(w.Header().Get("Location"), idp.URL+"/logout?") {
+		t.Errorf("logout redirect = %s, want end session endpoint", w.Header().Get("Location"))
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("logout cookies = %v, want session cookie deleted", c)
+	}
+}
@@ -0,0 +1,375 @@
+package fauth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Metric types of the Prometheus text exposition format
+const (
+	MetricCounter   = "counter"
+	MetricGauge     = "gauge"
+	MetricHistogram = "histogram"
+)
+
+// MetricFamily is a snapshot of a named metric and its samples
+type MetricFamily struct {
+	Name    string   `json:"name"`
+	Help    string   `json:"help"`
+	Type    string   `json:"type"`
+	Samples []Sample `json:"samples"`
+}
+
+// Sample is the value of a metric for a set of label values; the samples of a histogram have
+// a count, a sum and cumulative bucket counts (the +Inf bucket is the count)
+type Sample struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   float64           `json:"value"`
+	Count   uint64            `json:"count,omitempty"`
+	Sum     float64           `json:"sum,omitempty"`
+	Buckets []Bucket          `json:"buckets,omitempty"`
+}
+
+// Bucket is the cumulative count of histogram observations less than or equal to UpperBound
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// Stats is the JSON view of the metrics of the service
+type Stats struct {
+	Metrics []MetricFamily `json:"metrics"`
+}
+
+// latencyBuckets are the upper bounds in seconds of the decision latency histogram
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Metrics are the decision and access system metrics of an Auth:
+//   - decisions count decisions by host group, check, method and status
+//   - latency observes the time taken to decide by host group
+//   - ruleErrors count rule expressions that failed evaluation by rule
+//   - jwtFailures count request JWTs that failed verification by reason
+//   - reloads count access system updates by result and lastReload is the time of the last
+//     successful load
+//   - keyFetchErrors count failures to fetch keys and provider metadata by source
+//   - cacheLookups count decision cache lookups of cacheable rules by result (hit or miss)
+type Metrics struct {
+	decisions      *metricVec
+	latency        *metricVec
+	ruleErrors     *metricVec
+	jwtFailures    *metricVec
+	reloads        *metricVec
+	lastReload     *metricVec
+	keyFetchErrors *metricVec
+	cacheLookups   *metricVec
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		decisions:      newMetricVec("forward_auth_decisions_total", "Decisions by host group, check, method and status.", MetricCounter, "host_group", "check", "method", "status"),
+		latency:        newMetricVec("forward_auth_decision_duration_seconds", "Time taken to decide requests by host group.", MetricHistogram, "host_group"),
+		ruleErrors:     newMetricVec("forward_auth_rule_evaluation_errors_total", "Rule expressions that failed evaluation by rule.", MetricCounter, "rule"),
+		jwtFailures:    newMetricVec("forward_auth_jwt_verification_failures_total", "Request JWTs that failed verification by reason.", MetricCounter, "reason"),
+		reloads:        newMetricVec("forward_auth_acs_reloads_total", "Access system reloads by result.", MetricCounter, "result"),
+		lastReload:     newMetricVec("forward_auth_acs_last_reload_success_timestamp_seconds", "Time of the last successful access system load.", MetricGauge),
+		keyFetchErrors: newMetricVec("forward_auth_key_fetch_errors_total", "Failures to fetch keys and identity provider metadata by source.", MetricCounter, "source"),
+		cacheLookups:   newMetricVec("forward_auth_decision_cache_lookups_total", "Decision cache lookups by result.", MetricCounter, "result"),
+	}
+}
+
+// Metrics returns the metrics of auth
+func (auth *Auth) Metrics() *Metrics {
+	return auth.metrics
+}
+
+// Families returns a snapshot of the metrics
+func (m *Metrics) Families() []MetricFamily {
+	return []MetricFamily{
+		m.decisions.family(),
+		m.latency.family(),
+		m.ruleErrors.family(),
+		m.jwtFailures.family(),
+		m.reloads.family(),
+		m.lastReload.family(),
+		m.keyFetchErrors.family(),
+		m.cacheLookups.family(),
+	}
+}
+
+// decided records a decision and the time taken to reach it
+func (m *Metrics) decided(group, check, method string, status int, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		method = "OTHER"
+	}
+	m.decisions.add(1, group, check, method, strconv.Itoa(status))
+	m.latency.observe(latency.Seconds(), group)
+}
+
+func (m *Metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheLookups.add(1, "hit")
+		return
+	}
+	m.cacheLookups.add(1, "miss")
+}
+
+func (m *Metrics) ruleError(rule string) {
+	if m != nil {
+		m.ruleErrors.add(1, rule)
+	}
+}
+
+// jwtFailure records a JWT verification failure by the reason of err
+func (m *Metrics) jwtFailure(err error) {
+	if m != nil {
+		m.jwtFailures.add(1, jwtFailureReason(err))
+	}
+}
+
+func (m *Metrics) reloaded(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.reloads.add(1, "failure")
+		return
+	}
+	m.reloads.add(1, "success")
+	m.loaded()
+}
+
+func (m *Metrics) loaded() {
+	if m != nil {
+		m.lastReload.set(float64(time.Now().UnixNano()) / 1e9)
+	}
+}
+
+// KeyFetchError records a failure to fetch keys or identity provider metadata from source
+func (m *Metrics) KeyFetchError(source string) {
+	if m != nil {
+		m.keyFetchErrors.add(1, source)
+	}
+}
+
+// jwtFailureReason classifies a JWT verification error
+func jwtFailureReason(err error) string {
+	var v *jwt.ValidationError
+	if !errors.As(err, &v) {
+		return "invalid"
+	}
+	switch {
+	case v.Errors&jwt.ValidationErrorMalformed != 0:
+		return "malformed"
+	case v.Errors&jwt.ValidationErrorUnverifiable != 0:
+		return "unverifiable"
+	case v.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return "signature"
+	case v.Errors&jwt.ValidationErrorExpired != 0:
+		return "expired"
+	case v.Errors&jwt.ValidationErrorNotValidYet != 0, v.Errors&jwt.ValidationErrorIssuedAt != 0:
+		return "not_valid_yet"
+	}
+	return "invalid"
+}
+
+// StoreMetrics returns the health of store and, for stores backed by a database, the statistics
+// of its connection pool
+func StoreMetrics(store Store) []MetricFamily {
+	up := 1.0
+	if err := store.Health(); err != nil {
+		up = 0
+	}
+	labels := map[string]string{"store": store.ID()}
+	families := []MetricFamily{
+		{Name: "forward_auth_store_up", Help: "Whether the store is healthy.", Type: MetricGauge, Samples: []Sample{{Labels: labels, Value: up}}},
+	}
+
+	dbStore, ok := store.(DBStatser)
+	if !ok {
+		return families
+	}
+	stats := dbStore.DBStats()
+	for _, f := range []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"forward_auth_db_max_open_connections", "Maximum number of open database connections.", MetricGauge, float64(stats.MaxOpenConnections)},
+		{"forward_auth_db_open_connections", "Open database connections.", MetricGauge, float64(stats.OpenConnections)},
+		{"forward_auth_db_in_use_connections", "Database connections in use.", MetricGauge, float64(stats.InUse)},
+		{"forward_auth_db_idle_connections", "Idle database connections.", MetricGauge, float64(stats.Idle)},
+		{"forward_auth_db_wait_count_total", "Database connections waited for.", MetricCounter, float64(stats.WaitCount)},
+		{"forward_auth_db_wait_duration_seconds_total", "Time spent waiting for database connections.", MetricCounter, stats.WaitDuration.Seconds()},
+		{"forward_auth_db_max_idle_closed_total", "Database connections closed by the idle limit.", MetricCounter, float64(stats.MaxIdleClosed)},
+		{"forward_auth_db_max_idle_time_closed_total", "Database connections closed by the idle time limit.", MetricCounter, float64(stats.MaxIdleTimeClosed)},
+		{"forward_auth_db_max_lifetime_closed_total", "Database connections closed by the lifetime limit.", MetricCounter, float64(stats.MaxLifetimeClosed)},
+	} {
+		families = append(families, MetricFamily{Name: f.name, Help: f.help, Type: f.kind, Samples: []Sample{{Labels: labels, Value: f.value}}})
+	}
+	return families
+}
+
+// DBStatser is implemented by stores backed by a database connection pool
+type DBStatser interface {
+	DBStats() sql.DBStats
+}
+
+// WriteMetrics writes families in the Prometheus text exposition format
+func WriteMetrics(w io.Writer, families []MetricFamily) error {
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.Name, f.Help, f.Name, f.Type)
+		for _, s := range f.Samples {
+			if f.Type != MetricHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", f.Name, labelString(s.Labels, "", 0), formatValue(s.Value))
+				continue
+			}
+			for _, bucket := range s.Buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.Name, labelString(s.Labels, "le", bucket.UpperBound), bucket.Count)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.Name, labelString(s.Labels, "le", math.Inf(1)), s.Count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.Name, labelString(s.Labels, "", 0), formatValue(s.Sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.Name, labelString(s.Labels, "", 0), s.Count)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelEscaper escapes label values as the text exposition format requires: only backslash,
+// double quote and line feed are escaped, other characters (including UTF-8) are written as is
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats labels sorted by name followed by the le label of a bucket, if named
+func labelString(labels map[string]string, le string, bound float64) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(labels[name])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", le, formatValue(bound)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricVec is a metric with a value, or a histogram, for each combination of label values
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels  []string
+	value   float64
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*metricValue)}
+}
+
+// get returns the value for the label values; the caller must hold the mutex
+func (v *metricVec) get(labels []string) *metricValue {
+	key := strings.Join(labels, "\xff")
+	value, ok := v.values[key]
+	if !ok {
+		value = &metricValue{labels: labels}
+		if v.kind == MetricHistogram {
+			value.buckets = make([]uint64, len(latencyBuckets))
+		}
+		v.values[key] = value
+	}
+	return value
+}
+
+func (v *metricVec) add(delta float64, labels ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.get(labels).value += delta
+}
+
+func (v *metricVec) set(value float64, labels ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.get(labels).value = value
+}
+
+func (v *metricVec) observe(value float64, labels ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	h := v.get(labels)
+	h.count++
+	h.sum += value
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+}
+
+func (v *metricVec) family() MetricFamily {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	f := MetricFamily{Name: v.name, Help: v.help, Type: v.kind, Samples: []Sample{}}
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := v.values[key]
+		s := Sample{Value: value.value}
+		if len(v.labels) > 0 {
+			s.Labels = make(map[string]string)
+			for i, name := range v.labels {
+				s.Labels[name] = value.labels[i]
+			}
+		}
+		if v.kind == MetricHistogram {
+			s.Count, s.Sum = value.count, value.sum
+			for i, bound := range latencyBuckets {
+				s.Buckets = append(s.Buckets, Bucket{UpperBound: bound, Count: value.buckets[i]})
+			}
+		}
+		f.Samples = append(f.Samples, s)
+	}
+	return f
+}
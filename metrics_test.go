@@ -0,0 +1,70 @@
+package fauth_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestMetrics(t *testing.T) {
+	auth := loadAccessSystem(t)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token-value")
+	auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", header)
+	auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", header)
+	// methods that are not HTTP methods are recorded as OTHER
+	auth.Check("apis.example.com", "BREW", "/widgets-api/v1/widgets", header)
+
+	header = http.Header{}
+	header.Set(jwtHeader, testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-1")})+"x")
+	auth.Check("apis.example.com", "POST", "/widgets-api/v1/widgets", header)
+
+	// explained decisions are not counted
+	auth.Explain("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{})
+
+	if err := auth.UpdateFunc()(&fauth.AccessSystem{Checks: &fauth.HostChecks{HostGroups: []fauth.HostGroup{
+		{Name: "Bad", Hosts: []string{"bad.example.com"}, Default: "deny", Checks: []fauth.Check{{Name: "bad", Base: "/", Paths: []fauth.Path{
+			{Path: "/", Rules: map[fauth.Method]fauth.Rule{"GET": {Expression: "bearer("}}},
+		}}}},
+	}}}); err == nil {
+		t.Fatal("got no error for invalid update")
+	}
+
+	var out bytes.Buffer
+	if err := fauth.WriteMetrics(&out, auth.Metrics().Families()); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, want := range []string{
+		"# TYPE forward_auth_decisions_total counter",
+		`forward_auth_decisions_total{check="widgets-api",host_group="API Hosts",method="GET",status="200"} 2`,
+		`forward_auth_decisions_total{check="widgets-api",host_group="API Hosts",method="OTHER",status="404"} 1`,
+		`forward_auth_decision_duration_seconds_bucket{host_group="API Hosts",le="+Inf"} 4`,
+		`forward_auth_decision_duration_seconds_count{host_group="API Hosts"} 4`,
+		`forward_auth_jwt_verification_failures_total{reason="signature"} 1`,
+		`forward_auth_acs_reloads_total{result="failure"} 1`,
+		"forward_auth_acs_last_reload_success_timestamp_seconds ",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics do not contain %s:\n%s", want, text)
+		}
+	}
+}
+
+func TestWriteMetricsLabelEscaping(t *testing.T) {
+	families := []fauth.MetricFamily{{Name: "forward_auth_decisions_total", Help: "decisions", Type: fauth.MetricCounter, Samples: []fauth.Sample{
+		{Labels: map[string]string{"host_group": "Hôtes \"API\" ✓", "check": "a\\b\nc\td\x01"}, Value: 1},
+	}}}
+	var out bytes.Buffer
+	if err := fauth.WriteMetrics(&out, families); err != nil {
+		t.Fatal(err)
+	}
+	want := "forward_auth_decisions_total{check=\"a\\\\b\\nc\td\x01\",host_group=\"Hôtes \\\"API\\\" ✓\"} 1"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("metrics do not contain %q:\n%q", want, out.String())
+	}
+}
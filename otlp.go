@@ -0,0 +1,259 @@
+package fauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// OTLPExporter exports spans to an OpenTelemetry collector over OTLP/HTTP with the JSON
+// encoding; spans are posted when a batch is full, every interval and on Close. Spans are
+// dropped with an error if the collector falls behind by more than ten batches
+type OTLPExporter struct {
+	url      string
+	service  string
+	headers  map[string]string
+	client   *http.Client
+	size     int
+	interval time.Duration
+	spans    chan *SpanData
+	done     chan struct{}
+	mutex    sync.RWMutex
+	closed   bool
+}
+
+// NewOTLPExporter returns an exporter posting spans of service to the traces endpoint of the
+// collector at endpoint, eg http://otel-collector:4318, in batches of size; headers are added to
+// each export request
+func NewOTLPExporter(endpoint, service string, headers map[string]string, size int, interval time.Duration) (exporter *OTLPExporter, err error) {
+	if endpoint == "" {
+		return exporter, fmt.Errorf("an OTLP exporter requires a collector endpoint")
+	}
+	if size <= 0 || interval <= 0 {
+		return exporter, fmt.Errorf("invalid span batch size %d or interval %s", size, interval)
+	}
+	exporter = &OTLPExporter{
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		size:     size,
+		interval: interval,
+		spans:    make(chan *SpanData, 10*size),
+		done:     make(chan struct{}),
+	}
+	go exporter.run()
+	return exporter, nil
+}
+
+// Export queues span for export; spans exported after Close are dropped with an error
+func (e *OTLPExporter) Export(span *SpanData) error {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.closed {
+		return fmt.Errorf("trace exporter is closed; dropping span")
+	}
+	select {
+	case e.spans <- span:
+		return nil
+	default:
+		return fmt.Errorf("trace collector is %d spans behind; dropping span", cap(e.spans))
+	}
+}
+
+// Close exports the pending spans and stops the exporter
+func (e *OTLPExporter) Close() error {
+	e.mutex.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mutex.Unlock()
+	<-e.done
+	return nil
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, e.size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			log.Errorf("failed to export %d spans: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span, ok := <-e.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == e.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// post posts a batch of spans to the collector
+func (e *OTLPExporter) post(batch []*SpanData) error {
+	data, err := json.Marshal(OTLPRequest(e.service, batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector %s returned %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON encoding of an export request; see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type (
+	// OTLPTraces is the body of an OTLP/HTTP trace export request
+	OTLPTraces struct {
+		ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+	}
+	// OTLPResourceSpans are the spans of a resource
+	OTLPResourceSpans struct {
+		Resource   OTLPResource     `json:"resource"`
+		ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+	}
+	// OTLPResource describes the service producing spans
+	OTLPResource struct {
+		Attributes []OTLPAttribute `json:"attributes"`
+	}
+	// OTLPScopeSpans are the spans of an instrumentation scope
+	OTLPScopeSpans struct {
+		Scope OTLPScope  `json:"scope"`
+		Spans []OTLPSpan `json:"spans"`
+	}
+	// OTLPScope names an instrumentation scope
+	OTLPScope struct {
+		Name string `json:"name"`
+	}
+	// OTLPSpan is an exported span; times are nanoseconds since the Unix epoch
+	OTLPSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []OTLPAttribute `json:"attributes,omitempty"`
+		Status            OTLPStatus      `json:"status"`
+	}
+	// OTLPAttribute is a key value pair
+	OTLPAttribute struct {
+		Key   string    `json:"key"`
+		Value OTLPValue `json:"value"`
+	}
+	// OTLPValue is an attribute value of one type
+	OTLPValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+	// OTLPStatus is the status of a span; Code is 2 for a span that recorded an error
+	OTLPStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlpInstrumentation is the instrumentation scope of exported spans
+const otlpInstrumentation = "bitbucket.org/_metalogic_/forward-auth"
+
+// OTLPRequest returns the OTLP/HTTP export request of spans produced by service
+func OTLPRequest(service string, spans []*SpanData) *OTLPTraces {
+	scope := OTLPScopeSpans{Scope: OTLPScope{Name: otlpInstrumentation}, Spans: make([]OTLPSpan, 0, len(spans))}
+	for _, s := range spans {
+		span := OTLPSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			span.Status = OTLPStatus{Code: 2, Message: s.Error}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	return &OTLPTraces{ResourceSpans: []OTLPResourceSpans{{
+		Resource:   OTLPResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": service})},
+		ScopeSpans: []OTLPScopeSpans{scope},
+	}}}
+}
+
+// otlpAttributes returns attributes sorted by key; values of other types are formatted as strings
+func otlpAttributes(attributes map[string]interface{}) []OTLPAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]OTLPAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value OTLPValue
+		switch v := attributes[key].(type) {
+		case bool:
+			value.BoolValue = &v
+		case int:
+			i := strconv.Itoa(v)
+			value.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			value.IntValue = &i
+		case float64:
+			value.DoubleValue = &v
+		case string:
+			value.StringValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		result = append(result, OTLPAttribute{Key: key, Value: value})
+	}
+	return result
+}
@@ -0,0 +1,366 @@
+package fauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/httpsig"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// PolicyTestSuite is a list of requests with the decision status expected for each; suites are
+// kept next to the access file they test, eg:
+//
+//	{
+//	  "cases": [
+//	    {
+//	      "name": "app lists widgets",
+//	      "host": "apis.example.com",
+//	      "method": "GET",
+//	      "uri": "/widgets-api/v1/widgets",
+//	      "bearer": "MC_APP_KEY",
+//	      "want": 200
+//	    },
+//	    {
+//	      "name": "reader cannot create widgets",
+//	      "host": "apis.example.com",
+//	      "method": "POST",
+//	      "uri": "/widgets-api/v1/widgets",
+//	      "jwt": { "uid": "user-1", "permissions": { "ALL": ["WIDGETS:READ"] } },
+//	      "want": 403
+//	    }
+//	  ]
+//	}
+type PolicyTestSuite struct {
+	Cases []PolicyTestCase `json:"cases"`
+}
+
+// PolicyTestCase is a request and its expected decision status; credentials are symbolic and
+// are minted by the runner with throwaway keys:
+//   - Bearer is the name of a bearer token defined by the access system (eg MC_APP_KEY)
+//   - JWT describes the identity of a user JWT
+//   - Signature signs the request with a key registered for a tenant
+//
+// Headers are added to the request as given. Callouts are the results of the allow() callouts of
+// the case by URL; allow() never calls out in a test, and a callout to a URL without a result is
+// not evaluated and fails
+type PolicyTestCase struct {
+	Name      string            `json:"name"`
+	Host      string            `json:"host"`
+	Method    string            `json:"method"`
+	URI       string            `json:"uri"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Bearer    string            `json:"bearer,omitempty"`
+	JWT       *TestIdentity     `json:"jwt,omitempty"`
+	Signature *TestSignature    `json:"signature,omitempty"`
+	Callouts  map[string]bool   `json:"callouts,omitempty"`
+	Want      int               `json:"want"`
+}
+
+// TestIdentity describes the identity of a minted user JWT; Permissions maps a context (or ALL)
+// to permissions of the form CATEGORY:ACTION, eg {"ALL": ["WIDGETS:READ", "REPORTS:ALL"]}.
+// Tenant defaults to the owner UID; an expired JWT is minted if Expired is true
+type TestIdentity struct {
+	UID            string              `json:"uid"`
+	Tenant         string              `json:"tenant,omitempty"`
+	Name           string              `json:"name,omitempty"`
+	Email          string              `json:"email,omitempty"`
+	Superuser      bool                `json:"superuser,omitempty"`
+	Classification *Classification     `json:"classification,omitempty"`
+	Permissions    map[string][]string `json:"permissions,omitempty"`
+	Expired        bool                `json:"expired,omitempty"`
+}
+
+// TestSignature signs a request for Tenant in Mode, one of cavage (the default) or rfc9421
+type TestSignature struct {
+	Tenant string `json:"tenant"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// PolicyTestResult is the outcome of a policy test case; Err is set if the case could not be run
+type PolicyTestResult struct {
+	Case     PolicyTestCase
+	Decision *Decision
+	Err      error
+}
+
+// Passed returns true if the case ran and was decided with the expected status
+func (r PolicyTestResult) Passed() bool {
+	return r.Err == nil && r.Decision != nil && r.Decision.Status == r.Case.Want
+}
+
+func (r PolicyTestResult) String() string {
+	c := r.Case
+	request := fmt.Sprintf("%s %s%s", c.Method, c.Host, c.URI)
+	if c.Name != "" {
+		request = c.Name + ": " + request
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("ERROR %s: %s", request, r.Err)
+	}
+	status := "PASS"
+	if !r.Passed() {
+		status = "FAIL"
+	}
+	rule := r.Decision.Rule
+	if rule == "" {
+		rule = "no rule"
+	}
+	return fmt.Sprintf("%s %s: got %d want %d (%s: %s)", status, request, r.Decision.Status, c.Want, rule, r.Decision.Message)
+}
+
+// LoadPolicyTestSuite reads a policy test suite from file
+func LoadPolicyTestSuite(file string) (suite *PolicyTestSuite, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return suite, err
+	}
+	suite = &PolicyTestSuite{}
+	if err = json.Unmarshal(data, suite); err != nil {
+		return suite, fmt.Errorf("%s: %s", file, err)
+	}
+	return suite, nil
+}
+
+// RunPolicyTests decides each case of suite through the host checks of acs and returns the
+// results in order in enforcing run mode; acs is not modified. Bearer token values, the identity provider key and
+// the public keys of signing tenants are replaced by throwaway values and allow() callouts by the
+// results of each case so that no secrets or network access are needed; an error is returned if
+// an Auth cannot be created for acs
+func RunPolicyTests(acs *AccessSystem, suite *PolicyTestSuite) (results []PolicyTestResult, err error) {
+	idpKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return results, err
+	}
+	idpPEM, err := publicKeyPEM(&idpKey.PublicKey)
+	if err != nil {
+		return results, err
+	}
+
+	test := *acs
+	if acs.Checks != nil {
+		// cases are always decided in enforcing mode
+		checks := *acs.Checks
+		checks.Mode = ""
+		checks.HostGroups = make([]HostGroup, len(acs.Checks.HostGroups))
+		for i, group := range acs.Checks.HostGroups {
+			group.Mode = ""
+			checks.HostGroups[i] = group
+		}
+		test.Checks = &checks
+	}
+	test.Owner.PrivateKey = nil
+	test.Owner.PublicKey = nil
+	test.Blocks = make(map[string]bool)
+	for subject, block := range acs.Blocks {
+		test.Blocks[subject] = block
+	}
+
+	// every token name known to the access system is given a random value
+	values := make(map[string]string)
+	test.Tokens = make(map[string]string)
+	test.Digests = nil
+	for name := range newValidator(acs).tokens {
+		value := randomString()
+		values[name] = value
+		test.Tokens[value] = name
+	}
+
+	// signing tenants are given throwaway keys
+	tenantKeys := make(map[string]*rsa.PrivateKey)
+	test.PublicKeys = make(map[string]string)
+	for tenant, key := range acs.PublicKeys {
+		test.PublicKeys[tenant] = key
+	}
+	for _, c := range suite.Cases {
+		if c.Signature == nil || tenantKeys[c.Signature.Tenant] != nil {
+			continue
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return results, err
+		}
+		pub, err := publicKeyPEM(&key.PublicKey)
+		if err != nil {
+			return results, err
+		}
+		tenantKeys[c.Signature.Tenant] = key
+		test.PublicKeys[c.Signature.Tenant] = string(pub)
+	}
+
+	auth, err := NewAuth(&test, testJWTHeader, idpPEM, nil)
+	if err != nil {
+		return results, err
+	}
+
+	for _, c := range suite.Cases {
+		result := PolicyTestResult{Case: c}
+		stubs := c.Callouts
+		if stubs == nil {
+			stubs = make(map[string]bool)
+		}
+		auth.StubCallouts(stubs)
+		header, err := c.header(test.Owner.UID, values, idpKey, tenantKeys)
+		if err != nil {
+			result.Err = err
+		} else {
+			result.Decision = auth.Check(c.Host, strings.ToUpper(c.Method), c.URI, header)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// testJWTHeader is the header carrying minted JWTs
+const testJWTHeader = "X-Jwt-Header"
+
+// header returns the forwarded request header of c with its credentials minted
+func (c PolicyTestCase) header(owner string, tokens map[string]string, idpKey *rsa.PrivateKey, tenantKeys map[string]*rsa.PrivateKey) (header http.Header, err error) {
+	if c.Host == "" || c.Method == "" || c.URI == "" {
+		return header, fmt.Errorf("host, method and uri are required")
+	}
+	if c.Want == 0 {
+		return header, fmt.Errorf("expected status is required")
+	}
+
+	header = make(http.Header)
+	header.Set("X-Forwarded-Method", strings.ToUpper(c.Method))
+	header.Set("X-Forwarded-Proto", "https")
+	header.Set("X-Forwarded-Host", c.Host)
+	header.Set("X-Forwarded-Uri", c.URI)
+	for name, value := range c.Headers {
+		header.Set(name, value)
+	}
+
+	if c.Bearer != "" {
+		token, ok := tokens[c.Bearer]
+		if !ok {
+			return header, fmt.Errorf("bearer token %s is not defined by the access system", c.Bearer)
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	if c.JWT != nil {
+		token, err := c.JWT.mint(owner, idpKey)
+		if err != nil {
+			return header, err
+		}
+		header.Set(testJWTHeader, token)
+	}
+
+	if c.Signature != nil {
+		if err = c.Signature.sign(header, c.Method, tenantKeys[c.Signature.Tenant]); err != nil {
+			return header, err
+		}
+	}
+	return header, nil
+}
+
+// mint returns an RS256 JWT for the identity signed with idpKey
+func (i *TestIdentity) mint(owner string, idpKey *rsa.PrivateKey) (string, error) {
+	tenant := i.Tenant
+	if tenant == "" {
+		tenant = owner
+	}
+	identity := &Identity{
+		TID:            &tenant,
+		UID:            &i.UID,
+		Superuser:      i.Superuser,
+		Classification: i.Classification,
+	}
+	if i.Name != "" {
+		identity.Name = &i.Name
+	}
+	if i.Email != "" {
+		identity.Email = &i.Email
+	}
+	for context, perms := range i.Permissions {
+		up := UserPermission{Context: context}
+		for _, perm := range perms {
+			category, action, ok := strings.Cut(perm, ":")
+			if !ok {
+				return "", fmt.Errorf("permission '%s' must be of the form CATEGORY:ACTION", perm)
+			}
+			up.Permissions = append(up.Permissions, Permission{Category: category, Actions: []string{action}})
+		}
+		identity.UserPermissions = append(identity.UserPermissions, up)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	if i.Expired {
+		expires = time.Now().Add(-time.Hour)
+	}
+	claims := struct {
+		Identity *Identity `json:"identity"`
+		jwt.RegisteredClaims
+	}{
+		Identity:         identity,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expires)},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(idpKey)
+}
+
+// sign adds a signature of the request to header; RFC 9421 signatures cover the method,
+// authority and path of the forwarded request and the date
+func (s *TestSignature) sign(header http.Header, method string, key *rsa.PrivateKey) error {
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	switch s.Mode {
+	case "", SignatureCavage:
+		signer, _, err := httpsig.NewSigner([]httpsig.Algorithm{httpsig.RSA_SHA256}, httpsig.DigestSha256, []string{"date"}, httpsig.Signature, 0)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(method, "https://"+header.Get("X-Forwarded-Host"), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Date", header.Get("Date"))
+		if err = signer.SignRequest(key, s.Tenant, req, nil); err != nil {
+			return err
+		}
+		header.Set(string(httpsig.Signature), req.Header.Get(string(httpsig.Signature)))
+		return nil
+	case SignatureRFC9421:
+		u, err := url.Parse(header.Get("X-Forwarded-Uri"))
+		if err != nil {
+			return err
+		}
+		header.Set(SignatureInputHeader, fmt.Sprintf(`sig1=("@method" "@authority" "@path" "date");created=%d;keyid="%s";alg="%s"`,
+			time.Now().Unix(), s.Tenant, RSA_V1_5_SHA256))
+		// the verifier computes the signature base; the placeholder signature is replaced
+		header.Set(SignatureHeader, "sig1=:AA==:")
+		v, err := NewRFC9421Verifier(header, method, u.EscapedPath(), u.RawQuery)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256([]byte(v.Base()))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return err
+		}
+		header.Set(SignatureHeader, "sig1=:"+base64.StdEncoding.EncodeToString(sig)+":")
+		return nil
+	}
+	return fmt.Errorf("invalid signature mode '%s'", s.Mode)
+}
+
+func publicKeyPEM(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,186 @@
+package fauth_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestPolicyTestSuite(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/access.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs := &fauth.AccessSystem{}
+	if err := json.Unmarshal(data, acs); err != nil {
+		t.Fatal(err)
+	}
+	suite, err := fauth.LoadPolicyTestSuite("testdata/access.tests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := fauth.RunPolicyTests(acs, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(suite.Cases) {
+		t.Fatalf("got %d results for %d cases", len(results), len(suite.Cases))
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			t.Error(r)
+		}
+	}
+	if acs.Tokens["app-token-value"] != "MC_APP_KEY" {
+		t.Errorf("RunPolicyTests modified the tokens of the access system")
+	}
+}
+
+func TestPolicyTestFailures(t *testing.T) {
+	acs := &fauth.AccessSystem{
+		Owner:  fauth.Owner{UID: "tenant-1"},
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com"},
+					Default: "deny",
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path: "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{
+										"GET": {Expression: "bearer('MC_APP_KEY')"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	suite := &fauth.PolicyTestSuite{
+		Cases: []fauth.PolicyTestCase{
+			{Name: "wrong expectation", Host: "apis.example.com", Method: "GET", URI: "/widgets-api/v1/widgets", Bearer: "MC_APP_KEY", Want: http.StatusForbidden},
+			{Name: "unknown token", Host: "apis.example.com", Method: "GET", URI: "/widgets-api/v1/widgets", Bearer: "NO_SUCH_KEY", Want: http.StatusOK},
+			{Name: "bad permission", Host: "apis.example.com", Method: "GET", URI: "/widgets-api/v1/widgets", JWT: &fauth.TestIdentity{UID: "user-1", Permissions: map[string][]string{"ALL": {"READ"}}}, Want: http.StatusOK},
+		},
+	}
+
+	results, err := fauth.RunPolicyTests(acs, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"FAIL wrong expectation: GET apis.example.com/widgets-api/v1/widgets: got 200 want 403 (widgets-api GET /widgets",
+		"ERROR unknown token: GET apis.example.com/widgets-api/v1/widgets: bearer token NO_SUCH_KEY is not defined",
+		"ERROR bad permission: GET apis.example.com/widgets-api/v1/widgets: permission 'READ' must be of the form CATEGORY:ACTION",
+	}
+	for i, r := range results {
+		if r.Passed() {
+			t.Errorf("case %s passed", r.Case.Name)
+		}
+		if !strings.HasPrefix(r.String(), want[i]) {
+			t.Errorf("got %s, want prefix %s", r, want[i])
+		}
+	}
+}
+
+func TestPolicyTestCallouts(t *testing.T) {
+	// the callouts of a case never reach the URL named by the rule, nor read the ROOT_KEY
+	t.Setenv("ROOT_KEY", "")
+	os.Unsetenv("ROOT_KEY")
+	var calls int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer service.Close()
+
+	acs := &fauth.AccessSystem{Checks: shadowChecks("allow('READ', 'u1', 'widgets', '" + service.URL + "')")}
+	request := fauth.PolicyTestCase{Host: "apis.example.com", Method: "GET", URI: "/widgets-api/v1/widgets"}
+	allowed, denied, unstubbed := request, request, request
+	allowed.Callouts, allowed.Want = map[string]bool{service.URL: true}, http.StatusOK
+	denied.Callouts, denied.Want = map[string]bool{service.URL: false}, http.StatusForbidden
+	unstubbed.Want = http.StatusForbidden
+
+	results, err := fauth.RunPolicyTests(acs, &fauth.PolicyTestSuite{Cases: []fauth.PolicyTestCase{allowed, denied, unstubbed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			t.Error(r)
+		}
+	}
+	if !strings.Contains(results[2].Decision.Message, "not evaluated") {
+		t.Errorf("got message %s for a callout without a result", results[2].Decision.Message)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("got %d callouts from policy tests", n)
+	}
+}
+
+func TestPolicyTestSignatures(t *testing.T) {
+	acs := &fauth.AccessSystem{
+		Owner: fauth.Owner{UID: "tenant-1"},
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "Partner Hosts",
+					Hosts:   []string{"partners.example.com"},
+					Default: "deny",
+					Checks: []fauth.Check{
+						{
+							Name: "orders-api",
+							Base: "/orders-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path: "/tenants/:tenantID/orders",
+									Rules: map[fauth.Method]fauth.Rule{
+										"GET":  {Expression: "signature(param(':tenantID'))"},
+										"POST": {Expression: "signature(param(':tenantID'), 'rfc9421')"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	uri := "/orders-api/v1/tenants/tenant-2/orders"
+	suite := &fauth.PolicyTestSuite{
+		Cases: []fauth.PolicyTestCase{
+			{Name: "cavage", Host: "partners.example.com", Method: "GET", URI: uri, Signature: &fauth.TestSignature{Tenant: "tenant-2"}, Want: http.StatusOK},
+			{Name: "cavage other tenant", Host: "partners.example.com", Method: "GET", URI: uri, Signature: &fauth.TestSignature{Tenant: "tenant-3"}, Want: http.StatusForbidden},
+			{Name: "cavage unsigned", Host: "partners.example.com", Method: "GET", URI: uri, Want: http.StatusForbidden},
+			{Name: "rfc9421", Host: "partners.example.com", Method: "POST", URI: uri, Signature: &fauth.TestSignature{Tenant: "tenant-2", Mode: fauth.SignatureRFC9421}, Want: http.StatusOK},
+			{Name: "rfc9421 rejects cavage", Host: "partners.example.com", Method: "POST", URI: uri, Signature: &fauth.TestSignature{Tenant: "tenant-2"}, Want: http.StatusForbidden},
+		},
+	}
+
+	results, err := fauth.RunPolicyTests(acs, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			t.Error(r)
+		}
+	}
+}
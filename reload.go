@@ -0,0 +1,136 @@
+package fauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// ReloadStatus reports the live access system and the outcome of the most recent reloads:
+//   - Version is the fingerprint of the live access system (see Fingerprint) and Loaded is the
+//     time it was loaded
+//   - LastAttempt is the time of the most recent reload, successful or not
+//   - Failures counts the reloads that failed since the live access system was loaded;
+//     LastError and LastFailure are the error and time of the most recent of them
+//   - Degraded explains why the live access system may be stale, eg because it is the last
+//     known good access system loaded while the store was unavailable (see SetDegraded)
+//
+// A failed reload leaves the live access system in place
+type ReloadStatus struct {
+	Version     string     `json:"version"`
+	Loaded      time.Time  `json:"loaded"`
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	Degraded    string     `json:"degraded,omitempty"`
+}
+
+// Failed returns true if the most recent reload failed
+func (s ReloadStatus) Failed() bool {
+	return s.Failures > 0
+}
+
+// reloadState records the reloads of an Auth since its live access system was loaded
+type reloadState struct {
+	attempt  time.Time
+	failures int
+	err      error
+	failed   time.Time
+	degraded string
+}
+
+// Fingerprint returns the digest of acs that identifies the version of an access system
+// regardless of where it was loaded from; empty fields are omitted as by FormatAccessSystem, so
+// that an empty map loaded from one store and a nil map loaded from another have one fingerprint
+func Fingerprint(acs *AccessSystem) string {
+	data, err := json.Marshal(acs)
+	if err == nil {
+		data, err = omitEmpty(data, "")
+	}
+	if err != nil { // shouldn't happen
+		log.Errorf("failed to marshal access system: %s", err)
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReloadStatus returns the version of the live access system and the outcome of recent reloads
+func (auth *Auth) ReloadStatus() ReloadStatus {
+	s := auth.current()
+	status := ReloadStatus{Version: s.version, Loaded: s.loaded}
+
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	r := auth.reload
+	status.Degraded = r.degraded
+	if !r.attempt.IsZero() {
+		status.LastAttempt = &r.attempt
+	}
+	if r.failures > 0 {
+		status.Failures = r.failures
+		status.LastError = r.err.Error()
+		status.LastFailure = &r.failed
+	}
+	return status
+}
+
+// ReloadFailed records a reload that failed before an access system could be loaded, eg
+// because the store could not be read or its access file could not be parsed; the live
+// access system is kept
+func (auth *Auth) ReloadFailed(err error) {
+	if err == nil {
+		err = fmt.Errorf("access system reload failed")
+	}
+	auth.reloaded(err)
+}
+
+// reloaded records the outcome of a reload in the reload status and metrics of auth
+func (auth *Auth) reloaded(err error) {
+	auth.metrics.reloaded(err)
+
+	now := time.Now()
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.reload.attempt = now
+	if err == nil {
+		auth.reload.failures, auth.reload.err, auth.reload.degraded = 0, nil, ""
+		return
+	}
+	log.Errorf("access system reload failed; keeping version %s: %s", auth.current().version, err)
+	auth.reload.failures++
+	auth.reload.err = err
+	auth.reload.failed = now
+}
+
+// validateReload returns the first error in the host groups, checks and paths of acs that the
+// access system API would reject; a reload is only compiled and applied if it is well formed
+func validateReload(acs *AccessSystem) error {
+	if acs == nil {
+		return fmt.Errorf("no access system was loaded")
+	}
+	if acs.Checks == nil {
+		return nil
+	}
+	for _, group := range acs.Checks.HostGroups {
+		if err := group.Validate(); err != nil {
+			return fmt.Errorf("host group %s: %s", group.Name, err)
+		}
+		for _, check := range group.Checks {
+			if err := check.Validate(); err != nil {
+				return fmt.Errorf("host group %s check %s: %s", group.Name, check.Name, err)
+			}
+			for _, path := range check.Paths {
+				if err := path.Validate(); err != nil {
+					return fmt.Errorf("host group %s check %s path %s: %s", group.Name, check.Name, path.Path, err)
+				}
+			}
+		}
+	}
+	return nil
+}
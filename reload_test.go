@@ -0,0 +1,51 @@
+package fauth_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestReloadStatus(t *testing.T) {
+	auth := newTestAuth(t, versionedAccess(1))
+	status := auth.ReloadStatus()
+	if status.Version != fauth.Fingerprint(versionedAccess(1)) || status.Failed() || status.LastAttempt != nil {
+		t.Fatalf("got initial status %+v", status)
+	}
+	update := auth.UpdateFunc()
+
+	// a host group without a default is rejected before it is compiled
+	invalid := versionedAccess(2)
+	invalid.Checks.HostGroups[0].Default = ""
+	if err := update(invalid); err == nil {
+		t.Fatal("got no error for host group without default")
+	}
+	auth.ReloadFailed(fmt.Errorf("unexpected end of JSON input"))
+
+	status = auth.ReloadStatus()
+	if status.Version != fauth.Fingerprint(versionedAccess(1)) || status.Failures != 2 || status.LastFailure == nil {
+		t.Errorf("got status %+v after failed reloads", status)
+	}
+	if !strings.Contains(status.LastError, "JSON") {
+		t.Errorf("got last error %s", status.LastError)
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token")
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header); d.Token != "APP_KEY_1" {
+		t.Errorf("got token '%s' after failed reloads, want APP_KEY_1", d.Token)
+	}
+
+	if err := update(versionedAccess(2)); err != nil {
+		t.Fatal(err)
+	}
+	status = auth.ReloadStatus()
+	if status.Version != fauth.Fingerprint(versionedAccess(2)) || status.Failed() || status.LastError != "" || status.LastAttempt == nil {
+		t.Errorf("got status %+v after reload", status)
+	}
+	if status.Version == fauth.Fingerprint(versionedAccess(1)) {
+		t.Errorf("access systems 1 and 2 have the same fingerprint")
+	}
+}
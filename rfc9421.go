@@ -0,0 +1,612 @@
+package fauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/httpsig"
+	"bitbucket.org/_metalogic_/log"
+)
+
+// RFC 9421 HTTP Message Signatures carry the covered components and signature parameters
+// in the Signature-Input header and the signature value in the Signature header, each keyed
+// by a signature label:
+//
+//	Signature-Input: sig1=("@method" "@authority" "@path" "content-type");created=1618884473;keyid="test-key-ed25519"
+//	Signature: sig1=:wqcAqbmYJ2ji2glfAMaRy4gruYYnx2nEFN2HN6jrnDnQCK1u02Gb04v9EDgwUPiu4A0w6vuQv5lIp5WPpBKRCw==:
+//
+// The older draft-cavage format carries everything in a single Signature header and is
+// verified by httpsig.NewForwardAuthVerifier.
+const (
+	SignatureInputHeader = "Signature-Input"
+	SignatureHeader      = "Signature"
+)
+
+// signature algorithms registered by RFC 9421 section 6.2.2
+const (
+	RSA_PSS_SHA512    = "rsa-pss-sha512"
+	RSA_V1_5_SHA256   = "rsa-v1_5-sha256"
+	HMAC_SHA256       = "hmac-sha256"
+	ECDSA_P256_SHA256 = "ecdsa-p256-sha256"
+	ECDSA_P384_SHA384 = "ecdsa-p384-sha384"
+	ED25519           = "ed25519"
+)
+
+// maximum allowed clock skew when checking created and expires signature parameters
+const signatureClockSkew = 10
+
+// DefaultSignatureMaxAge is the default maximum age of the created signature parameter; older
+// signatures are rejected so that a captured request cannot be replayed indefinitely
+const DefaultSignatureMaxAge = 5 * time.Minute
+
+var _ httpsig.Verifier = &RFC9421Verifier{}
+
+// SetSignatureMaxAge sets the maximum age of the created parameter of RFC 9421 signatures
+// verified by auth (default DefaultSignatureMaxAge)
+func (auth *Auth) SetSignatureMaxAge(maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return fmt.Errorf("invalid signature max age %s", maxAge)
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.signatureMaxAge = maxAge
+	return nil
+}
+
+// getSignatureMaxAge returns the signature max age of auth, which is nil for handlers that are
+// not bound to an Auth
+func (auth *Auth) getSignatureMaxAge() time.Duration {
+	if auth == nil {
+		return DefaultSignatureMaxAge
+	}
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	return auth.signatureMaxAge
+}
+
+// RFC9421Verifier verifies an RFC 9421 HTTP message signature on a Traefik forwarded request
+type RFC9421Verifier struct {
+	label     string
+	keyID     string
+	alg       string
+	created   int64
+	expires   int64
+	signature []byte
+	base      string
+}
+
+// NewRFC9421Verifier returns a verifier for the first signature found in the Signature-Input
+// and Signature headers of a Traefik auth request. Derived components are resolved against the
+// forwarded method, path and query, and against the X-Forwarded-Host and X-Forwarded-Proto headers;
+// path is the path as it appears in the target URI, eg /a%2Fb rather than the decoded /a/b.
+// It returns an error if the headers are missing or malformed, if the signature does not cover the
+// method, authority and path of the request, if a covered component cannot be resolved, or if the
+// signature is expired, created in the future or created more than DefaultSignatureMaxAge ago.
+func NewRFC9421Verifier(h http.Header, method, path, rawQuery string) (*RFC9421Verifier, error) {
+	return newRFC9421Verifier(h, method, path, rawQuery, "", DefaultSignatureMaxAge)
+}
+
+// NewRFC9421LabelVerifier is like NewRFC9421Verifier but selects the signature by label, or the
+// first signature if label is empty, and rejects signatures created more than maxAge ago
+func NewRFC9421LabelVerifier(h http.Header, method, path, rawQuery, label string, maxAge time.Duration) (*RFC9421Verifier, error) {
+	return newRFC9421Verifier(h, method, path, rawQuery, label, maxAge)
+}
+
+// requiredComponents are the components a signature must cover, each satisfied by any of the
+// listed components, so that a signature cannot be replayed against another request target
+var requiredComponents = [][]string{
+	{"@method"},
+	{"@authority", "@target-uri"},
+	{"@path", "@target-uri", "@request-target"},
+}
+
+func newRFC9421Verifier(h http.Header, method, path, rawQuery, label string, maxAge time.Duration) (*RFC9421Verifier, error) {
+	inputs, err := parseDictionary(strings.Join(h.Values(SignatureInputHeader), ", "))
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s header: %s", SignatureInputHeader, err)
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%s header not found", SignatureInputHeader)
+	}
+	signatures, err := parseDictionary(strings.Join(h.Values(SignatureHeader), ", "))
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s header: %s", SignatureHeader, err)
+	}
+
+	var input dictionaryMember
+	if label == "" {
+		input = inputs[0]
+	} else {
+		var found bool
+		for _, m := range inputs {
+			if m.name == label {
+				input, found = m, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("signature input '%s' not found", label)
+		}
+	}
+
+	var sigValue string
+	for _, m := range signatures {
+		if m.name == input.name {
+			sigValue = m.value
+			break
+		}
+	}
+	if sigValue == "" {
+		return nil, fmt.Errorf("signature '%s' not found in %s header", input.name, SignatureHeader)
+	}
+	if len(sigValue) < 2 || sigValue[0] != ':' || sigValue[len(sigValue)-1] != ':' {
+		return nil, fmt.Errorf("signature '%s' is not a byte sequence", input.name)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigValue[1 : len(sigValue)-1])
+	if err != nil {
+		return nil, fmt.Errorf("signature '%s' is not valid base64: %s", input.name, err)
+	}
+
+	components, params, err := parseInnerList(input.value)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature input '%s': %s", input.name, err)
+	}
+
+	v := &RFC9421Verifier{
+		label:     input.name,
+		signature: sig,
+	}
+	for _, p := range params {
+		switch p.name {
+		case "keyid":
+			v.keyID = unquote(p.value)
+		case "alg":
+			v.alg = unquote(p.value)
+		case "created":
+			v.created, err = strconv.ParseInt(p.value, 10, 64)
+		case "expires":
+			v.expires, err = strconv.ParseInt(p.value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature parameter %s: %s", p.name, p.value)
+		}
+	}
+
+	for _, required := range requiredComponents {
+		if !covers(components, required) {
+			return nil, fmt.Errorf("signature '%s' does not cover %s", v.label, strings.Join(required, " or "))
+		}
+	}
+
+	now := time.Now().Unix()
+	if v.created == 0 {
+		return nil, fmt.Errorf("signature '%s' has no created parameter", v.label)
+	}
+	if v.created-now > signatureClockSkew {
+		return nil, fmt.Errorf("created is in the future")
+	}
+	if now-v.created > int64(maxAge/time.Second)+signatureClockSkew {
+		return nil, fmt.Errorf("signature was created more than %s ago", maxAge)
+	}
+	if v.expires != 0 && now-v.expires > signatureClockSkew {
+		return nil, fmt.Errorf("signature expired")
+	}
+
+	msg := &forwardedMessage{
+		header:   h,
+		method:   method,
+		path:     path,
+		rawQuery: rawQuery,
+	}
+
+	var b strings.Builder
+	for _, c := range components {
+		value, err := msg.component(c)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(c.raw)
+		b.WriteString(": ")
+		b.WriteString(value)
+		b.WriteString("\n")
+	}
+	b.WriteString(`"@signature-params": `)
+	b.WriteString(input.value)
+	v.base = b.String()
+
+	log.Debugf("RFC 9421 signature base for %s: %q", v.label, v.base)
+
+	return v, nil
+}
+
+// covers returns true if any of names is among components
+func covers(components []componentID, names []string) bool {
+	for _, c := range components {
+		for _, name := range names {
+			if c.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// KeyID returns the keyid signature parameter
+func (v *RFC9421Verifier) KeyID() string {
+	return v.keyID
+}
+
+// Label returns the label of the signature being verified
+func (v *RFC9421Verifier) Label() string {
+	return v.label
+}
+
+// Algorithm returns the alg signature parameter, which is optional in RFC 9421
+func (v *RFC9421Verifier) Algorithm() string {
+	return v.alg
+}
+
+// Base returns the signature base computed from the covered components
+func (v *RFC9421Verifier) Base() string {
+	return v.base
+}
+
+// Verify verifies the signature with key. The algorithm is taken from the alg signature
+// parameter when present and otherwise from the type of key; RSA keys are tried with
+// rsa-pss-sha512 and then rsa-v1_5-sha256. The algo argument is accepted for compatibility
+// with httpsig.Verifier and is only consulted to choose an RSA algorithm when alg is absent.
+func (v *RFC9421Verifier) Verify(key crypto.PublicKey, algo httpsig.Algorithm) error {
+	if v.alg != "" {
+		return verifyMessage(v.alg, key, []byte(v.base), v.signature)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algo == httpsig.RSA_SHA256 {
+			if err := verifyMessage(RSA_V1_5_SHA256, k, []byte(v.base), v.signature); err == nil {
+				return nil
+			}
+		}
+		if err := verifyMessage(RSA_PSS_SHA512, k, []byte(v.base), v.signature); err == nil {
+			return nil
+		}
+		return verifyMessage(RSA_V1_5_SHA256, k, []byte(v.base), v.signature)
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize == 384 {
+			return verifyMessage(ECDSA_P384_SHA384, k, []byte(v.base), v.signature)
+		}
+		return verifyMessage(ECDSA_P256_SHA256, k, []byte(v.base), v.signature)
+	case ed25519.PublicKey:
+		return verifyMessage(ED25519, k, []byte(v.base), v.signature)
+	case []byte:
+		return verifyMessage(HMAC_SHA256, k, []byte(v.base), v.signature)
+	}
+	return fmt.Errorf("unsupported key type %T for RFC 9421 signature", key)
+}
+
+func verifyMessage(alg string, key crypto.PublicKey, base, sig []byte) error {
+	switch alg {
+	case RSA_PSS_SHA512:
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s requires an RSA public key", alg)
+		}
+		digest := sha512.Sum512(base)
+		return rsa.VerifyPSS(k, crypto.SHA512, digest[:], sig, &rsa.PSSOptions{SaltLength: 64})
+	case RSA_V1_5_SHA256:
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s requires an RSA public key", alg)
+		}
+		digest := sha256.Sum256(base)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case ECDSA_P256_SHA256:
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().BitSize != 256 {
+			return fmt.Errorf("%s requires a P-256 public key", alg)
+		}
+		digest := sha256.Sum256(base)
+		return verifyECDSA(k, digest[:], sig, 32)
+	case ECDSA_P384_SHA384:
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().BitSize != 384 {
+			return fmt.Errorf("%s requires a P-384 public key", alg)
+		}
+		digest := sha512.Sum384(base)
+		return verifyECDSA(k, digest[:], sig, 48)
+	case ED25519:
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s requires an Ed25519 public key", alg)
+		}
+		if !ed25519.Verify(k, base, sig) {
+			return fmt.Errorf("invalid http message signature")
+		}
+		return nil
+	case HMAC_SHA256:
+		k, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("%s requires a shared secret of type []byte", alg)
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(base)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return fmt.Errorf("invalid http message signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported RFC 9421 signature algorithm: %s", alg)
+}
+
+// RFC 9421 ECDSA signatures are the fixed size concatenation of r and s
+func verifyECDSA(key *ecdsa.PublicKey, digest, sig []byte, size int) error {
+	if len(sig) != 2*size {
+		return fmt.Errorf("invalid ECDSA signature length %d", len(sig))
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(key, digest, r, s) {
+		return fmt.Errorf("invalid http message signature")
+	}
+	return nil
+}
+
+// forwardedMessage resolves RFC 9421 component values from a Traefik auth request
+type forwardedMessage struct {
+	header   http.Header
+	method   string
+	path     string
+	rawQuery string
+}
+
+func (m *forwardedMessage) authority() string {
+	host := m.header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = m.header.Get("Host")
+	}
+	return strings.ToLower(host)
+}
+
+func (m *forwardedMessage) scheme() string {
+	scheme := m.header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "https"
+	}
+	return strings.ToLower(scheme)
+}
+
+func (m *forwardedMessage) component(c componentID) (string, error) {
+	for _, p := range c.params {
+		if p.name != "name" && (p.name != "req" || p.value != "?1") {
+			return "", fmt.Errorf("unsupported parameter '%s' on component %s", p.name, c.raw)
+		}
+	}
+
+	switch c.name {
+	case "@method":
+		return strings.ToUpper(m.method), nil
+	case "@authority":
+		return m.authority(), nil
+	case "@scheme":
+		return m.scheme(), nil
+	case "@path":
+		if m.path == "" {
+			return "/", nil
+		}
+		return m.path, nil
+	case "@query":
+		return "?" + m.rawQuery, nil
+	case "@request-target":
+		if m.rawQuery == "" {
+			return m.path, nil
+		}
+		return m.path + "?" + m.rawQuery, nil
+	case "@target-uri":
+		target := m.scheme() + "://" + m.authority() + m.path
+		if m.rawQuery != "" {
+			target += "?" + m.rawQuery
+		}
+		return target, nil
+	case "@query-param":
+		name := ""
+		for _, p := range c.params {
+			if p.name == "name" {
+				name = unquote(p.value)
+			}
+		}
+		if name == "" {
+			return "", fmt.Errorf("component @query-param requires a name parameter")
+		}
+		// the name parameter is percent-encoded like the value
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			return "", fmt.Errorf("invalid @query-param name: %s", err)
+		}
+		values, err := url.ParseQuery(m.rawQuery)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse query for @query-param: %s", err)
+		}
+		vs, ok := values[name]
+		if !ok || len(vs) != 1 {
+			return "", fmt.Errorf("query parameter '%s' must occur exactly once", name)
+		}
+		return percentEncode(vs[0]), nil
+	case "@status", "@signature-params":
+		return "", fmt.Errorf("component %s is not permitted in a request signature", c.name)
+	}
+
+	if strings.HasPrefix(c.name, "@") {
+		return "", fmt.Errorf("unknown derived component %s", c.name)
+	}
+
+	values, ok := m.header[http.CanonicalHeaderKey(c.name)]
+	if !ok {
+		return "", fmt.Errorf("covered header field '%s' not found in request", c.name)
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+// percentEncode encodes s as the value of an RFC 9421 @query-param component: every character
+// but the RFC 3986 unreserved characters is percent-encoded, so a space is encoded as %20 and
+// not as the + of url.QueryEscape
+func percentEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// componentID is a covered component identifier; raw is its serialization in Signature-Input
+type componentID struct {
+	raw    string
+	name   string
+	params []parameter
+}
+
+type parameter struct {
+	name  string
+	value string
+}
+
+type dictionaryMember struct {
+	name  string
+	value string
+}
+
+// parseDictionary splits a structured field dictionary into members; it is
+// sufficient for the Signature-Input and Signature fields and keeps member values in their
+// serialized form, which RFC 9421 requires for the @signature-params line of the signature base
+func parseDictionary(s string) (members []dictionaryMember, err error) {
+	var (
+		depth   int
+		quoted  bool
+		escaped bool
+		start   int
+	)
+	split := func(end int) error {
+		item := strings.TrimSpace(s[start:end])
+		if item == "" {
+			return nil
+		}
+		eq := strings.Index(item, "=")
+		if eq <= 0 {
+			return fmt.Errorf("dictionary member '%s' has no value", item)
+		}
+		members = append(members, dictionaryMember{
+			name:  strings.TrimSpace(item[:eq]),
+			value: strings.TrimSpace(item[eq+1:]),
+		})
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			if err = split(i); err != nil {
+				return members, err
+			}
+			start = i + 1
+		}
+	}
+	if quoted || depth != 0 {
+		return members, fmt.Errorf("unbalanced quotes or parentheses")
+	}
+	return members, split(len(s))
+}
+
+// parseInnerList parses an inner list of quoted component identifiers and its parameters,
+// eg ("@method" "@query-param";name="Pet" "content-type");created=1618884473;keyid="k"
+func parseInnerList(s string) (components []componentID, params []parameter, err error) {
+	if len(s) == 0 || s[0] != '(' {
+		return nil, nil, fmt.Errorf("inner list must begin with '('")
+	}
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, nil, fmt.Errorf("inner list is not closed")
+	}
+	list := s[1:end]
+	for len(strings.TrimSpace(list)) > 0 {
+		list = strings.TrimLeft(list, " ")
+		if list[0] != '"' {
+			return nil, nil, fmt.Errorf("component identifier must be a quoted string: %s", list)
+		}
+		close := strings.Index(list[1:], `"`)
+		if close < 0 {
+			return nil, nil, fmt.Errorf("unterminated component identifier: %s", list)
+		}
+		name := list[1 : close+1]
+		rest := list[close+2:]
+		next := strings.Index(rest, " ")
+		if next < 0 {
+			next = len(rest)
+		}
+		cps, err := parseParameters(rest[:next])
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.ToLower(name) != name {
+			return nil, nil, fmt.Errorf("component identifier must be lowercase: %s", name)
+		}
+		components = append(components, componentID{
+			raw:    list[:close+2+next],
+			name:   name,
+			params: cps,
+		})
+		list = rest[next:]
+	}
+	params, err = parseParameters(s[end+1:])
+	return components, params, err
+}
+
+// parseParameters parses a sequence of ;key=value parameters; a bare key has the value ?1
+func parseParameters(s string) (params []parameter, err error) {
+	if strings.TrimSpace(s) == "" {
+		return params, nil
+	}
+	if s[0] != ';' {
+		return nil, fmt.Errorf("malformed parameters: %s", s)
+	}
+	for _, p := range strings.Split(s[1:], ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("malformed parameters: %s", s)
+		}
+		value := "?1"
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		params = append(params, parameter{name: kv[0], value: value})
+	}
+	return params, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(strings.ReplaceAll(s[1:len(s)-1], `\"`, `"`), `\\`, `\`)
+	}
+	return s
+}
@@ -0,0 +1,153 @@
+package fauth
+
+import (
+	"fmt"
+	"strings"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// Run modes control how decisions are enforced:
+//   - enforcing denies requests that the host checks deny (the default)
+//   - permissive allows every request but logs the requests that would have been denied
+//   - disabled allows every request without evaluating the host checks
+const (
+	RunEnforcing  = "enforcing"
+	RunPermissive = "permissive"
+	RunDisabled   = "disabled"
+)
+
+// RunModes lists the valid run modes
+var RunModes = []string{RunEnforcing, RunPermissive, RunDisabled}
+
+// legacyRunModes are the run modes of earlier releases, by lower case name, and the run modes
+// that replace them: noAuth was set by -disable and none was documented by the admin API
+var legacyRunModes = map[string]string{
+	"noauth": RunDisabled,
+	"none":   RunDisabled,
+}
+
+// replaceLegacyRunMode returns the run mode that replaces a legacy run mode with a deprecation
+// warning, or mode if it is not a legacy run mode
+func replaceLegacyRunMode(mode string) string {
+	if replacement, ok := legacyRunModes[strings.ToLower(mode)]; ok {
+		log.Warningf("run mode '%s' is deprecated; use '%s'", mode, replacement)
+		return replacement
+	}
+	return mode
+}
+
+// RunModeInfo reports the run mode in effect globally and for each host group
+type RunModeInfo struct {
+	Mode       string            `json:"mode"`
+	HostGroups map[string]string `json:"hostGroups,omitempty"`
+}
+
+// validateRunMode returns an error if mode is not empty and not a valid run mode
+func validateRunMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	for _, m := range RunModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid run mode '%s'; must be one of %v", mode, RunModes)
+}
+
+// runModes holds the run modes set at runtime; a mode set at runtime takes precedence over the
+// host checks of the access system and a host group mode takes precedence over the global mode
+// of the same source
+type runModes struct {
+	global string            // set at runtime
+	groups map[string]string // set at runtime by host group name
+}
+
+// mode returns the run mode in effect for the named host group, or globally if group is empty,
+// given the run modes set by the host checks of snapshot s
+func (m runModes) mode(s *snapshot, group string) string {
+	if mode := m.groups[group]; group != "" && mode != "" {
+		return mode
+	}
+	if m.global != "" {
+		return m.global
+	}
+	if mode := s.groupModes[group]; group != "" && mode != "" {
+		return mode
+	}
+	if s.mode != "" {
+		return s.mode
+	}
+	return RunEnforcing
+}
+
+// SetRunMode sets the global run mode, overriding the modes of the access system; an empty
+// mode restores the modes of the access system. The legacy run modes noAuth and none are
+// replaced by disabled
+func (auth *Auth) SetRunMode(mode string) error {
+	mode = replaceLegacyRunMode(mode)
+	if err := validateRunMode(mode); err != nil {
+		return err
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.runModes.global = mode
+	return nil
+}
+
+// SetHostGroupRunMode sets the run mode of the named host group, overriding the global run
+// mode and the modes of the access system; an empty mode removes the host group run mode
+func (auth *Auth) SetHostGroupRunMode(group, mode string) error {
+	mode = replaceLegacyRunMode(mode)
+	if err := validateRunMode(mode); err != nil {
+		return err
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if _, ok := auth.current().groupModes[group]; !ok {
+		return fmt.Errorf("host group '%s' not found", group)
+	}
+	groups := make(map[string]string)
+	for name, m := range auth.runModes.groups {
+		groups[name] = m
+	}
+	if mode == "" {
+		delete(groups, group)
+	} else {
+		groups[group] = mode
+	}
+	auth.runModes.groups = groups
+	return nil
+}
+
+// RunMode returns the global run mode
+func (auth *Auth) RunMode() string {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	return auth.runModes.mode(auth.current(), "")
+}
+
+// HostRunMode returns the run mode in effect for host
+func (auth *Auth) HostRunMode(host string) string {
+	return auth.hostRunMode(auth.current(), host)
+}
+
+// hostRunMode returns the run mode in effect for host with snapshot s
+func (auth *Auth) hostRunMode(s *snapshot, host string) string {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	return auth.runModes.mode(s, s.hostGroups[host].Name)
+}
+
+// RunModeInfo returns the global run mode and the run mode in effect for each host group
+func (auth *Auth) RunModeInfo() RunModeInfo {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	s := auth.current()
+	info := RunModeInfo{Mode: auth.runModes.mode(s, ""), HostGroups: make(map[string]string)}
+	for group := range s.groupModes {
+		info.HostGroups[group] = auth.runModes.mode(s, group)
+	}
+	return info
+}
@@ -0,0 +1,143 @@
+package fauth_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func runModeAccessSystem(mode, groupMode string) *fauth.AccessSystem {
+	return &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: &fauth.HostChecks{
+			Mode: mode,
+			HostGroups: []fauth.HostGroup{
+				{
+					Name:    "API Hosts",
+					Hosts:   []string{"apis.example.com"},
+					Default: "deny",
+					Mode:    groupMode,
+					Checks: []fauth.Check{
+						{
+							Name: "widgets-api",
+							Base: "/widgets-api/v1",
+							Paths: []fauth.Path{
+								{
+									Path: "/widgets",
+									Rules: map[fauth.Method]fauth.Rule{
+										"GET": {Expression: "bearer('MC_APP_KEY')"},
+									},
+								},
+							},
+						},
+					},
+				},
+				{Name: "Web Hosts", Hosts: []string{"www.example.com"}, Default: "deny"},
+			},
+		},
+	}
+}
+
+func TestRunModePrecedence(t *testing.T) {
+	auth := newTestAuth(t, runModeAccessSystem(fauth.RunPermissive, fauth.RunDisabled))
+
+	if got := auth.HostRunMode("apis.example.com"); got != fauth.RunDisabled {
+		t.Errorf("host group mode: got %s, want %s", got, fauth.RunDisabled)
+	}
+	if got := auth.HostRunMode("www.example.com"); got != fauth.RunPermissive {
+		t.Errorf("access system mode: got %s, want %s", got, fauth.RunPermissive)
+	}
+
+	// a runtime global mode overrides the modes of the access system
+	if err := auth.SetRunMode(fauth.RunEnforcing); err != nil {
+		t.Fatal(err)
+	}
+	if got := auth.HostRunMode("apis.example.com"); got != fauth.RunEnforcing {
+		t.Errorf("runtime global mode: got %s, want %s", got, fauth.RunEnforcing)
+	}
+
+	// a runtime host group mode overrides the runtime global mode
+	if err := auth.SetHostGroupRunMode("Web Hosts", fauth.RunDisabled); err != nil {
+		t.Fatal(err)
+	}
+	info := auth.RunModeInfo()
+	if info.Mode != fauth.RunEnforcing || info.HostGroups["Web Hosts"] != fauth.RunDisabled || info.HostGroups["API Hosts"] != fauth.RunEnforcing {
+		t.Errorf("got run mode info %+v", info)
+	}
+
+	// resetting restores the modes of the access system
+	auth.SetRunMode("")
+	auth.SetHostGroupRunMode("Web Hosts", "")
+	if got := auth.HostRunMode("www.example.com"); got != fauth.RunPermissive {
+		t.Errorf("reset mode: got %s, want %s", got, fauth.RunPermissive)
+	}
+	if got := newTestAuth(t, runModeAccessSystem("", "")).RunMode(); got != fauth.RunEnforcing {
+		t.Errorf("default mode: got %s, want %s", got, fauth.RunEnforcing)
+	}
+}
+
+func TestRunModeDecisions(t *testing.T) {
+	auth := newTestAuth(t, runModeAccessSystem("", ""))
+	uri := "/widgets-api/v1/widgets"
+
+	d := auth.Check("apis.example.com", "GET", uri, http.Header{})
+	if d.Status != http.StatusForbidden || d.Mode != fauth.RunEnforcing || !d.Enforced() {
+		t.Errorf("enforcing: got status %d mode %s", d.Status, d.Mode)
+	}
+
+	auth.SetHostGroupRunMode("API Hosts", fauth.RunPermissive)
+	d = auth.Check("apis.example.com", "GET", uri, http.Header{})
+	if d.Status != http.StatusOK || d.Unenforced != http.StatusForbidden || d.Enforced() {
+		t.Errorf("permissive denial: got status %d unenforced %d", d.Status, d.Unenforced)
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token-value")
+	d = auth.Check("apis.example.com", "GET", uri, header)
+	if d.Status != http.StatusOK || d.Unenforced != 0 || d.Token != "MC_APP_KEY" || !d.Enforced() {
+		t.Errorf("permissive allow: got status %d unenforced %d token %s", d.Status, d.Unenforced, d.Token)
+	}
+	if e := auth.Explain("apis.example.com", "GET", uri, http.Header{}); e.Mode != fauth.RunPermissive || e.Unenforced != http.StatusForbidden || e.Rule == "" {
+		t.Errorf("permissive explain: got mode %s unenforced %d rule %s", e.Mode, e.Unenforced, e.Rule)
+	}
+
+	auth.SetHostGroupRunMode("API Hosts", fauth.RunDisabled)
+	d = auth.Check("apis.example.com", "GET", uri, http.Header{})
+	if d.Status != http.StatusOK || d.Rule != "" || d.Enforced() {
+		t.Errorf("disabled: got status %d rule %s", d.Status, d.Rule)
+	}
+	if d := auth.Check("www.example.com", "GET", "/", http.Header{}); d.Status != http.StatusForbidden {
+		t.Errorf("other host group: got status %d, want %d", d.Status, http.StatusForbidden)
+	}
+}
+
+func TestRunModeErrors(t *testing.T) {
+	auth := newTestAuth(t, runModeAccessSystem("", ""))
+	if err := auth.SetRunMode("audit"); err == nil || !strings.Contains(err.Error(), "invalid run mode") {
+		t.Errorf("got error %v for invalid mode", err)
+	}
+	if err := auth.SetHostGroupRunMode("No Such Hosts", fauth.RunDisabled); err == nil {
+		t.Errorf("got no error for unknown host group")
+	}
+
+	if _, err := fauth.NewAuth(runModeAccessSystem("audit", ""), jwtHeader, nil, nil); err == nil {
+		t.Errorf("got no error for invalid access system mode")
+	}
+	if _, err := fauth.NewAuth(runModeAccessSystem("", "audit"), jwtHeader, nil, nil); err == nil {
+		t.Errorf("got no error for invalid host group mode")
+	}
+}
+
+func TestLegacyRunModes(t *testing.T) {
+	auth := newTestAuth(t, runModeAccessSystem("", ""))
+	for _, mode := range []string{"noAuth", "none"} {
+		auth.SetRunMode("")
+		if err := auth.SetRunMode(mode); err != nil {
+			t.Fatalf("got error %s for legacy run mode %s", err, mode)
+		}
+		if got := auth.RunMode(); got != fauth.RunDisabled {
+			t.Errorf("got run mode %s for legacy run mode %s, want %s", got, mode, fauth.RunDisabled)
+		}
+	}
+}
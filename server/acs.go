@@ -43,6 +43,7 @@ func HostGroups(store fauth.Store) func(w http.ResponseWriter, r *http.Request,
 // @Success 200 {string} ok
 // @Failure 401 {object} ErrorResponse
 // @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /forward-auth/v1/hostgroups [get]
 func CreateHostGroup(userHeader string, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
@@ -74,7 +75,7 @@ func CreateHostGroup(userHeader string, store fauth.Store) func(w http.ResponseW
 
 		hostChecks, err := db.CreateHostGroup(sessionGUID, group)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -127,7 +128,7 @@ func UpdateHostGroup(userHeader string, store fauth.Store) func(w http.ResponseW
 
 		hostChecks, err := db.UpdateHostGroup(sessionGUID, groupGUID, group)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -145,7 +146,7 @@ func DeleteHostGroup(store fauth.Store) func(w http.ResponseWriter, r *http.Requ
 		groupGUID := params["groupGUID"]
 		hostChecks, err := db.DeleteHostGroup(groupGUID)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -199,7 +200,7 @@ func CreateHost(userHeader string, store fauth.Store) func(w http.ResponseWriter
 
 		hostChecks, err := db.CreateHost(sessionGUID, groupGUID, host.Hostname)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -255,7 +256,7 @@ func UpdateHost(userHeader string, store fauth.Store) func(w http.ResponseWriter
 
 		hostChecks, err := db.UpdateHost(sessionGUID, groupGUID, hostGUID, host.Hostname)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -274,7 +275,7 @@ func DeleteHost(store fauth.Store) func(w http.ResponseWriter, r *http.Request,
 		hostGUID := params["hostGUID"]
 		hostChecks, err := db.DeleteHost(groupGUID, hostGUID)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -328,7 +329,7 @@ func CreateCheck(userHeader string, store fauth.Store) func(w http.ResponseWrite
 
 		hostChecks, err := db.CreateCheck(sessionGUID, groupGUID, check)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -384,7 +385,7 @@ func UpdateCheck(userHeader string, store fauth.Store) func(w http.ResponseWrite
 
 		hostChecks, err := db.UpdateCheck(sessionGUID, groupGUID, checkGUID, check)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -403,7 +404,7 @@ func DeleteCheck(store fauth.Store) func(w http.ResponseWriter, r *http.Request,
 		checkGUID := params["checkGUID"]
 		hostChecks, err := db.DeleteCheck(groupGUID, checkGUID)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
@@ -459,7 +460,7 @@ func CreatePath(userHeader string, store fauth.Store) func(w http.ResponseWriter
 
 		pathJSON, err := db.CreatePath(sessionGUID, groupGUID, checkGUID, path)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, pathJSON)
@@ -515,7 +516,7 @@ func UpdatePath(userHeader string, store fauth.Store) func(w http.ResponseWriter
 
 		pathJSON, err := db.UpdatePath(sessionGUID, groupGUID, checkGUID, pathGUID, path)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, pathJSON)
@@ -534,9 +535,18 @@ func DeletePath(store fauth.Store) func(w http.ResponseWriter, r *http.Request,
 		pathGUID := params["pathGUID"]
 		hostChecks, err := db.DeletePath(groupGUID, checkGUID, pathGUID)
 		if err != nil {
-			ErrJSON(w, NewServerError(err.Error()))
+			ErrJSON(w, acsError(err))
 			return
 		}
 		OkJSON(w, hostChecks)
 	}
 }
+
+// acsError returns the error response of a host checks write; the error responses of the store,
+// such as the conflict of writing the tables once a version is published, are returned as is
+func acsError(err error) error {
+	if e, ok := err.(*ErrorResponse); ok {
+		return e
+	}
+	return NewServerError(err.Error())
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"bitbucket.org/_metalogic_/build"
 	fauth "bitbucket.org/_metalogic_/forward-auth"
@@ -13,28 +15,35 @@ import (
 	"bitbucket.org/_metalogic_/log"
 )
 
-var runMode string
-
-func init() {
-	runMode = "enforcing"
+// Info is the runtime information of the service, its run modes and the published version of the
+// access system it enforces (zero if the store does not record versions)
+type Info struct {
+	*build.Runtime
+	RunMode       fauth.RunModeInfo `json:"runMode"`
+	AccessVersion int               `json:"accessVersion"`
 }
 
 // @Tags Common endpoints
 // @Summary get forward-auth service info
-// @Description get forward-auth service info, including version, log level
+// @Description get forward-auth service info, including version, log level, run modes and the published
+// @Description access system version enforced by the replica
 // @ID get-info
 // @Produce json
-// @Success 200 {object} build.Runtime
+// @Success 200 {object} Info
 // @Failure 400 {object} ErrorResponse
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /info [get]
-func APIInfo(store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+func APIInfo(store fauth.Store, auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		rt := &build.Runtime{
-			BuildInfo:   build.Info,
-			ServiceInfo: store.Info(),
-			LogLevel:    log.GetLevel().String(),
+		rt := &Info{
+			Runtime: &build.Runtime{
+				BuildInfo:   build.Info,
+				ServiceInfo: store.Info(),
+				LogLevel:    log.GetLevel().String(),
+			},
+			RunMode:       auth.RunModeInfo(),
+			AccessVersion: auth.AccessVersion(),
 		}
 
 		runtimeJSON, err := json.Marshal(rt)
@@ -48,46 +57,98 @@ func APIInfo(store fauth.Store) func(w http.ResponseWriter, r *http.Request, par
 
 // @Tags Common endpoints
 // @Summary check health of forward-auth service
-// @Description checks health of forward-auth service, currently uses a database ping
+// @Description checks health of forward-auth service, currently uses a database ping; the service is
+// @Description reported degraded, but healthy, while it enforces the last good access system after failed reloads
+// @Description or the last known good access system saved to disk while the store is unavailable; the
+// @Description response headers identify the live access system
 // @ID get-health
 // @Produce plain
 // @Success 200 {string} string "ok"
+// @Header 200 {string} X-Forward-Auth-Fingerprint "fingerprint of the live access system"
+// @Header 200 {string} X-Forward-Auth-Loaded "load time of the live access system"
+// @Header 200 {string} X-Forward-Auth-Store "store the access system is loaded from"
+// @Header 200 {int} X-Forward-Auth-Access-Version "published version of the live access system"
 // @Failure 400 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /forward-auth/v1/health [get]
-func Health(store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+func Health(store fauth.Store, auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 		w.Header().Set("Content-Type", "text/plain")
+		setAccessHeaders(w, auth.AccessStatus())
+		status := auth.ReloadStatus()
+		if status.Degraded != "" {
+			fmt.Fprintf(w, "degraded: %s\n", status.Degraded)
+			return
+		}
 		err := store.Health()
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusServiceUnavailable)+fmt.Sprintf(": %s", err), http.StatusServiceUnavailable)
 			return
 		}
+		if status.Failed() {
+			fmt.Fprintf(w, "degraded: %d reloads failed since version %s was loaded at %s; last failure at %s: %s\n",
+				status.Failures, status.Version, status.Loaded.Format(time.RFC3339),
+				status.LastFailure.Format(time.RFC3339), status.LastError)
+			return
+		}
 		fmt.Fprint(w, "ok\n")
 		return
 	}
 }
 
+// setAccessHeaders sets the headers identifying the access system of status, so that deployment
+// tooling can verify a rollout from health checks
+func setAccessHeaders(w http.ResponseWriter, status fauth.AccessStatus) {
+	w.Header().Set("X-Forward-Auth-Fingerprint", status.Fingerprint)
+	w.Header().Set("X-Forward-Auth-Loaded", status.Loaded.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Forward-Auth-Store", status.Store)
+	if status.Version > 0 {
+		w.Header().Set("X-Forward-Auth-Access-Version", strconv.Itoa(status.Version))
+	}
+}
+
 // @Tags Common endpoints
 // @Summary get forward-auth service statistics
-// @Description get forward-auth service statistics, currently database stats only
+// @Description get forward-auth service statistics as JSON; the metrics are those exported at /metrics
 // @ID get-stats
 // @Produce  json
 // @Success 200 {object} fauth.Stats
-// @Failure 400 {object} ErrorResponse
-// @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /forward-auth/v1/stats [get]
-func Stats(store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+func Stats(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		w.Header().Set("Content-Type", "application/json")
-		stats := store.Stats()
-		fmt.Fprint(w, stats)
-		return
+		data, err := json.Marshal(fauth.Stats{Metrics: metrics(auth, store)})
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		OkJSON(w, string(data))
+	}
+}
+
+// @Tags Common endpoints
+// @Summary get forward-auth service metrics
+// @Description get decision, rule, JWT, access system reload, key fetch and store metrics in the
+// @Description Prometheus text exposition format
+// @ID get-metrics
+// @Produce plain
+// @Success 200 {string} string "metrics"
+// @Router /forward-auth/v1/metrics [get]
+func Metrics(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := fauth.WriteMetrics(w, metrics(auth, store)); err != nil {
+			log.Errorf("failed to write metrics: %s", err)
+		}
 	}
 }
 
+// metrics returns the metrics of auth and store
+func metrics(auth *fauth.Auth, store fauth.Store) []fauth.MetricFamily {
+	return append(auth.Metrics().Families(), fauth.StoreMetrics(store)...)
+}
+
 // @Tags Admin endpoints
 // @Summary gets the current service log level
 // @Description gets the service log level (one of Trace, Debug, Info, Warn or Error)
@@ -144,37 +205,293 @@ func SetLogLevel() func(w http.ResponseWriter, r *http.Request, params map[strin
 	}
 }
 
-// @Summary gets the mode for authorization, currently either enforcing or none
-// @Description sets the mode for authorization, currently either enforcing or none
+// @Tags Admin endpoints
+// @Summary gets the run modes for authorization
+// @Description gets the global run mode and the run mode in effect for each host group; one of enforcing,
+// @Description permissive (allow all requests, logging those that would be denied) or disabled
+// @ID get-runmode
+// @Produce json
+// @Success 200 {object} fauth.RunModeInfo
+// @Failure 500 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/run [get]
+func RunMode(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		data, err := json.Marshal(auth.RunModeInfo())
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		OkJSON(w, string(data))
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary sets the global run mode for authorization
+// @Description sets the global run mode to one of enforcing, permissive or disabled, overriding the run modes
+// @Description of access.json; requires the ROOT_KEY bearer token
 // @ID set-runmode
 // @Produce json
-// @Param verbosity path string true "Log Level"
-// @Success 200 {object} types.Message
+// @Param mode path string true "Run Mode"
+// @Success 200 {object} fauth.RunModeInfo
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/run/{mode} [put]
+func SetRunMode(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "setting the run mode") {
+			return
+		}
+		mode := strings.ToLower(params["mode"])
+		if err := auth.SetRunMode(mode); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		log.Warningf("global run mode is set to '%s'", mode)
+		RunMode(auth)(w, r, params)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary resets the global run mode for authorization
+// @Description removes the global run mode set by the admin API, restoring the run modes of access.json;
+// @Description requires the ROOT_KEY bearer token
+// @ID reset-runmode
+// @Produce json
+// @Success 200 {object} fauth.RunModeInfo
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/run [delete]
+func ResetRunMode(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "resetting the run mode") {
+			return
+		}
+		auth.SetRunMode("")
+		log.Warning("global run mode is reset")
+		RunMode(auth)(w, r, params)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary sets the run mode of a host group
+// @Description sets the run mode of the named host group to one of enforcing, permissive or disabled,
+// @Description overriding the global run mode and the run modes of access.json; requires the ROOT_KEY bearer token
+// @ID set-hostgroup-runmode
+// @Produce json
+// @Param group path string true "Host Group Name"
+// @Param mode path string true "Run Mode"
+// @Success 200 {object} fauth.RunModeInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/run/hostgroups/{group}/{mode} [put]
+func SetHostGroupRunMode(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "setting the run mode") {
+			return
+		}
+		group, mode := params["group"], strings.ToLower(params["mode"])
+		if err := auth.SetHostGroupRunMode(group, mode); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		log.Warningf("run mode of host group %s is set to '%s'", group, mode)
+		RunMode(auth)(w, r, params)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary resets the run mode of a host group
+// @Description removes the run mode of the named host group set by the admin API; requires the ROOT_KEY bearer token
+// @ID reset-hostgroup-runmode
+// @Produce json
+// @Param group path string true "Host Group Name"
+// @Success 200 {object} fauth.RunModeInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/run/hostgroups/{group} [delete]
+func ResetHostGroupRunMode(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "resetting the run mode") {
+			return
+		}
+		group := params["group"]
+		if err := auth.SetHostGroupRunMode(group, ""); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		log.Warningf("run mode of host group %s is reset", group)
+		RunMode(auth)(w, r, params)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary gets the divergence report of the shadow host checks
+// @Description gets the number of requests decided differently by the shadow and live host checks, by check
+// @Description and path, and the most recent divergences with both decisions; requires the ROOT_KEY bearer token
+// @ID get-shadow
+// @Produce json
+// @Success 200 {object} fauth.ShadowReport
+// @Failure 401 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
-// @Failure 500 {object} ErrorResponse
-func RunMode() func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+// @Router /forward-auth/v1/admin/shadow [get]
+func Shadow(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		w.Header().Set("Content-Type", "application/json")
-		MsgJSON(w, fmt.Sprintf("run mode is set to '%s'", runMode))
+		if !adminAuthorized(w, r, auth, "the shadow report") {
+			return
+		}
+		report, ok := auth.ShadowReport()
+		if !ok {
+			ErrJSON(w, NewNotFoundError("no shadow host checks are set"))
+			return
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		OkJSON(w, string(data))
 	}
 }
 
 // @Tags Admin endpoints
-// @Summary sets the run mode for authorization, currently either enforcing or none
-// @Description sets the run mode for authorization, currently either enforcing or none
-// @ID set-runmode
+// @Summary sets the shadow host checks
+// @Description sets the host checks of an access system as shadow host checks that decide every request next
+// @Description to the live host checks without being enforced; tokens and keys are those of the live access
+// @Description system; replaces any shadow and its report; requires the ROOT_KEY bearer token
+// @ID set-shadow
+// @Accept json
+// @Produce json
+// @Param acs body fauth.AccessSystem true "access system with shadow host checks"
+// @Success 200 {object} fauth.ShadowReport
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/shadow [put]
+func SetShadow(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "setting the shadow") {
+			return
+		}
+		acs := &fauth.AccessSystem{}
+		if err := json.NewDecoder(r.Body).Decode(acs); err != nil {
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid access system: %s", err)))
+			return
+		}
+		if acs.Checks == nil {
+			ErrJSON(w, NewBadRequestError("access system has no host checks"))
+			return
+		}
+		if err := auth.SetShadow(acs.Checks); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		log.Warning("shadow host checks are set")
+		Shadow(auth)(w, r, params)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary promotes the shadow host checks
+// @Description makes the shadow host checks live and removes the shadow; the host checks are replaced again
+// @Description when the store reloads; requires the ROOT_KEY bearer token
+// @ID promote-shadow
 // @Produce json
-// @Param verbosity path string true "Log Level"
 // @Success 200 {object} types.Message
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/shadow/promote [post]
+func PromoteShadow(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "promoting the shadow") {
+			return
+		}
+		if err := auth.PromoteShadow(); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		MsgJSON(w, "shadow host checks promoted")
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary removes the shadow host checks
+// @Description removes the shadow host checks and their report; requires the ROOT_KEY bearer token
+// @ID delete-shadow
+// @Produce json
+// @Success 200 {object} types.Message
+// @Failure 401 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
-// @Failure 500 {object} ErrorResponse
-func SetRunMode() func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+// @Router /forward-auth/v1/admin/shadow [delete]
+func RemoveShadow(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		w.Header().Set("Content-Type", "application/json")
-		mode := params["mode"]
-		runMode = strings.ToLower(mode)
-		MsgJSON(w, fmt.Sprintf("run mode is set to '%s'", runMode))
+		if !adminAuthorized(w, r, auth, "removing the shadow") {
+			return
+		}
+		if !auth.RemoveShadow() {
+			ErrJSON(w, NewNotFoundError("no shadow host checks are set"))
+			return
+		}
+		MsgJSON(w, "shadow host checks removed")
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary flushes the decision cache
+// @Description removes all cached decisions, eg after credentials are revoked by the identity provider;
+// @Description requires the ROOT_KEY bearer token
+// @ID delete-cache
+// @Produce json
+// @Success 200 {object} types.Message
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/cache [delete]
+func FlushDecisions(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "flushing the decision cache") {
+			return
+		}
+		MsgJSON(w, fmt.Sprintf("flushed %d cached decisions", auth.FlushDecisions()))
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary gets the status of the live access system
+// @Description gets the fingerprint, load time, store and published version of the live access system and
+// @Description the numbers of its host groups, hosts, checks, paths, rules, tokens and keys; requires the
+// @Description ROOT_KEY bearer token
+// @ID get-status
+// @Produce json
+// @Success 200 {object} fauth.AccessStatus
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/status [get]
+func AccessStatus(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "the access system status") {
+			return
+		}
+		status := auth.AccessStatus()
+		setAccessHeaders(w, status)
+		okJSON(w, status)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary gets the reload status of the access system
+// @Description gets the version and load time of the live access system and the time and error of the most
+// @Description recent failed reload; failed reloads leave the live access system in place; requires the
+// @Description ROOT_KEY bearer token
+// @ID get-reload
+// @Produce json
+// @Success 200 {object} fauth.ReloadStatus
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/reload [get]
+func ReloadStatus(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "the reload status") {
+			return
+		}
+		data, err := json.Marshal(auth.ReloadStatus())
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		OkJSON(w, string(data))
 	}
 }
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// newAuditor returns the decision auditor configured by the environment:
+//   - AUDIT_SINKS is a comma separated list of sinks: stdout, file, syslog and sql (default stdout);
+//     none disables auditing
+//   - AUDIT_FILE, AUDIT_FILE_MAX_SIZE_MB and AUDIT_FILE_MAX_BACKUPS configure the rotating file sink
+//   - AUDIT_SYSLOG_NETWORK and AUDIT_SYSLOG_ADDR address the syslog daemon (default local)
+//   - AUDIT_SQL_BATCH_SIZE and AUDIT_SQL_INTERVAL batch inserts into the audit table of the store
+//   - AUDIT_SAMPLE_ALLOWED is the fraction of allowed decisions audited (default 1)
+func newAuditor(store fauth.Store) (auditor *fauth.Auditor, err error) {
+	sample := 1.0
+	if s := config.IfGetenv("AUDIT_SAMPLE_ALLOWED", ""); s != "" {
+		if sample, err = strconv.ParseFloat(s, 64); err != nil {
+			return auditor, fmt.Errorf("invalid AUDIT_SAMPLE_ALLOWED: %s", err)
+		}
+	}
+
+	var sinks []fauth.AuditSink
+	for _, name := range strings.Split(config.IfGetenv("AUDIT_SINKS", "stdout"), ",") {
+		var sink fauth.AuditSink
+		switch strings.TrimSpace(name) {
+		case "", "none":
+			continue
+		case "stdout":
+			sink = fauth.NewJSONAuditSink(os.Stdout)
+		case "file":
+			sink, err = fauth.NewFileAuditSink(
+				config.IfGetenv("AUDIT_FILE", "/var/log/forward-auth/audit.log"),
+				int64(config.IfGetInt("AUDIT_FILE_MAX_SIZE_MB", 100))<<20,
+				config.IfGetInt("AUDIT_FILE_MAX_BACKUPS", 5))
+		case "syslog":
+			sink, err = fauth.NewSyslogAuditSink(config.IfGetenv("AUDIT_SYSLOG_NETWORK", ""), config.IfGetenv("AUDIT_SYSLOG_ADDR", ""), "forward-auth")
+		case "sql":
+			auditStore, ok := store.(fauth.AuditStore)
+			if !ok {
+				return auditor, fmt.Errorf("the %s store does not support the sql audit sink", store.ID())
+			}
+			sink, err = auditStore.AuditSink(config.IfGetInt("AUDIT_SQL_BATCH_SIZE", 100), config.IfGetDuration("AUDIT_SQL_INTERVAL", 5*time.Second))
+		default:
+			return auditor, fmt.Errorf("invalid audit sink '%s'", name)
+		}
+		if err != nil {
+			return auditor, fmt.Errorf("audit sink %s: %s", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return fauth.NewAuditor(sample, sinks...)
+}
@@ -7,11 +7,11 @@ import (
 	"net/http/httputil"
 	"strconv"
 	"strings"
+	"time"
 
 	fauth "bitbucket.org/_metalogic_/forward-auth"
 	. "bitbucket.org/_metalogic_/glib/http" // dot import fo avoid package prefix in reference (shutup lint)
 	"bitbucket.org/_metalogic_/log"
-	"github.com/pborman/uuid"
 )
 
 var ok = []byte("ok")
@@ -19,101 +19,232 @@ var ok = []byte("ok")
 // @Tags Auth endpoints
 // @Summary authorizes a request based on configured access control rules
 // @Description authorizes a request based on configured access control rules;
-// @Description jwtHeader, traceHeader and userHeader are added to the forwarded request headers
+// @Description jwtHeader, traceHeader and userHeader are added to the forwarded request headers,
+// @Description along with any decision headers configured globally or for the host group of the request
+// @Description and, if an owner private key is configured, an identity assertion in assertionHeader;
+// @Description the W3C trace context of the request is continued and the traceparent of the decision
+// @Description span is returned in the traceparent header;
+// @Description for host groups with a login, unauthenticated browser requests are redirected to the
+// @Description identity provider and the login callback and logout paths are served; a structured audit
+// @Description event is written for each decision
 // @ID get-auth
 // @Produce  json
 // @Success 200 {string} ok
+// @Success 302 {string} string "redirect to login"
 // @Failure 401 {object} ErrorResponse
 // @Failure 403 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /forward-auth/v1/auth [get]
-func Auth(auth *fauth.Auth, userHeader, traceHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+func Auth(auth *fauth.Auth, auditor *fauth.Auditor, tracer *fauth.Tracer, userHeader, traceHeader, assertionHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		if auth.RunMode() == "noAuth" {
-			log.Warning("runMode is set to 'noAuth' - all access controls are disabled")
-			w.WriteHeader(http.StatusOK)
-			w.Write(ok)
-			return
-		}
-
-		testing := (r.Header.Get("Forward-Auth-Mode") == "testing")
-		if testing {
-			log.Warning("authMode testing is enabled by Forward-Auth-Mode header - no requests are being forwarded")
-		}
+		start := time.Now()
 
 		if log.Loggable(log.DebugLevel) {
-			data, err := httputil.DumpRequest(r, false)
+			data, err := httputil.DumpRequest(redactedRequest(r, auth.JWTHeader()), false)
 			if err != nil {
 				ErrJSON(w, NewUnauthorizedError("authorization failed to unpack request"))
 				return
 			}
 			raw := strconv.Quote(strings.ReplaceAll(strings.ReplaceAll(string(data), "\r", ""), "\n", "; "))
-			log.Debugf("dump raw HTTP request: %s", raw[1:len(raw)-1])
+			log.Debugf("dump redacted HTTP request: %s", raw[1:len(raw)-1])
 		}
 
-		// pass or create traceID and add to request header
+		// forwarded request headers are used for authorization decisions
+		host := r.Header.Get("X-Forwarded-Host")
+		method := r.Header.Get("X-Forwarded-Method")
+		path := r.Header.Get("X-Forwarded-Uri")
+
+		// continue the W3C trace of the request or start a new one; the traceparent of the decision
+		// span is returned so that it can be forwarded to the upstream service
+		parent, _ := fauth.ParseTraceContext(r.Header.Get(fauth.TraceparentHeader), r.Header.Get(fauth.TracestateHeader))
+		span := tracer.Start("forward-auth "+method, fauth.SpanServer, parent)
+		defer span.End()
+		span.SetAttribute("http.method", method)
+		span.SetAttribute("http.host", host)
+		span.SetAttribute("http.target", fauth.RedactURI(path))
+		span.Context().Inject(w.Header())
+
+		// pass the legacy traceID or set it to the W3C trace ID and add to response header
 		traceID := r.Header.Get(traceHeader)
 		if traceID == "" {
-			traceID = uuid.New()
+			traceID = span.Context().TraceID
 			log.Debugf("setting %s in header: %s", traceHeader, traceID)
 			w.Header().Add(traceHeader, traceID)
 		} else {
 			log.Debugf("found %s in header: %s", traceHeader, traceID)
 		}
 
-		// forwarded request headers are used for authorization decisions
-		host := r.Header.Get("X-Forwarded-Host")
-		method := r.Header.Get("X-Forwarded-Method")
-		path := r.Header.Get("X-Forwarded-Uri")
-
-		// check for host overrides
-		if auth.Override(host) == "allow" {
-			if testing {
-				tstJSON(w, http.StatusOK, "allow override for host "+host)
-			} else {
-				OkJSON(w, "allow override for host "+host)
-			}
-			log.Debug("allow override for host " + host)
-			return
-		} else if auth.Override(host) == "deny" {
-			if testing {
-				tstJSON(w, http.StatusForbidden, "deny override for host "+host)
-			} else {
-				ErrJSON(w, NewForbiddenError("deny override for host "+host))
-			}
-			log.Debug("deny override for host " + host)
-			return
+		// strip incoming copies of decision headers so they can't be spoofed
+		fields := auth.ResponseHeaders(host)
+		for name := range fields {
+			r.Header.Del(name)
 		}
+		r.Header.Del(assertionHeader)
 
-		mux, err := auth.Muxer(host)
-		if err != nil { // shouldn't happen
-			ErrJSON(w, NewForbiddenError(err.Error()))
+		// serve login callback and logout paths of host groups with a login
+		if handled, err := auth.HandleLogin(w, r, host, path); handled {
+			if err != nil {
+				log.Warning(err.Error())
+				ErrJSON(w, NewUnauthorizedError(err.Error()))
+			}
 			return
 		}
 
-		// TODO return user - username is always empty in this call ??
-		status, message, username := mux.Check(method, path, r.Header)
+		// the JWT of a login session is passed on as the request JWT
+		sessionJWT := auth.Session(host, r.Header)
 
-		if testing {
-			tstJSON(w, status, message)
-			return
-		}
+		decision := auth.CheckSpan(span, host, method, path, r.Header)
+		auditor.Audit(auth.AuditEvent(decision, host, method, path, r.Header, traceID, time.Since(start)))
 
-		switch status {
-		case 401: // upstream should handle login
-			ErrJSON(w, NewUnauthorizedError(message))
+		switch decision.Status {
+		case 401: // redirect browsers to login if configured for the host, otherwise upstream should handle login
+			if auth.LoginChallenge(w, r, host, path) {
+				return
+			}
+			ErrJSON(w, NewUnauthorizedError(decision.Message))
 		case 403:
-			ErrJSON(w, NewForbiddenError(message))
+			ErrJSON(w, NewForbiddenError(decision.Message))
 		case 404: // always deny on not found
-			ErrJSON(w, NewForbiddenError(message))
+			ErrJSON(w, NewForbiddenError(decision.Message))
 		case 200:
-			if username != "" {
+			if sessionJWT != "" {
+				w.Header().Set(auth.JWTHeader(), sessionJWT)
+			}
+			if username := decision.User(); username != "" {
 				log.Debugf("Adding HTTP header %s %s", userHeader, username)
 				w.Header().Add(userHeader, username)
 			}
+			for name, values := range decision.Headers(fields) {
+				log.Debugf("Adding HTTP header %s %s", name, values)
+				w.Header()[name] = values
+			}
+			// no identity is asserted for requests the host checks did not allow
+			if auth.CanAssert() && decision.Enforced() {
+				assertion, err := auth.Assert(decision, host, method, path)
+				if err != nil {
+					log.Errorf("failed to sign identity assertion for %s %s%s: %s", method, host, path, err)
+					ErrJSON(w, NewServerError("failed to sign identity assertion"))
+					return
+				}
+				w.Header().Set(assertionHeader, assertion)
+			}
 			w.Write(ok)
+		default:
+			ErrJSON(w, NewForbiddenError(decision.Message))
+		}
+	}
+}
+
+// credentialHeaders are the request headers redacted from debug logs in addition to the JWT header
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactedRequest returns a copy of r with its credentials and the secret query parameters of
+// its forwarded URI redacted
+func redactedRequest(r *http.Request, jwtHeader string) *http.Request {
+	redacted := r.Clone(r.Context())
+	for _, name := range append(credentialHeaders, jwtHeader) {
+		if redacted.Header.Get(name) != "" {
+			redacted.Header.Set(name, "REDACTED")
+		}
+	}
+	if uri := redacted.Header.Get("X-Forwarded-Uri"); uri != "" {
+		redacted.Header.Set("X-Forwarded-Uri", fauth.RedactURI(uri))
+	}
+	redacted.URL.RawQuery = ""
+	return redacted
+}
+
+// ExplainRequest is a simulated forwarded request; Headers are the request headers, including
+// any credentials, keyed by name
+type ExplainRequest struct {
+	Host    string            `json:"host"`
+	Method  string            `json:"method"`
+	URI     string            `json:"uri"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// adminToken is the name of the bearer token authorizing admin requests that reveal or change
+// how requests are decided
+const adminToken = "ROOT_KEY"
+
+// adminAuthorized returns true if r presents the admin bearer token, otherwise it writes an
+// unauthorized error for action
+func adminAuthorized(w http.ResponseWriter, r *http.Request, auth *fauth.Auth, action string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || !auth.CheckBearerAuth(token, adminToken) {
+		ErrJSON(w, NewUnauthorizedError(action+" requires the "+adminToken+" bearer token"))
+		return false
+	}
+	return true
+}
+
+// @Tags Admin endpoints
+// @Summary explains the decision for a simulated forwarded request
+// @Description decides a simulated forwarded request and returns the decision trace: the blocked subject
+// @Description or host override that applied, the matched host group, prefix, pattern and captured params,
+// @Description the rule expression, the value of each builtin call and sub-expression and the validation
+// @Description of the request JWT; requires the ROOT_KEY bearer token
+// @ID explain
+// @Accept json
+// @Produce json
+// @Param request body ExplainRequest true "simulated forwarded request"
+// @Success 200 {object} fauth.Explanation
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/explain [post]
+func Explain(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "explain") {
+			return
+		}
+
+		req := &ExplainRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid explain request: %s", err)))
+			return
+		}
+		if req.Host == "" || req.Method == "" || req.URI == "" {
+			ErrJSON(w, NewBadRequestError("explain request requires host, method and uri"))
+			return
+		}
+
+		header := http.Header{}
+		for name, value := range req.Headers {
+			header.Set(name, value)
+		}
+		method := strings.ToUpper(req.Method)
+		header.Set("X-Forwarded-Host", req.Host)
+		header.Set("X-Forwarded-Method", method)
+		header.Set("X-Forwarded-Uri", req.URI)
+
+		data, err := json.Marshal(auth.Explain(req.Host, method, req.URI, header))
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		OkJSON(w, string(data))
+	}
+}
+
+// @Tags Auth endpoints
+// @Summary returns the JSON Web Key Set that verifies identity assertions
+// @Description returns the JSON Web Key Set publishing the owner public key that verifies identity assertions;
+// @Description the key set is empty if no owner private key is configured
+// @ID get-jwks
+// @Produce json
+// @Success 200 {object} fauth.JWKS
+// @Failure 500 {object} ErrorResponse
+// @Router /forward-auth/v1/.well-known/jwks.json [get]
+func JWKS(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		data, err := json.Marshal(auth.JWKS())
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
 		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		OkJSON(w, string(data))
 	}
 }
 
@@ -152,23 +283,47 @@ func Block(svc *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params
 	}
 }
 
-// @Tags Auth endpoints
-// @Summary TODO: returns a text representation of the access tree
-// @Description TODO: returns a text representation of the access tree
+// @Tags Admin endpoints
+// @Summary returns the access tree
+// @Description returns the routing structure compiled from the live access system for each host: its host
+// @Description group, default, run mode and override, the prefix of each check, the patterns of each prefix
+// @Description in the order they are matched and the rule of each method; format is text (default), json or
+// @Description dot (Graphviz); requires the ROOT_KEY bearer token
 // @ID get-tree
+// @Produce plain
 // @Produce json
-// @Success 200 {object} types.Message
+// @Param format query string false "text, json or dot"
+// @Param host query string false "only the given host"
+// @Param prefix query string false "only the prefixes starting with prefix"
+// @Success 200 {object} fauth.AccessTree
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
-// @Failure 500 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/tree [get]
 func Tree(auth *fauth.Auth) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		w.Header().Set("Content-Type", "application/json")
-		data, err := json.MarshalIndent(auth, "", "  ")
-		if err != nil {
-			ErrJSON(w, err)
+		if !adminAuthorized(w, r, auth, "the access tree") {
+			return
+		}
+		query := r.URL.Query()
+		host := query.Get("host")
+		tree := auth.AccessTree(host, query.Get("prefix"))
+		if host != "" && len(tree.Hosts) == 0 {
+			ErrJSON(w, NewNotFoundError(fmt.Sprintf("host checks not defined for %s", host)))
+			return
+		}
+		switch format := query.Get("format"); format {
+		case "", "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, tree.Text())
+		case "json":
+			okJSON(w, tree)
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+			fmt.Fprint(w, tree.DOT())
+		default:
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid tree format '%s'; want text, json or dot", format)))
 		}
-		MsgJSON(w, string(data))
 	}
 }
 
@@ -192,7 +347,8 @@ func Unblock(svc *fauth.Auth) func(w http.ResponseWriter, r *http.Request, param
 
 // @Tags Auth endpoints
 // @Summary forces an auth update from a store
-// @Description forces an auth update from a store (invoked via broadcast from /reload)
+// @Description forces an auth update from a store (invoked on each replica by POST /admin/cluster/reload);
+// @Description requires the ROOT_KEY bearer token
 // @ID update-auth
 // @Produce  json
 // @Success 200 {string} ok
@@ -200,20 +356,27 @@ func Unblock(svc *fauth.Auth) func(w http.ResponseWriter, r *http.Request, param
 // @Failure 403 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /forward-auth/v1/auth [put]
-func Update(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+func Update(auth *fauth.Auth, tracer *fauth.Tracer, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
-		// get access control system from the store
-		acs, err := store.Load()
-		if err != nil {
-			ErrJSON(w, err)
+		if !adminAuthorized(w, r, auth, "updating the access system") {
 			return
 		}
-		// update access
-		err = auth.UpdateFunc()(acs)
-		if err != nil {
+		if err := reloadAccess(auth, tracer, r, store); err != nil {
 			ErrJSON(w, err)
 			return
 		}
 		MsgJSON(w, "access system update succeeded")
 	}
 }
+
+// reloadAccess loads the access system from store and updates auth, tracing the load as a child
+// of the trace context of r
+func reloadAccess(auth *fauth.Auth, tracer *fauth.Tracer, r *http.Request, store fauth.Store) error {
+	parent, _ := fauth.ParseTraceContext(r.Header.Get(fauth.TraceparentHeader), r.Header.Get(fauth.TracestateHeader))
+	acs, err := loadAccess(tracer, parent, store)
+	if err != nil {
+		auth.ReloadFailed(err)
+		return err
+	}
+	return auth.UpdateFunc()(acs)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	. "bitbucket.org/_metalogic_/glib/http" // dot import fo avoid package prefix in reference (shutup lint)
+)
+
+// newCluster returns the cluster of forward-auth replicas configured by the environment:
+//   - CLUSTER_PEERS is a comma separated list of peer addresses, eg forward-auth-0:8080
+//   - CLUSTER_SERVICE is a DNS SRV name or headless service name the peers are discovered from
+//   - CLUSTER_PEER_PORT is the port of peers discovered from a headless service (default 8080)
+//   - CLUSTER_PEER_SCHEME is the scheme peers are addressed with (default http)
+//   - CLUSTER_TIMEOUT limits each request to a peer (default 10s)
+func newCluster() (*fauth.Cluster, error) {
+	var peers []string
+	if list := config.IfGetenv("CLUSTER_PEERS", ""); list != "" {
+		peers = strings.Split(list, ",")
+	}
+	return fauth.NewCluster(peers,
+		config.IfGetenv("CLUSTER_SERVICE", ""),
+		config.IfGetInt("CLUSTER_PEER_PORT", 8080),
+		config.IfGetenv("CLUSTER_PEER_SCHEME", "http"),
+		config.IfGetDuration("CLUSTER_TIMEOUT", 10*time.Second))
+}
+
+// @Tags Admin endpoints
+// @Summary gets the access system versions of the forward-auth replicas
+// @Description gets the reload status of each replica discovered from CLUSTER_PEERS or CLUSTER_SERVICE; a
+// @Description replica whose access system version differs from the majority is flagged as a mismatch;
+// @Description requires the ROOT_KEY bearer token
+// @ID get-cluster
+// @Produce json
+// @Success 200 {object} fauth.ClusterStatus
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/cluster [get]
+func ClusterStatus(auth *fauth.Auth, cluster *fauth.Cluster) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "the cluster status") {
+			return
+		}
+		status, err := cluster.Status(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		okJSON(w, status)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary reloads the access system of every forward-auth replica
+// @Description reloads each replica discovered from CLUSTER_PEERS or CLUSTER_SERVICE from its store and gets
+// @Description the resulting reload status of each; converged is true if every replica reloaded the same
+// @Description access system version; requires the ROOT_KEY bearer token
+// @ID reload-cluster
+// @Produce json
+// @Success 200 {object} fauth.ClusterStatus
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/cluster/reload [post]
+func ReloadCluster(auth *fauth.Auth, cluster *fauth.Cluster) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !adminAuthorized(w, r, auth, "reloading the cluster") {
+			return
+		}
+		status, err := cluster.Reload(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		okJSON(w, status)
+	}
+}
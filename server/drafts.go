@@ -0,0 +1,492 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	. "bitbucket.org/_metalogic_/glib/http" // dot import fo avoid package prefix in reference (shutup lint)
+)
+
+// DraftRequest names a new draft of the host checks
+type DraftRequest struct {
+	Name string `json:"name"`
+}
+
+// @Tags Draft endpoints
+// @Summary lists the drafts of the host checks
+// @Description lists the drafts of the host checks without their host checks; requires the ROOT_KEY bearer token
+// @ID get-drafts
+// @Produce json
+// @Success 200 {array} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts [get]
+func Drafts(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "listing drafts")
+		if !ok {
+			return
+		}
+		list, err := drafts.Drafts()
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if list == nil {
+			list = []fauth.Draft{}
+		}
+		okJSON(w, list)
+	}
+}
+
+// @Tags Draft endpoints
+// @Summary creates a draft of the host checks
+// @Description creates a named draft of the host checks as stored; edits to the draft are not live until it is
+// @Description published; requires the ROOT_KEY bearer token
+// @ID create-draft
+// @Accept json
+// @Produce json
+// @Param request body DraftRequest true "draft name"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts [post]
+func CreateDraft(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "creating a draft")
+		if !ok {
+			return
+		}
+		var req DraftRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid draft request: %s", err)))
+			return
+		}
+		if err := (fauth.Draft{Name: req.Name}).Validate(); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		draft, err := drafts.CreateDraft(StringHeader(r, userHeader, rootGUID), req.Name)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		okJSON(w, draft)
+	}
+}
+
+// @Tags Draft endpoints
+// @Summary gets a draft of the host checks
+// @Description gets a draft with its host checks; requires the ROOT_KEY bearer token
+// @ID get-draft
+// @Produce json
+// @Param draft path string true "draft name"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft} [get]
+func Draft(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "getting a draft")
+		if !ok {
+			return
+		}
+		draft, err := drafts.Draft(params["draft"])
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		okJSON(w, draft)
+	}
+}
+
+// @Tags Draft endpoints
+// @Summary deletes a draft of the host checks
+// @Description deletes a draft without publishing it; requires the ROOT_KEY bearer token
+// @ID delete-draft
+// @Produce json
+// @Param draft path string true "draft name"
+// @Success 200 {string} ok
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft} [delete]
+func DeleteDraft(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "deleting a draft")
+		if !ok {
+			return
+		}
+		if err := drafts.DeleteDraft(params["draft"]); err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		MsgJSON(w, fmt.Sprintf("deleted draft %s", params["draft"]))
+	}
+}
+
+// @Tags Draft endpoints
+// @Summary replaces the host checks of a draft
+// @Description replaces all host checks of a draft; saving an edit clears the approval of the draft; requires
+// @Description the ROOT_KEY bearer token
+// @ID update-draft
+// @Accept json
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param body body fauth.HostChecks true "host checks"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft} [put]
+func UpdateDraft(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return editDraft(auth, store, userHeader, func(r *http.Request, params map[string]string, draft *fauth.Draft) error {
+		var checks fauth.HostChecks
+		if err := json.NewDecoder(r.Body).Decode(&checks); err != nil {
+			return err
+		}
+		draft.Checks = &checks
+		return nil
+	})
+}
+
+// @Tags Draft endpoints
+// @Summary adds or replaces a host group of a draft
+// @Description adds the host group, with its hosts, checks and paths, to a draft or replaces the host group
+// @Description of the same name; requires the ROOT_KEY bearer token
+// @ID set-draft-hostgroup
+// @Accept json
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param group path string true "host group name"
+// @Param body body fauth.HostGroup true "host group"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/hostgroups/{group} [put]
+func SetDraftHostGroup(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return editDraft(auth, store, userHeader, func(r *http.Request, params map[string]string, draft *fauth.Draft) error {
+		var group fauth.HostGroup
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			return err
+		}
+		group.Name = params["group"]
+		if err := group.Validate(); err != nil {
+			return err
+		}
+		draft.SetHostGroup(group)
+		return nil
+	})
+}
+
+// @Tags Draft endpoints
+// @Summary removes a host group from a draft
+// @Description removes a host group from a draft; requires the ROOT_KEY bearer token
+// @ID delete-draft-hostgroup
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param group path string true "host group name"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/hostgroups/{group} [delete]
+func DeleteDraftHostGroup(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return editDraft(auth, store, userHeader, func(r *http.Request, params map[string]string, draft *fauth.Draft) error {
+		return draft.RemoveHostGroup(params["group"])
+	})
+}
+
+// @Tags Draft endpoints
+// @Summary adds or replaces a check of a draft
+// @Description adds the check, with its paths, to a host group of a draft or replaces the check of the same
+// @Description name; requires the ROOT_KEY bearer token
+// @ID set-draft-check
+// @Accept json
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param group path string true "host group name"
+// @Param check path string true "check name"
+// @Param body body fauth.Check true "check"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/hostgroups/{group}/checks/{check} [put]
+func SetDraftCheck(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return editDraft(auth, store, userHeader, func(r *http.Request, params map[string]string, draft *fauth.Draft) error {
+		var check fauth.Check
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			return err
+		}
+		check.Name = params["check"]
+		if err := check.Validate(); err != nil {
+			return err
+		}
+		for _, path := range check.Paths {
+			if err := path.Validate(); err != nil {
+				return fmt.Errorf("path %s: %s", path.Path, err)
+			}
+		}
+		return draft.SetCheck(params["group"], check)
+	})
+}
+
+// @Tags Draft endpoints
+// @Summary removes a check from a draft
+// @Description removes a check from a host group of a draft; requires the ROOT_KEY bearer token
+// @ID delete-draft-check
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param group path string true "host group name"
+// @Param check path string true "check name"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/hostgroups/{group}/checks/{check} [delete]
+func DeleteDraftCheck(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return editDraft(auth, store, userHeader, func(r *http.Request, params map[string]string, draft *fauth.Draft) error {
+		return draft.RemoveCheck(params["group"], params["check"])
+	})
+}
+
+// @Tags Draft endpoints
+// @Summary reviews a draft of the host checks
+// @Description returns the changes from the live access system to a draft, the validation diagnostics of the
+// @Description draft and the results of the policy tests of POLICY_TEST_SUITE and of the optional request
+// @Description body run against it; requires the ROOT_KEY bearer token
+// @ID review-draft
+// @Accept json
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param suite body fauth.PolicyTestSuite false "additional policy tests"
+// @Success 200 {object} fauth.DraftReview
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/review [post]
+func ReviewDraft(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "reviewing a draft")
+		if !ok {
+			return
+		}
+		suite, err := policyTestSuite()
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		if r.ContentLength != 0 {
+			var extra fauth.PolicyTestSuite
+			if err := json.NewDecoder(r.Body).Decode(&extra); err != nil {
+				ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid policy test suite: %s", err)))
+				return
+			}
+			if suite == nil {
+				suite = &fauth.PolicyTestSuite{}
+			}
+			suite.Cases = append(suite.Cases, extra.Cases...)
+		}
+		draft, err := drafts.Draft(params["draft"])
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		review, err := reviewDraft(auth, drafts, draft, suite)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		okJSON(w, review)
+	}
+}
+
+// @Tags Draft endpoints
+// @Summary approves a draft of the host checks
+// @Description approves a revision of a draft for publishing; the approver, identified by the user header, must
+// @Description not be the administrator who saved the revision; requires the ROOT_KEY bearer token
+// @ID approve-draft
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param revision query int true "the reviewed revision of the draft"
+// @Success 200 {object} fauth.Draft
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/approve [post]
+func ApproveDraft(auth *fauth.Auth, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "approving a draft")
+		if !ok {
+			return
+		}
+		revision, err := strconv.Atoi(r.URL.Query().Get("revision"))
+		if err != nil {
+			ErrJSON(w, NewBadRequestError("the reviewed revision of the draft is required to approve it"))
+			return
+		}
+		draft, err := drafts.Draft(params["draft"])
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if draft.Revision != revision {
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("draft %s is at revision %d, not the reviewed revision %d", draft.Name, draft.Revision, revision)))
+			return
+		}
+		user := StringHeader(r, userHeader, rootGUID)
+		if err = draft.CanApprove(user); err != nil {
+			ErrJSON(w, NewForbiddenError(err.Error()))
+			return
+		}
+		draft, err = drafts.ApproveDraft(user, draft)
+		if err != nil {
+			ErrJSON(w, draftError(err))
+			return
+		}
+		okJSON(w, draft)
+	}
+}
+
+// @Tags Draft endpoints
+// @Summary publishes a draft of the host checks
+// @Description reviews a draft and, if it introduces no validation errors, passes the policy tests of
+// @Description POLICY_TEST_SUITE and is approved when DRAFT_APPROVAL_REQUIRED is set, replaces the host checks
+// @Description of the store with it in a single step and reloads it; requires the ROOT_KEY bearer token
+// @ID publish-draft
+// @Accept json
+// @Produce json
+// @Param draft path string true "draft name"
+// @Param request body PublishRequest true "comment describing the change"
+// @Success 200 {object} fauth.DraftReview
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/drafts/{draft}/publish [post]
+func PublishDraft(auth *fauth.Auth, tracer *fauth.Tracer, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "publishing a draft")
+		if !ok {
+			return
+		}
+		var req PublishRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid publish request: %s", err)))
+			return
+		}
+		if req.Comment == "" || len(req.Comment) > 256 {
+			ErrJSON(w, NewBadRequestError("a comment of at most 256 characters is required to publish a draft"))
+			return
+		}
+		draft, err := drafts.Draft(params["draft"])
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if config.IfGetBool("DRAFT_APPROVAL_REQUIRED", false) && draft.Approved == nil {
+			ErrJSON(w, NewForbiddenError(fmt.Sprintf("draft %s revision %d must be approved by a second administrator before it is published", draft.Name, draft.Revision)))
+			return
+		}
+		suite, err := policyTestSuite()
+		if err != nil {
+			ErrJSON(w, NewServerError(err.Error()))
+			return
+		}
+		review, err := reviewDraft(auth, drafts, draft, suite)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if err = review.Publishable(); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		if err = drafts.PublishDraft(StringHeader(r, userHeader, rootGUID), draft, req.Comment); err != nil {
+			ErrJSON(w, draftError(err))
+			return
+		}
+		if err = reloadAccess(auth, tracer, r, store); err != nil {
+			ErrJSON(w, NewServerError(fmt.Sprintf("draft %s was published but failed to load: %s", draft.Name, err)))
+			return
+		}
+		okJSON(w, review)
+	}
+}
+
+// editDraft returns a handler that applies edit to the named draft and saves it
+func editDraft(auth *fauth.Auth, store fauth.Store, userHeader string, edit func(r *http.Request, params map[string]string, draft *fauth.Draft) error) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		drafts, ok := draftStore(w, r, auth, store, "editing a draft")
+		if !ok {
+			return
+		}
+		draft, err := drafts.Draft(params["draft"])
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if err = edit(r, params, draft); err != nil {
+			ErrJSON(w, NewBadRequestError(err.Error()))
+			return
+		}
+		draft, err = drafts.SaveDraft(StringHeader(r, userHeader, rootGUID), draft)
+		if err != nil {
+			ErrJSON(w, draftError(err))
+			return
+		}
+		okJSON(w, draft)
+	}
+}
+
+// draftError returns the error response of a draft store error; a draft changed since it was read
+// or created from host checks that were published since is a conflict
+func draftError(err error) error {
+	if errors.Is(err, fauth.ErrDraftConflict) || errors.Is(err, fauth.ErrDraftStale) {
+		return &ErrorResponse{Status: http.StatusConflict, Message: err.Error(), Timestamp: time.Now().UnixNano()}
+	}
+	return err
+}
+
+// reviewDraft reviews draft against the live access system of auth
+func reviewDraft(auth *fauth.Auth, drafts fauth.DraftStore, draft *fauth.Draft, suite *fauth.PolicyTestSuite) (*fauth.DraftReview, error) {
+	acs, err := drafts.DraftAccess(draft)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ReviewDraft(draft, acs, suite)
+}
+
+// policyTestSuite returns the policy test suite of POLICY_TEST_SUITE, or nil if it is not set
+func policyTestSuite() (*fauth.PolicyTestSuite, error) {
+	file := config.IfGetenv("POLICY_TEST_SUITE", "")
+	if file == "" {
+		return nil, nil
+	}
+	return fauth.LoadPolicyTestSuite(file)
+}
+
+// draftStore returns store as a DraftStore if r is authorized for action and store keeps drafts,
+// otherwise it writes an error
+func draftStore(w http.ResponseWriter, r *http.Request, auth *fauth.Auth, store fauth.Store, action string) (fauth.DraftStore, bool) {
+	if !adminAuthorized(w, r, auth, action) {
+		return nil, false
+	}
+	drafts, ok := store.(fauth.DraftStore)
+	if !ok {
+		ErrJSON(w, NewBadRequestError(fmt.Sprintf("the %s store does not keep drafts", store.ID())))
+		return nil, false
+	}
+	return drafts, true
+}
@@ -11,12 +11,6 @@ func msgJSONList(w http.ResponseWriter, list []string) {
 	fmt.Fprint(w, json)
 }
 
-func tstJSON(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	json := fmt.Sprintf("{\"status\" : %d, \"message\" : \"%s\"}", status, message)
-	http.Error(w, json, http.StatusPreconditionRequired)
-}
-
 // returns true if key has given value in paramMap
 func checkQuery(paramMap map[string][]string, key, value string) bool {
 	if values, ok := paramMap[key]; !ok {
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/log"
+)
+
+// lastKnownGoodFile returns the file that access systems loaded from the store are saved to,
+// or the empty string if LAST_KNOWN_GOOD_FILE is none
+func lastKnownGoodFile() string {
+	file := config.IfGetenv("LAST_KNOWN_GOOD_FILE", "/var/cache/forward-auth/last-known-good.json")
+	if file == "none" {
+		return ""
+	}
+	return file
+}
+
+// startupAccess loads the access system from store and saves it to the last known good file;
+// if the store fails to load, the access system saved to the file is returned with degraded
+// explaining that it may be stale. An error is returned if neither can be loaded
+func startupAccess(tracer *fauth.Tracer, store fauth.Store, file string) (acs *fauth.AccessSystem, degraded string, err error) {
+	acs, err = loadAccess(tracer, fauth.TraceContext{}, store)
+	if err == nil {
+		if file != "" {
+			if err := fauth.SaveLastKnownGood(file, store.ID(), acs); err != nil {
+				log.Errorf("failed to save last known good access system to %s: %s", file, err)
+			}
+		}
+		return acs, degraded, nil
+	}
+	if file == "" {
+		return acs, degraded, err
+	}
+
+	lkg, lkgErr := fauth.LoadLastKnownGood(file)
+	if lkgErr != nil {
+		return acs, degraded, fmt.Errorf("%s store failed to load: %s; no last known good access system: %s", store.ID(), err, lkgErr)
+	}
+	degraded = fmt.Sprintf("%s store failed to load at startup: %s; enforcing the last known good access system version %s saved by the %s store at %s",
+		store.ID(), err, lkg.Version, lkg.Store, lkg.Saved.Format(time.RFC3339))
+	log.Error(degraded)
+	return lkg.Access, degraded, nil
+}
+
+// retryStore reloads the access system from store until it loads and updates auth, waiting
+// after each failure for an interval that doubles from one second to max
+func retryStore(auth *fauth.Auth, tracer *fauth.Tracer, store fauth.Store, max time.Duration) {
+	update := auth.UpdateFunc()
+	interval := time.Second
+	for {
+		time.Sleep(interval)
+		acs, err := loadAccess(tracer, fauth.TraceContext{}, store)
+		if err == nil {
+			err = update(acs)
+		} else {
+			auth.ReloadFailed(err)
+		}
+		if err == nil {
+			log.Warningf("%s store loaded; no longer degraded", store.ID())
+			return
+		}
+		if interval *= 2; interval > max {
+			interval = max
+		}
+		log.Errorf("%s store retry failed; retrying in %s: %s", store.ID(), interval, err)
+	}
+}
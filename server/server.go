@@ -3,10 +3,13 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"bitbucket.org/_metalogic_/config"
 	fauth "bitbucket.org/_metalogic_/forward-auth"
@@ -20,15 +23,25 @@ const rootGUID = "ROOT"
 
 // AuthzServer ...
 type AuthzServer struct {
-	server *http.Server
-	store  fauth.Store
-	auth   *fauth.Auth
-	info   map[string]string
+	server  *http.Server
+	store   fauth.Store
+	auth    *fauth.Auth
+	auditor *fauth.Auditor
+	tracer  *fauth.Tracer
+	info    map[string]string
 }
 
-func Start(addr, runMode, tenantParam, jwtHeader, userHeader, traceHeader string, store fauth.Store, wg *sync.WaitGroup) (svr *AuthzServer) {
-	// load the access controls
-	acs, err := store.Load()
+func Start(addr, runMode, tenantParam, jwtHeader, userHeader, traceHeader, assertionHeader string, store fauth.Store, wg *sync.WaitGroup) (svr *AuthzServer) {
+	// spans are exported to the collector configured by the environment
+	tracer, err := newTracer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// load the access controls, falling back to the last known good access system if the
+	// store is unavailable
+	lkgFile := lastKnownGoodFile()
+	acs, degraded, err := startupAccess(tracer, store, lkgFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -54,15 +67,63 @@ func Start(addr, runMode, tenantParam, jwtHeader, userHeader, traceHeader string
 	if err != nil {
 		log.Fatal(err)
 	}
+	auth.SetLastKnownGood(lkgFile, store.ID())
+	if degraded != "" {
+		auth.SetDegraded(degraded)
+		go retryStore(auth, tracer, store, config.IfGetDuration("STORE_RETRY_MAX_INTERVAL", time.Minute))
+	}
+
+	// a run mode given at startup overrides the run modes of the access system
+	if runMode != "" {
+		if err = auth.SetRunMode(strings.ToLower(runMode)); err != nil {
+			log.Fatal(err)
+		}
+		log.Warningf("global run mode is set to '%s'", auth.RunMode())
+	}
+
+	// decisions of rules with a cache TTL are cached unless DECISION_CACHE_SIZE is 0
+	if err = auth.SetDecisionCache(config.IfGetInt("DECISION_CACHE_SIZE", 10000)); err != nil {
+		log.Fatal(err)
+	}
+
+	// RFC 9421 signatures created longer ago than SIGNATURE_MAX_AGE are rejected as replays
+	if err = auth.SetSignatureMaxAge(config.IfGetDuration("SIGNATURE_MAX_AGE", fauth.DefaultSignatureMaxAge)); err != nil {
+		log.Fatal(err)
+	}
+
+	// Session key encrypts login cookies; it must be shared by all replicas
+	if key := config.IfGetenv("SESSION_KEY", ""); key != "" {
+		sessionKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			log.Fatalf("invalid SESSION_KEY: %s", err)
+		}
+		if err = auth.SetSessionKey(sessionKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// decisions are audited to the sinks configured by the environment
+	auditor, err := newAuditor(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// peers of the cluster are reloaded together by the cluster endpoints
+	cluster, err := newCluster()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// auth := fauth.NewAuth(addr)
 	svr = &AuthzServer{
 		server: &http.Server{
 			Addr:    addr,
-			Handler: router(auth, store, userHeader, traceHeader)},
-		auth:  auth,
-		store: store,
-		info:  make(map[string]string),
+			Handler: router(auth, auditor, tracer, store, cluster, userHeader, traceHeader, assertionHeader)},
+		auth:    auth,
+		auditor: auditor,
+		tracer:  tracer,
+		store:   store,
+		info:    make(map[string]string),
 	}
 
 	log.Debugf("configured authorization environment %+v", svr)
@@ -70,7 +131,7 @@ func Start(addr, runMode, tenantParam, jwtHeader, userHeader, traceHeader string
 	// listen for changes on the store
 	go func() {
 		defer wg.Done() // let caller know we are done cleaning up
-		store.Listen(auth.UpdateFunc())
+		store.Listen(tracedUpdate(tracer, store, auth.UpdateFunc()), auth.ReloadFailed)
 	}()
 
 	// start the HTTP server
@@ -89,38 +150,62 @@ func Start(addr, runMode, tenantParam, jwtHeader, userHeader, traceHeader string
 }
 
 // Stats returns server statistics
-// TODO keep running stats of authorization request handling
-func (svc *AuthzServer) Stats() string {
-	js := fmt.Sprintf("{\"Requests\": %d, \"Allowed\" : %d, \"Denied\": %d}", 100, 50, 50)
-	return js
+func (svc *AuthzServer) Stats() fauth.Stats {
+	return fauth.Stats{Metrics: metrics(svc.auth, svc.store)}
 }
 
 // Shutdown does a clean shutdown of the authorization server
 func (svc *AuthzServer) Shutdown(ctx context.Context) {
-	svc.store.Close()
 	if err := svc.server.Shutdown(ctx); err != nil {
 		log.Fatal(err)
 	}
+	if err := svc.auditor.Close(); err != nil {
+		log.Error(err.Error())
+	}
+	if err := svc.tracer.Close(); err != nil {
+		log.Error(err.Error())
+	}
+	svc.store.Close()
 	log.Warning("shutdown Authz server")
 }
 
 // create the router for Service
-func router(auth *fauth.Auth, store fauth.Store, userHeader, traceHeader string) *httptreemux.TreeMux {
+func router(auth *fauth.Auth, auditor *fauth.Auditor, tracer *fauth.Tracer, store fauth.Store, cluster *fauth.Cluster, userHeader, traceHeader, assertionHeader string) *httptreemux.TreeMux {
 	// initialize HTTP router
 	treemux := httptreemux.New()
 	api := treemux.NewGroup("/")
 
 	// Common endpoints
-	api.GET("/health", Health(store))
-	api.GET("/info", APIInfo(store))
-	api.GET("/stats", Stats(store))
+	api.GET("/health", Health(store, auth))
+	api.GET("/info", APIInfo(store, auth))
+	api.GET("/stats", Stats(auth, store))
+	api.GET("/metrics", Metrics(auth, store))
+	api.GET("/.well-known/jwks.json", JWKS(auth))
 
 	// Admin endpoints
 	api.GET("/admin/loglevel", LogLevel())
 	api.PUT("/admin/loglevel/:verbosity", SetLogLevel())
-	api.GET("/admin/run", RunMode())
-	api.PUT("/admin/run/:mode", SetRunMode())
+	api.GET("/admin/run", RunMode(auth))
+	api.PUT("/admin/run/:mode", SetRunMode(auth))
+	api.DELETE("/admin/run", ResetRunMode(auth))
+	api.PUT("/admin/run/hostgroups/:group/:mode", SetHostGroupRunMode(auth))
+	api.DELETE("/admin/run/hostgroups/:group", ResetHostGroupRunMode(auth))
 	api.GET("/admin/tree", Tree(auth))
+	api.POST("/admin/explain", Explain(auth))
+	api.GET("/admin/shadow", Shadow(auth))
+	api.PUT("/admin/shadow", SetShadow(auth))
+	api.POST("/admin/shadow/promote", PromoteShadow(auth))
+	api.DELETE("/admin/shadow", RemoveShadow(auth))
+	api.DELETE("/admin/cache", FlushDecisions(auth))
+	api.GET("/admin/status", AccessStatus(auth))
+	api.GET("/admin/reload", ReloadStatus(auth))
+	api.GET("/admin/cluster", ClusterStatus(auth, cluster))
+	api.POST("/admin/cluster/reload", ReloadCluster(auth, cluster))
+	api.GET("/admin/versions", Versions(auth, store))
+	api.POST("/admin/versions", PublishVersion(auth, tracer, store, userHeader))
+	api.GET("/admin/versions/:version", Version(auth, store))
+	api.GET("/admin/versions/:version/diff/:to", DiffVersions(auth, store))
+	api.POST("/admin/versions/:version/activate", ActivateVersion(auth, tracer, store, userHeader))
 	api.GET("/openapi/*", httpSwagger.Handler(
 		httpSwagger.URL("doc.json"), // The url pointing to API definition
 		httpSwagger.DeepLinking(true),
@@ -128,13 +213,29 @@ func router(auth *fauth.Auth, store fauth.Store, userHeader, traceHeader string)
 		httpSwagger.DomID("#swagger-ui")))
 
 	// Auth endpoints
-	api.GET("/auth", Auth(auth, userHeader, traceHeader))
-	api.POST("/auth/update", Update(auth, store)) // called by deployment-api broadcast to trigger update from store
+	api.GET("/auth", Auth(auth, auditor, tracer, userHeader, traceHeader, assertionHeader))
+	api.POST("/auth/update", Update(auth, tracer, store)) // called by POST /admin/cluster/reload to trigger update from store
 	api.GET("/block", Blocked(auth))
 	api.POST("/block/:userGUID", Block(auth))
 	api.DELETE("/block/:userGUID", Unblock(auth))
 
-	// ACS endpoints - the file storage adapter does not implement these endpoints
+	// Draft endpoints - edits to the host checks are saved to a named draft that is reviewed and
+	// published as a whole
+	api.GET("/admin/drafts", Drafts(auth, store))
+	api.POST("/admin/drafts", CreateDraft(auth, store, userHeader))
+	api.GET("/admin/drafts/:draft", Draft(auth, store))
+	api.PUT("/admin/drafts/:draft", UpdateDraft(auth, store, userHeader))
+	api.DELETE("/admin/drafts/:draft", DeleteDraft(auth, store))
+	api.PUT("/admin/drafts/:draft/hostgroups/:group", SetDraftHostGroup(auth, store, userHeader))
+	api.DELETE("/admin/drafts/:draft/hostgroups/:group", DeleteDraftHostGroup(auth, store, userHeader))
+	api.PUT("/admin/drafts/:draft/hostgroups/:group/checks/:check", SetDraftCheck(auth, store, userHeader))
+	api.DELETE("/admin/drafts/:draft/hostgroups/:group/checks/:check", DeleteDraftCheck(auth, store, userHeader))
+	api.POST("/admin/drafts/:draft/review", ReviewDraft(auth, store))
+	api.POST("/admin/drafts/:draft/approve", ApproveDraft(auth, store, userHeader))
+	api.POST("/admin/drafts/:draft/publish", PublishDraft(auth, tracer, store, userHeader))
+
+	// ACS endpoints - the file storage adapter does not implement these endpoints; the mssql store
+	// rejects writes with 409 Conflict once a version is published, after which drafts are edited
 	api.GET("/hostgroups", HostGroups(store))
 	api.POST("/hostgroups", CreateHostGroup(userHeader, store))
 	api.GET("/hostgroups/:groupGUID", HostGroup(store))
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// newTracer returns the tracer configured by the environment; the tracer is nil, and spans are
+// only propagated, if no collector endpoint is configured:
+//   - OTEL_EXPORTER_OTLP_ENDPOINT is the base URL of the OTLP/HTTP collector, eg http://otel-collector:4318
+//   - OTEL_EXPORTER_OTLP_HEADERS is a comma separated list of name=value headers added to exports
+//   - OTEL_SERVICE_NAME is the service name of exported spans (default forward-auth)
+//   - OTEL_TRACES_SAMPLER_ARG is the fraction of new traces sampled (default 1)
+//   - OTEL_BSP_MAX_EXPORT_BATCH_SIZE and OTEL_BSP_SCHEDULE_DELAY (milliseconds) batch exports
+func newTracer() (tracer *fauth.Tracer, err error) {
+	endpoint := config.IfGetenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if endpoint == "" {
+		return tracer, nil
+	}
+
+	ratio := 1.0
+	if s := config.IfGetenv("OTEL_TRACES_SAMPLER_ARG", ""); s != "" {
+		if ratio, err = strconv.ParseFloat(s, 64); err != nil {
+			return tracer, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG: %s", err)
+		}
+	}
+
+	headers := make(map[string]string)
+	for _, header := range strings.Split(config.IfGetenv("OTEL_EXPORTER_OTLP_HEADERS", ""), ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(header, "=")
+		if !ok {
+			return tracer, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS header '%s'", header)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	exporter, err := fauth.NewOTLPExporter(endpoint, config.IfGetenv("OTEL_SERVICE_NAME", "forward-auth"), headers,
+		config.IfGetInt("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", 512),
+		time.Duration(config.IfGetInt("OTEL_BSP_SCHEDULE_DELAY", 5000))*time.Millisecond)
+	if err != nil {
+		return tracer, err
+	}
+	return fauth.NewTracer(exporter, ratio)
+}
+
+// loadAccess loads the access system from store in a span continuing parent
+func loadAccess(tracer *fauth.Tracer, parent fauth.TraceContext, store fauth.Store) (acs *fauth.AccessSystem, err error) {
+	span := tracer.Start("store.load", fauth.SpanInternal, parent)
+	defer span.End()
+	span.SetAttribute("forward_auth.store", store.ID())
+	acs, err = store.Load()
+	span.SetError(err)
+	return acs, err
+}
+
+// tracedUpdate wraps the access system update function passed to the listener of store so that
+// each update loaded by the store is traced
+func tracedUpdate(tracer *fauth.Tracer, store fauth.Store, update func(*fauth.AccessSystem) error) func(*fauth.AccessSystem) error {
+	return func(acs *fauth.AccessSystem) error {
+		span := tracer.Start("store.update", fauth.SpanInternal, fauth.TraceContext{})
+		defer span.End()
+		span.SetAttribute("forward_auth.store", store.ID())
+		err := update(acs)
+		span.SetError(err)
+		return err
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	. "bitbucket.org/_metalogic_/glib/http" // dot import fo avoid package prefix in reference (shutup lint)
+)
+
+// PublishRequest describes the change published as a new access system version
+type PublishRequest struct {
+	Comment string `json:"comment"`
+}
+
+// VersionDiff is the semantic difference between the host checks of two access system versions
+type VersionDiff struct {
+	From    int            `json:"from"`
+	To      int            `json:"to"`
+	Changes []fauth.Change `json:"changes"`
+}
+
+// @Tags Admin endpoints
+// @Summary lists the published access system versions
+// @Description lists the published versions of the host checks, newest first, with their comment and
+// @Description author; the active version is the one loaded by forward-auth; requires the ROOT_KEY bearer token
+// @ID get-versions
+// @Produce json
+// @Success 200 {array} fauth.SystemVersion
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/versions [get]
+func Versions(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		versioner, ok := versionStore(w, r, auth, store, "listing access system versions")
+		if !ok {
+			return
+		}
+		versions, err := versioner.Versions()
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if versions == nil {
+			versions = []fauth.SystemVersion{}
+		}
+		okJSON(w, versions)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary gets a published access system version
+// @Description gets a published version with its host checks; requires the ROOT_KEY bearer token
+// @ID get-version
+// @Produce json
+// @Param version path int true "version number"
+// @Success 200 {object} fauth.SystemVersion
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/versions/{version} [get]
+func Version(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		versioner, ok := versionStore(w, r, auth, store, "getting an access system version")
+		if !ok {
+			return
+		}
+		version, ok := versionParam(w, params["version"])
+		if !ok {
+			return
+		}
+		v, err := versioner.SystemVersion(version)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		okJSON(w, v)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary diffs two published access system versions
+// @Description returns the host groups, hosts, checks, paths and rules added, removed and changed from one
+// @Description published version to another; requires the ROOT_KEY bearer token
+// @ID diff-versions
+// @Produce json
+// @Param version path int true "version number diffed from"
+// @Param to path int true "version number diffed to"
+// @Success 200 {object} VersionDiff
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/versions/{version}/diff/{to} [get]
+func DiffVersions(auth *fauth.Auth, store fauth.Store) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		versioner, ok := versionStore(w, r, auth, store, "diffing access system versions")
+		if !ok {
+			return
+		}
+		fromVersion, ok := versionParam(w, params["version"])
+		if !ok {
+			return
+		}
+		toVersion, ok := versionParam(w, params["to"])
+		if !ok {
+			return
+		}
+		from, err := versioner.SystemVersion(fromVersion)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		to, err := versioner.SystemVersion(toVersion)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		changes := fauth.DiffVersions(from, to)
+		if changes == nil {
+			changes = []fauth.Change{}
+		}
+		okJSON(w, VersionDiff{From: fromVersion, To: toVersion, Changes: changes})
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary publishes the host checks as the first access system version
+// @Description records the current host checks tables of the store as the first immutable version, makes it the
+// @Description active version and reloads it; the author is taken from the user header; later versions are
+// @Description published from drafts; requires the ROOT_KEY bearer token
+// @ID publish-version
+// @Accept json
+// @Produce json
+// @Param request body PublishRequest true "comment describing the change"
+// @Success 200 {object} fauth.SystemVersion
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/versions [post]
+func PublishVersion(auth *fauth.Auth, tracer *fauth.Tracer, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		versioner, ok := versionStore(w, r, auth, store, "publishing an access system version")
+		if !ok {
+			return
+		}
+		var req PublishRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid publish request: %s", err)))
+			return
+		}
+		if req.Comment == "" || len(req.Comment) > 256 {
+			ErrJSON(w, NewBadRequestError("a comment of at most 256 characters is required to publish a version"))
+			return
+		}
+		v, err := versioner.PublishVersion(StringHeader(r, userHeader, rootGUID), req.Comment)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if err = reloadAccess(auth, tracer, r, store); err != nil {
+			ErrJSON(w, NewServerError(fmt.Sprintf("version %d was published but failed to load: %s", v.Version, err)))
+			return
+		}
+		okJSON(w, v)
+	}
+}
+
+// @Tags Admin endpoints
+// @Summary activates a published access system version
+// @Description makes a published version the active version and reloads it, eg to roll back a change; other
+// @Description replicas load it on their next update; requires the ROOT_KEY bearer token
+// @ID activate-version
+// @Produce json
+// @Param version path int true "version number"
+// @Success 200 {object} fauth.SystemVersion
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /forward-auth/v1/admin/versions/{version}/activate [post]
+func ActivateVersion(auth *fauth.Auth, tracer *fauth.Tracer, store fauth.Store, userHeader string) func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		versioner, ok := versionStore(w, r, auth, store, "activating an access system version")
+		if !ok {
+			return
+		}
+		version, ok := versionParam(w, params["version"])
+		if !ok {
+			return
+		}
+		v, err := versioner.ActivateVersion(StringHeader(r, userHeader, rootGUID), version)
+		if err != nil {
+			ErrJSON(w, err)
+			return
+		}
+		if err = reloadAccess(auth, tracer, r, store); err != nil {
+			ErrJSON(w, NewServerError(fmt.Sprintf("version %d was activated but failed to load: %s", v.Version, err)))
+			return
+		}
+		okJSON(w, v)
+	}
+}
+
+// versionStore returns store as a Versioner if r is authorized for action and store records
+// access system versions, otherwise it writes an error
+func versionStore(w http.ResponseWriter, r *http.Request, auth *fauth.Auth, store fauth.Store, action string) (fauth.Versioner, bool) {
+	if !adminAuthorized(w, r, auth, action) {
+		return nil, false
+	}
+	versioner, ok := store.(fauth.Versioner)
+	if !ok {
+		ErrJSON(w, NewBadRequestError(fmt.Sprintf("the %s store does not record access system versions", store.ID())))
+		return nil, false
+	}
+	return versioner, true
+}
+
+// versionParam returns the version number of a path parameter, otherwise it writes an error
+func versionParam(w http.ResponseWriter, param string) (int, bool) {
+	version, err := strconv.Atoi(param)
+	if err != nil || version <= 0 {
+		ErrJSON(w, NewBadRequestError(fmt.Sprintf("invalid access system version '%s'", param)))
+		return 0, false
+	}
+	return version, true
+}
+
+// okJSON writes v as a JSON response
+func okJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		ErrJSON(w, NewServerError(err.Error()))
+		return
+	}
+	OkJSON(w, string(data))
+}
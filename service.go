@@ -1,5 +1,7 @@
 package fauth
 
+import "time"
+
 // Common defines the common service interface
 type Common interface {
 	Health() error
@@ -13,10 +15,29 @@ type Store interface {
 	ID() string
 	Close() error
 	Database() (Database, error)
-	Listen(func(*AccessSystem) error)
+	// Listen calls update with the access system loaded each time the store changes, or failed
+	// with the error if a changed access system cannot be loaded
+	Listen(update func(*AccessSystem) error, failed func(error))
 	Load() (*AccessSystem, error)
 }
 
+// Exporter is implemented by stores that can export their access system as stored,
+// without resolving secrets from the environment
+type Exporter interface {
+	Export() (*AccessSystem, error)
+}
+
+// Importer is implemented by stores that can import an access system
+type Importer interface {
+	Import(acs *AccessSystem) error
+}
+
+// AuditStore is implemented by stores that can record decision audit events in a database
+// table; events are inserted in batches of size at least every interval
+type AuditStore interface {
+	AuditSink(size int, interval time.Duration) (AuditSink, error)
+}
+
 type Database interface {
 	Blocks() (map[string]bool, error)
 	Tokens(root string) (map[string]string, error)
@@ -0,0 +1,294 @@
+package fauth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// maxDivergences is the number of most recent divergences kept by a shadow
+const maxDivergences = 100
+
+// shadowQueueSize is the number of requests queued for comparison by a shadow; requests checked
+// while the queue is full are dropped without being compared
+const shadowQueueSize = 1000
+
+// ShadowReport reports the divergence of the shadow host checks from the live host checks:
+//   - Loaded is the time the shadow was set
+//   - Requests and Divergences count the requests decided by both and those decided differently
+//   - Dropped counts the requests not compared because the comparison queue was full
+//   - Routes count requests and divergences by the check and path a request was routed to,
+//     most divergent first
+//   - Recent are the most recent divergences, oldest first
+type ShadowReport struct {
+	Loaded      time.Time     `json:"loaded"`
+	Requests    int64         `json:"requests"`
+	Divergences int64         `json:"divergences"`
+	Dropped     int64         `json:"dropped"`
+	Routes      []ShadowRoute `json:"routes"`
+	Recent      []Divergence  `json:"recent"`
+}
+
+// ShadowRoute counts the requests routed to a check and path and those decided differently;
+// requests that match no check have an empty check and path
+type ShadowRoute struct {
+	Check       string `json:"check"`
+	Path        string `json:"path"`
+	Requests    int64  `json:"requests"`
+	Divergences int64  `json:"divergences"`
+}
+
+// Divergence is a request decided differently by the live and shadow host checks
+type Divergence struct {
+	Time   time.Time      `json:"time"`
+	Host   string         `json:"host"`
+	Method string         `json:"method"`
+	URI    string         `json:"uri"`
+	Live   ShadowDecision `json:"live"`
+	Shadow ShadowDecision `json:"shadow"`
+}
+
+// ShadowDecision summarizes a decision compared by a shadow
+type ShadowDecision struct {
+	Status  int    `json:"status"`
+	Rule    string `json:"rule,omitempty"`
+	Check   string `json:"check,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// shadow evaluates host checks next to the live host checks without enforcing them; requests
+// are compared in the background so that the shadow does not delay live decisions
+type shadow struct {
+	checks *HostChecks
+	auth   *Auth
+	loaded time.Time
+	queue  chan shadowRequest
+	done   chan struct{}
+	once   sync.Once
+
+	mutex       sync.Mutex
+	requests    int64
+	divergences int64
+	dropped     int64
+	routes      map[ShadowRoute]*ShadowRoute
+	recent      []Divergence
+}
+
+// shadowRequest is a request decided by the live host checks queued for comparison
+type shadowRequest struct {
+	host     string
+	method   string
+	uri      string
+	header   http.Header
+	live     *Decision
+	callouts *callouts
+}
+
+// SetShadow sets checks as the shadow host checks; every request checked is also decided by the
+// shadow and the decisions that differ from the live decision are recorded. The shadow shares
+// the tokens, keys and identity provider of auth, and is rebuilt when auth is reloaded; an error
+// is returned if checks are invalid
+func (auth *Auth) SetShadow(checks *HostChecks) error {
+	shadowAuth := &Auth{
+		jwtHeader: auth.jwtHeader,
+		keyFunc:   auth.keyFunc,
+		metrics:   newMetrics(),
+	}
+	snap, err := auth.current().withChecks(shadowAuth, checks)
+	if err != nil {
+		return err
+	}
+	shadowAuth.state.Store(snap)
+
+	s := &shadow{
+		checks: checks,
+		auth:   shadowAuth,
+		loaded: time.Now(),
+		queue:  make(chan shadowRequest, shadowQueueSize),
+		done:   make(chan struct{}),
+		routes: make(map[ShadowRoute]*ShadowRoute),
+	}
+	go s.run()
+
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if auth.shadow != nil {
+		auth.shadow.stop()
+	}
+	auth.shadow = s
+	return nil
+}
+
+// RemoveShadow removes the shadow host checks; it returns false if there is no shadow
+func (auth *Auth) RemoveShadow() bool {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	removed := auth.shadow != nil
+	if removed {
+		auth.shadow.stop()
+	}
+	auth.shadow = nil
+	return removed
+}
+
+// PromoteShadow makes the shadow host checks live and removes the shadow
+func (auth *Auth) PromoteShadow() error {
+	s := auth.getShadow()
+	if s == nil {
+		return fmt.Errorf("no shadow host checks are set")
+	}
+	snap, err := auth.current().withChecks(auth, s.checks)
+	if err != nil {
+		return err
+	}
+	auth.swap(snap)
+
+	report := s.report()
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if auth.shadow == s {
+		s.stop()
+		auth.shadow = nil
+	}
+	log.Warningf("promoted shadow host checks loaded at %s after %d divergences in %d requests",
+		report.Loaded.Format(time.RFC3339), report.Divergences, report.Requests)
+	return nil
+}
+
+// ShadowReport returns the divergence report of the shadow host checks; ok is false if there
+// is no shadow
+func (auth *Auth) ShadowReport() (report *ShadowReport, ok bool) {
+	s := auth.getShadow()
+	if s == nil {
+		return report, false
+	}
+	return s.report(), true
+}
+
+func (auth *Auth) getShadow() *shadow {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+	return auth.shadow
+}
+
+// rebuild rebuilds the shadow snapshot to share the owner, tokens and keys of the live snapshot
+// live, so that rotating them by a reload does not make the shadow diverge
+func (s *shadow) rebuild(live *snapshot) {
+	snap, err := live.withChecks(s.auth, s.checks)
+	if err != nil {
+		log.Warningf("failed to rebuild shadow host checks on reload: %s", err)
+		return
+	}
+	s.auth.state.Store(snap)
+}
+
+// enqueue queues a request decided by the live host checks for comparison; requests that were
+// blocked or not evaluated by the live host checks are not compared. The allow() callouts of the
+// live decision are replayed by the shadow
+func (s *shadow) enqueue(host, method, uri string, header http.Header, live *Decision, c *callouts) {
+	if live.Mode == RunDisabled || live.Rule == "block" {
+		return
+	}
+	r := shadowRequest{host: host, method: method, uri: uri, header: header, live: live, callouts: c.replayed()}
+	select {
+	case s.queue <- r:
+	default:
+		s.mutex.Lock()
+		s.dropped++
+		s.mutex.Unlock()
+	}
+}
+
+// run compares queued requests until the shadow is stopped
+func (s *shadow) run() {
+	for {
+		select {
+		case r := <-s.queue:
+			s.compare(r.host, r.method, r.uri, r.header, r.live, r.callouts)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *shadow) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// compare decides a request with the shadow host checks and records whether the shadow decision
+// differs from the live decision. Permissive decisions are compared by the status they would
+// have had
+func (s *shadow) compare(host, method, uri string, header http.Header, live *Decision, c *callouts) {
+	liveStatus := live.Status
+	if live.Unenforced != 0 {
+		liveStatus = live.Unenforced
+	}
+	decision := s.auth.decide(s.auth.current(), host, method, uri, header, nil, nil, c)
+
+	key := ShadowRoute{Check: live.Check, Path: live.Path}
+	if key.Check == "" {
+		key = ShadowRoute{Check: decision.Check, Path: decision.Path}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	route, ok := s.routes[key]
+	if !ok {
+		route = &ShadowRoute{Check: key.Check, Path: key.Path}
+		s.routes[key] = route
+	}
+	s.requests++
+	route.Requests++
+	if decision.Status == liveStatus {
+		return
+	}
+
+	s.divergences++
+	route.Divergences++
+	d := Divergence{
+		Time:   time.Now(),
+		Host:   host,
+		Method: method,
+		URI:    uri,
+		Live:   ShadowDecision{Status: liveStatus, Rule: live.Rule, Check: live.Check, Path: live.Path, Message: live.Message},
+		Shadow: ShadowDecision{Status: decision.Status, Rule: decision.Rule, Check: decision.Check, Path: decision.Path, Message: decision.Message},
+	}
+	if len(s.recent) == maxDivergences {
+		s.recent = s.recent[1:]
+	}
+	s.recent = append(s.recent, d)
+	log.Infof("shadow divergence for %s %s%s: live %d by rule '%s', shadow %d by rule '%s'",
+		method, host, uri, liveStatus, live.Rule, decision.Status, decision.Rule)
+}
+
+func (s *shadow) report() *ShadowReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	report := &ShadowReport{
+		Loaded:      s.loaded,
+		Requests:    s.requests,
+		Divergences: s.divergences,
+		Dropped:     s.dropped,
+		Routes:      make([]ShadowRoute, 0, len(s.routes)),
+		Recent:      append([]Divergence{}, s.recent...),
+	}
+	for _, route := range s.routes {
+		report.Routes = append(report.Routes, *route)
+	}
+	sort.Slice(report.Routes, func(i, j int) bool {
+		a, b := report.Routes[i], report.Routes[j]
+		if a.Divergences != b.Divergences {
+			return a.Divergences > b.Divergences
+		}
+		if a.Check != b.Check {
+			return a.Check < b.Check
+		}
+		return a.Path < b.Path
+	})
+	return report
+}
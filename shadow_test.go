@@ -0,0 +1,186 @@
+package fauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// shadowReport waits for the shadow of auth to compare requests and returns its report
+func shadowReport(t *testing.T, auth *fauth.Auth, requests int64) *fauth.ShadowReport {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		report, ok := auth.ShadowReport()
+		if !ok {
+			t.Fatal("no shadow report")
+		}
+		if report.Requests >= requests || time.Now().After(deadline) {
+			return report
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func shadowChecks(expression string) *fauth.HostChecks {
+	return &fauth.HostChecks{
+		HostGroups: []fauth.HostGroup{
+			{
+				Name:    "API Hosts",
+				Hosts:   []string{"apis.example.com"},
+				Default: "deny",
+				Checks: []fauth.Check{
+					{
+						Name: "widgets-api",
+						Base: "/widgets-api/v1",
+						Paths: []fauth.Path{
+							{
+								Path: "/widgets",
+								Rules: map[fauth.Method]fauth.Rule{
+									"GET":  {Expression: expression},
+									"POST": {Expression: "bearer('ROOT_KEY')"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestShadowDivergence(t *testing.T) {
+	auth := newTestAuth(t, &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY", "root-token-value": "ROOT_KEY"},
+		Checks: shadowChecks("bearer('MC_APP_KEY')"),
+	})
+	if err := auth.SetShadow(shadowChecks("bearer('ROOT_KEY')")); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "/widgets-api/v1/widgets"
+	app := http.Header{}
+	app.Set("Authorization", "Bearer app-token-value")
+	if d := auth.Check("apis.example.com", "GET", uri, app); d.Status != http.StatusOK {
+		t.Errorf("live decision got status %d, want %d", d.Status, http.StatusOK)
+	}
+	auth.Check("apis.example.com", "POST", uri, app)
+	auth.Check("apis.example.com", "GET", "/other-api/v1/things", app)
+
+	report := shadowReport(t, auth, 3)
+	if report.Requests != 3 || report.Divergences != 1 {
+		t.Errorf("got %d divergences in %d requests, want 1 in 3", report.Divergences, report.Requests)
+	}
+	want := fauth.ShadowRoute{Check: "widgets-api", Path: "/widgets-api/v1/widgets", Requests: 2, Divergences: 1}
+	if len(report.Routes) != 2 || report.Routes[0] != want {
+		t.Errorf("got routes %+v, want first %+v", report.Routes, want)
+	}
+	if len(report.Recent) != 1 {
+		t.Fatalf("got %d recent divergences, want 1", len(report.Recent))
+	}
+	d := report.Recent[0]
+	if d.Method != "GET" || d.Live.Status != http.StatusOK || d.Shadow.Status != http.StatusForbidden ||
+		d.Live.Rule != "widgets-api GET /widgets-api/v1/widgets" || d.Shadow.Rule != d.Live.Rule {
+		t.Errorf("got divergence %+v", d)
+	}
+
+	// the shadow is promoted to live
+	if err := auth.PromoteShadow(); err != nil {
+		t.Fatal(err)
+	}
+	if d := auth.Check("apis.example.com", "GET", uri, app); d.Status != http.StatusForbidden {
+		t.Errorf("promoted decision got status %d, want %d", d.Status, http.StatusForbidden)
+	}
+	if _, ok := auth.ShadowReport(); ok {
+		t.Errorf("shadow remains after promotion")
+	}
+	if err := auth.PromoteShadow(); err == nil {
+		t.Errorf("got no error promoting without a shadow")
+	}
+}
+
+func TestShadowErrors(t *testing.T) {
+	auth := newTestAuth(t, &fauth.AccessSystem{Checks: shadowChecks("true")})
+	if err := auth.SetShadow(shadowChecks("bearer('MC_APP_KEY'")); err == nil {
+		t.Errorf("got no error for invalid shadow host checks")
+	}
+	if auth.RemoveShadow() {
+		t.Errorf("removed a shadow that was not set")
+	}
+
+	// requests not evaluated by the live host checks are not compared
+	if err := auth.SetShadow(shadowChecks("false")); err != nil {
+		t.Fatal(err)
+	}
+	auth.SetRunMode(fauth.RunDisabled)
+	auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{})
+	if report, _ := auth.ShadowReport(); report.Requests != 0 {
+		t.Errorf("got %d requests compared in disabled mode", report.Requests)
+	}
+	auth.SetRunMode(fauth.RunPermissive)
+	auth.Check("apis.example.com", "POST", "/widgets-api/v1/widgets", http.Header{})
+	if report := shadowReport(t, auth, 1); report.Requests != 1 || report.Divergences != 0 {
+		t.Errorf("got %d divergences in %d requests in permissive mode", report.Divergences, report.Requests)
+	}
+	if !auth.RemoveShadow() {
+		t.Errorf("shadow not removed")
+	}
+}
+
+func TestShadowReload(t *testing.T) {
+	acs := &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token-value": "MC_APP_KEY"},
+		Checks: shadowChecks("bearer('MC_APP_KEY')"),
+	}
+	auth := newTestAuth(t, acs)
+	if err := auth.SetShadow(shadowChecks("bearer('MC_APP_KEY')")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shadow uses the tokens of the reloaded access system
+	rotated := &fauth.AccessSystem{
+		Tokens: map[string]string{"rotated-token-value": "MC_APP_KEY"},
+		Blocks: map[string]bool{},
+		Checks: shadowChecks("bearer('MC_APP_KEY')"),
+	}
+	if err := auth.UpdateFunc()(rotated); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer rotated-token-value")
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", header); d.Status != http.StatusOK {
+		t.Errorf("live decision got status %d, want %d", d.Status, http.StatusOK)
+	}
+	if report := shadowReport(t, auth, 1); report.Requests != 1 || report.Divergences != 0 {
+		t.Errorf("got %d divergences in %d requests after rotating tokens, want 0 in 1", report.Divergences, report.Requests)
+	}
+}
+
+func TestShadowCallouts(t *testing.T) {
+	t.Setenv("ROOT_KEY", "root-key")
+	var calls int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer service.Close()
+
+	allow := "allow('READ', 'u1', 'widgets', '" + service.URL + "')"
+	auth := newTestAuth(t, &fauth.AccessSystem{Checks: shadowChecks(allow)})
+	if err := auth.SetShadow(shadowChecks(allow + " || allow('READ', 'u1', 'gadgets', '" + service.URL + "')")); err != nil {
+		t.Fatal(err)
+	}
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets", http.Header{}); d.Status != http.StatusOK {
+		t.Errorf("live decision got status %d, want %d: %s", d.Status, http.StatusOK, d.Message)
+	}
+
+	// the shadow replays the callout of the live decision
+	if report := shadowReport(t, auth, 1); report.Requests != 1 || report.Divergences != 0 {
+		t.Errorf("got %d divergences in %d requests, want 0 in 1", report.Divergences, report.Requests)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d callouts, want 1 by the live decision", n)
+	}
+}
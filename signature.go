@@ -1,12 +1,22 @@
 package fauth
 
 import (
-	"crypto/rsa"
+	"crypto"
 
 	"bitbucket.org/_metalogic_/httpsig"
 	"bitbucket.org/_metalogic_/log"
 )
 
+// Signature modes accepted as the optional second argument of the signature() builtin
+//   - cavage accepts only the draft-cavage Signature header (the default)
+//   - rfc9421 accepts only RFC 9421 Signature-Input/Signature headers
+//   - any accepts either format, preferring RFC 9421 when both are present
+const (
+	SignatureCavage  = "cavage"
+	SignatureRFC9421 = "rfc9421"
+	SignatureAny     = "any"
+)
+
 // Verifying requires an application to use the keyID to both retrieve the key needed for verification
 // as well as determine the algorithm to use.
 // Public keys are stored in a cached key-value map tenantID => publicKey.
@@ -15,10 +25,10 @@ import (
 // An RSA public-private key pair is generated as follows:
 //  $ openssl genrsa -out rsa.private 4096
 //  $ openssl rsa -in rsaprivate -outrsa.public -pubout -outform PEM
-func verify(verifier httpsig.Verifier, tenantID string, pubKeys map[string]*rsa.PublicKey) bool {
+func verify(verifier httpsig.Verifier, tenantID string, pubKeys map[string]crypto.PublicKey) bool {
 
 	keyID := verifier.KeyID()
-	rsa, found := pubKeys[keyID]
+	key, found := pubKeys[keyID]
 
 	if !found {
 		log.Errorf("public key not found in store for %s", keyID)
@@ -31,10 +41,40 @@ func verify(verifier httpsig.Verifier, tenantID string, pubKeys map[string]*rsa.
 	}
 
 	// The verifier will verify the Digest in addition to the HTTP signature
-	err := verifier.Verify(rsa, httpsig.RSA_SHA256)
+	err := verifier.Verify(key, httpsig.RSA_SHA256)
 	if err != nil {
 		log.Errorf("signature verification failed: %s", err)
 		return false
 	}
 	return true
 }
+
+// verifySignature selects the verifier for mode and verifies it for tenantID;
+// a nil verifier means the request carries no signature in that format
+func verifySignature(mode string, cavage httpsig.Verifier, rfc9421 *RFC9421Verifier, tenantID string, pubKeys map[string]crypto.PublicKey) bool {
+	switch mode {
+	case "", SignatureCavage:
+		if cavage == nil {
+			log.Debugf("no draft-cavage signature found for tenant %s", tenantID)
+			return false
+		}
+		return verify(cavage, tenantID, pubKeys)
+	case SignatureRFC9421:
+		if rfc9421 == nil {
+			log.Debugf("no RFC 9421 signature found for tenant %s", tenantID)
+			return false
+		}
+		return verify(rfc9421, tenantID, pubKeys)
+	case SignatureAny:
+		if rfc9421 != nil {
+			return verify(rfc9421, tenantID, pubKeys)
+		}
+		if cavage != nil {
+			return verify(cavage, tenantID, pubKeys)
+		}
+		log.Debugf("no signature found for tenant %s", tenantID)
+		return false
+	}
+	log.Errorf("invalid signature mode '%s'", mode)
+	return false
+}
@@ -0,0 +1,242 @@
+package fauth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+	"bitbucket.org/_metalogic_/pat"
+)
+
+// snapshot is the immutable state built from a loaded access system:
+//   - acs is the access system and version its fingerprint; loaded is the time it was built
+//   - owner, tokens, digests, publicKeys, caPools and signer are loaded from the access system
+//   - checks are the host checks of the snapshot; hostMuxers, hostGroups, overrides, headers,
+//     globalHeaders and logins are built from them, and mode and groupModes are their run modes
+//   - routes are the prefixes registered with the host muxer of each host (see AccessTree)
+//   - serial is unique to each snapshot of an Auth and keys the decisions it caches
+//
+// Each load builds a complete snapshot that replaces the current snapshot of Auth atomically. A
+// request is decided on the snapshot current when its decision starts, so that requests in flight
+// during a reload finish on the snapshot they started on; the rule handlers of a snapshot are
+// bound to it
+type snapshot struct {
+	auth          *Auth
+	serial        uint64
+	acs           *AccessSystem
+	version       string
+	loaded        time.Time
+	owner         Owner
+	tokens        map[string]string
+	digests       map[string]string
+	publicKeys    map[string]crypto.PublicKey
+	caPools       map[string]*x509.CertPool
+	signer        *signer
+	checks        *HostChecks
+	overrides     map[string]string
+	hostMuxers    map[string]*pat.HostMux
+	hostGroups    map[string]HostGroup
+	routes        map[string][]PrefixTree
+	headers       map[string]map[string]string
+	globalHeaders map[string]string
+	logins        map[string]*oidcLogin
+	mode          string
+	groupModes    map[string]string
+}
+
+// newSnapshot builds the snapshot of acs for auth; an error is returned, and no snapshot, if the
+// owner private key is invalid or any host check fails to compile
+func newSnapshot(auth *Auth, acs *AccessSystem) (s *snapshot, err error) {
+	signer, err := newSigner(acs.Owner)
+	if err != nil {
+		return s, err
+	}
+	s = &snapshot{
+		auth:       auth,
+		serial:     atomic.AddUint64(&auth.serial, 1),
+		acs:        acs,
+		version:    Fingerprint(acs),
+		loaded:     time.Now(),
+		owner:      acs.Owner,
+		tokens:     acs.Tokens,
+		digests:    acs.Digests,
+		publicKeys: loadPublicKeys(acs.PublicKeys),
+		caPools:    loadCertificateAuthorities(acs.CertificateAuthorities),
+		signer:     signer,
+	}
+	if err = s.compile(acs.Checks); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// withChecks builds a snapshot of checks for auth that shares the owner, tokens and keys of s
+func (s *snapshot) withChecks(auth *Auth, checks *HostChecks) (*snapshot, error) {
+	acs := *s.acs
+	acs.Checks = checks
+	n := &snapshot{
+		auth:       auth,
+		serial:     atomic.AddUint64(&auth.serial, 1),
+		acs:        &acs,
+		version:    Fingerprint(&acs),
+		loaded:     time.Now(),
+		owner:      s.owner,
+		tokens:     s.tokens,
+		digests:    s.digests,
+		publicKeys: s.publicKeys,
+		caPools:    s.caPools,
+		signer:     s.signer,
+	}
+	if err := n.compile(checks); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// compile builds the host muxers, overrides, headers, logins and run modes of checks; it is
+// only called while the snapshot is built
+func (s *snapshot) compile(checks *HostChecks) error {
+	s.checks = checks
+	s.hostMuxers = make(map[string]*pat.HostMux)
+	s.hostGroups = make(map[string]HostGroup)
+	s.routes = make(map[string][]PrefixTree)
+	s.groupModes = make(map[string]string)
+	if checks == nil {
+		log.Warning("empty host checks for auth")
+		s.setHeaders(checks)
+		return s.setLogins(checks)
+	}
+
+	if err := validateHeaders(checks.Headers, s.auth.jwtHeader); err != nil {
+		return err
+	}
+	if err := validateRunMode(checks.Mode); err != nil {
+		return err
+	}
+	for _, group := range checks.HostGroups {
+		if err := validateHeaders(group.Headers, s.auth.jwtHeader); err != nil {
+			return fmt.Errorf("host group %s: %s", group.Name, err)
+		}
+		if err := validateRunMode(group.Mode); err != nil {
+			return fmt.Errorf("host group %s: %s", group.Name, err)
+		}
+	}
+
+	// create Pat Host Muxers from Checks
+	for _, group := range checks.HostGroups {
+		s.groupModes[group.Name] = group.Mode
+		// default to deny
+		hostMux := pat.NewDenyMux()
+		if group.Default == "allow" {
+			hostMux = pat.NewAllowMux()
+		}
+		// each host in a group shares the hostMux
+		var hosts []string
+		for _, host := range group.Hosts {
+			if v, ok := checks.Overrides[host]; ok {
+				log.Warningf("%s override on host %s disables defined host checks", v, host)
+			}
+			if _, ok := s.hostMuxers[host]; ok {
+				log.Errorf("ignoring duplicate host checks for %s", host)
+				continue
+			}
+			s.hostMuxers[host] = hostMux
+			s.hostGroups[host] = HostGroup{Name: group.Name, Default: group.Default}
+			hosts = append(hosts, host)
+		}
+		// add path prefixes to hostMux
+		registered := make(routes)
+		for _, check := range group.Checks {
+			// deny if method + path is not found
+			pathPrefix := hostMux.AddPrefix(check.Base, s.auth.traceRoute(route{check: check.Name, prefix: check.Base}, pat.NotFoundHandler))
+			prefix := registered.addPrefix(check)
+			methods := []struct {
+				method string
+				add    func(string, pat.HandlerFunc)
+			}{
+				{"GET", pathPrefix.Get},
+				{"POST", pathPrefix.Post},
+				{"PUT", pathPrefix.Put},
+				{"PATCH", pathPrefix.Patch},
+				{"DELETE", pathPrefix.Del},
+				{"HEAD", pathPrefix.Head},
+				{"OPTIONS", pathPrefix.Options},
+			}
+			for _, path := range check.Paths {
+				for _, m := range methods {
+					r, ok := path.Rules[Method(m.method)]
+					if !ok {
+						continue
+					}
+					named := namedRule(r, check, path, m.method)
+					handler, err := s.handler(named)
+					if err != nil {
+						return fmt.Errorf("host group %s: %s", group.Name, err)
+					}
+					m.add(path.Path, s.auth.traceRoute(route{check: check.Name, prefix: check.Base, pattern: path.Path, rule: &r}, handler))
+					prefix.addRule(path.Path, m.method, named)
+				}
+			}
+		}
+		prefixes := registered.prefixes()
+		for _, host := range hosts {
+			s.routes[host] = prefixes
+		}
+	}
+
+	if err := s.setLogins(checks); err != nil {
+		return err
+	}
+	s.mode = checks.Mode
+	s.overrides = checks.Overrides
+	s.setHeaders(checks)
+	return nil
+}
+
+// current returns the current snapshot of auth
+func (auth *Auth) current() *snapshot {
+	return auth.state.Load().(*snapshot)
+}
+
+// swap makes s the current snapshot of auth; runtime host group run modes are kept for the host
+// groups of s and the decisions cached with the previous snapshot are flushed
+func (auth *Auth) swap(s *snapshot) {
+	auth.mutex.Lock()
+	auth.state.Store(s)
+	kept := make(map[string]string)
+	for name, m := range auth.runModes.groups {
+		if _, ok := s.groupModes[name]; ok {
+			kept[name] = m
+		}
+	}
+	auth.runModes.groups = kept
+	shadow := auth.shadow
+	auth.mutex.Unlock()
+	auth.FlushDecisions()
+
+	if shadow != nil {
+		shadow.rebuild(s)
+	}
+}
+
+// muxer returns the pattern mux for host
+func (s *snapshot) muxer(host string) (mux *pat.HostMux, err error) {
+	if mux, ok := s.hostMuxers[host]; ok {
+		return mux, nil
+	}
+	return mux, fmt.Errorf("host checks not defined for %s", host)
+}
+
+// tokenName returns the name of bearer token or the empty string if the token is unknown
+func (s *snapshot) tokenName(token string) string {
+	if name, ok := s.tokens[token]; ok {
+		return name
+	}
+	if len(s.digests) == 0 {
+		return ""
+	}
+	return s.digests[HashToken(token)]
+}
@@ -0,0 +1,143 @@
+package fauth_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// versionedAccess returns an access system whose only rule accepts the bearer token app-token
+// under a token name that changes with version; a request decided with the muxer of one version
+// and the tokens of another is denied
+func versionedAccess(version int) *fauth.AccessSystem {
+	name := fmt.Sprintf("APP_KEY_%d", version)
+	return &fauth.AccessSystem{
+		Tokens: map[string]string{"app-token": name},
+		Checks: &fauth.HostChecks{HostGroups: []fauth.HostGroup{{
+			Name:    "API Hosts",
+			Hosts:   []string{"apis.example.com"},
+			Default: "deny",
+			Checks: []fauth.Check{{Name: "widgets-api", Base: "/widgets-api/v1", Paths: []fauth.Path{{
+				Path:  "/widgets/:wid",
+				Rules: map[fauth.Method]fauth.Rule{"GET": {Name: "read widget", CacheTTL: "1m", Expression: "bearer('" + name + "')"}},
+			}}}},
+		}}},
+	}
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	auth := newTestAuth(t, versionedAccess(0))
+	if err := auth.SetDecisionCache(100); err != nil {
+		t.Fatal(err)
+	}
+	update := auth.UpdateFunc()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for v := 1; v <= 50; v++ {
+			if err := update(versionedAccess(v)); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := auth.SetHostGroupRunMode("API Hosts", fauth.RunEnforcing); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				header := http.Header{}
+				header.Set("Authorization", "Bearer app-token")
+				d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header)
+				if d.Status != http.StatusOK || d.Token == "" {
+					t.Errorf("got status %d token '%s' deciding on a reload: %s", d.Status, d.Token, d.Message)
+					return
+				}
+				auth.RunModeInfo()
+				auth.ResponseHeaders("apis.example.com")
+			}
+		}()
+	}
+	wg.Wait()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token")
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header); d.Token != "APP_KEY_50" {
+		t.Errorf("got token %s after reloads, want APP_KEY_50", d.Token)
+	}
+}
+
+func TestInFlightRequestFinishesOnSnapshot(t *testing.T) {
+	t.Setenv("ROOT_KEY", "root-key-value")
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+	}))
+	defer resource.Close()
+
+	acs := versionedAccess(1)
+	acs.Checks.HostGroups[0].Checks[0].Paths[0].Rules["GET"] = fauth.Rule{
+		Name:       "read widget",
+		Expression: "bearer('APP_KEY_1') && allow('READ', 'user-1', param(':wid'), '" + resource.URL + "')",
+	}
+	auth := newTestAuth(t, acs)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token")
+	decided := make(chan *fauth.Decision)
+	go func() {
+		decided <- auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header.Clone())
+	}()
+
+	// the token is revoked while the request waits on its allow callout
+	<-arrived
+	if err := auth.UpdateFunc()(&fauth.AccessSystem{Checks: acs.Checks}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	if d := <-decided; d.Status != http.StatusOK || d.Token != "APP_KEY_1" {
+		t.Errorf("in-flight request got status %d token '%s', want 200 APP_KEY_1: %s", d.Status, d.Token, d.Message)
+	}
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header.Clone()); d.Status != http.StatusForbidden {
+		t.Errorf("got status %d after the token was revoked", d.Status)
+	}
+}
+
+func TestInvalidReloadKeepsSnapshot(t *testing.T) {
+	auth := newTestAuth(t, versionedAccess(1))
+
+	invalid := versionedAccess(2)
+	invalid.Checks.HostGroups[0].Checks[0].Paths[0].Rules["GET"] = fauth.Rule{Expression: "bearer('APP_KEY_2' ||"}
+	if err := auth.UpdateFunc()(invalid); err == nil {
+		t.Fatal("got no error for invalid rule")
+	}
+
+	// neither the tokens nor the host checks of the invalid update are applied
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-token")
+	if d := auth.Check("apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header); d.Status != http.StatusOK || d.Token != "APP_KEY_1" {
+		t.Errorf("got status %d token '%s' after invalid update", d.Status, d.Token)
+	}
+}
@@ -0,0 +1,27 @@
+-- +goose Up
+
+-- each row of SYSTEMS is an immutable published version of the host checks; the active
+-- version is the one loaded by forward-auth
+
+ALTER TABLE [authz].[SYSTEMS] ADD [HostChecks] [nvarchar](max) NULL;
+
+ALTER TABLE [authz].[SYSTEMS] ADD [Active] [bit] NOT NULL CONSTRAINT [DF_SYSTEMS_Active] DEFAULT (0);
+
+ALTER TABLE [authz].[SYSTEMS] ADD CONSTRAINT [DF_SYSTEMS_Name] DEFAULT ('forward-auth') FOR [Name];
+
+CREATE UNIQUE NONCLUSTERED INDEX [UX_authz_SYSTEMS_Active] ON [authz].[SYSTEMS]
+(
+	[Active] ASC
+) WHERE [Active] = 1;
+
+-- +goose Down
+
+DROP INDEX [UX_authz_SYSTEMS_Active] ON [authz].[SYSTEMS];
+
+ALTER TABLE [authz].[SYSTEMS] DROP CONSTRAINT [DF_SYSTEMS_Name];
+
+ALTER TABLE [authz].[SYSTEMS] DROP CONSTRAINT [DF_SYSTEMS_Active];
+
+ALTER TABLE [authz].[SYSTEMS] DROP COLUMN [Active];
+
+ALTER TABLE [authz].[SYSTEMS] DROP COLUMN [HostChecks];
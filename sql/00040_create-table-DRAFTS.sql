@@ -0,0 +1,43 @@
+-- +goose Up
+
+-- each row of DRAFTS is a named draft of the host checks; a draft is edited as a whole and
+-- published as a new version in SYSTEMS by PublishDraft
+
+CREATE TABLE [authz].[DRAFTS](
+	[ID] [int] IDENTITY(1,1) NOT NULL,
+	[Name] [varchar](64) NOT NULL,
+	[Base] [int] NOT NULL,
+	[Revision] [int] NOT NULL,
+	[HostChecks] [nvarchar](max) NOT NULL,
+	[Approved] [datetime] NULL,
+	[ApproveUser] [varchar](36) NULL,
+	[Created] [datetime] NOT NULL,
+	[CreateUser] [varchar](36) NOT NULL,
+	[Updated] [datetime] NOT NULL,
+	[UpdateUser] [varchar](36) NOT NULL
+) ON [PRIMARY]
+GO
+ALTER TABLE [authz].[DRAFTS] ADD PRIMARY KEY CLUSTERED 
+(
+	[ID] ASC
+)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, SORT_IN_TEMPDB = OFF, IGNORE_DUP_KEY = OFF, ONLINE = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+GO
+ALTER TABLE [authz].[DRAFTS] ADD  CONSTRAINT [UK_DRAFTS_Name] UNIQUE NONCLUSTERED 
+(
+	[Name] ASC
+)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, SORT_IN_TEMPDB = OFF, IGNORE_DUP_KEY = OFF, ONLINE = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+GO
+
+ALTER TABLE [authz].[DRAFTS] ADD CONSTRAINT [DF_DRAFTS_Revision]  DEFAULT (0) FOR [Revision];
+
+ALTER TABLE [authz].[DRAFTS] ADD CONSTRAINT [DF_DRAFTS_Created]  DEFAULT (getdate()) FOR [Created];
+
+ALTER TABLE [authz].[DRAFTS] ADD CONSTRAINT [DF_DRAFTS_CreateUser]  DEFAULT ('ROOT') FOR [CreateUser];
+
+ALTER TABLE [authz].[DRAFTS] ADD CONSTRAINT [DF_DRAFTS_Updated]  DEFAULT (getdate()) FOR [Updated];
+
+ALTER TABLE [authz].[DRAFTS] ADD CONSTRAINT [DF_DRAFTS_UpdateUser]  DEFAULT ('ROOT') FOR [UpdateUser];
+
+-- +goose Down
+
+DROP TABLE [authz].[DRAFTS];
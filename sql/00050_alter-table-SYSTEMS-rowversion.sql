@@ -0,0 +1,10 @@
+-- +goose Up
+
+-- the row version of SYSTEMS changes on each publish and activation; forward-auth polls it with
+-- GetChangeVersion to reload the access system when it changes
+
+ALTER TABLE [authz].[SYSTEMS] ADD [RowVersion] [rowversion] NOT NULL;
+
+-- +goose Down
+
+ALTER TABLE [authz].[SYSTEMS] DROP COLUMN [RowVersion];
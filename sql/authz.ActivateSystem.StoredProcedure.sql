@@ -0,0 +1,75 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- ActivateSystem makes a published version of the access control system the active
+-- version, eg to roll back to an earlier version; the host checks of the version are
+-- unchanged
+--
+CREATE PROCEDURE [authz].[ActivateSystem]
+@SessionGUID VARCHAR(36),
+@Version INT
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @ID INT
+    SELECT @ID = ID FROM [authz].[SYSTEMS] WHERE [Version] = @Version AND HostChecks IS NOT NULL
+    IF @ID IS NULL
+    BEGIN
+        SET @ReturnCode = @BaseCode + 404;
+        SET @Message = 'access system version does not exist: ' + CAST(@Version AS VARCHAR(10));
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    BEGIN TRANSACTION
+
+        UPDATE [authz].[SYSTEMS] SET [Active] = 0 WHERE [Active] = 1 AND ID <> @ID
+
+        UPDATE [authz].[SYSTEMS]
+        SET [Active] = 1,
+            [Updated] = getdate(),
+            [UpdateUser] = @SessionGUID
+        WHERE ID = @ID
+
+    COMMIT TRANSACTION
+
+    DECLARE @json NVARCHAR(max);
+
+    SET @json =
+      (SELECT [s].Version AS "version",
+              [s].Comment AS "comment",
+              [s].Active AS "active",
+              FORMAT([s].Created,'yyyy-MM-ddTHH:mm:ssZ') AS "created",
+              [s].CreateUser AS "createUser",
+              FORMAT([s].Updated,'yyyy-MM-ddTHH:mm:ssZ') AS "updated",
+              [s].UpdateUser AS "updateUser"
+       FROM [authz].SYSTEMS [s]
+       WHERE [s].ID = @ID
+       FOR JSON PATH, WITHOUT_ARRAY_WRAPPER)
+
+    SELECT @json
+
+    END TRY
+
+    BEGIN CATCH
+        IF @@TRANCOUNT > 0
+        BEGIN
+            ROLLBACK TRANSACTION
+        END
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'activate system failed: ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
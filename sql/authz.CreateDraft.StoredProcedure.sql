@@ -0,0 +1,54 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- CreateDraft creates a draft of the host checks of the active version, or of the host
+-- checks tables if no version has been published
+--
+CREATE PROCEDURE [authz].[CreateDraft]
+@SessionGUID VARCHAR(36),
+@Name VARCHAR(64)
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @Base INT
+    DECLARE @HostChecks NVARCHAR(max)
+    SELECT @Base = [Version], @HostChecks = HostChecks FROM [authz].[SYSTEMS] WHERE [Active] = 1 AND HostChecks IS NOT NULL
+    IF @HostChecks IS NULL
+    BEGIN
+        SET @Base = 0
+        SET @HostChecks =
+          (SELECT JSON_QUERY('{}') AS "overrides",
+                  JSON_QUERY(authz.HostGroupsJSON()) AS "hostGroups"
+           FOR JSON PATH, INCLUDE_NULL_VALUES, WITHOUT_ARRAY_WRAPPER)
+    END
+
+    INSERT INTO [authz].[DRAFTS] ([Name], [Base], [HostChecks], [CreateUser], [UpdateUser])
+    VALUES (@Name, @Base, @HostChecks, @SessionGUID, @SessionGUID)
+
+    SELECT [authz].DraftJSON(SCOPE_IDENTITY())
+
+    END TRY
+
+    BEGIN CATCH
+        IF @@TRANCOUNT > 0
+        BEGIN
+            ROLLBACK TRANSACTION
+        END
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'create draft failed for draft ' + @Name + ': ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -0,0 +1,35 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+CREATE TABLE [authz].[DECISIONS](
+	[ID] [bigint] IDENTITY(1,1) NOT NULL,
+	[Time] [datetime2] NOT NULL,
+	[TraceID] [varchar](64) NULL,
+	[Host] [varchar](255) NOT NULL,
+	[Method] [varchar](16) NOT NULL,
+	[Path] [varchar](2048) NOT NULL,
+	[Check] [varchar](64) NULL,
+	[Pattern] [varchar](1024) NULL,
+	[Rule] [varchar](1024) NULL,
+	[Outcome] [varchar](8) NOT NULL,
+	[Status] [int] NOT NULL,
+	[Reason] [varchar](1024) NULL,
+	[Mode] [varchar](16) NULL,
+	[Unenforced] [int] NOT NULL,
+	[UID] [varchar](64) NULL,
+	[Token] [varchar](64) NULL,
+	[Tenant] [varchar](64) NULL,
+	[LatencyMs] [float] NOT NULL
+) ON [PRIMARY]
+GO
+ALTER TABLE [authz].[DECISIONS] ADD PRIMARY KEY CLUSTERED 
+(
+	[ID] ASC
+)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, SORT_IN_TEMPDB = OFF, IGNORE_DUP_KEY = OFF, ONLINE = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+GO
+CREATE NONCLUSTERED INDEX [IX_authz_DECISIONS_Time] ON [authz].[DECISIONS]
+(
+	[Time] ASC
+)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, SORT_IN_TEMPDB = OFF, DROP_EXISTING = OFF, ONLINE = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+GO
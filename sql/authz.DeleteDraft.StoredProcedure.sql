@@ -0,0 +1,49 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- DeleteDraft deletes a draft
+--
+CREATE PROCEDURE [authz].[DeleteDraft]
+@Name VARCHAR(64)
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @ID INT
+    DECLARE @StoredRevision INT
+    SELECT @ID = ID, @StoredRevision = Revision FROM [authz].[DRAFTS] WITH (UPDLOCK) WHERE [Name] = @Name
+    IF @ID IS NULL
+    BEGIN
+        SET @ReturnCode = @BaseCode + 404;
+        SET @Message = 'draft does not exist: ' + @Name;
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    DELETE FROM [authz].[DRAFTS] WHERE ID = @ID
+
+    SELECT '{"message": "deleted draft ' + @Name + '"}'
+
+    END TRY
+
+    BEGIN CATCH
+        IF @@TRANCOUNT > 0
+        BEGIN
+            ROLLBACK TRANSACTION
+        END
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'delete draft failed for draft ' + @Name + ': ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -0,0 +1,27 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- DraftJSON returns a draft with its host checks as JSON
+--
+CREATE FUNCTION [authz].[DraftJSON] (@ID INT)
+RETURNS NVARCHAR(max)
+AS
+BEGIN
+    RETURN
+      (SELECT [d].Name AS "name",
+              [d].Base AS "base",
+              [d].Revision AS "revision",
+              JSON_QUERY([d].HostChecks) AS "authorization",
+              FORMAT([d].Created,'yyyy-MM-ddTHH:mm:ssZ') AS "created",
+              [d].CreateUser AS "createUser",
+              FORMAT([d].Updated,'yyyy-MM-ddTHH:mm:ssZ') AS "updated",
+              [d].UpdateUser AS "updateUser",
+              FORMAT([d].Approved,'yyyy-MM-ddTHH:mm:ssZ') AS "approved",
+              [d].ApproveUser AS "approveUser"
+       FROM [authz].DRAFTS [d]
+       WHERE [d].ID = @ID
+       FOR JSON PATH, WITHOUT_ARRAY_WRAPPER)
+END
+GO
@@ -0,0 +1,40 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- GetChangeVersion returns a value that changes whenever the access control system loaded by
+-- forward-auth may have changed: the highest row version of SYSTEMS, which changes on each
+-- publish and activation, and the row counts and last updates of the host checks tables, which
+-- change on each insert, update and delete while no version is active
+--
+CREATE PROCEDURE [authz].[GetChangeVersion]
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    SELECT CONCAT(
+        (SELECT CONVERT(VARCHAR(18), MAX([RowVersion]), 1) FROM [authz].[SYSTEMS]), ';',
+        (SELECT CONCAT(COUNT_BIG(*), '@', FORMAT(MAX([Updated]), 'yyyyMMddHHmmssfff')) FROM [authz].[HOST_GROUPS]), ';',
+        (SELECT CONCAT(COUNT_BIG(*), '@', FORMAT(MAX([Updated]), 'yyyyMMddHHmmssfff')) FROM [authz].[HOSTS]), ';',
+        (SELECT CONCAT(COUNT_BIG(*), '@', FORMAT(MAX([Updated]), 'yyyyMMddHHmmssfff')) FROM [authz].[CHECKS]), ';',
+        (SELECT CONCAT(COUNT_BIG(*), '@', FORMAT(MAX([Updated]), 'yyyyMMddHHmmssfff')) FROM [authz].[PATHS]))
+
+    END TRY
+
+    BEGIN CATCH
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'get change version failed: ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -0,0 +1,47 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- GetDraft returns a draft with its host checks
+--
+CREATE PROCEDURE [authz].[GetDraft]
+@Name VARCHAR(64)
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @ID INT
+    DECLARE @StoredRevision INT
+    SELECT @ID = ID, @StoredRevision = Revision FROM [authz].[DRAFTS] WITH (UPDLOCK) WHERE [Name] = @Name
+    IF @ID IS NULL
+    BEGIN
+        SET @ReturnCode = @BaseCode + 404;
+        SET @Message = 'draft does not exist: ' + @Name;
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    SELECT [authz].DraftJSON(@ID)
+
+    END TRY
+
+    BEGIN CATCH
+        IF @@TRANCOUNT > 0
+        BEGIN
+            ROLLBACK TRANSACTION
+        END
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'get draft failed for draft ' + @Name + ': ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -0,0 +1,48 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- GetDrafts returns the drafts of the host checks without their host checks
+--
+CREATE PROCEDURE [authz].[GetDrafts]
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @json NVARCHAR(max);
+
+    SET @json =
+      (SELECT [d].Name AS "name",
+              [d].Base AS "base",
+              [d].Revision AS "revision",
+              FORMAT([d].Created,'yyyy-MM-ddTHH:mm:ssZ') AS "created",
+              [d].CreateUser AS "createUser",
+              FORMAT([d].Updated,'yyyy-MM-ddTHH:mm:ssZ') AS "updated",
+              [d].UpdateUser AS "updateUser",
+              FORMAT([d].Approved,'yyyy-MM-ddTHH:mm:ssZ') AS "approved",
+              [d].ApproveUser AS "approveUser"
+       FROM [authz].DRAFTS [d]
+       ORDER BY [d].Name
+       FOR JSON PATH)
+
+    SELECT ISNULL(@json, '[]')
+
+    END TRY
+
+    BEGIN CATCH
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'get drafts failed: ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -0,0 +1,64 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- GetSystem returns a published version of the access control system with its host
+-- checks; if @Version is NULL the active version is returned, or NULL if no version
+-- is active
+--
+CREATE PROCEDURE [authz].[GetSystem]
+@Version INT = NULL
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @ID INT
+    IF @Version IS NULL
+        SELECT @ID = ID FROM [authz].[SYSTEMS] WHERE [Active] = 1 AND HostChecks IS NOT NULL
+    ELSE
+    BEGIN
+        SELECT @ID = ID FROM [authz].[SYSTEMS] WHERE [Version] = @Version AND HostChecks IS NOT NULL
+        IF @ID IS NULL
+        BEGIN
+            SET @ReturnCode = @BaseCode + 404;
+            SET @Message = 'access system version does not exist: ' + CAST(@Version AS VARCHAR(10));
+            THROW @ReturnCode, @Message, 1;
+        END
+    END
+
+    DECLARE @json NVARCHAR(max);
+
+    SET @json =
+      (SELECT [s].Version AS "version",
+              [s].Comment AS "comment",
+              [s].Active AS "active",
+              JSON_QUERY([s].HostChecks) AS "authorization",
+              FORMAT([s].Created,'yyyy-MM-ddTHH:mm:ssZ') AS "created",
+              [s].CreateUser AS "createUser",
+              FORMAT([s].Updated,'yyyy-MM-ddTHH:mm:ssZ') AS "updated",
+              [s].UpdateUser AS "updateUser"
+       FROM [authz].SYSTEMS [s]
+       WHERE [s].ID = @ID
+       FOR JSON PATH, WITHOUT_ARRAY_WRAPPER)
+
+    SELECT @json
+
+    END TRY
+
+    BEGIN CATCH
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'get system failed: ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
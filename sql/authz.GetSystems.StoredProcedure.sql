@@ -0,0 +1,48 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- GetSystems returns the published versions of the access control system, newest
+-- first, without their host checks
+--
+CREATE PROCEDURE [authz].[GetSystems]
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    DECLARE @json NVARCHAR(max);
+
+    SET @json =
+      (SELECT [s].Version AS "version",
+              [s].Comment AS "comment",
+              [s].Active AS "active",
+              FORMAT([s].Created,'yyyy-MM-ddTHH:mm:ssZ') AS "created",
+              [s].CreateUser AS "createUser",
+              FORMAT([s].Updated,'yyyy-MM-ddTHH:mm:ssZ') AS "updated",
+              [s].UpdateUser AS "updateUser"
+       FROM [authz].SYSTEMS [s]
+       WHERE [s].HostChecks IS NOT NULL
+       ORDER BY [s].Version DESC
+       FOR JSON PATH)
+
+    SELECT ISNULL(@json, '[]')
+
+    END TRY
+
+    BEGIN CATCH
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'get systems failed: ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
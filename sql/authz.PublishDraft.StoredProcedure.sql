@@ -0,0 +1,86 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- PublishDraft records the host checks of a draft at @Revision as a new active version
+-- and deletes the draft in a single transaction; a draft based on a version other than the
+-- active version is rejected, since publishing it would discard the changes published since
+--
+CREATE PROCEDURE [authz].[PublishDraft]
+@SessionGUID VARCHAR(36),
+@Name VARCHAR(64),
+@Revision INT,
+@Comment VARCHAR(256),
+@Version INT OUTPUT
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    BEGIN TRANSACTION
+
+    DECLARE @ID INT
+    DECLARE @StoredRevision INT
+    DECLARE @Base INT
+    SELECT @ID = ID, @StoredRevision = Revision, @Base = Base FROM [authz].[DRAFTS] WITH (UPDLOCK) WHERE [Name] = @Name
+    IF @ID IS NULL
+    BEGIN
+        SET @ReturnCode = @BaseCode + 404;
+        SET @Message = 'draft does not exist: ' + @Name;
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    IF @StoredRevision <> @Revision
+    BEGIN
+        SET @ReturnCode = @BaseCode + 409;
+        SET @Message = 'the draft was changed since it was read: ' + @Name;
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    DECLARE @Active INT
+    SELECT @Active = [Version] FROM [authz].[SYSTEMS] WITH (UPDLOCK, HOLDLOCK) WHERE [Active] = 1 AND HostChecks IS NOT NULL
+    IF ISNULL(@Active, 0) <> @Base
+    BEGIN
+        SET @ReturnCode = @BaseCode + 409;
+        SET @Message = 'the host checks were published since the draft was created from them: ' + @Name
+            + ' is based on version ' + CAST(@Base AS VARCHAR(10)) + ', not version ' + CAST(ISNULL(@Active, 0) AS VARCHAR(10));
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    UPDATE [authz].[SYSTEMS] SET [Active] = 0 WHERE [Active] = 1
+
+    INSERT INTO [authz].[SYSTEMS] ([Version], [Comment], [HostChecks], [Active], [CreateUser], [UpdateUser])
+    SELECT NEXT VALUE FOR [authz].Version, @Comment, [d].HostChecks, 1, @SessionGUID, @SessionGUID
+    FROM [authz].[DRAFTS] [d]
+    WHERE [d].ID = @ID
+
+    SELECT @Version = [Version] FROM [authz].[SYSTEMS] WHERE ID = SCOPE_IDENTITY()
+
+    DELETE FROM [authz].[DRAFTS] WHERE ID = @ID
+
+    COMMIT TRANSACTION
+
+    SELECT '{"version": ' + CAST(@Version AS VARCHAR(10)) + '}'
+
+    END TRY
+
+    BEGIN CATCH
+        IF @@TRANCOUNT > 0
+        BEGIN
+            ROLLBACK TRANSACTION
+        END
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'publish draft failed for draft ' + @Name + ': ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -0,0 +1,70 @@
+SET ANSI_NULLS ON
+GO
+SET QUOTED_IDENTIFIER ON
+GO
+--
+-- SaveDraft saves the host checks of a draft at @Revision, clearing its approval
+--
+CREATE PROCEDURE [authz].[SaveDraft]
+@SessionGUID VARCHAR(36),
+@Name VARCHAR(64),
+@Revision INT,
+@HostChecks NVARCHAR(max)
+WITH EXEC AS CALLER
+AS
+BEGIN
+    DECLARE @BaseCode INT = 50000
+    DECLARE @ReturnCode INT
+    DECLARE @Message VARCHAR(200)
+
+    BEGIN TRY
+
+    BEGIN TRANSACTION
+
+    DECLARE @ID INT
+    DECLARE @StoredRevision INT
+    SELECT @ID = ID, @StoredRevision = Revision FROM [authz].[DRAFTS] WITH (UPDLOCK) WHERE [Name] = @Name
+    IF @ID IS NULL
+    BEGIN
+        SET @ReturnCode = @BaseCode + 404;
+        SET @Message = 'draft does not exist: ' + @Name;
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    IF @StoredRevision <> @Revision
+    BEGIN
+        SET @ReturnCode = @BaseCode + 409;
+        SET @Message = 'the draft was changed since it was read: ' + @Name;
+        THROW @ReturnCode, @Message, 1;
+    END
+
+    UPDATE [authz].[DRAFTS]
+    SET [HostChecks] = @HostChecks,
+        [Revision] = [Revision] + 1,
+        [Approved] = NULL,
+        [ApproveUser] = NULL,
+        [Updated] = getdate(),
+        [UpdateUser] = @SessionGUID
+    WHERE ID = @ID
+
+    COMMIT TRANSACTION
+
+    SELECT [authz].DraftJSON(@ID)
+
+    END TRY
+
+    BEGIN CATCH
+        IF @@TRANCOUNT > 0
+        BEGIN
+            ROLLBACK TRANSACTION
+        END
+        IF ERROR_NUMBER() > 50000
+        BEGIN
+            THROW;
+        END
+        DECLARE @ErrorMessage VARCHAR(400)
+        SELECT @ErrorMessage = 'save draft failed for draft ' + @Name + ': ' + ERROR_MESSAGE();
+        THROW 50000, @ErrorMessage, 1;
+    END CATCH
+END
+GO
@@ -17,14 +17,27 @@ BEGIN
     
     BEGIN TRANSACTION
 
+		-- the version records the host checks as published; it is never updated
+		DECLARE @HostChecks NVARCHAR(max)
+		SET @HostChecks =
+		  (SELECT JSON_QUERY('{}') AS "overrides",
+		          JSON_QUERY(authz.HostGroupsJSON()) AS "hostGroups"
+		   FOR JSON PATH, INCLUDE_NULL_VALUES, WITHOUT_ARRAY_WRAPPER)
+
+		UPDATE [authz].[SYSTEMS] SET [Active] = 0 WHERE [Active] = 1
+
 		INSERT INTO [authz].[SYSTEMS] (
 		  [Version],
 			[Comment],
+			[HostChecks],
+			[Active],
 			[CreateUser],
 			[UpdateUser])
 		VALUES (
 			NEXT VALUE FOR [authz].Version,
 			@Comment,
+			@HostChecks,
+			1,
 			@SessionGUID,
 			@SessionGUID);
 
@@ -39,6 +52,7 @@ BEGIN
     SET @json = 
       (SELECT [s].Version AS "version", 
               [s].Comment AS "comment",
+              [s].Active AS "active",
               FORMAT([s].Created,'yyyy-MM-ddTHH:mm:ssZ') AS "created",
               [s].CreateUser AS "createUser",
               FORMAT([s].Updated,'yyyy-MM-ddTHH:mm:ssZ') AS "updated",
@@ -1,5 +0,0 @@
-package fauth
-
-type Stats struct {
-}
-
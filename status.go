@@ -0,0 +1,68 @@
+package fauth
+
+import "time"
+
+// AccessStatus identifies the access system an Auth enforces, so that deployment tooling can
+// verify that a rollout reached every replica:
+//   - Fingerprint is the canonical hash of the live access system (see Fingerprint); replicas
+//     enforcing the same access system report the same fingerprint wherever it was loaded from
+//   - Loaded is the time the live access system was loaded, Store the ID of the store it is
+//     loaded from and Version its published version, if the store versions access systems
+//   - Degraded explains why the live access system may be stale (see ReloadStatus)
+//   - Counts are the numbers of entities of the live access system
+type AccessStatus struct {
+	Fingerprint string       `json:"fingerprint"`
+	Loaded      time.Time    `json:"loaded"`
+	Store       string       `json:"store"`
+	Version     int          `json:"version,omitempty"`
+	Degraded    string       `json:"degraded,omitempty"`
+	Counts      AccessCounts `json:"counts"`
+}
+
+// AccessCounts counts the entities of an access system; Tokens counts the bearer tokens and
+// token digests and Keys the public keys
+type AccessCounts struct {
+	HostGroups int `json:"hostGroups"`
+	Hosts      int `json:"hosts"`
+	Checks     int `json:"checks"`
+	Paths      int `json:"paths"`
+	Rules      int `json:"rules"`
+	Tokens     int `json:"tokens"`
+	Keys       int `json:"keys"`
+}
+
+// AccessStatus returns the status of the live access system of auth
+func (auth *Auth) AccessStatus() AccessStatus {
+	s := auth.current()
+	status := AccessStatus{
+		Fingerprint: s.version,
+		Loaded:      s.loaded,
+		Version:     s.acs.Version,
+		Counts: AccessCounts{
+			Tokens: len(s.tokens) + len(s.digests),
+			Keys:   len(s.publicKeys),
+		},
+	}
+
+	// the store of the last known good access system is the store access systems are loaded from
+	auth.mutex.RLock()
+	status.Store, status.Degraded = auth.lkgStore, auth.reload.degraded
+	auth.mutex.RUnlock()
+
+	if s.checks == nil {
+		return status
+	}
+	counts := &status.Counts
+	for _, group := range s.checks.HostGroups {
+		counts.HostGroups++
+		counts.Hosts += len(group.Hosts)
+		for _, check := range group.Checks {
+			counts.Checks++
+			for _, path := range check.Paths {
+				counts.Paths++
+				counts.Rules += len(path.Rules)
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,39 @@
+package fauth_test
+
+import (
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestAccessStatus(t *testing.T) {
+	acs := versionedAccess(1)
+	acs.Version = 7
+	acs.Digests = map[string]string{fauth.HashToken("tenant-token"): "TENANT_KEY"}
+	auth := newTestAuth(t, acs)
+	auth.SetLastKnownGood("", "mssql")
+
+	status := auth.AccessStatus()
+	if status.Fingerprint != fauth.Fingerprint(acs) || status.Store != "mssql" || status.Version != 7 || status.Loaded.IsZero() {
+		t.Errorf("got status %+v", status)
+	}
+	want := fauth.AccessCounts{HostGroups: 1, Hosts: 1, Checks: 1, Paths: 1, Rules: 1, Tokens: 2}
+	if status.Counts != want {
+		t.Errorf("got counts %+v, want %+v", status.Counts, want)
+	}
+
+	// replicas that load the same access system report the same fingerprint
+	other := newTestAuth(t, versionedAccess(1))
+	if err := other.UpdateFunc()(acs); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := other.AccessStatus().Fingerprint; fingerprint != status.Fingerprint {
+		t.Errorf("got fingerprint %s of the same access system, want %s", fingerprint, status.Fingerprint)
+	}
+	if err := auth.UpdateFunc()(versionedAccess(2)); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := auth.AccessStatus().Fingerprint; fingerprint == status.Fingerprint {
+		t.Error("got the same fingerprint after loading another access system")
+	}
+}
@@ -0,0 +1,215 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/log"
+)
+
+/*******************************
+ implement the DraftStore interface
+********************************/
+
+// drafts are kept as JSON files in the drafts directory (FILE_DRAFTS_DIR); publishing a draft
+// replaces the host checks of the access file, which the file watcher then reloads. The version
+// of the access file counts the drafts published to it: a draft is based on the version it was
+// created from and cannot be published once another draft has been published
+
+// Drafts returns the drafts in the drafts directory without their host checks
+func (store *FileStore) Drafts() (drafts []fauth.Draft, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(store.drafts, "*.json"))
+	if err != nil {
+		return drafts, err
+	}
+	for _, file := range files {
+		draft, err := store.readDraft(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return drafts, err
+		}
+		draft.Checks = nil
+		drafts = append(drafts, *draft)
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i].Name < drafts[j].Name })
+	return drafts, nil
+}
+
+// Draft returns a draft with its host checks
+func (store *FileStore) Draft(name string) (draft *fauth.Draft, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.readDraft(name)
+}
+
+// CreateDraft creates a draft of the host checks in the access file
+func (store *FileStore) CreateDraft(sessionGUID, name string) (draft *fauth.Draft, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	draft = &fauth.Draft{Name: name}
+	if err = draft.Validate(); err != nil {
+		return draft, err
+	}
+	if _, err = os.Stat(store.draftFile(name)); err == nil {
+		return draft, fmt.Errorf("draft %s already exists", name)
+	}
+	access, err := store.Export()
+	if err != nil {
+		return draft, err
+	}
+	now := time.Now()
+	draft.Base = access.Version
+	draft.Checks = access.Checks
+	draft.Created, draft.CreateUser = now, sessionGUID
+	draft.Updated, draft.UpdateUser = now, sessionGUID
+	return draft, store.writeDraft(draft)
+}
+
+// SaveDraft saves the host checks of draft if it is at the stored revision, clearing its approval
+func (store *FileStore) SaveDraft(sessionGUID string, draft *fauth.Draft) (saved *fauth.Draft, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	saved, err = store.readRevision(draft)
+	if err != nil {
+		return saved, err
+	}
+	saved.Checks = draft.Checks
+	saved.Revision++
+	saved.Updated, saved.UpdateUser = time.Now(), sessionGUID
+	saved.Approved, saved.ApproveUser = nil, ""
+	return saved, store.writeDraft(saved)
+}
+
+// ApproveDraft records the approval of draft if it is at the stored revision
+func (store *FileStore) ApproveDraft(sessionGUID string, draft *fauth.Draft) (approved *fauth.Draft, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	approved, err = store.readRevision(draft)
+	if err != nil {
+		return approved, err
+	}
+	now := time.Now()
+	approved.Approved, approved.ApproveUser = &now, sessionGUID
+	return approved, store.writeDraft(approved)
+}
+
+// DeleteDraft deletes a draft
+func (store *FileStore) DeleteDraft(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, err := store.readDraft(name); err != nil {
+		return err
+	}
+	return os.Remove(store.draftFile(name))
+}
+
+// DraftAccess returns the access system loaded from the access file with the host checks of draft
+func (store *FileStore) DraftAccess(draft *fauth.Draft) (acs *fauth.AccessSystem, err error) {
+	access, err := store.Export()
+	if err != nil {
+		return acs, err
+	}
+	access.Checks = draft.Checks
+	if access.Checks == nil {
+		access.Checks = &fauth.HostChecks{}
+	}
+	return resolve(access)
+}
+
+// PublishDraft replaces the host checks of the access file with those of draft, if it is at the
+// stored revision and no other draft was published since it was created, and deletes the draft
+func (store *FileStore) PublishDraft(sessionGUID string, draft *fauth.Draft, comment string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored, err := store.readRevision(draft)
+	if err != nil {
+		return err
+	}
+	access, err := store.Export()
+	if err != nil {
+		return err
+	}
+	if stored.Base != access.Version {
+		return fmt.Errorf("%w: draft %s is based on version %d, not version %d", fauth.ErrDraftStale, draft.Name, stored.Base, access.Version)
+	}
+	access.Version++
+	access.Checks = stored.Checks
+	if err = store.Import(access); err != nil {
+		return err
+	}
+	log.Infof("[Session GUID: %s]: published draft %s revision %d to %s: %s", sessionGUID, draft.Name, draft.Revision, store.access, comment)
+	return os.Remove(store.draftFile(draft.Name))
+}
+
+// readRevision reads the stored draft, returning ErrDraftConflict if it is not at the revision of draft
+func (store *FileStore) readRevision(draft *fauth.Draft) (stored *fauth.Draft, err error) {
+	stored, err = store.readDraft(draft.Name)
+	if err != nil {
+		return stored, err
+	}
+	if stored.Revision != draft.Revision {
+		return stored, fauth.ErrDraftConflict
+	}
+	return stored, nil
+}
+
+func (store *FileStore) readDraft(name string) (draft *fauth.Draft, err error) {
+	draft = &fauth.Draft{Name: name}
+	if err = draft.Validate(); err != nil {
+		return draft, err
+	}
+	data, err := ioutil.ReadFile(store.draftFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return draft, fmt.Errorf("draft %s does not exist", name)
+	}
+	if err != nil {
+		return draft, err
+	}
+	if err = json.Unmarshal(data, draft); err != nil {
+		return draft, fmt.Errorf("invalid draft %s: %s", name, err)
+	}
+	return draft, nil
+}
+
+// writeDraft replaces the draft file by rename so that a draft is never partially written
+func (store *FileStore) writeDraft(draft *fauth.Draft) error {
+	data, err := json.MarshalIndent(draft, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(store.drafts, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(store.drafts, ".draft-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.draftFile(draft.Name))
+}
+
+func (store *FileStore) draftFile(name string) string {
+	return filepath.Join(store.drafts, name+".json")
+}
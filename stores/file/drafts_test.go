@@ -0,0 +1,61 @@
+package file_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/forward-auth/stores/file"
+)
+
+func TestPublishStaleDraft(t *testing.T) {
+	t.Setenv("MC_APP_KEY", "app-token")
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "access.json"), []byte(accessFile("owner")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FILE_DRAFTS_DIR", filepath.Join(dir, "drafts"))
+	store, err := file.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	first, err := store.CreateDraft("admin", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.CreateDraft("admin", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.PublishDraft("admin", first, "first change"); err != nil {
+		t.Fatal(err)
+	}
+	access, err := store.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.Version != first.Base+1 {
+		t.Errorf("got access file version %d after publishing, want %d", access.Version, first.Base+1)
+	}
+
+	// the second draft would discard the first change
+	if err = store.PublishDraft("admin", second, "second change"); !errors.Is(err, fauth.ErrDraftStale) {
+		t.Errorf("got error %v publishing a stale draft, want %v", err, fauth.ErrDraftStale)
+	}
+	third, err := store.CreateDraft("admin", "third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.PublishDraft("admin", third, "third change"); err != nil {
+		t.Errorf("got error %v publishing a draft of the published host checks", err)
+	}
+}
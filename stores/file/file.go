@@ -7,6 +7,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	_ "embed"
 
@@ -19,11 +22,16 @@ import (
 //go:embed base.json
 var base []byte
 
-// FileStore implements the forward-auth file storage interface
+// FileStore implements the forward-auth file storage interface; changes to the access file
+// are reloaded once no further change is seen for debounce (FILE_RELOAD_DEBOUNCE). Drafts of
+// the host checks are kept in the drafts directory (FILE_DRAFTS_DIR)
 type FileStore struct {
 	directory string
 	access    string
+	drafts    string
 	watcher   *fsnotify.Watcher
+	debounce  time.Duration
+	mutex     sync.Mutex
 }
 
 // New creates a new forward-auth service from data files in directory dir
@@ -47,7 +55,9 @@ func New(dir string) (store *FileStore, err error) {
 	store = &FileStore{
 		directory: dir,
 		access:    access,
+		drafts:    config.IfGetenv("FILE_DRAFTS_DIR", filepath.Join(dir, "drafts")),
 		watcher:   watcher,
+		debounce:  config.IfGetDuration("FILE_RELOAD_DEBOUNCE", 500*time.Millisecond),
 	}
 
 	log.Debugf("initialized new %s service %+v from %s", store.ID(), store, dir)
@@ -68,7 +78,7 @@ func (store *FileStore) Load() (acs *fauth.AccessSystem, err error) {
 
 	acs = &fauth.AccessSystem{}
 
-	acs, err = load(store)
+	acs, err = LoadFile(store.access)
 
 	if err != nil {
 		return acs, err
@@ -79,8 +89,37 @@ func (store *FileStore) Load() (acs *fauth.AccessSystem, err error) {
 	return acs, nil
 }
 
-// load acs from store
-func load(store *FileStore) (acs *fauth.AccessSystem, err error) {
+// Base returns the base Access System embedded in the file store that access files extend
+func Base() (acs *fauth.AccessSystem, err error) {
+	acs = &fauth.AccessSystem{}
+	err = json.Unmarshal(base, acs)
+	return acs, err
+}
+
+// LoadFile loads the Access System from the embedded base and the access file, resolving
+// token, key and secret values by their source
+func LoadFile(file string) (acs *fauth.AccessSystem, err error) {
+	// load the application Access Control System
+	data, err := readFile(file)
+	if err != nil {
+		return acs, err
+	}
+
+	access := &fauth.AccessSystem{}
+
+	err = json.Unmarshal(data, access)
+	if err != nil {
+		return acs, err
+	}
+
+	log.Debugf("loaded access ACS from '%s': %+v", file, access)
+
+	return resolve(access)
+}
+
+// resolve returns the Access System of the embedded base extended by access, resolving token,
+// key and secret values by their source
+func resolve(access *fauth.AccessSystem) (acs *fauth.AccessSystem, err error) {
 
 	// load the base Access Control System
 
@@ -104,26 +143,14 @@ func load(store *FileStore) (acs *fauth.AccessSystem, err error) {
 	//
 	acs.Tokens = make(map[string]string, 0)
 
-	err = loadTokens(acs, acs.Tokens, acs.PublicKeys)
-	if err != nil {
-		return acs, err
-	}
-
-	// load the application Access Control System
-	data, err := readFile(store.access)
-	if err != nil {
-		return acs, err
-	}
-
-	access := &fauth.AccessSystem{}
+	// digests maps the digests of bearer tokens configured by digest rather than value to token names
+	acs.Digests = make(map[string]string, 0)
 
-	err = json.Unmarshal(data, access)
+	err = loadTokens(acs, acs.Tokens, acs.Digests, acs.PublicKeys)
 	if err != nil {
 		return acs, err
 	}
 
-	log.Debugf("loaded access ACS from '%s': %+v", store.access, access)
-
 	owner := access.Owner
 	if owner.Bearer == nil {
 		return acs, fmt.Errorf("owner root bearer token is undefined")
@@ -141,13 +168,37 @@ func load(store *FileStore) (acs *fauth.AccessSystem, err error) {
 			return acs, fmt.Errorf("bearer token value is empty")
 		}
 		acs.Tokens[value] = "ROOT_KEY"
+	case "digest":
+		if err := checkDigest(owner.Bearer.Value); err != nil {
+			return acs, err
+		}
+		acs.Digests[owner.Bearer.Value] = "ROOT_KEY"
 	default:
 		return acs, fmt.Errorf("invalid bearer token source for owner %s: %s", owner.Name, owner.Bearer.Source)
 	}
 
+	// owner keys sign and publish identity assertions
+	err = loadOwnerKeys(&owner)
+	if err != nil {
+		return acs, err
+	}
+
 	acs.Owner = owner
 
-	err = loadTokens(access, acs.Tokens, acs.PublicKeys)
+	err = loadTokens(access, acs.Tokens, acs.Digests, acs.PublicKeys)
+	if err != nil {
+		return acs, err
+	}
+
+	// certificate authorities verify client certificates forwarded by Traefik
+	cas, err := loadCertificateAuthorities(access.CertificateAuthorities)
+	if err != nil {
+		return acs, err
+	}
+	acs.CertificateAuthorities = append(acs.CertificateAuthorities, cas...)
+
+	// login client secrets authenticate forward-auth to identity providers
+	err = loadLogins(access.Checks)
 	if err != nil {
 		return acs, err
 	}
@@ -156,7 +207,7 @@ func load(store *FileStore) (acs *fauth.AccessSystem, err error) {
 	return acs, nil
 }
 
-func loadTokens(acs *fauth.AccessSystem, tokens map[string]string, publicKeys map[string]string) error {
+func loadTokens(acs *fauth.AccessSystem, tokens, digests map[string]string, publicKeys map[string]string) error {
 	for _, application := range acs.Applications {
 		// map application bearer token value to name
 		if application.Bearer != nil {
@@ -167,6 +218,11 @@ func loadTokens(acs *fauth.AccessSystem, tokens map[string]string, publicKeys ma
 				tokens[config.MustGetConfig(application.Bearer.Name)] = application.Bearer.Name
 			case "file":
 				tokens[application.Bearer.Value] = application.Bearer.Name
+			case "digest":
+				if err := checkDigest(application.Bearer.Value); err != nil {
+					return err
+				}
+				digests[application.Bearer.Value] = application.Bearer.Name
 			default:
 				return fmt.Errorf("invalid bearer token source for application %s: %s", application.Name, application.Bearer.Source)
 			}
@@ -188,6 +244,11 @@ func loadTokens(acs *fauth.AccessSystem, tokens map[string]string, publicKeys ma
 					return fmt.Errorf("bearer token value is empty")
 				}
 				tokens[value] = tenant.UUID
+			case "digest":
+				if err := checkDigest(tenant.Bearer.Value); err != nil {
+					return err
+				}
+				digests[tenant.Bearer.Value] = tenant.UUID
 			default:
 				return fmt.Errorf("invalid bearer token source for tenant %s: %s", tenant.Name, tenant.Bearer.Source)
 			}
@@ -215,12 +276,131 @@ func loadTokens(acs *fauth.AccessSystem, tokens map[string]string, publicKeys ma
 	return nil
 }
 
+// checkDigest checks that the value of a bearer token with source digest is a token digest
+func checkDigest(value string) error {
+	if !strings.HasPrefix(value, fauth.TokenDigestPrefix) {
+		return fmt.Errorf("bearer token digest must begin with %s", fauth.TokenDigestPrefix)
+	}
+	return nil
+}
+
+// loadOwnerKeys resolves the values of the optional owner public and private keys by source
+func loadOwnerKeys(owner *fauth.Owner) error {
+	if owner.PrivateKey != nil {
+		switch owner.PrivateKey.Source {
+		case "env":
+			owner.PrivateKey.Value = config.MustGetConfig(owner.PrivateKey.Name)
+		case "file":
+			if owner.PrivateKey.Value == "" {
+				return fmt.Errorf("private key value is empty")
+			}
+		default:
+			return fmt.Errorf("invalid private key source for owner %s: %s", owner.Name, owner.PrivateKey.Source)
+		}
+	}
+	if owner.PublicKey != nil {
+		switch owner.PublicKey.Source {
+		case "env":
+			owner.PublicKey.Value = config.MustGetConfig(owner.PublicKey.Name)
+		case "file":
+			if owner.PublicKey.Value == "" {
+				return fmt.Errorf("public key value is empty")
+			}
+		default:
+			return fmt.Errorf("invalid public key source for owner %s: %s", owner.Name, owner.PublicKey.Source)
+		}
+	}
+	return nil
+}
+
+// loadLogins resolves the client secrets of host group logins by source
+func loadLogins(checks *fauth.HostChecks) error {
+	if checks == nil {
+		return nil
+	}
+	for _, group := range checks.HostGroups {
+		if group.Login == nil || group.Login.ClientSecret == nil {
+			continue
+		}
+		secret := group.Login.ClientSecret
+		switch secret.Source {
+		case "env":
+			secret.Value = config.MustGetConfig(secret.Name)
+		case "file":
+			if secret.Value == "" {
+				return fmt.Errorf("login client secret value is empty for host group %s", group.Name)
+			}
+		default:
+			return fmt.Errorf("invalid login client secret source for host group %s: %s", group.Name, secret.Source)
+		}
+	}
+	return nil
+}
+
+// loadCertificateAuthorities resolves the PEM bundles of certificate authorities by source
+func loadCertificateAuthorities(cas []fauth.CertificateAuthority) (resolved []fauth.CertificateAuthority, err error) {
+	for _, ca := range cas {
+		switch ca.Source {
+		case "env":
+			ca.Value = config.MustGetConfig(ca.Name)
+		case "file":
+			if ca.Value == "" {
+				return resolved, fmt.Errorf("certificate authority %s value is empty", ca.Name)
+			}
+		default:
+			return resolved, fmt.Errorf("invalid certificate authority source for %s: %s", ca.Name, ca.Source)
+		}
+		resolved = append(resolved, ca)
+	}
+	return resolved, nil
+}
+
 func loadChecks(checks *fauth.HostChecks, acs *fauth.AccessSystem) {
 	acs.Checks.HostGroups = append(acs.Checks.HostGroups, checks.HostGroups...)
 
 	for k, v := range checks.Overrides {
 		acs.Checks.Overrides[k] = v
 	}
+
+	if len(checks.Headers) > 0 && acs.Checks.Headers == nil {
+		acs.Checks.Headers = make(map[string]string, len(checks.Headers))
+	}
+	for k, v := range checks.Headers {
+		acs.Checks.Headers[k] = v
+	}
+}
+
+// Export returns the access system in the access file as stored
+func (store *FileStore) Export() (acs *fauth.AccessSystem, err error) {
+	data, err := readFile(store.access)
+	if err != nil {
+		return acs, err
+	}
+	acs = &fauth.AccessSystem{}
+	err = json.Unmarshal(data, acs)
+	return acs, err
+}
+
+// Import replaces the access file with acs; the file is replaced by rename so that the
+// file watcher never loads a partially written file
+func (store *FileStore) Import(acs *fauth.AccessSystem) error {
+	data, err := fauth.FormatAccessSystem(acs)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(store.directory, ".access-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.access)
 }
 
 // Close closes the file storage adapter;
@@ -1,30 +1,60 @@
 package file
 
 import (
+	"time"
+
 	fauth "bitbucket.org/_metalogic_/forward-auth"
 	"bitbucket.org/_metalogic_/log"
-	"github.com/fsnotify/fsnotify"
 )
 
-// Listen listens for changes to the access control file, calling
-// updateACS to refresh its caches on change
-func (store *FileStore) Listen(updateACS func(*fauth.AccessSystem) error) {
+// Listen listens for changes to the access control file, calling update to refresh its caches
+// on change or failed if the changed file cannot be loaded; a file that fails to load is never
+// passed to update. Changes are debounced so that editors that save by rename, chmod or
+// truncate-then-write trigger a single reload of the complete file
+func (store *FileStore) Listen(update func(*fauth.AccessSystem) error, failed func(error)) {
 
 	go func() {
+		var (
+			timer  *time.Timer
+			reload <-chan time.Time
+		)
 		for {
 			select {
 			case event, ok := <-store.watcher.Events:
 				if !ok {
+					if timer != nil {
+						timer.Stop()
+					}
 					return
 				}
 				log.Debugf("files watch: %s", event)
-				if event.Name == store.access && (event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Write == fsnotify.Write) {
-					log.Infof("access file %s has changed; reloading", event.Name)
-					acs, err := store.Load()
-					if err != nil {
-						log.Errorf("error reloading %s: %s", event.Name, err)
+				if event.Name != store.access {
+					continue
+				}
+				// each operation on the access file restarts the debounce interval
+				if timer == nil {
+					timer = time.NewTimer(store.debounce)
+				} else {
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
 					}
-					updateACS(acs)
+					timer.Reset(store.debounce)
+				}
+				reload = timer.C
+			case <-reload:
+				reload = nil
+				log.Infof("access file %s has changed; reloading", store.access)
+				acs, err := store.Load()
+				if err != nil {
+					log.Errorf("error reloading %s; keeping the current access system: %s", store.access, err)
+					failed(err)
+					continue
+				}
+				if err = update(acs); err != nil {
+					log.Errorf("rejected reload of %s; keeping the current access system: %s", store.access, err)
 				}
 			case err, ok := <-store.watcher.Errors:
 				if !ok {
@@ -0,0 +1,83 @@
+package file_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/forward-auth/stores/file"
+)
+
+// accessFile returns an access file of owner
+func accessFile(owner string) string {
+	return fmt.Sprintf(`{
+  "owner": { "name": "%s", "bearer": { "source": "file", "value": "root-token" } },
+  "authorization": { "hostGroups": [ { "name": "Test Hosts", "hosts": [ "test.localhost" ], "default": "allow" } ] }
+}`, owner)
+}
+
+func TestListenDebounce(t *testing.T) {
+	t.Setenv("MC_APP_KEY", "app-token")
+	t.Setenv("FILE_RELOAD_DEBOUNCE", "200ms")
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	access := filepath.Join(dir, "access.json")
+	if err = ioutil.WriteFile(access, []byte(accessFile("initial")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := file.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mutex   sync.Mutex
+		updates []string
+		failed  []error
+	)
+	store.Listen(func(acs *fauth.AccessSystem) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		updates = append(updates, acs.Owner.Name)
+		return nil
+	}, func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failed = append(failed, err)
+	})
+
+	// an editor truncates the access file and writes it in several steps
+	f, err := os.OpenFile(access, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := accessFile("final")
+	for i := 0; i < len(content); i += len(content) / 4 {
+		end := i + len(content)/4
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err = f.WriteString(content[i:end]); err != nil {
+			t.Fatal(err)
+		}
+		f.Sync()
+		time.Sleep(50 * time.Millisecond)
+	}
+	f.Close()
+	os.Chmod(access, 0600)
+
+	time.Sleep(time.Second)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(updates) != 1 || updates[0] != "final" || len(failed) != 0 {
+		t.Errorf("got updates %v and failures %v, want one update of the final access file", updates, failed)
+	}
+}
@@ -45,6 +45,9 @@ func (store *MSSql) HostGroups() (groupsJSON string, err error) {
 }
 
 func (store *MSSql) CreateHostGroup(sessionGUID string, group fauth.HostGroup) (groupJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return groupJSON, err
+	}
 	txn, err := store.DB.BeginTx(context.TODO(), nil)
 	if err != nil {
 		log.Error(err)
@@ -96,6 +99,9 @@ func (store *MSSql) HostGroup(groupGUID string) (groupJSON string, err error) {
 
 }
 func (store *MSSql) UpdateHostGroup(sessionGUID, groupGUID string, group fauth.HostGroup) (groupJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return groupJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -126,6 +132,9 @@ func (store *MSSql) UpdateHostGroup(sessionGUID, groupGUID string, group fauth.H
 	return groupJSON, err
 }
 func (store *MSSql) DeleteHostGroup(groupGUID string) (msgJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return msgJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -178,6 +187,9 @@ func (store *MSSql) Hosts(groupGUID string) (hostsJSON string, err error) {
 }
 
 func (store *MSSql) CreateHost(sessionGUID, groupGUID string, hostname string) (hostJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return hostJSON, err
+	}
 	var (
 		hostGUID string
 		rows     *sql.Rows
@@ -237,6 +249,9 @@ func (store *MSSql) Host(groupGUID, hostGUID string) (hostJSON string, err error
 }
 
 func (store *MSSql) UpdateHost(sessionGUID, groupGUID, hostGUID string, hostname string) (hostJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return hostJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -268,6 +283,9 @@ func (store *MSSql) UpdateHost(sessionGUID, groupGUID, hostGUID string, hostname
 }
 
 func (store *MSSql) DeleteHost(groupGUID, hostGUID string) (msgJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return msgJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -323,6 +341,9 @@ func (store *MSSql) Checks(groupGUID string) (checksJSON string, err error) {
 }
 
 func (store *MSSql) CreateCheck(sessionGUID, groupGUID string, check fauth.Check) (checkJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return checkJSON, err
+	}
 	var (
 		checkGUID string
 		rows      *sql.Rows
@@ -385,6 +406,9 @@ func (store *MSSql) Check(groupGUID, checkGUID string) (checkJSON string, err er
 }
 
 func (store *MSSql) UpdateCheck(sessionGUID, groupGUID, checkGUID string, check fauth.Check) (checkJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return checkJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -415,6 +439,9 @@ func (store *MSSql) UpdateCheck(sessionGUID, groupGUID, checkGUID string, check
 }
 
 func (store *MSSql) DeleteCheck(groupGUID, checkGUID string) (msgJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return msgJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -471,6 +498,9 @@ func (store *MSSql) Paths(groupGUID, checkGUID string) (pathsJSON string, err er
 }
 
 func (store *MSSql) CreatePath(sessionGUID, groupGUID, checkGUID string, path fauth.Path) (pathJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return pathJSON, err
+	}
 	var (
 		pathGUID string
 		rows     *sql.Rows
@@ -538,6 +568,9 @@ func (store *MSSql) Path(groupGUID, checkGUID, pathGUID string) (pathJSON string
 }
 
 func (store *MSSql) UpdatePath(sessionGUID, groupGUID, checkGUID, pathGUID string, path fauth.Path) (pathJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return pathJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -576,6 +609,9 @@ func (store *MSSql) UpdatePath(sessionGUID, groupGUID, checkGUID, pathGUID strin
 }
 
 func (store *MSSql) DeletePath(groupGUID, checkGUID, pathGUID string) (msgJSON string, err error) {
+	if err = tablesWritable(store); err != nil {
+		return msgJSON, err
+	}
 	var (
 		rows *sql.Rows
 	)
@@ -0,0 +1,18 @@
+package mssql
+
+import (
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// insertDecision inserts a decision audit event into [authz].[DECISIONS]
+const insertDecision = `INSERT INTO [authz].[DECISIONS]
+	([Time], [TraceID], [Host], [Method], [Path], [Check], [Pattern], [Rule], [Outcome], [Status],
+	 [Reason], [Mode], [Unenforced], [UID], [Token], [Tenant], [LatencyMs])
+	VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10, @p11, @p12, @p13, @p14, @p15, @p16, @p17)`
+
+// AuditSink returns a sink recording decision audit events in the [authz].[DECISIONS] table
+func (store *MSSql) AuditSink(size int, interval time.Duration) (fauth.AuditSink, error) {
+	return fauth.NewSQLAuditSink(store.DB, insertDecision, size, interval)
+}
@@ -17,6 +17,9 @@ CREATE TABLE [authz].[SYSTEMS]
 	[CreateUser] [varchar](36) NOT NULL,
 	[Updated] [datetime] NOT NULL,
 	[UpdateUser] [varchar](36) NOT NULL,
+	[HostChecks] [nvarchar](max) NULL,
+	[Active] [bit] NOT NULL,
+	[RowVersion] [rowversion] NOT NULL,
 ) ON [PRIMARY]
 GO
 
@@ -34,6 +37,13 @@ ALTER TABLE [authz].[SYSTEMS] ADD CONSTRAINT [DF_SYSTEMS_Updated] DEFAULT (getda
 GO
 ALTER TABLE [authz].[SYSTEMS] ADD CONSTRAINT [DF_SYSTEMS_UpdateUser] DEFAULT ('ROOT') FOR [UpdateUser]
 GO
+ALTER TABLE [authz].[SYSTEMS] ADD CONSTRAINT [DF_SYSTEMS_Name] DEFAULT ('forward-auth') FOR [Name]
+GO
+ALTER TABLE [authz].[SYSTEMS] ADD CONSTRAINT [DF_SYSTEMS_Active] DEFAULT (0) FOR [Active]
+GO
 
 ALTER TABLE [authz].[SYSTEMS] ADD CONSTRAINT UK_SYSTEMS_Version UNIQUE ([Version])
-GO
\ No newline at end of file
+GO
+
+CREATE UNIQUE NONCLUSTERED INDEX [UX_authz_SYSTEMS_Active] ON [authz].[SYSTEMS] ([Active]) WHERE [Active] = 1
+GO
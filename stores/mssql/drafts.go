@@ -0,0 +1,106 @@
+package mssql
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/log"
+)
+
+/*******************************
+ implement the DraftStore interface
+********************************/
+
+// Drafts returns the drafts of the host checks without their host checks
+func (store *MSSql) Drafts() (drafts []fauth.Draft, err error) {
+	draftsJSON, err := store.queryJSON("[authz].[GetDrafts]")
+	if err != nil {
+		return drafts, err
+	}
+	err = json.Unmarshal([]byte(draftsJSON), &drafts)
+	return drafts, err
+}
+
+// Draft returns a draft with its host checks
+func (store *MSSql) Draft(name string) (draft *fauth.Draft, err error) {
+	return store.draft("[authz].[GetDraft]", sql.Named("Name", name))
+}
+
+// CreateDraft creates a draft of the host checks of the active version
+func (store *MSSql) CreateDraft(sessionGUID, name string) (draft *fauth.Draft, err error) {
+	draft = &fauth.Draft{Name: name}
+	if err = draft.Validate(); err != nil {
+		return draft, err
+	}
+	log.Debugf("[Session GUID: %s]: create draft %s", sessionGUID, name)
+	return store.draft("[authz].[CreateDraft]",
+		sql.Named("SessionGUID", sessionGUID),
+		sql.Named("Name", name))
+}
+
+// SaveDraft saves the host checks of draft if it is at the stored revision, clearing its approval
+func (store *MSSql) SaveDraft(sessionGUID string, draft *fauth.Draft) (saved *fauth.Draft, err error) {
+	checks := draft.Checks
+	if checks == nil {
+		checks = &fauth.HostChecks{}
+	}
+	checksJSON, err := json.Marshal(checks)
+	if err != nil {
+		return saved, err
+	}
+	log.Debugf("[Session GUID: %s]: save draft %s revision %d", sessionGUID, draft.Name, draft.Revision)
+	return store.draft("[authz].[SaveDraft]",
+		sql.Named("SessionGUID", sessionGUID),
+		sql.Named("Name", draft.Name),
+		sql.Named("Revision", draft.Revision),
+		sql.Named("HostChecks", string(checksJSON)))
+}
+
+// ApproveDraft records the approval of draft if it is at the stored revision
+func (store *MSSql) ApproveDraft(sessionGUID string, draft *fauth.Draft) (approved *fauth.Draft, err error) {
+	log.Debugf("[Session GUID: %s]: approve draft %s revision %d", sessionGUID, draft.Name, draft.Revision)
+	return store.draft("[authz].[ApproveDraft]",
+		sql.Named("SessionGUID", sessionGUID),
+		sql.Named("Name", draft.Name),
+		sql.Named("Revision", draft.Revision))
+}
+
+// DeleteDraft deletes a draft
+func (store *MSSql) DeleteDraft(name string) error {
+	_, err := store.queryJSON("[authz].[DeleteDraft]", sql.Named("Name", name))
+	return err
+}
+
+// DraftAccess returns the access system loaded if draft were published
+func (store *MSSql) DraftAccess(draft *fauth.Draft) (acs *fauth.AccessSystem, err error) {
+	return &fauth.AccessSystem{Checks: draft.Checks}, nil
+}
+
+// PublishDraft records the host checks of draft, if it is at the stored revision and based on the
+// active version, as a new active version and deletes the draft in a single transaction
+func (store *MSSql) PublishDraft(sessionGUID string, draft *fauth.Draft, comment string) error {
+	var version int
+	_, err := store.queryJSON("[authz].[PublishDraft]",
+		sql.Named("SessionGUID", sessionGUID),
+		sql.Named("Name", draft.Name),
+		sql.Named("Revision", draft.Revision),
+		sql.Named("Comment", comment),
+		sql.Named("Version", sql.Out{Dest: &version}))
+	if err != nil {
+		return err
+	}
+	log.Infof("[Session GUID: %s]: published draft %s revision %d as version %d", sessionGUID, draft.Name, draft.Revision, version)
+	return nil
+}
+
+// draft returns the draft returned as JSON by procedure
+func (store *MSSql) draft(procedure string, args ...interface{}) (draft *fauth.Draft, err error) {
+	draftJSON, err := store.queryJSON(procedure, args...)
+	if err != nil {
+		return draft, err
+	}
+	draft = &fauth.Draft{}
+	err = json.Unmarshal([]byte(draftJSON), draft)
+	return draft, err
+}
@@ -80,9 +80,19 @@ func (loader *Loader) Import(file string) (n int, err error) {
 
 	log.Debugf("loaded access system from file %s: %+v", file, acs)
 
+	return importAccessSystem(loader.DB, &acs)
+}
+
+// importAccessSystem creates the host groups of acs with their hosts, checks and paths
+// in a single transaction returning the number of host groups created
+func importAccessSystem(db *sql.DB, acs *fauth.AccessSystem) (n int, err error) {
+	if acs.Checks == nil {
+		return n, fmt.Errorf("access system has no host checks to import")
+	}
+
 	sessionGUID := "ROOT"
 
-	txn, err := loader.DB.BeginTx(context.TODO(), nil)
+	txn, err := db.BeginTx(context.TODO(), nil)
 	if err != nil {
 		log.Error(err)
 		return n, err
@@ -91,6 +101,7 @@ func (loader *Loader) Import(file string) (n int, err error) {
 	for i, group := range acs.Checks.HostGroups {
 		groupGUID, groupJSON, err := createHostGroup(txn, sessionGUID, group)
 		if err != nil {
+			txn.Rollback()
 			return n, err
 		}
 		log.Debugf("importing host group %s: %s", groupGUID, groupJSON)
@@ -122,8 +133,7 @@ func (loader *Loader) Import(file string) (n int, err error) {
 		}
 	}
 
-	txn.Commit()
-	return n, nil
+	return n, txn.Commit()
 }
 
 func createSystem(txn *sql.Tx, sessionGUID, name, description string) (systemGUID, systemJSON string, err error) {
@@ -0,0 +1,97 @@
+package mssql
+
+import (
+	"time"
+
+	"bitbucket.org/_metalogic_/config"
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	"bitbucket.org/_metalogic_/log"
+)
+
+// Listen polls the change version of the database (see authz.GetChangeVersion) every
+// DB_POLL_INTERVAL, calling update with the access system loaded when it changes or failed if it
+// cannot be loaded; an access system that fails to load is never passed to update. A change is
+// reloaded once the change version is unchanged for DB_CHANGE_DEBOUNCE, so that a burst of edits
+// triggers a single reload. Polls that fail, eg while the database is unreachable, are retried
+// with a backoff that doubles up to DB_RETRY_MAX_INTERVAL, and a change missed meanwhile is
+// reloaded by the first poll that succeeds
+func (store *MSSql) Listen(update func(*fauth.AccessSystem) error, failed func(error)) {
+	p := &poller{
+		interval:      config.IfGetDuration("DB_POLL_INTERVAL", 5*time.Second),
+		debounce:      config.IfGetDuration("DB_CHANGE_DEBOUNCE", time.Second),
+		max:           config.IfGetDuration("DB_RETRY_MAX_INTERVAL", time.Minute),
+		changeVersion: store.changeVersion,
+		load:          store.Load,
+		sleep:         time.Sleep,
+	}
+	go func() {
+		p.start()
+		for {
+			p.poll(update, failed)
+		}
+	}()
+}
+
+// changeVersion returns the change version of the database
+func (store *MSSql) changeVersion() (version string, err error) {
+	return store.queryJSON("[authz].[GetChangeVersion]")
+}
+
+// poller reloads the access system when the change version of the database changes
+type poller struct {
+	interval      time.Duration
+	debounce      time.Duration
+	max           time.Duration
+	changeVersion func() (string, error)
+	load          func() (*fauth.AccessSystem, error)
+	sleep         func(time.Duration)
+
+	seen string        // change version of the access system last loaded
+	wait time.Duration // time until the next poll
+}
+
+// start takes the change version at startup as the version of the access system already loaded
+func (p *poller) start() {
+	var err error
+	if p.seen, err = p.changeVersion(); err != nil {
+		log.Errorf("failed to get mssql change version: %s", err)
+	}
+	p.wait = p.interval
+}
+
+// poll waits for the next poll and reloads the access system if the change version changed
+func (p *poller) poll(update func(*fauth.AccessSystem) error, failed func(error)) {
+	p.sleep(p.wait)
+	version, err := p.changeVersion()
+	if err != nil {
+		if p.wait *= 2; p.wait > p.max {
+			p.wait = p.max
+		}
+		log.Errorf("failed to poll mssql change version; retrying in %s: %s", p.wait, err)
+		return
+	}
+	p.wait = p.interval
+	if version == p.seen {
+		return
+	}
+	// wait for the burst of changes to settle, but no longer than the poll interval
+	for settle := time.Duration(0); settle < p.interval; settle += p.debounce {
+		p.sleep(p.debounce)
+		latest, err := p.changeVersion()
+		if err != nil || latest == version {
+			break
+		}
+		version = latest
+	}
+	log.Infof("mssql change version is %s; reloading", version)
+	acs, err := p.load()
+	if err != nil {
+		log.Errorf("error reloading from mssql; keeping the current access system: %s", err)
+		failed(err)
+		return
+	}
+	p.seen = version
+	if err = update(acs); err != nil {
+		log.Errorf("rejected reload from mssql; keeping the current access system: %s", err)
+	}
+}
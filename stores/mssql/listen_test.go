@@ -0,0 +1,109 @@
+package mssql
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+// testPoller returns a poller whose change versions are taken in turn from versions, where ""
+// fails the poll, and which records its sleeps and loads instead of waiting and loading
+func testPoller(versions ...string) (p *poller, slept *[]time.Duration, loads *int) {
+	slept, loads = new([]time.Duration), new(int)
+	p = &poller{
+		interval: 5 * time.Second,
+		debounce: time.Second,
+		max:      time.Minute,
+		changeVersion: func() (string, error) {
+			if len(versions) == 0 {
+				return "", errors.New("no more versions")
+			}
+			version := versions[0]
+			versions = versions[1:]
+			if version == "" {
+				return "", errors.New("database is unreachable")
+			}
+			return version, nil
+		},
+		load: func() (*fauth.AccessSystem, error) {
+			*loads++
+			return &fauth.AccessSystem{}, nil
+		},
+		sleep: func(d time.Duration) { *slept = append(*slept, d) },
+	}
+	p.start()
+	return p, slept, loads
+}
+
+func TestPollDebounce(t *testing.T) {
+	// a burst of changes that settles after two debounce periods is reloaded once
+	p, slept, loads := testPoller("1", "2", "3", "4", "4")
+	updates := 0
+	update := func(*fauth.AccessSystem) error { updates++; return nil }
+	p.poll(update, func(err error) { t.Fatal(err) })
+	if *loads != 1 || updates != 1 || p.seen != "4" {
+		t.Errorf("got %d loads and %d updates of version %s, want 1 of version 4", *loads, updates, p.seen)
+	}
+	want := []time.Duration{5 * time.Second, time.Second, time.Second, time.Second}
+	if !reflect.DeepEqual(*slept, want) {
+		t.Errorf("got sleeps %v, want %v", *slept, want)
+	}
+
+	// a burst of changes that does not settle is reloaded after the poll interval
+	p, slept, loads = testPoller("1", "2", "3", "4", "5", "6", "7", "8")
+	p.poll(update, func(err error) { t.Fatal(err) })
+	if *loads != 1 || p.seen != "7" || len(*slept) != 6 {
+		t.Errorf("got %d loads of version %s after sleeps %v", *loads, p.seen, *slept)
+	}
+
+	// an unchanged version is not reloaded
+	p, _, loads = testPoller("1", "1")
+	p.poll(update, func(err error) { t.Fatal(err) })
+	if *loads != 0 {
+		t.Errorf("got %d loads of an unchanged version", *loads)
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+	// failed polls back off up to the maximum interval, and a change missed meanwhile is
+	// reloaded by the first poll that succeeds
+	p, slept, loads := testPoller("1", "", "", "", "", "", "", "2", "2")
+	updates := 0
+	update := func(*fauth.AccessSystem) error { updates++; return nil }
+	for i := 0; i < 7; i++ {
+		p.poll(update, func(err error) { t.Fatal(err) })
+	}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute, time.Minute, time.Second}
+	if !reflect.DeepEqual(*slept, want) {
+		t.Errorf("got sleeps %v, want %v", *slept, want)
+	}
+	if *loads != 1 || updates != 1 || p.seen != "2" || p.wait != p.interval {
+		t.Errorf("got %d loads and %d updates of version %s, next poll in %s", *loads, updates, p.seen, p.wait)
+	}
+}
+
+func TestPollLoadFailure(t *testing.T) {
+	// a change that fails to load is reported and reloaded by the next poll
+	p, _, loads := testPoller("1", "2", "2", "2", "2")
+	p.load = func() (*fauth.AccessSystem, error) {
+		*loads++
+		if *loads == 1 {
+			return nil, errors.New("invalid rule")
+		}
+		return &fauth.AccessSystem{}, nil
+	}
+	var failures []error
+	updates := 0
+	update := func(*fauth.AccessSystem) error { updates++; return nil }
+	p.poll(update, func(err error) { failures = append(failures, err) })
+	if len(failures) != 1 || updates != 0 || p.seen != "1" {
+		t.Fatalf("got failures %v and %d updates, seen version %s", failures, updates, p.seen)
+	}
+	p.poll(update, func(err error) { t.Fatal(err) })
+	if *loads != 2 || updates != 1 || p.seen != "2" {
+		t.Errorf("got %d loads and %d updates of version %s after a failed load", *loads, updates, p.seen)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"time"
 
@@ -56,9 +57,11 @@ func New() (store *MSSql, err error) {
 	info := make(map[string]string)
 	info["Database"] = name
 	info["Type"] = "sqlserver"
-	store.info["Version"], err = Version(store.DB, "postgres")
+	// the database may be unavailable at startup; forward-auth then starts from its last known
+	// good access system and retries the store
+	info["Version"], err = Version(db, "sqlserver")
 	if err != nil {
-		log.Error(err.Error())
+		log.Errorf("failed to get sqlserver version: %s", err)
 	}
 	store = &MSSql{
 		DB:      db,
@@ -68,7 +71,7 @@ func New() (store *MSSql, err error) {
 
 	log.Debugf("initialized new mssql service %+v", store)
 
-	return store, err
+	return store, nil
 }
 
 /*******************************
@@ -84,16 +87,55 @@ func (store *MSSql) Close() error {
 	return store.DB.Close()
 }
 
-// Load loads an access control system from the database
+// Load loads an access control system from the database; the host checks are those of the
+// active published version, or those in the database if no version has been published
 func (store *MSSql) Load() (acs *fauth.AccessSystem, err error) {
-	var (
-		rows *sql.Rows
-	)
+	return load(store)
+}
 
-	rows, err = store.DB.QueryContext(store.context, "[authz].[GetAccessControlSystem]")
+// accessSource is the part of the store that Load reads from
+type accessSource interface {
+	activeVersion() (*fauth.SystemVersion, error)
+	hostChecks() (*fauth.HostChecks, error)
+}
+
+// load loads the active version of source, or the host checks of its tables if no version has
+// been published; the tables are not read, and are read-only, once a version is published
+func load(source accessSource) (acs *fauth.AccessSystem, err error) {
+	active, err := source.activeVersion()
+	if err != nil {
+		return acs, err
+	}
+	if active != nil {
+		return &fauth.AccessSystem{Version: active.Version, Checks: active.Checks}, nil
+	}
+	checks, err := source.hostChecks()
+	if err != nil {
+		return acs, err
+	}
+	return &fauth.AccessSystem{Checks: checks}, nil
+}
 
+// tablesWritable returns a conflict once a version of source is published: Load no longer reads
+// the host checks tables, so edits to them would be accepted but never enforced; published host
+// checks are edited in drafts instead
+func tablesWritable(source accessSource) error {
+	active, err := source.activeVersion()
 	if err != nil {
-		return acs, DBError(err)
+		return err
+	}
+	if active != nil {
+		return &ErrorResponse{Status: http.StatusConflict, Timestamp: time.Now().UnixNano(),
+			Message: fmt.Sprintf("the host checks tables are read-only since version %d was published; edit the host checks in a draft", active.Version)}
+	}
+	return nil
+}
+
+// hostChecks returns the host checks of the host group, host, check and path tables
+func (store *MSSql) hostChecks() (checks *fauth.HostChecks, err error) {
+	rows, err := store.DB.QueryContext(store.context, "[authz].[GetAccessControlSystem]")
+	if err != nil {
+		return checks, DBError(err)
 	}
 	defer rows.Close()
 
@@ -103,20 +145,31 @@ func (store *MSSql) Load() (acs *fauth.AccessSystem, err error) {
 	}
 	if err != nil {
 		log.Error(err.Error())
-		return acs, NewDBError(err.Error())
+		return checks, NewDBError(err.Error())
 	}
 
-	checks := &fauth.HostChecks{}
+	checks = &fauth.HostChecks{}
 	err = json.Unmarshal([]byte(checksJSON), checks)
 	if err != nil {
 		log.Error(err.Error())
-		return acs, NewDBError(err.Error())
+		return checks, NewDBError(err.Error())
 	}
+	return checks, nil
+}
+
+// Export returns the access control system in the database
+func (store *MSSql) Export() (acs *fauth.AccessSystem, err error) {
+	return store.Load()
+}
 
-	acs = &fauth.AccessSystem{
-		Checks: checks,
+// Import creates the host groups of acs in the database
+func (store *MSSql) Import(acs *fauth.AccessSystem) error {
+	n, err := importAccessSystem(store.DB, acs)
+	if err != nil {
+		return err
 	}
-	return acs, nil
+	log.Debugf("imported %d host groups to database", n)
+	return nil
 }
 
 // Blocks returns the map of blocked users
@@ -185,5 +238,7 @@ func (store *MSSql) Stats() string {
 	return js
 }
 
-func (store *MSSql) Listen(func(*fauth.AccessSystem) error) {
+// DBStats returns the statistics of the database connection pool
+func (store *MSSql) DBStats() sql.DBStats {
+	return store.DB.Stats()
 }
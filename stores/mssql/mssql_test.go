@@ -0,0 +1,70 @@
+package mssql
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	. "bitbucket.org/_metalogic_/glib/http" // dot import fo avoid package prefix in reference (shutup lint)
+)
+
+// stubSource is an access source with an optional active version and host checks in its tables
+type stubSource struct {
+	active     *fauth.SystemVersion
+	checks     *fauth.HostChecks
+	tablesRead bool
+}
+
+func (s *stubSource) activeVersion() (*fauth.SystemVersion, error) {
+	return s.active, nil
+}
+
+func (s *stubSource) hostChecks() (*fauth.HostChecks, error) {
+	s.tablesRead = true
+	if s.checks == nil {
+		return nil, errors.New("tables are unavailable")
+	}
+	return s.checks, nil
+}
+
+func TestLoadPrefersActiveVersion(t *testing.T) {
+	published := &fauth.HostChecks{HostGroups: []fauth.HostGroup{{Name: "Published Hosts"}}}
+	edited := &fauth.HostChecks{HostGroups: []fauth.HostGroup{{Name: "Edited Hosts"}}}
+
+	// the tables are loaded until a version is published
+	source := &stubSource{checks: edited}
+	acs, err := load(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acs.Version != 0 || acs.Checks != edited {
+		t.Errorf("got version %d of %+v, want the unversioned tables", acs.Version, acs.Checks)
+	}
+
+	// the active version is loaded, and the tables ignored, once a version is published
+	source = &stubSource{active: &fauth.SystemVersion{Version: 3, Checks: published}, checks: edited}
+	acs, err = load(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acs.Version != 3 || acs.Checks != published || source.tablesRead {
+		t.Errorf("got version %d of %+v, want the active version 3", acs.Version, acs.Checks)
+	}
+
+	if _, err = load(&stubSource{}); err == nil {
+		t.Error("got no error loading unavailable tables")
+	}
+}
+
+func TestTablesWritable(t *testing.T) {
+	if err := tablesWritable(&stubSource{}); err != nil {
+		t.Errorf("got error %s writing the tables before a version is published", err)
+	}
+
+	// edits of the tables would be ignored by Load once a version is published
+	err := tablesWritable(&stubSource{active: &fauth.SystemVersion{Version: 3}})
+	if e, ok := err.(*ErrorResponse); !ok || e.Status != http.StatusConflict {
+		t.Errorf("got %v writing the tables after version 3 was published, want 409 Conflict", err)
+	}
+}
@@ -0,0 +1,108 @@
+package mssql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+	. "bitbucket.org/_metalogic_/glib/http" // dot import fo avoid package prefix in reference (shutup lint)
+	. "bitbucket.org/_metalogic_/glib/sql"
+	"bitbucket.org/_metalogic_/log"
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+/*******************************
+ implement the Versioner interface
+********************************/
+
+// Versions returns the published versions of the access control system, newest first
+func (store *MSSql) Versions() (versions []fauth.SystemVersion, err error) {
+	versionsJSON, err := store.queryJSON("[authz].[GetSystems]")
+	if err != nil {
+		return versions, err
+	}
+	err = json.Unmarshal([]byte(versionsJSON), &versions)
+	return versions, err
+}
+
+// SystemVersion returns a published version of the access control system with its host checks
+func (store *MSSql) SystemVersion(version int) (v *fauth.SystemVersion, err error) {
+	return store.systemVersion("[authz].[GetSystem]", sql.Named("Version", version))
+}
+
+// PublishVersion records the host checks tables as the first version; once a version is published
+// the tables are read-only and new versions are published from drafts
+func (store *MSSql) PublishVersion(sessionGUID, comment string) (v *fauth.SystemVersion, err error) {
+	if err = tablesWritable(store); err != nil {
+		return v, err
+	}
+	var version int
+	log.Debugf("[Session GUID: %s]: publish access system version: %s", sessionGUID, comment)
+	v, err = store.systemVersion("[authz].[VersionSystem]",
+		sql.Named("SessionGUID", sessionGUID),
+		sql.Named("Comment", comment),
+		sql.Named("Version", sql.Out{Dest: &version}))
+	if err != nil {
+		return v, err
+	}
+	log.Infof("[Session GUID: %s]: published access system version %d", sessionGUID, version)
+	return v, nil
+}
+
+// ActivateVersion makes a published version the active version loaded by forward-auth
+func (store *MSSql) ActivateVersion(sessionGUID string, version int) (v *fauth.SystemVersion, err error) {
+	log.Debugf("[Session GUID: %s]: activate access system version %d", sessionGUID, version)
+	return store.systemVersion("[authz].[ActivateSystem]",
+		sql.Named("SessionGUID", sessionGUID),
+		sql.Named("Version", version))
+}
+
+// activeVersion returns the active version of the access control system with its host checks,
+// or nil if no version has been published
+func (store *MSSql) activeVersion() (v *fauth.SystemVersion, err error) {
+	return store.systemVersion("[authz].[GetSystem]")
+}
+
+// systemVersion returns the version returned as JSON by procedure, or nil if it returns NULL
+func (store *MSSql) systemVersion(procedure string, args ...interface{}) (v *fauth.SystemVersion, err error) {
+	versionJSON, err := store.queryJSON(procedure, args...)
+	if err != nil || versionJSON == "" {
+		return v, err
+	}
+	v = &fauth.SystemVersion{}
+	err = json.Unmarshal([]byte(versionJSON), v)
+	return v, err
+}
+
+// queryJSON returns the JSON result of procedure; a NULL result is returned as the empty string
+func (store *MSSql) queryJSON(procedure string, args ...interface{}) (result string, err error) {
+	rows, err := store.DB.QueryContext(store.context, procedure, args...)
+	if err != nil {
+		return result, dbError(err)
+	}
+	defer rows.Close()
+
+	var js sql.NullString
+	for rows.Next() {
+		err = rows.Scan(&js)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		log.Errorf("%s", err)
+		return result, dbError(err)
+	}
+	return js.String, nil
+}
+
+// dbError returns the error response of a database error; DBError reports the conflicts thrown
+// as 50409 by procedures as 400 Bad Request, so they are returned as 409 Conflict here
+func dbError(err error) error {
+	if e, ok := err.(mssql.Error); ok && e.SQLErrorNumber() == 50000+http.StatusConflict {
+		return &ErrorResponse{Status: http.StatusConflict, Message: e.SQLErrorMessage(), Timestamp: time.Now().UnixNano()}
+	}
+	return DBError(err)
+}
@@ -50,15 +50,17 @@ func New() (svc *Service, err error) {
 
 	svc.info = make(map[string]string)
 	svc.info["Type"] = "postgres"
+	// the database may be unavailable at startup; forward-auth then starts from its last known
+	// good access system and retries the store
 	svc.info["Version"], err = Version(svc.DB, "postgres")
 	if err != nil {
-		log.Error(err.Error())
+		log.Errorf("failed to get postgres version: %s", err)
 	}
 	svc.info["Database"] = name
 	svc.DB.SetConnMaxLifetime(0)
 	svc.DB.SetMaxIdleConns(50)
 	svc.DB.SetMaxOpenConns(50)
-	return svc, err
+	return svc, nil
 }
 
 /*******************************
@@ -92,3 +94,8 @@ func (store *Service) Stats() (js string) {
 	// TODO
 	return js
 }
+
+// DBStats returns the statistics of the database connection pool
+func (store *Service) DBStats() sql.DBStats {
+	return store.DB.Stats()
+}
@@ -8,7 +8,7 @@ func (store Service) Database() (database fauth.Database, err error) {
 	return database, err
 }
 
-func (store Service) Listen(func(*fauth.AccessSystem) error) {
+func (store Service) Listen(func(*fauth.AccessSystem) error, func(error)) {
 }
 
 func (store Service) Load() (as *fauth.AccessSystem, err error) {
@@ -0,0 +1,283 @@
+package fauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/_metalogic_/log"
+)
+
+// W3C trace context headers; see https://www.w3.org/TR/trace-context/
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+// spanHeader is set by Check on the request header passed to the host muxer to identify the span
+// of a traced decision; incoming copies are removed before evaluation
+const spanHeader = "X-Forward-Auth-Span"
+
+// TraceContext identifies a span in a W3C trace:
+//   - TraceID and SpanID are the lowercase hex encoded 16 byte trace ID and 8 byte span ID
+//   - Sampled is true if the spans of the trace are recorded
+//   - State is the vendor specific tracestate, passed on unchanged
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+	State   string
+}
+
+// ParseTraceContext parses the values of the traceparent and tracestate headers of a request;
+// ok is false if traceparent is missing or invalid, in which case a new trace should be started
+func ParseTraceContext(traceparent, tracestate string) (tc TraceContext, ok bool) {
+	traceparent = strings.TrimSpace(traceparent)
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 {
+		return tc, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" || !isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(flags, 2) {
+		return tc, false
+	}
+	// version 00 has exactly four fields; later versions may append fields
+	if version == "00" && len(parts) != 4 {
+		return tc, false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(spanID, "0") == "" {
+		return tc, false
+	}
+	sampled, _ := hex.DecodeString(flags)
+	return TraceContext{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Sampled: sampled[0]&1 == 1,
+		State:   strings.TrimSpace(tracestate),
+	}, true
+}
+
+// isHex returns true if s is n lowercase hex digits
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent returns the traceparent header value of tc
+func (tc TraceContext) Traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + flags
+}
+
+// Inject sets the W3C trace context headers of tc in header
+func (tc TraceContext) Inject(header http.Header) {
+	header.Set(TraceparentHeader, tc.Traceparent())
+	if tc.State != "" {
+		header.Set(TracestateHeader, tc.State)
+	} else {
+		header.Del(TracestateHeader)
+	}
+}
+
+// randomID returns n random bytes hex encoded
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// Span kinds
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// SpanData is a finished span as exported:
+//   - Kind is one of SpanInternal, SpanServer or SpanClient
+//   - ParentID is the span ID of the parent span or empty for the root span of a trace
+//   - Attributes have string, bool, int, int64 or float64 values
+//   - Error is the error recorded by the span, if any
+type SpanData struct {
+	Name       string
+	Kind       int
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+// Span is an operation in a trace; spans that are not sampled are not recorded but carry their
+// trace context to be propagated. A nil span records nothing so callers need not check whether
+// a decision is traced
+type Span struct {
+	tracer    *Tracer
+	context   TraceContext
+	recording bool
+	data      SpanData
+	mutex     sync.Mutex
+	ended     bool
+}
+
+// Context returns the trace context of the span or an empty context for a nil span
+func (s *Span) Context() (tc TraceContext) {
+	if s == nil {
+		return tc
+	}
+	return s.context
+}
+
+// Child starts a span of kind that is a child of s; the child of a span that is not recording
+// is nil
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil || !s.recording {
+		return nil
+	}
+	return s.tracer.start(name, kind, s.context, true)
+}
+
+// SetAttribute sets an attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Attributes[key] = value
+}
+
+// SetError records err as the error of the span; a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || !s.recording || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End ends the span and exports it if it is recording; only the first call has any effect
+func (s *Span) End() {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mutex.Unlock()
+	s.tracer.export(&data)
+}
+
+// Tracer starts spans and exports those that are sampled; new traces are sampled at the rate
+// sampleRatio (0 to 1) while continued traces follow the sampling decision of the caller. A nil
+// tracer starts spans that are never recorded
+type Tracer struct {
+	exporter    SpanExporter
+	sampleRatio float64
+}
+
+// SpanExporter exports finished spans
+type SpanExporter interface {
+	Export(span *SpanData) error
+	Close() error
+}
+
+// NewTracer returns a tracer exporting spans with exporter
+func NewTracer(exporter SpanExporter, sampleRatio float64) (tracer *Tracer, err error) {
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return tracer, fmt.Errorf("invalid trace sample ratio %g; must be between 0 and 1", sampleRatio)
+	}
+	if exporter == nil {
+		return tracer, fmt.Errorf("a tracer requires a span exporter")
+	}
+	return &Tracer{exporter: exporter, sampleRatio: sampleRatio}, nil
+}
+
+// Start starts a span of kind continuing the trace of parent or starting a new trace if
+// parent has no trace ID
+func (t *Tracer) Start(name string, kind int, parent TraceContext) *Span {
+	if parent.TraceID == "" {
+		parent = TraceContext{
+			TraceID: randomID(16),
+			Sampled: t != nil && t.sampleRatio > 0 && (t.sampleRatio == 1 || mrand.Float64() < t.sampleRatio),
+		}
+	}
+	return t.start(name, kind, parent, t != nil && parent.Sampled)
+}
+
+func (t *Tracer) start(name string, kind int, parent TraceContext, recording bool) *Span {
+	// a span that is not recording propagates the span ID of its parent so that the spans of
+	// the caller and callee remain linked
+	spanID := parent.SpanID
+	if recording || spanID == "" {
+		spanID = randomID(8)
+	}
+	s := &Span{
+		tracer:    t,
+		context:   TraceContext{TraceID: parent.TraceID, SpanID: spanID, Sampled: parent.Sampled, State: parent.State},
+		recording: recording,
+	}
+	if recording {
+		s.data = SpanData{
+			Name:       name,
+			Kind:       kind,
+			TraceID:    s.context.TraceID,
+			SpanID:     s.context.SpanID,
+			ParentID:   parent.SpanID,
+			Start:      time.Now(),
+			Attributes: make(map[string]interface{}),
+		}
+	}
+	return s
+}
+
+func (t *Tracer) export(span *SpanData) {
+	if err := t.exporter.Export(span); err != nil {
+		log.Errorf("failed to export span %s: %s", span.Name, err)
+	}
+}
+
+// Close exports the pending spans and stops the exporter of the tracer
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Close()
+}
+
+// spanOf returns the span identified by the span header of a request or nil
+func (auth *Auth) spanOf(header http.Header) *Span {
+	id := header.Get(spanHeader)
+	if id == "" {
+		return nil
+	}
+	if s, ok := auth.spans.Load(id); ok {
+		return s.(*Span)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package fauth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestParseTraceContext(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		ok          bool
+		sampled     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		tc, ok := fauth.ParseTraceContext(test.traceparent, "vendor=value")
+		if ok != test.ok || tc.Sampled != test.sampled {
+			t.Errorf("%q: got ok %t sampled %t, want %t %t", test.traceparent, ok, tc.Sampled, test.ok, test.sampled)
+		}
+		if ok && test.traceparent[:2] == "00" && tc.Traceparent() != test.traceparent {
+			t.Errorf("%q: got traceparent %s", test.traceparent, tc.Traceparent())
+		}
+	}
+}
+
+// collector is an OTLP/HTTP collector stub recording exported spans by name
+type collector struct {
+	mutex sync.Mutex
+	spans map[string]fauth.OTLPSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	traces := &fauth.OTLPTraces{}
+	if err := json.NewDecoder(r.Body).Decode(traces); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rs := range traces.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans[span.Name] = span
+			}
+		}
+	}
+	w.Write([]byte("{}"))
+}
+
+func TestCheckSpan(t *testing.T) {
+	t.Setenv("ROOT_KEY", "root-key-value")
+
+	// the allow callout must receive the trace context of its span
+	var callout http.Header
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callout = r.Header.Clone()
+	}))
+	defer resource.Close()
+
+	c := &collector{spans: make(map[string]fauth.OTLPSpan)}
+	otel := httptest.NewServer(c)
+	defer otel.Close()
+
+	auth := newTestAuth(t, &fauth.AccessSystem{Checks: &fauth.HostChecks{HostGroups: []fauth.HostGroup{{
+		Name:    "API Hosts",
+		Hosts:   []string{"apis.example.com"},
+		Default: "deny",
+		Checks: []fauth.Check{{Name: "widgets-api", Base: "/widgets-api/v1", Paths: []fauth.Path{{
+			Path: "/widgets/:wid",
+			Rules: map[fauth.Method]fauth.Rule{
+				"GET": {Name: "read widget", Expression: "role('READ', 'WIDGETS') && allow('READ', 'user-1', param(':wid'), '" + resource.URL + "')"},
+			},
+		}}}},
+	}}}})
+
+	exporter, err := fauth.NewOTLPExporter(otel.URL, "forward-auth", map[string]string{"X-Collector-Key": "key"}, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer, err := fauth.NewTracer(exporter, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a sampled incoming trace is continued even though new traces are not sampled
+	parent, ok := fauth.ParseTraceContext("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+	if !ok {
+		t.Fatal("invalid traceparent")
+	}
+	span := tracer.Start("forward-auth GET", fauth.SpanServer, parent)
+
+	header := http.Header{}
+	header.Set(jwtHeader, testJWT(t, &fauth.Identity{TID: strptr("tenant-1"), UID: strptr("user-1"), UserPermissions: []fauth.UserPermission{
+		{Context: fauth.ALL, Permissions: []fauth.Permission{{Category: "WIDGETS", Actions: []string{"READ"}}}},
+	}}))
+	decision := auth.CheckSpan(span, "apis.example.com", "GET", "/widgets-api/v1/widgets/w-1", header)
+	if decision.Status != http.StatusOK {
+		t.Fatalf("got status %d: %s", decision.Status, decision.Message)
+	}
+	span.End()
+
+	// new traces are not sampled
+	tracer.Start("unsampled", fauth.SpanServer, fauth.TraceContext{}).End()
+
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// spans ending after the tracer is closed are dropped
+	tracer.Start("late", fauth.SpanServer, parent).End()
+	if err := exporter.Export(&fauth.SpanData{Name: "late"}); err == nil {
+		t.Error("got no error exporting a span after close")
+	}
+
+	root, ok := c.spans["forward-auth GET"]
+	if !ok {
+		t.Fatalf("root span not exported: %v", c.spans)
+	}
+	if root.TraceID != parent.TraceID || root.ParentSpanID != parent.SpanID || root.Kind != fauth.SpanServer {
+		t.Errorf("got root span %+v", root)
+	}
+	parents := map[string]string{"jwt.verify": root.SpanID, "rule.evaluate": root.SpanID, "allow": c.spans["rule.evaluate"].SpanID}
+	for name, parentID := range parents {
+		s, ok := c.spans[name]
+		if !ok {
+			t.Errorf("span %s not exported", name)
+			continue
+		}
+		if s.TraceID != parent.TraceID || s.ParentSpanID != parentID {
+			t.Errorf("span %s has trace %s parent %s, want %s %s", name, s.TraceID, s.ParentSpanID, parent.TraceID, parentID)
+		}
+	}
+	if _, ok := c.spans["unsampled"]; ok {
+		t.Errorf("unsampled span was exported")
+	}
+
+	allow := c.spans["allow"]
+	if got := callout.Get(fauth.TraceparentHeader); got != "00-"+parent.TraceID+"-"+allow.SpanID+"-01" {
+		t.Errorf("got callout traceparent %s for allow span %s", got, allow.SpanID)
+	}
+}
+
+func TestUnrecordedSpanPropagatesParent(t *testing.T) {
+	var tracer *fauth.Tracer
+	parent, _ := fauth.ParseTraceContext("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=value")
+	span := tracer.Start("forward-auth GET", fauth.SpanServer, parent)
+	if span.Context() != parent {
+		t.Errorf("got context %+v, want %+v", span.Context(), parent)
+	}
+	if span.Child("rule.evaluate", fauth.SpanInternal) != nil {
+		t.Errorf("got child of unrecorded span")
+	}
+	span.End()
+
+	header := http.Header{}
+	tracer.Start("forward-auth GET", fauth.SpanServer, fauth.TraceContext{}).Context().Inject(header)
+	if _, ok := fauth.ParseTraceContext(header.Get(fauth.TraceparentHeader), ""); !ok {
+		t.Errorf("got invalid traceparent %s for new trace", header.Get(fauth.TraceparentHeader))
+	}
+}
@@ -0,0 +1,226 @@
+package fauth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AccessTree is the routing structure compiled from the live access system for each host; it
+// shows what requests are matched against rather than the host checks as written:
+//   - a host that appears in several host groups is routed by the first of them only
+//   - a check with the same base as an earlier check of the host group replaces it, while checks
+//     whose bases overlap, such as /api and /api/v1, are matched in no particular order
+//   - a pattern is routed to the first rule registered for it and each method; GET rules are
+//     also registered for HEAD, so a later HEAD rule of the same pattern is never matched
+//
+// Prefixes are listed by name since a host matches them in no particular order, while patterns
+// are listed in the order they are matched
+type AccessTree struct {
+	Version string     `json:"version"`
+	Hosts   []HostTree `json:"hosts"`
+}
+
+// HostTree is the routing structure of a host; Default is the decision for requests that match no
+// prefix, Mode the run mode in effect and Override, if set, the decision of every request to the
+// host regardless of its host checks
+type HostTree struct {
+	Host     string       `json:"host"`
+	Group    string       `json:"group"`
+	Default  string       `json:"default"`
+	Mode     string       `json:"mode"`
+	Override string       `json:"override,omitempty"`
+	Prefixes []PrefixTree `json:"prefixes"`
+}
+
+// PrefixTree is the routing structure of the path prefix of a check; requests that match the
+// prefix but none of its patterns are denied
+type PrefixTree struct {
+	Prefix   string        `json:"prefix"`
+	Check    string        `json:"check"`
+	Patterns []PatternTree `json:"patterns"`
+}
+
+// PatternTree is a path pattern with the rule routed to for each method
+type PatternTree struct {
+	Pattern string       `json:"pattern"`
+	Methods []MethodTree `json:"methods"`
+}
+
+// MethodTree is the rule routed to for a method of a pattern; ImpliedBy is the method whose rule
+// was also registered for this method, eg GET for HEAD
+type MethodTree struct {
+	Method     string `json:"method"`
+	Rule       string `json:"rule"`
+	Expression string `json:"expression"`
+	CacheTTL   string `json:"cacheTTL,omitempty"`
+	ImpliedBy  string `json:"impliedBy,omitempty"`
+}
+
+// AccessTree returns the routing structure of the live access system for host, or for every
+// host if host is empty, with the prefixes starting with prefix
+func (auth *Auth) AccessTree(host, prefix string) *AccessTree {
+	s := auth.current()
+	tree := &AccessTree{Version: s.version, Hosts: []HostTree{}}
+
+	// hosts with an override are decided by it whether or not they have host checks
+	var hosts []string
+	for h := range s.hostMuxers {
+		if host == "" || h == host {
+			hosts = append(hosts, h)
+		}
+	}
+	for h := range s.overrides {
+		if _, ok := s.hostMuxers[h]; !ok && (host == "" || h == host) {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	for _, h := range hosts {
+		group := s.hostGroups[h]
+		ht := HostTree{
+			Host:     h,
+			Group:    group.Name,
+			Default:  group.Default,
+			Mode:     auth.hostRunMode(s, h),
+			Override: s.overrides[h],
+			Prefixes: []PrefixTree{},
+		}
+		for _, p := range s.routes[h] {
+			if strings.HasPrefix(p.Prefix, prefix) {
+				ht.Prefixes = append(ht.Prefixes, p)
+			}
+		}
+		tree.Hosts = append(tree.Hosts, ht)
+	}
+	return tree
+}
+
+// routes records the prefixes of the host muxer of a host group as snapshot.compile registers
+// them, by prefix since a check with the same base as an earlier check replaces it
+type routes map[string]*PrefixTree
+
+// addPrefix records the prefix of check, replacing any earlier check with the same base
+func (rs routes) addPrefix(check Check) *PrefixTree {
+	p := &PrefixTree{Prefix: check.Base, Check: check.Name, Patterns: []PatternTree{}}
+	rs[check.Base] = p
+	return p
+}
+
+// prefixes returns the prefixes recorded, sorted by prefix
+func (rs routes) prefixes() (prefixes []PrefixTree) {
+	for _, p := range rs {
+		prefixes = append(prefixes, *p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Prefix < prefixes[j].Prefix })
+	return prefixes
+}
+
+// addRule records that r is registered for method of pattern; the first rule registered for a
+// pattern and method is routed to, and the pattern muxer registers a GET rule for HEAD first
+func (p *PrefixTree) addRule(pattern, method string, r Rule) {
+	registered := []MethodTree{{Method: method, Rule: r.Name, Expression: r.Expression, CacheTTL: r.CacheTTL}}
+	if method == "GET" {
+		registered = []MethodTree{{Method: "HEAD", Rule: r.Name, Expression: r.Expression, CacheTTL: r.CacheTTL, ImpliedBy: "GET"}, registered[0]}
+	}
+
+	i := 0
+	for i < len(p.Patterns) && p.Patterns[i].Pattern != pattern {
+		i++
+	}
+	if i == len(p.Patterns) {
+		p.Patterns = append(p.Patterns, PatternTree{Pattern: pattern})
+	}
+	for _, m := range registered {
+		if !hasMethod(p.Patterns[i].Methods, m.Method) {
+			p.Patterns[i].Methods = append(p.Patterns[i].Methods, m)
+		}
+	}
+}
+
+func hasMethod(methods []MethodTree, method string) bool {
+	for _, m := range methods {
+		if m.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Text returns the tree as indented text, eg
+//
+//	apis.example.com: group API Hosts, default deny, mode enforcing
+//	  /widgets-api/v1: check widgets-api
+//	    /widgets/:wid
+//	      GET read widget: bearer('APP_KEY') (cache 1m)
+func (t *AccessTree) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "access system %s\n", t.Version)
+	for _, h := range t.Hosts {
+		fmt.Fprintf(&b, "%s: group %s, default %s, mode %s", h.Host, h.Group, h.Default, h.Mode)
+		if h.Override != "" {
+			fmt.Fprintf(&b, ", override %s", h.Override)
+		}
+		b.WriteString("\n")
+		for _, p := range h.Prefixes {
+			fmt.Fprintf(&b, "  %s: check %s\n", p.Prefix, p.Check)
+			for _, pattern := range p.Patterns {
+				fmt.Fprintf(&b, "    %s\n", pattern.Pattern)
+				for _, m := range pattern.Methods {
+					fmt.Fprintf(&b, "      %s %s: %s", m.Method, m.Rule, m.Expression)
+					if m.CacheTTL != "" {
+						fmt.Fprintf(&b, " (cache %s)", m.CacheTTL)
+					}
+					if m.ImpliedBy != "" {
+						fmt.Fprintf(&b, " (implied by %s)", m.ImpliedBy)
+					}
+					b.WriteString("\n")
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// DOT returns the tree as a Graphviz digraph with a node for each host, prefix, pattern and method
+func (t *AccessTree) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph access {\n  rankdir=LR;\n  node [shape=box, fontname=\"monospace\"];\n")
+	fmt.Fprintf(&b, "  label=%s;\n", dotQuote("access system "+t.Version))
+	for i, h := range t.Hosts {
+		host := fmt.Sprintf("h%d", i)
+		label := []string{h.Host, "group " + h.Group, "default " + h.Default, "mode " + h.Mode}
+		if h.Override != "" {
+			label = append(label, "override "+h.Override)
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=folder];\n", host, dotQuote(label...))
+		for j, p := range h.Prefixes {
+			prefix := fmt.Sprintf("%sp%d", host, j)
+			fmt.Fprintf(&b, "  %s [label=%s];\n  %s -> %s;\n", prefix, dotQuote(p.Prefix, "check "+p.Check), host, prefix)
+			for k, pattern := range p.Patterns {
+				node := fmt.Sprintf("%st%d", prefix, k)
+				fmt.Fprintf(&b, "  %s [label=%s, shape=ellipse];\n  %s -> %s;\n", node, dotQuote(pattern.Pattern), prefix, node)
+				for l, m := range pattern.Methods {
+					label := []string{m.Method + " " + m.Rule, m.Expression}
+					if m.ImpliedBy != "" {
+						label = append(label, "implied by "+m.ImpliedBy)
+					}
+					method := fmt.Sprintf("%sm%d", node, l)
+					fmt.Fprintf(&b, "  %s [label=%s, shape=note];\n  %s -> %s;\n", method, dotQuote(label...), node, method)
+				}
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotQuote returns lines as a quoted DOT string with a line break after each line
+func dotQuote(lines ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, line := range lines {
+		lines[i] = escaper.Replace(line)
+	}
+	return `"` + strings.Join(lines, `\l`) + `\l"`
+}
@@ -0,0 +1,84 @@
+package fauth_test
+
+import (
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestAccessTree(t *testing.T) {
+	acs := versionedAccess(1)
+	checks := acs.Checks
+	group := &checks.HostGroups[0]
+	group.Hosts = append(group.Hosts, "admin.example.com")
+	// the HEAD rule is shadowed by the HEAD route registered with the GET rule
+	group.Checks[0].Paths[0].Rules["HEAD"] = fauth.Rule{Expression: "false"}
+	group.Checks[0].Paths = append(group.Checks[0].Paths, fauth.Path{
+		Path:  "/widgets",
+		Rules: map[fauth.Method]fauth.Rule{"POST": {Name: "create widget", Expression: "bearer('APP_KEY_1')"}},
+	})
+	group.Checks = append(group.Checks, fauth.Check{Name: "gadgets-api", Base: "/gadgets-api/v1", Paths: []fauth.Path{{
+		Path:  "/gadgets",
+		Rules: map[fauth.Method]fauth.Rule{"DELETE": {Expression: "false"}},
+	}}})
+	checks.Overrides = map[string]string{"admin.example.com": "deny", "legacy.example.com": "allow"}
+	auth := newTestAuth(t, acs)
+
+	tree := auth.AccessTree("", "")
+	if tree.Version != fauth.Fingerprint(acs) || len(tree.Hosts) != 3 {
+		t.Fatalf("got tree %+v", tree)
+	}
+	if h := tree.Hosts[2]; h.Host != "legacy.example.com" || h.Override != "allow" || len(h.Prefixes) != 0 {
+		t.Errorf("got override host %+v", h)
+	}
+	if h := tree.Hosts[0]; h.Host != "admin.example.com" || h.Override != "deny" {
+		t.Errorf("got override host %+v", h)
+	}
+
+	host := tree.Hosts[1]
+	if host.Host != "apis.example.com" || host.Group != "API Hosts" || host.Default != "deny" || host.Mode != fauth.RunEnforcing {
+		t.Fatalf("got host %+v", host)
+	}
+	if len(host.Prefixes) != 2 || host.Prefixes[0].Prefix != "/gadgets-api/v1" || host.Prefixes[1].Prefix != "/widgets-api/v1" {
+		t.Fatalf("got prefixes %+v", host.Prefixes)
+	}
+	if m := host.Prefixes[0].Patterns[0].Methods[0]; m.Rule != "gadgets-api DELETE /gadgets-api/v1/gadgets" {
+		t.Errorf("got unnamed rule %+v", m)
+	}
+	patterns := host.Prefixes[1].Patterns
+	if len(patterns) != 2 || patterns[0].Pattern != "/widgets/:wid" || patterns[1].Pattern != "/widgets" {
+		t.Fatalf("got patterns %+v", patterns)
+	}
+	methods := patterns[0].Methods
+	if len(methods) != 2 || methods[0].Method != "HEAD" || methods[0].ImpliedBy != "GET" || methods[0].Expression != "bearer('APP_KEY_1')" ||
+		methods[1].Method != "GET" || methods[1].Rule != "read widget" || methods[1].CacheTTL != "1m" {
+		t.Errorf("got methods %+v", methods)
+	}
+
+	// the tree is filtered by host and prefix
+	tree = auth.AccessTree("apis.example.com", "/widgets")
+	if len(tree.Hosts) != 1 || len(tree.Hosts[0].Prefixes) != 1 || tree.Hosts[0].Prefixes[0].Check != "widgets-api" {
+		t.Errorf("got filtered tree %+v", tree)
+	}
+	if tree := auth.AccessTree("unknown.example.com", ""); len(tree.Hosts) != 0 {
+		t.Errorf("got tree %+v of unknown host", tree)
+	}
+
+	text := tree.Text()
+	for _, want := range []string{
+		"apis.example.com: group API Hosts, default deny, mode enforcing\n",
+		"  /widgets-api/v1: check widgets-api\n    /widgets/:wid\n",
+		"      GET read widget: bearer('APP_KEY_1') (cache 1m)\n",
+		"      HEAD read widget: bearer('APP_KEY_1') (cache 1m) (implied by GET)\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text tree does not contain %q:\n%s", want, text)
+		}
+	}
+	dot := tree.DOT()
+	if !strings.HasPrefix(dot, "digraph access {") || !strings.Contains(dot, `h0p0t0m1 [label="GET read widget\lbearer('APP_KEY_1')\l", shape=note];`) ||
+		!strings.Contains(dot, "h0p0t0 -> h0p0t0m1;") {
+		t.Errorf("got DOT tree:\n%s", dot)
+	}
+}
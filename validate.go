@@ -0,0 +1,490 @@
+package fauth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bitbucket.org/_metalogic_/eval"
+)
+
+// Severity is the severity of a diagnostic
+type Severity string
+
+const (
+	// SeverityError marks a problem that denies or breaks the affected requests
+	SeverityError Severity = "error"
+	// SeverityWarning marks a problem that is likely unintended
+	SeverityWarning Severity = "warning"
+)
+
+// Methods are the HTTP methods to which rules may apply
+var Methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+
+// Diagnostic is a problem found by ValidateAccessSystem; HostGroup, Check, Path and Method
+// locate the problem and are empty if not applicable
+type Diagnostic struct {
+	Severity   Severity `json:"severity"`
+	HostGroup  string   `json:"hostGroup,omitempty"`
+	Check      string   `json:"check,omitempty"`
+	Path       string   `json:"path,omitempty"`
+	Method     string   `json:"method,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+	Message    string   `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	if at := location(d.HostGroup, d.Check, d.Method, d.Path); at != "" {
+		return fmt.Sprintf("%s: %s: %s", d.Severity, at, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+}
+
+// location describes the location of a diagnostic or change in the host checks
+func location(hostGroup, check, method, path string) string {
+	var at []string
+	if hostGroup != "" {
+		at = append(at, fmt.Sprintf("host group '%s'", hostGroup))
+	}
+	if check != "" {
+		at = append(at, fmt.Sprintf("check '%s'", check))
+	}
+	if method != "" || path != "" {
+		at = append(at, strings.TrimSpace(method+" "+path))
+	}
+	return strings.Join(at, ", ")
+}
+
+// Diagnostics are the problems found in an access system
+type Diagnostics []Diagnostic
+
+// HasErrors returns true if any diagnostic is an error
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// valueType is the type of a builtin argument or result
+type valueType int
+
+const (
+	typeAny valueType = iota
+	typeString
+	typeBool
+	typeNumber
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeBool:
+		return "boolean"
+	case typeNumber:
+		return "number"
+	}
+	return "any"
+}
+
+// builtinSignature describes the arguments and result of a builtin; the last optional
+// params may be omitted and the last param of a variadic builtin may be repeated
+type builtinSignature struct {
+	params   []valueType
+	optional int
+	variadic bool
+	returns  valueType
+}
+
+// signatures are the signatures of the builtins available in rule expressions
+var signatures = map[string]builtinSignature{
+	"allow":          {params: []valueType{typeString, typeString, typeString, typeString}, returns: typeBool},
+	"bearer":         {params: []valueType{typeString}, variadic: true, returns: typeBool},
+	"param":          {params: []valueType{typeString}, returns: typeString},
+	"role":           {params: []valueType{typeString, typeString, typeString}, optional: 1, returns: typeBool},
+	"root":           {returns: typeBool},
+	"classification": {returns: typeAny},
+	"signature":      {params: []valueType{typeString, typeString}, optional: 1, returns: typeBool},
+	"cert":           {params: []valueType{typeString}, optional: 1, returns: typeBool},
+	"certsubject":    {params: []valueType{typeString, typeString}, optional: 1, returns: typeBool},
+	"certsan":        {params: []valueType{typeString, typeString}, optional: 1, returns: typeBool},
+	"certissuer":     {params: []valueType{typeString, typeString}, optional: 1, returns: typeBool},
+	"subdomain":      {returns: typeString},
+	"user":           {params: []valueType{typeString}, returns: typeBool},
+}
+
+// argument is an argument of a builtin call; literal is set for string literals
+type argument struct {
+	kind    valueType
+	literal *string
+}
+
+// call is a builtin call in a rule expression
+type call struct {
+	name string
+	args []argument
+}
+
+// ValidateAccessSystem checks the host checks of acs returning diagnostics for invalid host
+// groups, checks and paths, checks with overlapping bases, rules for unknown HTTP methods and
+// rule expressions that fail to parse, call builtins with the wrong number or type of arguments,
+// or reference token names, tenant IDs, CA bundles or path parameters that do not exist
+func ValidateAccessSystem(acs *AccessSystem) (diagnostics Diagnostics) {
+	if acs.Checks == nil {
+		return Diagnostics{{Severity: SeverityWarning, Message: "no host checks are defined"}}
+	}
+
+	// the JWT header is configured by the server and is only rejected as a decision header when
+	// the access system is loaded
+	v := newValidator(acs)
+	if err := validateHeaders(acs.Checks.Headers, ""); err != nil {
+		v.errorf(Diagnostic{}, "%s", err)
+	}
+	if err := validateRunMode(acs.Checks.Mode); err != nil {
+		v.errorf(Diagnostic{}, "%s", err)
+	} else if acs.Checks.Mode != "" && acs.Checks.Mode != RunEnforcing {
+		v.warningf(Diagnostic{}, "host checks are not enforced in run mode %s", acs.Checks.Mode)
+	}
+
+	hosts := make(map[string]string)
+	for _, group := range acs.Checks.HostGroups {
+		at := Diagnostic{HostGroup: group.Name}
+		if err := group.Validate(); err != nil {
+			v.errorf(at, "%s", err)
+		}
+		if err := validateHeaders(group.Headers, ""); err != nil {
+			v.errorf(at, "%s", err)
+		}
+		if group.Mode == RunPermissive || group.Mode == RunDisabled {
+			v.warningf(at, "host checks are not enforced in run mode %s", group.Mode)
+		}
+		if group.Login != nil {
+			if err := group.Login.Validate(); err != nil {
+				v.errorf(at, "login: %s", err)
+			}
+		}
+		for _, host := range group.Hosts {
+			if other, ok := hosts[host]; ok {
+				v.warningf(at, "host %s is already defined in host group '%s'; its checks in this group are ignored", host, other)
+				continue
+			}
+			hosts[host] = group.Name
+		}
+
+		for i, check := range group.Checks {
+			at := Diagnostic{HostGroup: group.Name, Check: check.Name}
+			if err := check.Validate(); err != nil {
+				v.errorf(at, "%s", err)
+			}
+			// the host muxer matches prefixes in no particular order
+			for _, other := range group.Checks[:i] {
+				if check.Base != other.Base && (strings.HasPrefix(check.Base, other.Base) || strings.HasPrefix(other.Base, check.Base)) {
+					v.warningf(at, "base %s overlaps base %s of check '%s'; requests matching both are routed to either check", check.Base, other.Base, other.Name)
+				}
+			}
+			for _, path := range check.Paths {
+				at := Diagnostic{HostGroup: group.Name, Check: check.Name, Path: check.Base + path.Path}
+				if err := path.Validate(); err != nil {
+					v.errorf(at, "%s", err)
+				}
+				for _, method := range sortedMethods(path.Rules) {
+					at := at
+					at.Method = string(method)
+					rule := path.Rules[method]
+					if !isMethod(string(method)) {
+						v.errorf(at, "unknown HTTP method %s; the rule is never applied", method)
+						continue
+					}
+					at.Expression = rule.Expression
+					v.expression(at, rule.Expression, pathParams(path.Path))
+					if _, err := namedRule(rule, check, path, string(method)).cacheTTL(); err != nil {
+						v.errorf(at, "%s", err)
+					} else if rule.CacheTTL != "" {
+						if _, reason := cachePolicy(rule.Expression); reason != "" {
+							v.warningf(at, "decisions are not cached because %s", reason)
+						}
+					}
+				}
+			}
+		}
+	}
+	return v.diagnostics
+}
+
+// validator accumulates the diagnostics of an access system
+type validator struct {
+	tokens      map[string]bool
+	tenants     map[string]bool
+	bundles     map[string]bool
+	diagnostics Diagnostics
+}
+
+func newValidator(acs *AccessSystem) *validator {
+	v := &validator{
+		tokens:  make(map[string]bool),
+		tenants: make(map[string]bool),
+		bundles: make(map[string]bool),
+	}
+	for _, name := range acs.Tokens {
+		v.tokens[name] = true
+	}
+	for _, name := range acs.Digests {
+		v.tokens[name] = true
+	}
+	if acs.Owner.Bearer != nil || acs.RootToken != "" {
+		v.tokens["ROOT_KEY"] = true
+	}
+	for _, application := range acs.Applications {
+		if application.Bearer != nil {
+			v.tokens[application.Bearer.Name] = true
+		}
+	}
+	for _, tenant := range acs.Tenants {
+		if tenant.Bearer != nil {
+			v.tokens[tenant.UUID] = true
+		}
+		if tenant.PublicKey != nil {
+			v.tenants[tenant.UUID] = true
+		}
+	}
+	for tenantID := range acs.PublicKeys {
+		v.tenants[tenantID] = true
+	}
+	for _, ca := range acs.CertificateAuthorities {
+		v.bundles[ca.Name] = true
+	}
+	return v
+}
+
+func (v *validator) errorf(at Diagnostic, format string, args ...interface{}) {
+	at.Severity = SeverityError
+	at.Message = fmt.Sprintf(format, args...)
+	v.diagnostics = append(v.diagnostics, at)
+}
+
+func (v *validator) warningf(at Diagnostic, format string, args ...interface{}) {
+	at.Severity = SeverityWarning
+	at.Message = fmt.Sprintf(format, args...)
+	v.diagnostics = append(v.diagnostics, at)
+}
+
+// expression type-checks the builtin calls of expr against their signatures and checks
+// the names they reference; params are the path parameters bound by the rule path
+func (v *validator) expression(at Diagnostic, expr string, params map[string]bool) {
+	parsed, err := eval.NewEvaluableExpressionWithFunctions(expr, stubs)
+	if err != nil {
+		v.errorf(at, "invalid expression: %s", err)
+		return
+	}
+
+	for _, c := range calls(parsed.Tokens()) {
+		sig, ok := signatures[c.name]
+		if !ok {
+			continue
+		}
+		min, max := len(sig.params)-sig.optional, len(sig.params)
+		switch {
+		case len(c.args) < min:
+			v.errorf(at, "%s() takes at least %d argument(s) but is called with %d", c.name, min, len(c.args))
+			continue
+		case !sig.variadic && len(c.args) > max:
+			v.errorf(at, "%s() takes at most %d argument(s) but is called with %d", c.name, max, len(c.args))
+			continue
+		}
+
+		for i, arg := range c.args {
+			want := sig.params[len(sig.params)-1]
+			if i < len(sig.params) {
+				want = sig.params[i]
+			}
+			if arg.kind != typeAny && want != typeAny && arg.kind != want {
+				v.errorf(at, "argument %d of %s() must be a %s not a %s", i+1, c.name, want, arg.kind)
+			}
+		}
+		v.references(at, c, params)
+	}
+}
+
+// references checks the literal token names, tenant IDs, signature modes, CA bundles and
+// path parameters referenced by c
+func (v *validator) references(at Diagnostic, c call, params map[string]bool) {
+	literal := func(i int) (string, bool) {
+		if i >= len(c.args) || c.args[i].literal == nil {
+			return "", false
+		}
+		return *c.args[i].literal, true
+	}
+	bundle := func(i int) {
+		if name, ok := literal(i); ok && !v.bundles[name] {
+			v.errorf(at, "%s() references undefined CA bundle '%s'", c.name, name)
+		}
+	}
+
+	switch c.name {
+	case "bearer":
+		for i := range c.args {
+			if name, ok := literal(i); ok && !v.tokens[name] {
+				v.errorf(at, "bearer() references token '%s' that no owner, application or tenant defines", name)
+			}
+		}
+	case "param":
+		if name, ok := literal(0); ok && strings.HasPrefix(name, ":") && !params[name] {
+			v.errorf(at, "param() references path parameter '%s' not bound by the path", name)
+		}
+	case "signature":
+		if tenantID, ok := literal(0); ok && !v.tenants[tenantID] {
+			v.errorf(at, "signature() references tenant '%s' that has no public key", tenantID)
+		}
+		if mode, ok := literal(1); ok && mode != SignatureCavage && mode != SignatureRFC9421 && mode != SignatureAny {
+			v.errorf(at, "signature() mode must be one of %s, %s or %s not '%s'", SignatureCavage, SignatureRFC9421, SignatureAny, mode)
+		}
+	case "cert":
+		bundle(0)
+	case "certsubject", "certsan", "certissuer":
+		bundle(1)
+	}
+}
+
+// calls returns the builtin calls in tokens, including nested calls
+func calls(tokens []eval.ExpressionToken) (found []call) {
+	for i, token := range tokens {
+		if token.Kind != eval.FUNCTION || i+1 >= len(tokens) || tokens[i+1].Kind != eval.CLAUSE {
+			continue
+		}
+		c := call{name: functionName(tokens, i)}
+		depth, start := 0, i+2
+		for j := i + 1; j < len(tokens); j++ {
+			switch tokens[j].Kind {
+			case eval.CLAUSE:
+				depth++
+				continue
+			case eval.CLAUSE_CLOSE:
+				depth--
+				if depth > 0 {
+					continue
+				}
+			case eval.SEPARATOR:
+				if depth > 1 {
+					continue
+				}
+			default:
+				continue
+			}
+			// an argument ends at a separator or the closing parenthesis of the call
+			if j > start || tokens[j].Kind == eval.SEPARATOR {
+				c.args = append(c.args, argumentOf(tokens, start, j))
+			}
+			start = j + 1
+			if depth == 0 {
+				break
+			}
+		}
+		found = append(found, c)
+	}
+	return found
+}
+
+// stubs stand in for the builtins when parsing expressions for validation; each returns
+// its name so that the builtin called by a FUNCTION token can be recovered
+var stubs map[string]eval.ExpressionFunction
+
+func init() {
+	stubs = make(map[string]eval.ExpressionFunction, len(builtins))
+	for name := range builtins {
+		name := name
+		stubs[name] = func(args ...interface{}) (interface{}, error) {
+			return name, nil
+		}
+	}
+}
+
+// functionName returns the name of the builtin called by the FUNCTION token at i
+func functionName(tokens []eval.ExpressionToken, i int) string {
+	if stub, ok := tokens[i].Value.(eval.ExpressionFunction); ok {
+		name, _ := stub()
+		s, _ := name.(string)
+		return s
+	}
+	return ""
+}
+
+// argumentOf returns the argument formed by tokens[start:end]
+func argumentOf(tokens []eval.ExpressionToken, start, end int) argument {
+	arg := tokens[start:end]
+	if len(arg) == 1 {
+		switch arg[0].Kind {
+		case eval.STRING:
+			s, _ := arg[0].Value.(string)
+			return argument{kind: typeString, literal: &s}
+		case eval.NUMERIC:
+			return argument{kind: typeNumber}
+		case eval.BOOLEAN:
+			return argument{kind: typeBool}
+		}
+	}
+	// a single call is typed by its result
+	if len(arg) >= 3 && arg[0].Kind == eval.FUNCTION && arg[1].Kind == eval.CLAUSE && closes(arg, 1) == len(arg)-1 {
+		return argument{kind: signatures[functionName(tokens, start)].returns}
+	}
+	return argument{kind: typeAny}
+}
+
+// closes returns the index of the parenthesis closing the one at i in tokens
+func closes(tokens []eval.ExpressionToken, i int) int {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch tokens[j].Kind {
+		case eval.CLAUSE:
+			depth++
+		case eval.CLAUSE_CLOSE:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// pathParams returns the names of the parameters bound by pattern, prefixed with a colon
+// as they are passed to param()
+func pathParams(pattern string) map[string]bool {
+	params := make(map[string]bool)
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != ':' {
+			continue
+		}
+		j := i + 1
+		for j < len(pattern) && isAlnum(pattern[j]) {
+			j++
+		}
+		params[pattern[i:j]] = true
+		i = j - 1
+	}
+	return params
+}
+
+// isAlnum reports whether c may appear in a path parameter name
+func isAlnum(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isMethod(method string) bool {
+	for _, m := range Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedMethods(rules map[Method]Rule) (methods []Method) {
+	for method := range rules {
+		methods = append(methods, method)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+	return methods
+}
@@ -0,0 +1,131 @@
+package fauth_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestValidateAccessSystemFixture(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/access.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs := &fauth.AccessSystem{}
+	if err := json.Unmarshal(data, acs); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := fauth.ValidateAccessSystem(acs); len(diagnostics) != 0 {
+		t.Errorf("ValidateAccessSystem() = %v, want no diagnostics", diagnostics)
+	}
+}
+
+func TestValidateAccessSystem(t *testing.T) {
+	acs := func(path string, rules map[fauth.Method]fauth.Rule) *fauth.AccessSystem {
+		return &fauth.AccessSystem{
+			Owner:                  fauth.Owner{Name: "Example", Bearer: &fauth.Token{Source: "env", Name: "ROOT_KEY"}},
+			Applications:           []fauth.Application{{Name: "widgets", Bearer: &fauth.Token{Source: "env", Name: "MC_APP_KEY"}}},
+			Tenants:                []fauth.Tenant{{Name: "Acme", UUID: "acme", PublicKey: &fauth.PublicKey{Source: "file", Name: "acme"}}},
+			CertificateAuthorities: []fauth.CertificateAuthority{{Name: "internal"}},
+			Checks: &fauth.HostChecks{
+				HostGroups: []fauth.HostGroup{
+					{
+						Name:    "API Hosts",
+						Hosts:   []string{"apis.example.com"},
+						Default: "deny",
+						Checks: []fauth.Check{
+							{
+								Name:  "widgets-api",
+								Base:  "/widgets-api/v1",
+								Paths: []fauth.Path{{Path: path, Rules: rules}},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		method     fauth.Method
+		expression string
+		want       string
+	}{
+		{"valid", "/widgets/:id", "GET", "bearer('ROOT_KEY', 'MC_APP_KEY') || (role('READ', 'WIDGETS') && user(param(':id')))", ""},
+		{"valid certificate", "/widgets", "GET", "cert() || certsan('svc.internal', 'internal') || signature('acme', 'rfc9421')", ""},
+		{"undefined function", "/widgets", "GET", "bearr('ROOT_KEY')", "Undefined function bearr"},
+		{"too few arguments", "/widgets", "GET", "role('READ')", "role() takes at least 2 argument(s) but is called with 1"},
+		{"too many arguments", "/widgets", "GET", "role(ALL, 'READ', 'WIDGETS', 'X')", "role() takes at most 3 argument(s) but is called with 4"},
+		{"unexpected arguments", "/widgets", "GET", "root('ROOT_KEY')", "root() takes at most 0 argument(s) but is called with 1"},
+		{"wrong argument type", "/widgets", "GET", "bearer(root())", "argument 1 of bearer() must be a string not a boolean"},
+		{"numeric argument", "/widgets", "GET", "user(42)", "argument 1 of user() must be a string not a number"},
+		{"unknown token", "/widgets", "GET", "bearer('ROOT_KEY', 'MC_APP_KY')", "token 'MC_APP_KY'"},
+		{"unknown tenant", "/widgets", "GET", "signature('unknown')", "tenant 'unknown'"},
+		{"invalid signature mode", "/widgets", "GET", "signature('acme', 'hmac')", "mode must be one of"},
+		{"unknown bundle", "/widgets", "GET", "certsubject('CN=billing', 'external')", "undefined CA bundle 'external'"},
+		{"unbound path param", "/widgets/:id", "GET", "user(param(':uid'))", "path parameter ':uid'"},
+		{"unknown method", "/widgets", "FETCH", "true", "unknown HTTP method FETCH"},
+		{"lower case method", "/widgets", "get", "true", "unknown HTTP method get"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics := fauth.ValidateAccessSystem(acs(tt.path, map[fauth.Method]fauth.Rule{tt.method: {Expression: tt.expression}}))
+			if tt.want == "" {
+				if len(diagnostics) != 0 {
+					t.Errorf("ValidateAccessSystem() = %v, want no diagnostics", diagnostics)
+				}
+				return
+			}
+			if len(diagnostics) != 1 || !diagnostics.HasErrors() {
+				t.Fatalf("ValidateAccessSystem() = %v, want one error", diagnostics)
+			}
+			d := diagnostics[0]
+			if !strings.Contains(d.Message, tt.want) {
+				t.Errorf("Message = %q, want %q", d.Message, tt.want)
+			}
+			if d.HostGroup != "API Hosts" || d.Check != "widgets-api" || d.Path != "/widgets-api/v1"+tt.path || d.Method != string(tt.method) {
+				t.Errorf("diagnostic location = %s, want API Hosts, widgets-api, %s /widgets-api/v1%s", d, tt.method, tt.path)
+			}
+		})
+	}
+}
+
+func TestValidateDuplicateHosts(t *testing.T) {
+	acs := &fauth.AccessSystem{
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{Name: "API Hosts", Hosts: []string{"apis.example.com"}, Default: "deny"},
+				{Name: "Other Hosts", Hosts: []string{"apis.example.com"}, Default: "allow"},
+			},
+		},
+	}
+	diagnostics := fauth.ValidateAccessSystem(acs)
+	if len(diagnostics) != 1 || diagnostics.HasErrors() || diagnostics[0].HostGroup != "Other Hosts" {
+		t.Errorf("ValidateAccessSystem() = %v, want duplicate host warning for Other Hosts", diagnostics)
+	}
+}
+
+func TestValidateOverlappingBases(t *testing.T) {
+	acs := &fauth.AccessSystem{
+		Checks: &fauth.HostChecks{
+			HostGroups: []fauth.HostGroup{
+				{Name: "API Hosts", Hosts: []string{"apis.example.com"}, Default: "deny", Checks: []fauth.Check{
+					{Name: "api", Base: "/api"},
+					{Name: "widgets-api", Base: "/widgets-api/v1"},
+					{Name: "api-v1", Base: "/api/v1"},
+					{Name: "widgets-api-v2", Base: "/widgets-api/v2"},
+				}},
+			},
+		},
+	}
+	diagnostics := fauth.ValidateAccessSystem(acs)
+	if len(diagnostics) != 1 || diagnostics.HasErrors() || diagnostics[0].Check != "api-v1" || !strings.Contains(diagnostics[0].Message, "base /api of check 'api'") {
+		t.Errorf("ValidateAccessSystem() = %v, want an overlapping base warning for api-v1", diagnostics)
+	}
+}
@@ -0,0 +1,46 @@
+package fauth
+
+import "time"
+
+// SystemVersion is an immutable published version of the host checks of an access system:
+//   - Version is the version number, increasing with each published version
+//   - Comment, Created and CreateUser describe the published change and its author
+//   - Active is true for the version loaded by forward-auth; Updated and UpdateUser are the time
+//     and user of its most recent activation
+//   - Checks are the host checks as published; they are omitted from version lists
+type SystemVersion struct {
+	Version    int         `json:"version"`
+	Comment    string      `json:"comment"`
+	Active     bool        `json:"active"`
+	Checks     *HostChecks `json:"authorization,omitempty"`
+	Created    time.Time   `json:"created"`
+	CreateUser string      `json:"createUser"`
+	Updated    time.Time   `json:"updated"`
+	UpdateUser string      `json:"updateUser"`
+}
+
+// Versioner is implemented by stores that record each published change of their host checks as
+// a SystemVersion; Load returns the host checks of the active version, if any
+type Versioner interface {
+	// Versions returns the published versions, newest first, without their host checks
+	Versions() ([]SystemVersion, error)
+	// SystemVersion returns the published version with its host checks
+	SystemVersion(version int) (*SystemVersion, error)
+	// PublishVersion records the current host checks of the store as a new active version; a store
+	// may only publish its host checks this way until a version is published
+	PublishVersion(sessionGUID, comment string) (*SystemVersion, error)
+	// ActivateVersion makes a published version the active version, eg to roll back a change
+	ActivateVersion(sessionGUID string, version int) (*SystemVersion, error)
+}
+
+// DiffVersions returns the semantic differences between the host checks of published versions
+// from and to (see DiffAccessSystems)
+func DiffVersions(from, to *SystemVersion) []Change {
+	return DiffAccessSystems(&AccessSystem{Checks: from.Checks}, &AccessSystem{Checks: to.Checks})
+}
+
+// AccessVersion returns the published version of the live access system, or zero if its host
+// checks are not versioned
+func (auth *Auth) AccessVersion() int {
+	return auth.current().acs.Version
+}
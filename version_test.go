@@ -0,0 +1,56 @@
+package fauth_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	fauth "bitbucket.org/_metalogic_/forward-auth"
+)
+
+func TestDiffVersions(t *testing.T) {
+	from := &fauth.SystemVersion{Version: 3, Checks: versionedAccess(1).Checks}
+	to := &fauth.SystemVersion{Version: 4, Checks: versionedAccess(2).Checks}
+	if changes := fauth.DiffVersions(from, from); len(changes) != 0 {
+		t.Errorf("DiffVersions() of a version with itself = %v, want none", changes)
+	}
+	changes := fauth.DiffVersions(from, to)
+	if len(changes) != 1 {
+		t.Fatalf("DiffVersions() = %v, want one change", changes)
+	}
+	want := `~ host group 'API Hosts', check 'widgets-api', GET /widgets-api/v1/widgets/:wid: expression "bearer('APP_KEY_1')" -> "bearer('APP_KEY_2')"`
+	if got := changes[0].String(); got != want {
+		t.Errorf("got change %s, want %s", got, want)
+	}
+
+	// versions without host checks are diffed as empty
+	if changes := fauth.DiffVersions(&fauth.SystemVersion{Version: 1}, to); len(changes) == 0 || changes[0].Kind != fauth.Added {
+		t.Errorf("DiffVersions() from an empty version = %v", changes)
+	}
+}
+
+func TestAccessVersion(t *testing.T) {
+	auth := newTestAuth(t, versionedAccess(1))
+	if v := auth.AccessVersion(); v != 0 {
+		t.Errorf("got access version %d of unversioned access system, want 0", v)
+	}
+
+	// a store that records versions loads the host checks of the active version
+	var v fauth.SystemVersion
+	data := `{"version":7,"comment":"roll back widgets","active":true,"authorization":{"hostGroups":[]},
+		"created":"2024-05-02T10:15:00Z","createUser":"ROOT","updated":"2024-05-03T08:00:00Z","updateUser":"ROOT"}`
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	acs := versionedAccess(2)
+	acs.Version = v.Version
+	if err := auth.UpdateFunc()(acs); err != nil {
+		t.Fatal(err)
+	}
+	if got := auth.AccessVersion(); got != 7 {
+		t.Errorf("got access version %d, want 7", got)
+	}
+	if !v.Created.Equal(time.Date(2024, 5, 2, 10, 15, 0, 0, time.UTC)) || !v.Active || v.Checks == nil {
+		t.Errorf("got version %+v", v)
+	}
+}